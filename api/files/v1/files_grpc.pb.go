@@ -0,0 +1,286 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: files/v1/files.proto
+
+package filesv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	FilesService_Upload_FullMethodName         = "/files.v1.FilesService/Upload"
+	FilesService_Download_FullMethodName       = "/files.v1.FilesService/Download"
+	FilesService_List_FullMethodName           = "/files.v1.FilesService/List"
+	FilesService_Delete_FullMethodName         = "/files.v1.FilesService/Delete"
+	FilesService_GetLatestByTag_FullMethodName = "/files.v1.FilesService/GetLatestByTag"
+)
+
+// FilesServiceClient is the client API for FilesService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// FilesService is the gRPC counterpart of the admin HTTP API. Every call
+// must carry the admin token as "authorization: Bearer <token>" metadata.
+type FilesServiceClient interface {
+	// Upload stores a file sent as a metadata message followed by content chunks.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadResponse], error)
+	// Download streams a file as a metadata message followed by content chunks.
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error)
+	// List returns the files matching a filter.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Delete removes a file.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// GetLatestByTag returns the latest file with a tag, optionally as of a time.
+	GetLatestByTag(ctx context.Context, in *GetLatestByTagRequest, opts ...grpc.CallOption) (*GetLatestByTagResponse, error)
+}
+
+type filesServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFilesServiceClient(cc grpc.ClientConnInterface) FilesServiceClient {
+	return &filesServiceClient{cc}
+}
+
+func (c *filesServiceClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FilesService_ServiceDesc.Streams[0], FilesService_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, UploadResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FilesService_UploadClient = grpc.ClientStreamingClient[UploadRequest, UploadResponse]
+
+func (c *filesServiceClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FilesService_ServiceDesc.Streams[1], FilesService_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadRequest, DownloadResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FilesService_DownloadClient = grpc.ServerStreamingClient[DownloadResponse]
+
+func (c *filesServiceClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, FilesService_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *filesServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, FilesService_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *filesServiceClient) GetLatestByTag(ctx context.Context, in *GetLatestByTagRequest, opts ...grpc.CallOption) (*GetLatestByTagResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetLatestByTagResponse)
+	err := c.cc.Invoke(ctx, FilesService_GetLatestByTag_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FilesServiceServer is the server API for FilesService service.
+// All implementations must embed UnimplementedFilesServiceServer
+// for forward compatibility.
+//
+// FilesService is the gRPC counterpart of the admin HTTP API. Every call
+// must carry the admin token as "authorization: Bearer <token>" metadata.
+type FilesServiceServer interface {
+	// Upload stores a file sent as a metadata message followed by content chunks.
+	Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error
+	// Download streams a file as a metadata message followed by content chunks.
+	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error
+	// List returns the files matching a filter.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Delete removes a file.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// GetLatestByTag returns the latest file with a tag, optionally as of a time.
+	GetLatestByTag(context.Context, *GetLatestByTagRequest) (*GetLatestByTagResponse, error)
+	mustEmbedUnimplementedFilesServiceServer()
+}
+
+// UnimplementedFilesServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFilesServiceServer struct{}
+
+func (UnimplementedFilesServiceServer) Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error {
+	return status.Error(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedFilesServiceServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error {
+	return status.Error(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedFilesServiceServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedFilesServiceServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedFilesServiceServer) GetLatestByTag(context.Context, *GetLatestByTagRequest) (*GetLatestByTagResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetLatestByTag not implemented")
+}
+func (UnimplementedFilesServiceServer) mustEmbedUnimplementedFilesServiceServer() {}
+func (UnimplementedFilesServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeFilesServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FilesServiceServer will
+// result in compilation errors.
+type UnsafeFilesServiceServer interface {
+	mustEmbedUnimplementedFilesServiceServer()
+}
+
+func RegisterFilesServiceServer(s grpc.ServiceRegistrar, srv FilesServiceServer) {
+	// If the following call panics, it indicates UnimplementedFilesServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&FilesService_ServiceDesc, srv)
+}
+
+func _FilesService_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FilesServiceServer).Upload(&grpc.GenericServerStream[UploadRequest, UploadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FilesService_UploadServer = grpc.ClientStreamingServer[UploadRequest, UploadResponse]
+
+func _FilesService_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FilesServiceServer).Download(m, &grpc.GenericServerStream[DownloadRequest, DownloadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FilesService_DownloadServer = grpc.ServerStreamingServer[DownloadResponse]
+
+func _FilesService_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FilesServiceServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FilesService_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FilesServiceServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FilesService_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FilesServiceServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FilesService_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FilesServiceServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FilesService_GetLatestByTag_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLatestByTagRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FilesServiceServer).GetLatestByTag(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FilesService_GetLatestByTag_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FilesServiceServer).GetLatestByTag(ctx, req.(*GetLatestByTagRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// FilesService_ServiceDesc is the grpc.ServiceDesc for FilesService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FilesService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "files.v1.FilesService",
+	HandlerType: (*FilesServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "List",
+			Handler:    _FilesService_List_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _FilesService_Delete_Handler,
+		},
+		{
+			MethodName: "GetLatestByTag",
+			Handler:    _FilesService_GetLatestByTag_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _FilesService_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Download",
+			Handler:       _FilesService_Download_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "files/v1/files.proto",
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/pavel-fokin/files-stash/internal/backup"
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/s3"
+)
+
+// storeConfig locates a disk backed stash, configured like the server
+type storeConfig struct {
+	DataDir string `env:"FILES_STASH_DATA_DIR,required,notEmpty"`
+	DBPath  string `env:"FILES_STASH_DB_PATH,required,notEmpty"`
+	Cold    coldConfig
+}
+
+// coldConfig locates the cold tier of a disk backed stash, configured like
+// the server
+type coldConfig struct {
+	Endpoint        string `env:"FILES_STASH_COLD_STORAGE_ENDPOINT"`
+	Region          string `env:"FILES_STASH_COLD_STORAGE_REGION"`
+	Bucket          string `env:"FILES_STASH_COLD_STORAGE_BUCKET"`
+	Prefix          string `env:"FILES_STASH_COLD_STORAGE_PREFIX"`
+	AccessKeyID     string `env:"FILES_STASH_COLD_STORAGE_ACCESS_KEY_ID"`
+	SecretAccessKey string `env:"FILES_STASH_COLD_STORAGE_SECRET_ACCESS_KEY"`
+}
+
+// storage creates the cold tier, or returns nil when the stash has none
+func (c coldConfig) storage() (files.FileStorage, error) {
+	if c.Bucket == "" {
+		return nil, nil
+	}
+	cold, err := s3.NewStorage(s3.Config{
+		Endpoint:        c.Endpoint,
+		Region:          c.Region,
+		Bucket:          c.Bucket,
+		Prefix:          c.Prefix,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+	}, &http.Client{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid cold storage: %w", err)
+	}
+	return cold, nil
+}
+
+// runBackup writes an archive of the stash to the file given as argument,
+// or to stdout:
+//
+//	files-stash backup [file]
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: files-stash backup [file]\n\nWrites an archive of the stash to file, or to stdout.")
+	}
+	flags.Parse(args)
+
+	var cfg storeConfig
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	var opts []backup.Option
+	cold, err := cfg.Cold.storage()
+	if err != nil {
+		return err
+	}
+	if cold != nil {
+		opts = append(opts, backup.WithColdStorage(cold))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	path := flags.Arg(0)
+	if path == "" || path == "-" {
+		return backup.Create(ctx, os.Stdout, cfg.DBPath, cfg.DataDir, opts...)
+	}
+
+	// Write next to the destination and rename once complete, so an
+	// interrupted backup doesn't replace a good one
+	tmpPath := path + ".partial"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	if err := backup.Create(ctx, file, cfg.DBPath, cfg.DataDir, opts...); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to move archive into place: %w", err)
+	}
+
+	slog.Info("Backup written", "path", path)
+	return nil
+}
+
+// runRestore unpacks an archive from the file given as argument, or from
+// stdin, into a stash without a database yet:
+//
+//	files-stash restore [file]
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: files-stash restore [file]\n\nRestores an archive from file, or from stdin. The database must not exist yet.")
+	}
+	flags.Parse(args)
+
+	var cfg storeConfig
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var archive io.Reader = os.Stdin
+	if path := flags.Arg(0); path != "" && path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer file.Close()
+		archive = file
+	}
+	if err := backup.Restore(ctx, archive, cfg.DBPath, cfg.DataDir); err != nil {
+		return err
+	}
+
+	slog.Info("Backup restored", "db_path", cfg.DBPath, "data_dir", cfg.DataDir)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/fs"
+	"github.com/pavel-fokin/files-stash/internal/sqlite"
+	"github.com/pavel-fokin/files-stash/internal/storage"
+)
+
+// gcConfig locates a disk backed stash and holds the settings of its
+// cleanup that gc applies too. The fields of storeConfig are spelled out,
+// since the environment isn't parsed into embedded unexported structs.
+type gcConfig struct {
+	DataDir            string        `env:"FILES_STASH_DATA_DIR,required,notEmpty"`
+	DBPath             string        `env:"FILES_STASH_DB_PATH,required,notEmpty"`
+	TombstoneRetention time.Duration `env:"FILES_STASH_TOMBSTONE_RETENTION" envDefault:"8760h"`
+	Cold               coldConfig
+}
+
+// gcReport counts what a collection removed
+type gcReport struct {
+	expiredFiles  int
+	tombstones    int
+	uploadParts   int
+	danglingRows  int
+	orphanBlobs   int
+	orphanBytes   int64
+	dbSizeBefore  int64
+	dbSizeAfter   int64
+	dbOptimizeErr error
+}
+
+// runGC removes expired files, old tombstones, abandoned upload parts,
+// database rows of files that are gone and content no file refers to, then
+// compacts the database, e.g. from cron on installations without the
+// server's janitor:
+//
+//	files-stash gc [-min-age duration]
+//
+// It's meant to run while the server is stopped; compacting the database
+// fails while the server holds it. Content younger than min-age is kept
+// even when nothing refers to it, since it may belong to an upload the
+// server is still storing.
+func runGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	minAge := flags.Duration("min-age", 24*time.Hour, "age content must reach before it's removed as unreferenced")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: files-stash gc [-min-age duration]\n\nRemoves expired and unreferenced data and compacts the database.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var cfg gcConfig
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	cold, err := cfg.Cold.storage()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	repo, err := sqlite.NewRepository(cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer repo.Close()
+	// Files are removed from both tiers, like the server does, while only
+	// the local disk is walked for unreferenced content
+	hot := fs.NewStorage(cfg.DataDir)
+	var backend files.FileStorage = hot
+	if cold != nil {
+		backend = storage.NewTiered(hot, cold)
+	}
+	service := files.NewService(backend, repo, "", 0, files.WithTombstoneRetention(cfg.TombstoneRetention))
+
+	var report gcReport
+	if report.expiredFiles, err = service.PurgeExpired(ctx); err != nil {
+		return err
+	}
+	if report.tombstones, err = service.PurgeTombstones(ctx); err != nil {
+		return err
+	}
+	if report.uploadParts, err = service.PurgeUploadParts(ctx); err != nil {
+		return err
+	}
+	if report.danglingRows, err = repo.PurgeDangling(ctx); err != nil {
+		return err
+	}
+
+	// Content is unreferenced once the rows above are gone
+	referenced, err := service.StorageIDs(ctx)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-*minAge)
+	err = hot.Walk(ctx, func(id string, info os.FileInfo) error {
+		if referenced[id] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := hot.Delete(ctx, id); err != nil {
+			return err
+		}
+		slog.Info("Removed unreferenced content", "storage_id", id, "size", info.Size())
+		report.orphanBlobs++
+		report.orphanBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove unreferenced content: %w", err)
+	}
+
+	// The cleanup above counts even when compacting fails
+	report.dbSizeBefore = fileSize(cfg.DBPath)
+	report.dbOptimizeErr = repo.Optimize(ctx)
+	report.dbSizeAfter = fileSize(cfg.DBPath)
+
+	report.print(os.Stdout)
+	return report.dbOptimizeErr
+}
+
+// print writes the report as a table
+func (r *gcReport) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Expired files\t%d\n", r.expiredFiles)
+	fmt.Fprintf(w, "Tombstones\t%d\n", r.tombstones)
+	fmt.Fprintf(w, "Upload parts\t%d\n", r.uploadParts)
+	fmt.Fprintf(w, "Dangling rows\t%d\n", r.danglingRows)
+	fmt.Fprintf(w, "Unreferenced content\t%d (%d bytes)\n", r.orphanBlobs, r.orphanBytes)
+	if r.dbOptimizeErr != nil {
+		fmt.Fprintf(w, "Database\tnot compacted\n")
+	} else {
+		fmt.Fprintf(w, "Database\t%d -> %d bytes\n", r.dbSizeBefore, r.dbSizeAfter)
+	}
+	w.Flush()
+}
+
+// fileSize returns the size of a file, or zero when it can't be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
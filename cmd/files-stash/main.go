@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
 	"github.com/pavel-fokin/files-stash/internal/server"
+	"github.com/pavel-fokin/files-stash/internal/telemetry"
 )
 
 func main() {
@@ -16,20 +23,117 @@ func main() {
 		slog.Info("No .env file found, using environment variables")
 	}
 
-	// Parse configuration from environment variables
-	cfg := server.Config{}
-	if err := env.Parse(&cfg); err != nil {
-		slog.Error("Failed to parse configuration", "error", err)
+	// Subcommands work on the stash configured for the server
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		commands := map[string]func([]string) error{
+			"backup":  runBackup,
+			"restore": runRestore,
+			"repair":  runRepair,
+			"migrate": runMigrate,
+			"gc":      runGC,
+		}
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command %q, expected backup, restore, repair, migrate or gc\n", os.Args[1])
+			os.Exit(2)
+		}
+		if err := command(os.Args[2:]); err != nil {
+			slog.Error("Command failed", "command", os.Args[1], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	flags := flag.NewFlagSet("files-stash", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("FILES_STASH_CONFIG"), "YAML or TOML config file, under the environment variables")
+	flags.Parse(os.Args[1:])
+
+	// Parse configuration from environment variables, on top of the config
+	// file and the deployment profile's presets
+	cfg, err := server.LoadConfig(*configPath, env.ToMap(os.Environ()))
+	var invalid server.ConfigError
+	if errors.As(err, &invalid) {
+		for _, problem := range invalid {
+			slog.Error("Invalid configuration", "problem", problem)
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		os.Exit(1)
+	}
+
+	logger, logLevel, err := server.NewLogger(os.Stdout, cfg)
+	if err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	// The server reloads its config file itself, SIGHUP included
+	cfg.ConfigFile = *configPath
+	if cfg.ConfigFile == "" {
+		go reloadLogLevel(logLevel)
+	}
+
+	// Export traces when an OTLP endpoint is configured
+	shutdownTracing, err := telemetry.Setup(context.Background())
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
 		os.Exit(1)
 	}
+	defer shutdownTracing(context.Background())
 
-	// Create a new server
-	srv := server.New(&cfg)
+	// Create the app, stopping it on SIGINT or SIGTERM
+	app := server.NewApp(cfg, logLevel)
+	if err := app.Start(); err != nil {
+		slog.Error("Failed to start", "error", err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Start the server
-	slog.Info("Starting server on :8080")
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	failed := false
+	select {
+	case <-ctx.Done():
+	case err := <-app.Err():
 		slog.Error("Server failed", "error", err)
+		failed = true
+	}
+
+	slog.Info("Shutting down", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := app.Stop(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down cleanly", "error", err)
+		failed = true
+	}
+	if failed {
+		shutdownTracing(context.Background())
 		os.Exit(1)
 	}
 }
+
+// reloadLogLevel sets the log level from FILES_STASH_LOG_LEVEL, as found in
+// the .env file or else the environment, whenever the process gets SIGHUP
+func reloadLogLevel(level *slog.LevelVar) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		value := os.Getenv("FILES_STASH_LOG_LEVEL")
+		if dotenv, err := godotenv.Read(); err == nil && dotenv["FILES_STASH_LOG_LEVEL"] != "" {
+			value = dotenv["FILES_STASH_LOG_LEVEL"]
+		}
+		if value == "" {
+			value = "info"
+		}
+
+		var changed slog.Level
+		if err := changed.UnmarshalText([]byte(value)); err != nil {
+			slog.Error("Invalid log level, keeping the current one", "level", value, "error", err)
+			continue
+		}
+		level.Set(changed)
+		slog.Info("Log level reloaded", "level", changed.String())
+	}
+}
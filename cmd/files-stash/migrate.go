@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/pavel-fokin/files-stash/internal/sqlite"
+)
+
+// migrateConfig locates the stash database
+type migrateConfig struct {
+	DBPath string `env:"FILES_STASH_DB_PATH,required,notEmpty"`
+}
+
+// runMigrate applies or rolls back database migrations, or lists them. The
+// server applies pending migrations on startup; this is for doing it ahead
+// of a deploy or undoing one:
+//
+//	files-stash migrate [-to version] up|down|status
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := flags.Int("to", -1, "schema version to migrate to; the latest for up, the previous one for down")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: files-stash migrate [-to version] up|down|status\n\nApplies or rolls back database migrations, or lists them.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var cfg migrateConfig
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	repo, err := sqlite.Open(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	statuses, err := repo.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	current := 0
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			current = status.Version
+		}
+	}
+
+	switch flags.Arg(0) {
+	case "up":
+		if *to < 0 {
+			*to = sqlite.LatestVersion()
+		}
+		if *to < current {
+			return fmt.Errorf("schema is at version %d already, use down to roll back", current)
+		}
+	case "down":
+		if *to < 0 {
+			*to = 0
+			for _, status := range statuses {
+				if status.Version < current {
+					*to = status.Version
+				}
+			}
+		}
+		if *to > current {
+			return fmt.Errorf("schema is at version %d, use up to migrate forward", current)
+		}
+	case "status":
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := repo.Migrate(ctx, *to); err != nil {
+		return err
+	}
+	slog.Info("Schema migrated", "from", current, "to", *to)
+	return nil
+}
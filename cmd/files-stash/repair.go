@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/fs"
+	"github.com/pavel-fokin/files-stash/internal/sqlite"
+	"github.com/pavel-fokin/files-stash/internal/storage"
+)
+
+// repairConfig locates a disk backed stash and its mirrors. The fields of
+// storeConfig are spelled out, since the environment isn't parsed into
+// embedded unexported structs.
+type repairConfig struct {
+	DataDir    string   `env:"FILES_STASH_DATA_DIR,required,notEmpty"`
+	DBPath     string   `env:"FILES_STASH_DB_PATH,required,notEmpty"`
+	MirrorDirs []string `env:"FILES_STASH_MIRROR_DIRS,required,notEmpty"`
+}
+
+// runRepair copies content missing from the data directory or any of its
+// mirrors from one holding it, e.g. after replacing a lost disk:
+//
+//	files-stash repair
+func runRepair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: files-stash repair\n\nRestores content missing from the data directory or its mirrors.")
+	}
+	flags.Parse(args)
+
+	var cfg repairConfig
+	if err := env.Parse(&cfg); err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	repo, err := sqlite.NewRepository(cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer repo.Close()
+
+	var secondaries []files.FileStorage
+	for _, dir := range cfg.MirrorDirs {
+		secondaries = append(secondaries, fs.NewStorage(dir))
+	}
+	mirror := storage.NewMirror(fs.NewStorage(cfg.DataDir), secondaries, time.Minute)
+	service := files.NewService(mirror, repo, "", 0)
+
+	repaired, err := service.RepairStorage(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("Storage repaired", "repaired", repaired)
+	return nil
+}
@@ -0,0 +1,377 @@
+// Package backup writes and reads archives of a disk backed stash: a
+// snapshot of its SQLite database together with the content of every file
+// and thumbnail the snapshot references.
+//
+// An archive is a gzip compressed tar stream with the database first, then
+// the content under blobs/<storage id> and finally manifest.json listing
+// the SHA-256 digest of every other entry. The digests are only known once
+// the entries are written, which keeps the archive streamable.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/fs"
+	"github.com/pavel-fokin/files-stash/internal/sqlite"
+	"github.com/pavel-fokin/files-stash/internal/storage"
+)
+
+// Archive entry names
+const (
+	dbEntry       = "files-stash.db"
+	blobPrefix    = "blobs/"
+	manifestEntry = "manifest.json"
+)
+
+// formatVersion is bumped when archives change incompatibly
+const formatVersion = 1
+
+// Manifest is the last entry of an archive
+type Manifest struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Checksums map[string]string `json:"checksums"` // hex SHA-256 by entry name
+}
+
+// Option configures Create
+type Option func(*options)
+
+type options struct {
+	cold files.FileStorage
+}
+
+// WithColdStorage reads content the stash moved to its cold tier from cold
+func WithColdStorage(cold files.FileStorage) Option {
+	return func(o *options) {
+		o.cold = cold
+	}
+}
+
+// Create writes an archive of the stash with its database at dbPath and its
+// content in dataDir to w. The stash can keep serving meanwhile: content
+// added after the database snapshot is left out, and content of files
+// deleted before it could be read is skipped. Content missing while its
+// file still exists fails the backup.
+func Create(ctx context.Context, w io.Writer, dbPath, dataDir string, opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Opening a missing database would create an empty one
+	if _, err := os.Stat(dbPath); err != nil {
+		return fmt.Errorf("failed to stat database: %w", err)
+	}
+	repo, err := sqlite.NewRepository(dbPath)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	tmpDir, err := os.MkdirTemp("", "files-stash-backup-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath := filepath.Join(tmpDir, dbEntry)
+	if err := repo.Snapshot(ctx, snapshotPath); err != nil {
+		return err
+	}
+	snapshotRepo, err := sqlite.NewRepository(snapshotPath)
+	if err != nil {
+		return err
+	}
+	ids, err := storageIDs(ctx, snapshotRepo)
+	snapshotRepo.Close()
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	manifest := Manifest{
+		Version:   formatVersion,
+		CreatedAt: time.Now().UTC(),
+		Checksums: make(map[string]string),
+	}
+
+	snapshot, err := os.Open(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database snapshot: %w", err)
+	}
+	defer snapshot.Close()
+	if manifest.Checksums[dbEntry], err = writeEntry(tw, dbEntry, snapshot); err != nil {
+		return err
+	}
+
+	var store files.FileStorage = fs.NewStorage(dataDir)
+	if o.cold != nil {
+		store = storage.NewTiered(store, o.cold)
+	}
+	// live lists the content the stash references now, loaded once content
+	// of the snapshot turns out to be missing
+	var live []string
+	var liveLoaded bool
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := blobPrefix + id
+		content, err := store.GetContent(ctx, id)
+		if err != nil {
+			if exists, existsErr := store.Exists(ctx, id); existsErr != nil || exists {
+				return fmt.Errorf("failed to read %s: %w", id, err)
+			}
+			if !liveLoaded {
+				if live, err = storageIDs(ctx, repo); err != nil {
+					return err
+				}
+				liveLoaded = true
+			}
+			if slices.Contains(live, id) {
+				return fmt.Errorf("content %s is missing from storage", id)
+			}
+			slog.Warn("Skipping content deleted since the snapshot", "storage_id", id)
+			continue
+		}
+		manifest.Checksums[name], err = writeContent(tw, name, content, tmpDir)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	header := &tar.Header{Name: manifestEntry, Mode: 0o644, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return nil
+}
+
+// storageIDs lists the content referenced by the database of repo
+func storageIDs(ctx context.Context, repo *sqlite.Repository) ([]string, error) {
+	fileList, err := repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range fileList {
+		ids = append(ids, file.ID)
+		thumbs, err := repo.ListThumbnails(ctx, file.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, thumb := range thumbs {
+			ids = append(ids, thumb.StorageID)
+		}
+	}
+	return ids, nil
+}
+
+// writeContent copies content into the archive and returns its digest.
+// Content that isn't a local file, such as that of the cold tier, is
+// spooled to dir first, since the entry header needs its size.
+func writeContent(tw *tar.Writer, name string, content io.Reader, dir string) (string, error) {
+	if _, ok := content.(interface{ Stat() (os.FileInfo, error) }); ok {
+		return writeEntry(tw, name, content)
+	}
+	spool, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return "", fmt.Errorf("failed to spool %s: %w", name, err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if _, err := io.Copy(spool, content); err != nil {
+		return "", fmt.Errorf("failed to spool %s: %w", name, err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to spool %s: %w", name, err)
+	}
+	return writeEntry(tw, name, spool)
+}
+
+// writeEntry copies an open file into the archive and returns its digest
+func writeEntry(tw *tar.Writer, name string, file io.Reader) (string, error) {
+	stat, ok := file.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return "", fmt.Errorf("failed to stat %s: not a file", name)
+	}
+	info, err := stat.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+
+	header := &tar.Header{Name: name, Mode: 0o644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(header); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(tw, io.TeeReader(file, hash)); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Restore unpacks an archive written by Create into a stash with its
+// database at dbPath and its content in dataDir. The database must not
+// exist yet. It's only put in place once every entry matched the manifest;
+// otherwise the content restored so far is removed again.
+func Restore(ctx context.Context, r io.Reader, dbPath, dataDir string) error {
+	if _, err := os.Stat(dbPath); err == nil {
+		return fmt.Errorf("database %s already exists", dbPath)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat database: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	// Unpack the database next to its final path so it can be renamed
+	// into place
+	tmpPath := dbPath + ".restore"
+	defer os.Remove(tmpPath)
+
+	storage := fs.NewStorage(dataDir)
+	restored, err := unpack(ctx, r, tmpPath, storage)
+	if err != nil {
+		for _, id := range restored {
+			if err := storage.Delete(context.WithoutCancel(ctx), id); err != nil {
+				slog.Error("Failed to remove restored content", "storage_id", id, "error", err)
+			}
+		}
+		return err
+	}
+
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return fmt.Errorf("failed to move database into place: %w", err)
+	}
+	return nil
+}
+
+// unpack writes the database entry to dbPath and the content to storage,
+// checking them against the manifest, and returns the IDs of the content
+// written, also when it fails
+func unpack(ctx context.Context, r io.Reader, dbPath string, storage *fs.Storage) ([]string, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	tr := tar.NewReader(gr)
+
+	var restored []string
+	var manifest *Manifest
+	checksums := make(map[string]string)
+	for {
+		if err := ctx.Err(); err != nil {
+			return restored, err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if manifest != nil {
+			return restored, fmt.Errorf("unexpected entry %s after the manifest", header.Name)
+		}
+
+		hash := sha256.New()
+		content := io.TeeReader(tr, hash)
+		switch {
+		case header.Name == dbEntry:
+			if err := writeFile(dbPath, content); err != nil {
+				return restored, err
+			}
+		case strings.HasPrefix(header.Name, blobPrefix):
+			id := strings.TrimPrefix(header.Name, blobPrefix)
+			if !validID(id) {
+				return restored, fmt.Errorf("invalid entry %s", header.Name)
+			}
+			restored = append(restored, id)
+			if _, err := storage.Save(ctx, id, id, "", content); err != nil {
+				return restored, fmt.Errorf("failed to restore %s: %w", id, err)
+			}
+		case header.Name == manifestEntry:
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return restored, fmt.Errorf("failed to decode manifest: %w", err)
+			}
+			continue
+		default:
+			return restored, fmt.Errorf("unknown entry %s", header.Name)
+		}
+		checksums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if manifest == nil {
+		return restored, errors.New("archive has no manifest, it may be truncated")
+	}
+	if manifest.Version != formatVersion {
+		return restored, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if _, ok := checksums[dbEntry]; !ok {
+		return restored, errors.New("archive has no database")
+	}
+	if len(checksums) != len(manifest.Checksums) {
+		return restored, fmt.Errorf("archive has %d entries, the manifest lists %d", len(checksums), len(manifest.Checksums))
+	}
+	for name, sum := range checksums {
+		if manifest.Checksums[name] != sum {
+			return restored, fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+	return restored, nil
+}
+
+// writeFile creates or replaces the file at path with the content
+func writeFile(path string, content io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// validID reports whether a storage ID from an archive stays inside the
+// data directory
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/fs"
+	"github.com/pavel-fokin/files-stash/internal/memory"
+	"github.com/pavel-fokin/files-stash/internal/sqlite"
+	"github.com/pavel-fokin/files-stash/internal/storage"
+)
+
+// newStash creates a stash with a file and one of its thumbnails and
+// returns its database path and data directory
+func newStash(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "stash.db")
+	dataDir := filepath.Join(dir, "data")
+
+	repo, err := sqlite.NewRepository(dbPath)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	storage := fs.NewStorage(dataDir)
+	_, err = storage.Save(ctx, "1", "a.txt", "text/plain", strings.NewReader("content"))
+	require.NoError(t, err)
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", Size: 7, MimeType: "text/plain", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	_, err = storage.Save(ctx, "1.thumb-20x20", "a.txt", "image/png", strings.NewReader("thumbnail"))
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateThumbnail(ctx, &files.Thumbnail{FileID: "1", Width: 20, Height: 20, StorageID: "1.thumb-20x20", MimeType: "image/png", Size: 9, CreatedAt: now}))
+
+	return dbPath, dataDir
+}
+
+// rewrite replaces the content of an archive entry, keeping the manifest
+func rewrite(t *testing.T, archive []byte, name, content string) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		if header.Name == name {
+			data = []byte(content)
+			header.Size = int64(len(data))
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return out.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	dbPath, dataDir := newStash(t)
+
+	var archive bytes.Buffer
+	require.NoError(t, Create(ctx, &archive, dbPath, dataDir))
+
+	t.Run("Restore", func(t *testing.T) {
+		dir := t.TempDir()
+		restoredDB := filepath.Join(dir, "restored.db")
+		restoredData := filepath.Join(dir, "data")
+		require.NoError(t, Restore(ctx, bytes.NewReader(archive.Bytes()), restoredDB, restoredData))
+
+		repo, err := sqlite.NewRepository(restoredDB)
+		require.NoError(t, err)
+		defer repo.Close()
+		file, err := repo.FindByID(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "a.txt", file.Name)
+
+		storage := fs.NewStorage(restoredData)
+		for id, want := range map[string]string{"1": "content", "1.thumb-20x20": "thumbnail"} {
+			content, err := storage.GetContent(ctx, id)
+			require.NoError(t, err)
+			data, err := io.ReadAll(content)
+			content.Close()
+			require.NoError(t, err)
+			assert.Equal(t, want, string(data))
+		}
+	})
+
+	t.Run("ExistingDatabase", func(t *testing.T) {
+		err := Restore(ctx, bytes.NewReader(archive.Bytes()), dbPath, t.TempDir())
+		assert.ErrorContains(t, err, "already exists")
+	})
+
+	t.Run("ChecksumMismatch", func(t *testing.T) {
+		dir := t.TempDir()
+		restoredDB := filepath.Join(dir, "restored.db")
+		restoredData := filepath.Join(dir, "data")
+
+		tampered := rewrite(t, archive.Bytes(), "blobs/1", "tampered")
+		err := Restore(ctx, bytes.NewReader(tampered), restoredDB, restoredData)
+		assert.ErrorContains(t, err, "checksum mismatch for blobs/1")
+
+		// Nothing is left behind
+		_, err = os.Stat(restoredDB)
+		assert.True(t, os.IsNotExist(err))
+		exists, err := fs.NewStorage(restoredData).Exists(ctx, "1")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		dir := t.TempDir()
+		restoredDB := filepath.Join(dir, "restored.db")
+
+		truncated := archive.Bytes()[:archive.Len()/2]
+		assert.Error(t, Restore(ctx, bytes.NewReader(truncated), restoredDB, filepath.Join(dir, "data")))
+		_, err := os.Stat(restoredDB)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("MissingDatabase", func(t *testing.T) {
+		dir := t.TempDir()
+		missing := filepath.Join(dir, "missing.db")
+		assert.Error(t, Create(ctx, io.Discard, missing, dir))
+		_, err := os.Stat(missing)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("MissingContent", func(t *testing.T) {
+		dbPath, dataDir := newStash(t)
+		require.NoError(t, fs.NewStorage(dataDir).Delete(ctx, "1.thumb-20x20"))
+
+		err := Create(ctx, io.Discard, dbPath, dataDir)
+		assert.ErrorContains(t, err, "content 1.thumb-20x20 is missing")
+	})
+
+	t.Run("ColdStorage", func(t *testing.T) {
+		dbPath, dataDir := newStash(t)
+		cold := memory.NewStorage()
+		moved, err := storage.NewTiered(fs.NewStorage(dataDir), cold).MoveTier(ctx, "1", true)
+		require.NoError(t, err)
+		require.True(t, moved)
+
+		var archive bytes.Buffer
+		require.NoError(t, Create(ctx, &archive, dbPath, dataDir, WithColdStorage(cold)))
+
+		dir := t.TempDir()
+		restoredData := filepath.Join(dir, "data")
+		require.NoError(t, Restore(ctx, &archive, filepath.Join(dir, "restored.db"), restoredData))
+		content, err := fs.NewStorage(restoredData).GetContent(ctx, "1")
+		require.NoError(t, err)
+		defer content.Close()
+		data, err := io.ReadAll(content)
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(data))
+	})
+}
@@ -0,0 +1,154 @@
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// chunkSize is the size of the chunks content is streamed to clamd in. It
+// must stay below clamd's StreamMaxLength.
+const chunkSize = 64 * 1024
+
+// Client scans content with a ClamAV daemon
+type Client struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+// New creates a client for clamd listening at target, a "tcp://host:port"
+// or "unix:///path" URL. Each scan must finish within timeout.
+func New(target string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clamd address: %w", err)
+	}
+	addr := u.Host
+	switch u.Scheme {
+	case "tcp":
+		if addr == "" {
+			return nil, fmt.Errorf("invalid clamd address %q", target)
+		}
+	case "unix":
+		addr = u.Path
+	default:
+		return nil, fmt.Errorf("unsupported clamd network %q", u.Scheme)
+	}
+	return &Client{network: u.Scheme, addr: addr, timeout: timeout}, nil
+}
+
+// Scan streams content to clamd and returns the name of the malware it
+// found, or an empty string when the content is clean
+func (c *Client) Scan(ctx context.Context, content io.Reader) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(c.deadline(ctx)); err != nil {
+		return "", err
+	}
+	// Abort the exchange when the request goes away
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := stream(conn, content); err != nil {
+		return "", fmt.Errorf("failed to send content to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// Ping checks that clamd is up
+func (c *Client) Ping(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(c.deadline(ctx)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if strings.TrimRight(reply, "\x00\n") != "PONG" {
+		return fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+// deadline is when an exchange with clamd must be over: after the timeout,
+// or earlier when ctx ends first. A zero timeout only follows ctx.
+func (c *Client) deadline(ctx context.Context) time.Time {
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// stream sends content with the INSTREAM command: chunks prefixed with
+// their big-endian length, ended by an empty chunk
+func stream(w io.Writer, content io.Reader) error {
+	if _, err := w.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(content, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseReply reads a reply such as "stream: OK" or
+// "stream: Eicar-Signature FOUND"
+func parseReply(reply string) (string, error) {
+	_, result, ok := strings.Cut(reply, ": ")
+	if !ok {
+		return "", fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd scan failed: %s", result)
+	}
+}
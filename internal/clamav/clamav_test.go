@@ -0,0 +1,143 @@
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd answers INSTREAM scans, finding malware in content containing
+// "EICAR", and PING commands
+func fakeClamd(t *testing.T, network, addr string) (string, <-chan []byte) {
+	listener, err := net.Listen(network, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	scanned := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			command, err := reader.ReadString(0)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			switch command {
+			case "zPING\x00":
+				conn.Write([]byte("PONG\x00"))
+			case "zINSTREAM\x00":
+				var content bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(reader, binary.BigEndian, &size); err != nil || size == 0 {
+						break
+					}
+					io.CopyN(&content, reader, int64(size))
+				}
+				select {
+				case scanned <- content.Bytes():
+				default:
+				}
+				if strings.Contains(content.String(), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			default:
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), scanned
+}
+
+func TestScan(t *testing.T) {
+	addr, scanned := fakeClamd(t, "tcp", "127.0.0.1:0")
+	client, err := New("tcp://"+addr, 5*time.Second)
+	require.NoError(t, err)
+
+	t.Run("Clean", func(t *testing.T) {
+		content := bytes.Repeat([]byte("clean "), chunkSize/3)
+		signature, err := client.Scan(context.Background(), bytes.NewReader(content))
+		require.NoError(t, err)
+		assert.Empty(t, signature)
+		assert.Equal(t, content, <-scanned)
+	})
+
+	t.Run("Infected", func(t *testing.T) {
+		signature, err := client.Scan(context.Background(), strings.NewReader("X5O!P%@AP EICAR test"))
+		require.NoError(t, err)
+		assert.Equal(t, "Eicar-Test-Signature", signature)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		signature, err := client.Scan(context.Background(), strings.NewReader(""))
+		require.NoError(t, err)
+		assert.Empty(t, signature)
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		assert.NoError(t, client.Ping(context.Background()))
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := listener.Addr().String()
+		listener.Close()
+
+		client, err := New("tcp://"+addr, time.Second)
+		require.NoError(t, err)
+		_, err = client.Scan(context.Background(), strings.NewReader("content"))
+		assert.Error(t, err)
+	})
+}
+
+func TestScanUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd(t, "unix", socket)
+
+	client, err := New("unix://"+socket, 5*time.Second)
+	require.NoError(t, err)
+	signature, err := client.Scan(context.Background(), strings.NewReader("EICAR"))
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", signature)
+}
+
+func TestParseReply(t *testing.T) {
+	signature, err := parseReply("stream: OK")
+	assert.NoError(t, err)
+	assert.Empty(t, signature)
+
+	signature, err = parseReply("stream: Win.Test.EICAR_HDB-1 FOUND")
+	assert.NoError(t, err)
+	assert.Equal(t, "Win.Test.EICAR_HDB-1", signature)
+
+	_, err = parseReply("INSTREAM size limit exceeded. ERROR")
+	assert.Error(t, err)
+
+	_, err = parseReply("stream: Size limit exceeded ERROR")
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	for _, target := range []string{"localhost:3310", "udp://localhost:3310", "tcp://"} {
+		_, err := New(target, time.Second)
+		assert.Error(t, err, target)
+	}
+}
@@ -0,0 +1,192 @@
+package files
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DownloadStats counts the completed downloads of a file
+type DownloadStats struct {
+	Downloads        int64      `json:"downloads"`
+	BytesServed      int64      `json:"bytes_served"`
+	LastDownloadedAt *time.Time `json:"last_downloaded_at,omitempty"`
+}
+
+// Access logs are paged, DefaultAccessLimit accesses at a time unless asked
+// otherwise, and at most MaxAccessLimit
+const (
+	DefaultAccessLimit = 50
+	MaxAccessLimit     = 500
+)
+
+// Access is a request to download a file, as answered
+type Access struct {
+	FileID    string    `json:"-"`
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Bytes     int64     `json:"bytes"` // of the response body sent
+	Status    int       `json:"status"`
+}
+
+// AccessLog is a page of the accesses to a file, latest first, with the
+// number of them on all pages
+type AccessLog struct {
+	Accesses []*Access `json:"accesses"`
+	Total    int       `json:"total"`
+	Limit    int       `json:"limit"`
+	Offset   int       `json:"offset"`
+}
+
+// FileMetadata is a file's metadata along with its download stats
+type FileMetadata struct {
+	*File
+	DownloadStats
+}
+
+// FileDownloads are the download stats of a single file in a DownloadReport
+type FileDownloads struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Tag  string `json:"tag,omitempty"`
+	DownloadStats
+}
+
+// DownloadReport lists the download stats of files, most downloaded first,
+// with totals over all of them. Files never downloaded are included, so
+// unused ones stand out before they're pruned.
+type DownloadReport struct {
+	Downloads   int64            `json:"downloads"`
+	BytesServed int64            `json:"bytes_served"`
+	Files       []*FileDownloads `json:"files"`
+}
+
+// GetMetadata retrieves the metadata and download stats of a file
+func (s *Service) GetMetadata(ctx context.Context, id string) (*FileMetadata, error) {
+	ctx, span := tracer.Start(ctx, "Service.GetMetadata")
+	defer span.End()
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if file.IsExpired(time.Now()) {
+		s.purge(ctx, file)
+		return nil, ErrExpired
+	}
+
+	stats, err := s.repo.FindDownloads(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find download stats: %w", err)
+	}
+	return &FileMetadata{File: file, DownloadStats: *stats}, nil
+}
+
+// DownloadReport reports the download stats of the files matching filter
+func (s *Service) DownloadReport(ctx context.Context, filter ListFilter) (*DownloadReport, error) {
+	ctx, span := tracer.Start(ctx, "Service.DownloadReport")
+	defer span.End()
+
+	fileList, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	stats, err := s.repo.ListDownloads(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list download stats: %w", err)
+	}
+
+	now := time.Now()
+	report := &DownloadReport{Files: []*FileDownloads{}}
+	for _, file := range fileList {
+		if file.IsExpired(now) || !filter.Match(file, now) {
+			continue
+		}
+		downloads := &FileDownloads{ID: file.ID, Name: file.Name, Tag: file.Tag, DownloadStats: stats[file.ID]}
+		report.Downloads += downloads.Downloads
+		report.BytesServed += downloads.BytesServed
+		report.Files = append(report.Files, downloads)
+	}
+	slices.SortStableFunc(report.Files, func(a, b *FileDownloads) int {
+		return cmp.Compare(b.Downloads, a.Downloads)
+	})
+	return report, nil
+}
+
+// RecordAccess adds a download request to the access log of its file.
+// Requests for files that don't exist aren't logged.
+func (s *Service) RecordAccess(ctx context.Context, access *Access) error {
+	ctx, span := tracer.Start(ctx, "Service.RecordAccess")
+	defer span.End()
+
+	if _, err := s.repo.FindByID(ctx, access.FileID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("file not found: %w", err)
+	}
+	if err := s.repo.RecordAccess(ctx, access); err != nil {
+		return fmt.Errorf("failed to record access: %w", err)
+	}
+	return nil
+}
+
+// AccessLog returns the page of the access log of a file starting at
+// offset
+func (s *Service) AccessLog(ctx context.Context, id string, limit, offset int) (*AccessLog, error) {
+	ctx, span := tracer.Start(ctx, "Service.AccessLog")
+	defer span.End()
+
+	if _, err := s.repo.FindByID(ctx, id); err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if limit <= 0 {
+		limit = DefaultAccessLimit
+	}
+	limit = min(limit, MaxAccessLimit)
+	offset = max(offset, 0)
+
+	accesses, total, err := s.repo.ListAccesses(ctx, id, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list accesses: %w", err)
+	}
+	if accesses == nil {
+		accesses = []*Access{}
+	}
+	return &AccessLog{Accesses: accesses, Total: total, Limit: limit, Offset: offset}, nil
+}
+
+// track records a download of file once its content has been read to the
+// end; downloads broken off part way aren't counted
+func (s *Service) track(ctx context.Context, file *File, content io.ReadCloser) io.ReadCloser {
+	ctx = context.WithoutCancel(ctx)
+	return &trackedContent{ReadCloser: content, record: func(bytes int64) {
+		if err := s.repo.RecordDownload(ctx, file.ID, bytes, time.Now()); err != nil {
+			slog.Error("Failed to record download", "file_id", file.ID, "error", err)
+		}
+	}}
+}
+
+// trackedContent counts the bytes read and reports them on reaching EOF
+type trackedContent struct {
+	io.ReadCloser
+	read   int64
+	once   sync.Once
+	record func(bytes int64)
+}
+
+func (c *trackedContent) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.read += int64(n)
+	if err == io.EOF {
+		c.once.Do(func() { c.record(c.read) })
+	}
+	return n, err
+}
@@ -0,0 +1,61 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// AttributePrefix marks form fields and list filters naming a custom
+// attribute, e.g. attr.commit=abc123
+const AttributePrefix = "attr."
+
+// Attribute limits keep attributes small enough to return with every file
+const (
+	maxAttributes         = 32
+	maxAttributeKeyLength = 64
+	maxAttributeValueSize = 1024
+)
+
+// ErrInvalidAttribute is returned when custom attributes break the limits
+var ErrInvalidAttribute = errors.New("invalid attribute")
+
+// ParseAttributes collects the custom attributes among form values, keyed
+// without their prefix. Only the first value of a field is used.
+func ParseAttributes(values url.Values) map[string]string {
+	var attrs map[string]string
+	for key := range values {
+		name, ok := strings.CutPrefix(key, AttributePrefix)
+		if !ok {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[name] = values.Get(key)
+	}
+	return attrs
+}
+
+// validateAttributes checks that attribute keys are short identifiers made
+// of letters, digits, '_', '-' and '.', and that values aren't too large
+func validateAttributes(attrs map[string]string) error {
+	if len(attrs) > maxAttributes {
+		return fmt.Errorf("%w: more than %d attributes", ErrInvalidAttribute, maxAttributes)
+	}
+	for key, value := range attrs {
+		if key == "" || len(key) > maxAttributeKeyLength {
+			return fmt.Errorf("%w: key %q must be 1 to %d characters", ErrInvalidAttribute, key, maxAttributeKeyLength)
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+				return fmt.Errorf("%w: key %q has invalid characters", ErrInvalidAttribute, key)
+			}
+		}
+		if len(value) > maxAttributeValueSize {
+			return fmt.Errorf("%w: value of %q exceeds %d bytes", ErrInvalidAttribute, key, maxAttributeValueSize)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrCodeTaken is returned by repositories storing a download code that
+// another file has already
+var ErrCodeTaken = errors.New("download code is taken")
+
+// DownloadCode is a short code a file can be downloaded with, for links
+// that are typed in by hand or read out over the phone. A file has at most
+// one code, which works as long as the file can be downloaded.
+type DownloadCode struct {
+	Code      string    `json:"code"`
+	FileID    string    `json:"file_id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"-"` // signed download link, set on resolving
+}
+
+// Download codes use Crockford's base32 alphabet, which leaves out letters
+// easily mistaken for digits
+const downloadCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// downloadCodeLength is the number of characters in a download code,
+// giving about a billion codes
+const downloadCodeLength = 6
+
+// downloadCodeAttempts bounds the retries on colliding codes
+const downloadCodeAttempts = 5
+
+// CreateDownloadCode returns the download code of a file, generating one
+// when the file has none yet
+func (s *Service) CreateDownloadCode(ctx context.Context, id string) (*DownloadCode, error) {
+	ctx, span := tracer.Start(ctx, "Service.CreateDownloadCode")
+	defer span.End()
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if file.IsExpired(time.Now()) {
+		return nil, ErrExpired
+	}
+
+	if code, err := s.repo.FindFileDownloadCode(ctx, id); err == nil {
+		return code, nil
+	}
+
+	for range downloadCodeAttempts {
+		code := &DownloadCode{Code: newDownloadCode(), FileID: id, CreatedAt: time.Now()}
+		err := s.repo.CreateDownloadCode(ctx, code)
+		if errors.Is(err, ErrCodeTaken) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to save download code: %w", err)
+		}
+		return code, nil
+	}
+	return nil, fmt.Errorf("failed to save download code: %w", ErrCodeTaken)
+}
+
+// ResolveDownloadCode returns the download code matching code, with a
+// signed link to the file it's for. Codes are matched regardless of case,
+// dashes and spaces, and letters read as digits.
+func (s *Service) ResolveDownloadCode(ctx context.Context, code string) (*DownloadCode, error) {
+	ctx, span := tracer.Start(ctx, "Service.ResolveDownloadCode")
+	defer span.End()
+
+	found, err := s.repo.FindDownloadCode(ctx, normalizeDownloadCode(code))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := s.repo.FindByID(ctx, found.FileID)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if file.IsExpired(time.Now()) {
+		return nil, ErrExpired
+	}
+	if err := checkDownloadable(file); err != nil {
+		return nil, err
+	}
+
+	if found.URL, err = s.generateSignedURL(file.ID, LinkOptions{}); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// newDownloadCode returns a random download code
+func newDownloadCode() string {
+	b := make([]byte, downloadCodeLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = downloadCodeAlphabet[int(b[i])%len(downloadCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// normalizeDownloadCode turns a code as typed into its canonical form
+func normalizeDownloadCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', ' ':
+			return -1
+		case 'O', 'o':
+			return '0'
+		case 'I', 'i', 'L', 'l':
+			return '1'
+		}
+		if 'a' <= r && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,432 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrDiffTooLarge is returned when a file is larger than the diff limit
+	ErrDiffTooLarge = errors.New("file is too large to diff")
+
+	// ErrNotText is returned when a file to diff isn't UTF-8 text
+	ErrNotText = errors.New("file is not text")
+)
+
+// Diff formats
+const (
+	DiffUnified = "unified" // line based unified diff
+	DiffJSON    = "json"    // structural diff of two JSON documents
+)
+
+// diffContext is the number of unchanged lines around each unified diff hunk
+const diffContext = 3
+
+// maxDiffEdits bounds the work spent looking for a minimal line diff. Files
+// differing in more lines are diffed as a whole replacement.
+const maxDiffEdits = 1000
+
+// FileDiff is the difference between two files
+type FileDiff struct {
+	A       *File
+	B       *File
+	Format  string
+	Unified string       // set for unified diffs, empty when the files are equal
+	Changes []JSONChange // set for JSON diffs
+}
+
+// JSONChange is a difference between two JSON documents at a JSON Pointer
+// path. Old is unset for added values and New for removed ones.
+type JSONChange struct {
+	Path string          `json:"path"`
+	Op   string          `json:"op"` // added, removed or changed
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+// WithDiffLimit sets the largest file size, in bytes, that can be diffed
+func WithDiffLimit(bytes int64) Option {
+	return func(s *Service) {
+		s.diffLimit = bytes
+	}
+}
+
+// Diff compares two stored text files. The format is DiffUnified or
+// DiffJSON; when empty, JSON files are diffed structurally and anything
+// else line by line.
+func (s *Service) Diff(ctx context.Context, idA, idB, format string) (*FileDiff, error) {
+	ctx, span := tracer.Start(ctx, "Service.Diff")
+	defer span.End()
+
+	a, dataA, err := s.readText(ctx, idA)
+	if err != nil {
+		return nil, err
+	}
+	b, dataB, err := s.readText(ctx, idB)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == "" {
+		format = DiffUnified
+		if isJSONMimeType(a.MimeType) && isJSONMimeType(b.MimeType) {
+			format = DiffJSON
+		}
+	}
+
+	diff := &FileDiff{A: a, B: b, Format: format}
+	switch format {
+	case DiffUnified:
+		diff.Unified = unifiedDiff("a/"+a.Name, "b/"+b.Name, splitLines(string(dataA)), splitLines(string(dataB)))
+	case DiffJSON:
+		diff.Changes, err = jsonDiff(dataA, dataB)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown diff format %q", format)
+	}
+	return diff, nil
+}
+
+// readText loads the content of a downloadable file no larger than the diff
+// limit, checking that it is text
+func (s *Service) readText(ctx context.Context, id string) (*File, []byte, error) {
+	file, content, err := s.download(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer content.Close()
+
+	if s.diffLimit > 0 && file.Size > s.diffLimit {
+		return nil, nil, fmt.Errorf("%w: %s", ErrDiffTooLarge, file.Name)
+	}
+
+	// The recorded size may be off for content replaced by hand
+	reader := content.(io.Reader)
+	if s.diffLimit > 0 {
+		reader = io.LimitReader(content, s.diffLimit+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file content: %w", err)
+	}
+	if s.diffLimit > 0 && int64(len(data)) > s.diffLimit {
+		return nil, nil, fmt.Errorf("%w: %s", ErrDiffTooLarge, file.Name)
+	}
+
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotText, file.Name)
+	}
+	return file, data, nil
+}
+
+// isJSONMimeType reports whether a MIME type is JSON, including +json types
+func isJSONMimeType(mimeType string) bool {
+	base := BaseMimeType(mimeType)
+	return base == "application/json" || strings.HasSuffix(base, "+json")
+}
+
+// splitLines splits text into lines keeping their line endings, so a
+// missing newline at the end of the file shows up in the diff
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineOp is a single step of an edit script turning one list of lines into
+// another
+type lineOp struct {
+	kind byte // ' ' keeps, '-' removes, '+' adds a line
+	line string
+}
+
+// unifiedDiff formats the differences between two lists of lines as a
+// unified diff, or returns an empty string when they are equal
+func unifiedDiff(nameA, nameB string, a, b []string) string {
+	ops := diffLines(a, b)
+	if !slices.ContainsFunc(ops, func(op lineOp) bool { return op.kind != ' ' }) {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// Walk the ops, grouping changes less than two contexts apart into hunks
+	lineA, lineB := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			lineA++
+			lineB++
+			i++
+			continue
+		}
+
+		start := max(0, i-diffContext)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				end = min(len(ops), end+diffContext)
+				break
+			}
+			end = next
+		}
+
+		hunkA, hunkB := lineA-(i-start), lineB-(i-start)
+		var countA, countB int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(hunkA, countA), hunkRange(hunkB, countB))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				lineA++
+			}
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the "start,count" of a hunk header. Empty ranges start
+// at the line before them, as in diff -u.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// diffLines returns an edit script turning a into b, using Myers' algorithm
+// on what remains after trimming the common prefix and suffix
+func diffLines(a, b []string) []lineOp {
+	var prefix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	var suffix int
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []lineOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, lineOp{' ', line})
+	}
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, lineOp{' ', line})
+	}
+	return ops
+}
+
+// myers finds a shortest edit script turning a into b. When more than
+// maxDiffEdits edits are needed, all of a is replaced by all of b.
+func myers(a, b []string) []lineOp {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxDiffEdits)
+
+	// v[k] is the furthest x reached on diagonal k = x - y; trace keeps a
+	// copy of v for every step to backtrack through
+	offset := limit + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		trace = append(trace, slices.Clone(v))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // down: add from b
+			} else {
+				x = v[offset+k-1] + 1 // right: remove from a
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		ops := make([]lineOp, 0, n+m)
+		for _, line := range a {
+			ops = append(ops, lineOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, lineOp{'+', line})
+		}
+		return ops
+	}
+
+	// Backtrack from the end, collecting ops in reverse
+	var ops []lineOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, lineOp{' ', a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				ops = append(ops, lineOp{'+', b[y]})
+			} else {
+				x--
+				ops = append(ops, lineOp{'-', a[x]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	slices.Reverse(ops)
+	return ops
+}
+
+// jsonDiff compares two JSON documents structurally. Object members are
+// compared by key and array elements by index.
+func jsonDiff(a, b []byte) ([]JSONChange, error) {
+	valueA, err := decodeJSON(a)
+	if err != nil {
+		return nil, err
+	}
+	valueB, err := decodeJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []JSONChange{}
+	compareJSON("", valueA, valueB, &changes)
+	return changes, nil
+}
+
+// decodeJSON decodes a single JSON document, keeping numbers as written
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON: %v", ErrNotText, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("%w: invalid JSON: trailing data", ErrNotText)
+	}
+	return value, nil
+}
+
+// compareJSON appends the differences between two decoded JSON values at
+// path to changes
+func compareJSON(path string, a, b any, changes *[]JSONChange) {
+	switch a := a.(type) {
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for key := range a {
+				keys = append(keys, key)
+			}
+			for key := range b {
+				if _, ok := a[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			slices.Sort(keys)
+			for _, key := range keys {
+				childPath := path + "/" + escapePointer(key)
+				valueA, inA := a[key]
+				valueB, inB := b[key]
+				switch {
+				case !inA:
+					*changes = append(*changes, JSONChange{Path: childPath, Op: "added", New: rawJSON(valueB)})
+				case !inB:
+					*changes = append(*changes, JSONChange{Path: childPath, Op: "removed", Old: rawJSON(valueA)})
+				default:
+					compareJSON(childPath, valueA, valueB, changes)
+				}
+			}
+			return
+		}
+	case []any:
+		if b, ok := b.([]any); ok {
+			for i := range max(len(a), len(b)) {
+				childPath := fmt.Sprintf("%s/%d", path, i)
+				switch {
+				case i >= len(a):
+					*changes = append(*changes, JSONChange{Path: childPath, Op: "added", New: rawJSON(b[i])})
+				case i >= len(b):
+					*changes = append(*changes, JSONChange{Path: childPath, Op: "removed", Old: rawJSON(a[i])})
+				default:
+					compareJSON(childPath, a[i], b[i], changes)
+				}
+			}
+			return
+		}
+	}
+
+	if !bytes.Equal(rawJSON(a), rawJSON(b)) {
+		*changes = append(*changes, JSONChange{Path: path, Op: "changed", Old: rawJSON(a), New: rawJSON(b)})
+	}
+}
+
+// rawJSON encodes a decoded JSON value back to JSON
+func rawJSON(value any) json.RawMessage {
+	data, _ := json.Marshal(value) // decoded JSON always encodes
+	return data
+}
+
+// escapePointer escapes a key for use in a JSON Pointer (RFC 6901)
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
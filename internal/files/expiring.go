@@ -0,0 +1,120 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/notify"
+)
+
+// expiringReportNames is how many file names the report message lists
+const expiringReportNames = 10
+
+// ExpiringFile is a file listed in an expiring-soon report
+type ExpiringFile struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Tag       string    `json:"tag,omitempty"`
+	Size      int64     `json:"size"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ExpiringReport lists the unpinned files expiring within a window,
+// soonest first
+type ExpiringReport struct {
+	Window string          `json:"window"`
+	Files  []*ExpiringFile `json:"files"`
+	Bytes  int64           `json:"bytes"`
+}
+
+// ExpiringReport lists the files expiring within window, so they can be
+// pinned or uploaded again before they are removed
+func (s *Service) ExpiringReport(ctx context.Context, window time.Duration) (*ExpiringReport, error) {
+	ctx, span := tracer.Start(ctx, "Service.ExpiringReport")
+	defer span.End()
+
+	fileList, err := s.List(ctx, "", ListFilter{ExpiringWithin: window})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ExpiringReport{Window: window.String(), Files: []*ExpiringFile{}}
+	for _, file := range fileList {
+		if !file.IsActive() {
+			continue
+		}
+		report.Files = append(report.Files, &ExpiringFile{
+			ID:        file.ID,
+			Name:      file.Name,
+			Tag:       file.Tag,
+			Size:      file.Size,
+			ExpiresAt: file.ExpiresAt,
+		})
+		report.Bytes += file.Size
+	}
+	slices.SortFunc(report.Files, func(a, b *ExpiringFile) int { return a.ExpiresAt.Compare(b.ExpiresAt) })
+	return report, nil
+}
+
+// Message summarizes the report for chat, naming the first few files
+func (r *ExpiringReport) Message() string {
+	names := make([]string, 0, expiringReportNames)
+	for _, file := range r.Files[:min(len(r.Files), expiringReportNames)] {
+		names = append(names, file.Name)
+	}
+	message := fmt.Sprintf("%d files expire within %s: %s", len(r.Files), r.Window, strings.Join(names, ", "))
+	if more := len(r.Files) - len(names); more > 0 {
+		message += fmt.Sprintf(" and %d more", more)
+	}
+	return message
+}
+
+// ExpiringReporter periodically notifies of the files expiring within a
+// window, when there are any
+type ExpiringReporter struct {
+	service  *Service
+	interval time.Duration
+	window   time.Duration
+}
+
+// NewExpiringReporter creates a reporter sending a report every interval
+func NewExpiringReporter(service *Service, interval, window time.Duration) *ExpiringReporter {
+	return &ExpiringReporter{service: service, interval: interval, window: window}
+}
+
+// Run sends reports until the context is cancelled
+func (r *ExpiringReporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce sends a report of the files expiring now
+func (r *ExpiringReporter) RunOnce(ctx context.Context) {
+	report, err := r.service.ExpiringReport(ctx, r.window)
+	if err != nil {
+		slog.Error("Expiring files report failed", "error", err)
+		return
+	}
+	if len(report.Files) == 0 || r.service.notifier == nil {
+		return
+	}
+
+	slog.Info("Files expiring soon", "files", len(report.Files), "window", report.Window)
+	event := notify.NewEvent(notify.EventFilesExpiring, report.Message(), report)
+	if err := r.service.notifier.Notify(ctx, event); err != nil {
+		slog.Error("Expiring files notification failed", "error", err)
+	}
+}
@@ -0,0 +1,338 @@
+package files
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// An export is a gzip compressed tar stream that moves files between stashes
+// whatever their backends. Every file has a files/<id>.json entry with its
+// metadata and comments, directly followed by its content under
+// blobs/<id>. Saved searches come first in searches.json and manifest.json
+// ends the stream, listing the SHA-256 digest of every other entry.
+// Thumbnails are left out; they are generated again on request.
+const (
+	exportSearchesEntry = "searches.json"
+	exportFilePrefix    = "files/"
+	exportBlobPrefix    = "blobs/"
+	exportManifestEntry = "manifest.json"
+)
+
+// exportVersion is bumped when exports change incompatibly
+const exportVersion = 1
+
+// ErrInvalidExport is returned when an imported stream isn't a complete export
+var ErrInvalidExport = errors.New("invalid export")
+
+// exportedFile is the metadata entry of a file in an export. Unlike the
+// API's representation, it carries the password hash.
+type exportedFile struct {
+	File         *File      `json:"file"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+	Comments     []*Comment `json:"comments,omitempty"`
+}
+
+// exportManifest is the last entry of an export
+type exportManifest struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Checksums map[string]string `json:"checksums"` // hex SHA-256 by entry name
+}
+
+// ImportResult counts the files an import created and those it skipped
+// because a file with the same ID already existed
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// Export writes every file that isn't expired, with its content, to w. Files
+// whose content is missing, such as registered files still waiting for it,
+// are left out.
+func (s *Service) Export(ctx context.Context, w io.Writer) error {
+	ctx, span := tracer.Start(ctx, "Service.Export")
+	defer span.End()
+
+	fileList, err := s.repo.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	searches, err := s.repo.ListSavedSearches(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list saved searches: %w", err)
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	manifest := exportManifest{
+		Version:   exportVersion,
+		CreatedAt: time.Now().UTC(),
+		Checksums: make(map[string]string),
+	}
+
+	if manifest.Checksums[exportSearchesEntry], err = writeJSONEntry(tw, exportSearchesEntry, searches); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, file := range fileList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if file.IsExpired(now) {
+			continue
+		}
+		exists, err := s.storage.Exists(ctx, file.ID)
+		if err != nil {
+			return fmt.Errorf("failed to check content of %s: %w", file.ID, err)
+		}
+		if !exists {
+			slog.Warn("Skipping file without content in export", "file_id", file.ID, "status", file.Status)
+			continue
+		}
+
+		comments, err := s.repo.ListComments(ctx, file.ID)
+		if err != nil {
+			return fmt.Errorf("failed to list comments of %s: %w", file.ID, err)
+		}
+		name := exportFilePrefix + file.ID + ".json"
+		entry := exportedFile{File: file, PasswordHash: file.PasswordHash, Comments: comments}
+		if manifest.Checksums[name], err = writeJSONEntry(tw, name, entry); err != nil {
+			return err
+		}
+
+		content, err := s.storage.GetContent(ctx, file.ID)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file.ID, err)
+		}
+		name = exportBlobPrefix + file.ID
+		manifest.Checksums[name], err = writeTarEntry(tw, name, file.Size, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := writeJSONEntry(tw, exportManifestEntry, manifest); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish export: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("failed to finish export: %w", err)
+	}
+	return nil
+}
+
+// writeJSONEntry writes a value as a JSON archive entry and returns its digest
+func writeJSONEntry(tw *tar.Writer, name string, value any) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	return writeTarEntry(tw, name, int64(len(data)), strings.NewReader(string(data)))
+}
+
+// writeTarEntry copies size bytes of content into an archive entry and
+// returns its digest. Content of another size fails the entry.
+func writeTarEntry(tw *tar.Writer, name string, size int64, content io.Reader) (string, error) {
+	header := &tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	hash := sha256.New()
+	n, err := io.Copy(tw, io.TeeReader(content, hash))
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if n != size {
+		return "", fmt.Errorf("failed to write %s: content is %d bytes, expected %d", name, n, size)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Import reads an export written by Export, of this or another stash, and
+// creates its files and saved searches. Files whose ID already exists are
+// skipped, so an interrupted import can be retried. When the stream turns
+// out incomplete or corrupt, every file created by the import is removed
+// again.
+func (s *Service) Import(ctx context.Context, r io.Reader) (*ImportResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.Import")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	imported, searches, err := s.importEntries(ctx, r, result)
+	if err != nil {
+		cleanupCtx := context.WithoutCancel(ctx)
+		for _, id := range imported {
+			if err := s.storage.Delete(cleanupCtx, id); err != nil {
+				slog.Error("Failed to remove imported content", "file_id", id, "error", err)
+			}
+			if err := s.repo.Delete(cleanupCtx, id); err != nil {
+				slog.Error("Failed to remove imported file", "file_id", id, "error", err)
+			}
+		}
+		return nil, err
+	}
+
+	// Searches are only saved once the stream proved complete
+	for _, search := range searches {
+		if err := s.repo.SaveSearch(ctx, search); err != nil {
+			return nil, fmt.Errorf("failed to save search %s: %w", search.Name, err)
+		}
+	}
+	return result, nil
+}
+
+// importEntries creates the files of an export as their content arrives and
+// checks the stream against its manifest. It returns the IDs of the files
+// created, also when it fails, and the saved searches to create.
+func (s *Service) importEntries(ctx context.Context, r io.Reader, result *ImportResult) ([]string, []*SavedSearch, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	tr := tar.NewReader(gr)
+
+	var imported []string
+	var searches []*SavedSearch
+	var pending *exportedFile // metadata waiting for its content
+	var manifest *exportManifest
+	checksums := make(map[string]string)
+	for {
+		if err := ctx.Err(); err != nil {
+			return imported, nil, err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+		if manifest != nil {
+			return imported, nil, fmt.Errorf("%w: unexpected entry %s after the manifest", ErrInvalidExport, header.Name)
+		}
+		if pending != nil && header.Name != exportBlobPrefix+pending.File.ID {
+			return imported, nil, fmt.Errorf("%w: missing content of %s", ErrInvalidExport, pending.File.ID)
+		}
+
+		hash := sha256.New()
+		content := io.TeeReader(tr, hash)
+		switch {
+		case header.Name == exportSearchesEntry:
+			if err := json.NewDecoder(content).Decode(&searches); err != nil {
+				return imported, nil, fmt.Errorf("%w: %s: %v", ErrInvalidExport, header.Name, err)
+			}
+		case strings.HasPrefix(header.Name, exportFilePrefix):
+			pending = &exportedFile{}
+			if err := json.NewDecoder(content).Decode(pending); err != nil || pending.File == nil || !validExportID(pending.File.ID) {
+				return imported, nil, fmt.Errorf("%w: %s", ErrInvalidExport, header.Name)
+			}
+		case strings.HasPrefix(header.Name, exportBlobPrefix):
+			if pending == nil {
+				return imported, nil, fmt.Errorf("%w: content without metadata %s", ErrInvalidExport, header.Name)
+			}
+			created, err := s.importFile(ctx, pending, content)
+			if created {
+				imported = append(imported, pending.File.ID)
+			}
+			if err != nil {
+				return imported, nil, err
+			}
+			if created {
+				result.Imported++
+			} else {
+				result.Skipped++
+			}
+			pending = nil
+		case header.Name == exportManifestEntry:
+			manifest = &exportManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return imported, nil, fmt.Errorf("%w: manifest: %v", ErrInvalidExport, err)
+			}
+			continue
+		default:
+			return imported, nil, fmt.Errorf("%w: unknown entry %s", ErrInvalidExport, header.Name)
+		}
+
+		// Skipped content still counts towards the entry's digest
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return imported, nil, fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+		checksums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if manifest == nil {
+		return imported, nil, fmt.Errorf("%w: no manifest, the stream may be truncated", ErrInvalidExport)
+	}
+	if manifest.Version != exportVersion {
+		return imported, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidExport, manifest.Version)
+	}
+	if len(checksums) != len(manifest.Checksums) {
+		return imported, nil, fmt.Errorf("%w: %d entries, the manifest lists %d", ErrInvalidExport, len(checksums), len(manifest.Checksums))
+	}
+	for name, sum := range checksums {
+		if manifest.Checksums[name] != sum {
+			return imported, nil, fmt.Errorf("%w: checksum mismatch for %s", ErrInvalidExport, name)
+		}
+	}
+	return imported, searches, nil
+}
+
+// validExportID reports whether a file ID from an export is safe to store
+// content under, not escaping the storage's directory
+func validExportID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// importFile stores the content and metadata of an exported file, unless a
+// file with its ID exists. It reports whether the file was created.
+func (s *Service) importFile(ctx context.Context, entry *exportedFile, content io.Reader) (bool, error) {
+	file := entry.File
+	if _, err := s.repo.FindByID(ctx, file.ID); err == nil {
+		return false, nil
+	}
+
+	// The content arrives before the manifest, so check it on its own
+	hash := sha256.New()
+	stored, err := s.storage.Save(ctx, file.ID, file.Name, file.MimeType, io.TeeReader(content, hash))
+	if err != nil {
+		return false, fmt.Errorf("failed to save %s: %w", file.ID, err)
+	}
+	file.StoredSize = stored.Size
+	cleanupCtx := context.WithoutCancel(ctx)
+	if sum := hex.EncodeToString(hash.Sum(nil)); file.Checksum != "" && sum != file.Checksum {
+		s.storage.Delete(cleanupCtx, file.ID)
+		return false, fmt.Errorf("%w: checksum mismatch for content of %s", ErrInvalidExport, file.ID)
+	}
+
+	file.PasswordHash = entry.PasswordHash
+	if err := s.repo.Create(ctx, file); err != nil {
+		s.storage.Delete(cleanupCtx, file.ID)
+		return false, fmt.Errorf("failed to save metadata of %s: %w", file.ID, err)
+	}
+	for _, comment := range entry.Comments {
+		comment.FileID = file.ID
+		if err := s.repo.CreateComment(ctx, comment); err != nil {
+			// The file is created, so it's removed with the others
+			return true, fmt.Errorf("failed to save comment of %s: %w", file.ID, err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,42 @@
+package files
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilenameBytes caps stored names at a length every common filesystem accepts
+const maxFilenameBytes = 255
+
+// SanitizeFilename makes a client-supplied name safe to store and send back
+// in headers: directory components are dropped, control characters
+// (including CR and LF) are removed, invalid UTF-8 is replaced, and the
+// result is trimmed to a bounded length. Empty results become "file".
+func SanitizeFilename(name string) string {
+	// Keep only the last path component, whichever separator was used
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	name = strings.Trim(name, ".")
+
+	// Truncate on a rune boundary
+	for len(name) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	if name == "" {
+		return "file"
+	}
+	return name
+}
@@ -1,33 +1,189 @@
 package files
 
 import (
+	"context"
 	"io"
 	"time"
 )
 
 // File represents the metadata of a stored file
 type File struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Tag              string            `json:"tag,omitempty"`
+	Size             int64             `json:"size"`
+	StoredSize       int64             `json:"stored_size,omitempty"` // bytes taken in storage, less than Size when compressed
+	MimeType         string            `json:"mime_type"`
+	DetectedMimeType string            `json:"detected_mime_type,omitempty"`
+	Checksum         string            `json:"sha256,omitempty"`
+	Description      string            `json:"description,omitempty"`
+	Link             string            `json:"link,omitempty"`
+	Pinned           bool              `json:"pinned"`
+	Public           bool              `json:"public,omitempty"` // downloadable without a signed link
+	Status           string            `json:"status"`           // lifecycle state, see status.go
+	CreatedAt        time.Time         `json:"created_at"`
+	ExpiresAt        time.Time         `json:"expires_at"`
+	Attributes       map[string]string `json:"attributes,omitempty"` // custom metadata such as commit=abc123
+	Origin           *Origin           `json:"origin,omitempty"`     // where the upload came from
+	Scan             *ScanResult       `json:"scan,omitempty"`       // virus scan of the content, when enabled
+	Integrity        *IntegrityCheck   `json:"integrity,omitempty"`  // last verification of the stored content
+	PasswordHash     string            `json:"-"`                    // Argon2id hash; downloads must supply the password when set
+}
+
+// IsExpired reports whether the file has passed its expiry time or was
+// marked expired by a purge that didn't finish. Pinned files never expire.
+func (f *File) IsExpired(now time.Time) bool {
+	return f.Status == StatusExpired || (!f.Pinned && now.After(f.ExpiresAt))
+}
+
+// Comment is a markdown note attached to a file
+type Comment struct {
+	ID        string    `json:"id"`
+	FileID    string    `json:"file_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Tombstone records a deleted file, so what it was and who removed it stay
+// known once its metadata is gone
+type Tombstone struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
 	Tag       string    `json:"tag,omitempty"`
-	Size      int64     `json:"size"`
-	MimeType  string    `json:"mime_type"`
-	CreatedAt time.Time `json:"created_at"`
-	ExpiresAt time.Time `json:"expires_at"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by,omitempty"` // empty for files removed by the stash itself
+	Reason    string    `json:"reason,omitempty"`
 }
 
-// FileRepository defines the interface for storing and retrieving file metadata
+// ReasonExpired is the reason recorded for files removed once expired
+const ReasonExpired = "expired"
+
+// ReasonAbandoned is the reason recorded for uploads removed once idle
+const ReasonAbandoned = "abandoned"
+
+// FileRepository defines the interface for storing and retrieving file
+// metadata. Methods return the context's error once ctx is done.
 type FileRepository interface {
-	Create(file *File) error
-	FindByID(id string) (*File, error)
-	FindByTag(tag string) (*File, error)
-	Delete(id string) error
-	List() ([]*File, error)
+	Create(ctx context.Context, file *File) error
+	FindByID(ctx context.Context, id string) (*File, error)
+	FindByTag(ctx context.Context, tag string, asOf time.Time) (*File, error)
+
+	// FindLatestNonExpiredByTag is FindByTag skipping the files expired at now
+	FindLatestNonExpiredByTag(ctx context.Context, tag string, asOf, now time.Time) (*File, error)
+
+	// FindByName returns the files with a tag, or the untagged ones for an
+	// empty tag, and a name
+	FindByName(ctx context.Context, tag, name string) ([]*File, error)
+	SetPinned(ctx context.Context, id string, pinned bool) error
+	Update(ctx context.Context, file *File) error
+
+	// SetStatus moves a file from one status to another, failing when the
+	// file's status isn't from anymore
+	SetStatus(ctx context.Context, id, from, to string) error
+
+	// SetIntegrity records the outcome of verifying a file's content
+	SetIntegrity(ctx context.Context, id string, check *IntegrityCheck) error
+
+	// CompleteUpload stores the content metadata, status and times of a
+	// processing file, failing when the file isn't processing anymore
+	CompleteUpload(ctx context.Context, file *File) error
+
+	// FailStalledUploads marks files still pending or processing that were
+	// registered before the given time as failed and returns their IDs
+	FailStalledUploads(ctx context.Context, registeredBefore time.Time) ([]string, error)
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]*File, error)
+
+	// Search returns the files matching all search terms, as split by
+	// SearchTerms, in their name, tag or attributes, best matches first
+	Search(ctx context.Context, terms []string) ([]*File, error)
+
+	// CleanupExpired removes the metadata of files expired at now, with
+	// everything attached to them, leaving a tombstone with ReasonExpired
+	// for each. It returns the storage IDs of the removed files and of their
+	// thumbnails so their content can be deleted.
+	CleanupExpired(ctx context.Context, now time.Time) (fileIDs, thumbnailIDs []string, err error)
+
+	// Stars are per-user bookmarks on files
+	Star(ctx context.Context, user, id string) error
+	Unstar(ctx context.Context, user, id string) error
+	ListStarred(ctx context.Context, user string) ([]*File, error)
+
+	// Saved searches are named list filters
+	SaveSearch(ctx context.Context, search *SavedSearch) error
+	FindSavedSearch(ctx context.Context, name string) (*SavedSearch, error)
+	ListSavedSearches(ctx context.Context) ([]*SavedSearch, error)
+	DeleteSavedSearch(ctx context.Context, name string) error
+
+	// Comments are notes attached to files
+	CreateComment(ctx context.Context, comment *Comment) error
+	ListComments(ctx context.Context, fileID string) ([]*Comment, error)
+	DeleteComment(ctx context.Context, fileID, id string) error
+
+	// Thumbnails are cached resized images of files
+	CreateThumbnail(ctx context.Context, thumb *Thumbnail) error
+	FindThumbnail(ctx context.Context, fileID string, width, height int) (*Thumbnail, error)
+	ListThumbnails(ctx context.Context, fileID string) ([]*Thumbnail, error)
+
+	// Usage samples are daily snapshots used for forecasting
+	RecordUsage(ctx context.Context, sample *UsageSample) error
+	ListUsage(ctx context.Context, since time.Time) ([]*UsageSample, error)
+
+	// Downloads count the completed downloads of each file.
+	// FindDownloads returns zero stats for files never downloaded, while
+	// ListDownloads only has entries for files downloaded at least once.
+	RecordDownload(ctx context.Context, id string, bytes int64, at time.Time) error
+	FindDownloads(ctx context.Context, id string) (*DownloadStats, error)
+	ListDownloads(ctx context.Context) (map[string]DownloadStats, error)
+
+	// Accesses log the download requests of each file, answered or not,
+	// until the file is deleted. ListAccesses returns a page of those of a
+	// file, latest first, with the number of them on all pages.
+	RecordAccess(ctx context.Context, access *Access) error
+	ListAccesses(ctx context.Context, fileID string, limit, offset int) ([]*Access, int, error)
+
+	// Tombstones record deleted files; DeleteTombstones removes those of
+	// files deleted before the given time and returns how many it removed
+	CreateTombstone(ctx context.Context, tombstone *Tombstone) error
+	FindTombstone(ctx context.Context, id string) (*Tombstone, error)
+	ListTombstones(ctx context.Context) ([]*Tombstone, error)
+	DeleteTombstones(ctx context.Context, before time.Time) (int, error)
+
+	// Upload parts are the pieces of multipart uploads until they complete.
+	// SaveUploadPart replaces a part uploaded again. ListUploadParts lists
+	// the parts of a file by number, or every part when fileID is empty.
+	SaveUploadPart(ctx context.Context, part *UploadPart) error
+	ListUploadParts(ctx context.Context, fileID string) ([]*UploadPart, error)
+	DeleteUploadParts(ctx context.Context, fileID string) error
+
+	// Links are issued signed download links that can be revoked.
+	// ListLinks lists every link when fileID is empty. UseLink marks a
+	// one-time link used, failing with ErrLinkUsed when it was used
+	// already; ReleaseLink undoes the use made at the given time.
+	CreateLink(ctx context.Context, link *Link) error
+	FindLink(ctx context.Context, id string) (*Link, error)
+	ListLinks(ctx context.Context, fileID string) ([]*Link, error)
+	UseLink(ctx context.Context, id string, at time.Time) error
+	ReleaseLink(ctx context.Context, id string, at time.Time) error
+	DeleteLink(ctx context.Context, id string) error
+
+	// Short links map short codes to signed download links
+	CreateShortLink(ctx context.Context, link *ShortLink) error
+	FindShortLink(ctx context.Context, code string) (*ShortLink, error)
+
+	// Download codes are short codes for files. CreateDownloadCode fails
+	// with ErrCodeTaken when another file has the code already.
+	CreateDownloadCode(ctx context.Context, code *DownloadCode) error
+	FindDownloadCode(ctx context.Context, code string) (*DownloadCode, error)
+	FindFileDownloadCode(ctx context.Context, fileID string) (*DownloadCode, error)
 }
 
-// FileStorage defines the interface for the physical file storage
+// FileStorage defines the interface for the physical file storage. Methods
+// return the context's error once ctx is done, including part way through Save.
 type FileStorage interface {
-	Save(id, name, mimeType string, content io.Reader) (*File, error)
-	GetContent(id string) (io.ReadCloser, error)
-	Delete(id string) error
+	Save(ctx context.Context, id, name, mimeType string, content io.Reader) (*File, error)
+	GetContent(ctx context.Context, id string) (io.ReadCloser, error)
+	Exists(ctx context.Context, id string) (bool, error)
+	Delete(ctx context.Context, id string) error
 }
@@ -0,0 +1,137 @@
+package files
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListFilter narrows down a file listing. The zero value matches every file.
+type ListFilter struct {
+	Tag       string
+	MimeType  string // exact type, or a prefix when it ends with "/" (e.g. "video/")
+	MinSize   int64
+	MaxSize   int64
+	OlderThan time.Duration
+	NewerThan time.Duration
+	Starred   bool
+	Status    string // one of the lifecycle states in status.go
+
+	// ExpiringWithin matches unpinned files expiring within the duration
+	ExpiringWithin time.Duration
+
+	// Integrity matches files whose last verification had the verdict,
+	// e.g. "mismatch"
+	Integrity string
+
+	// Attributes must all be set on a file to the given values
+	Attributes map[string]string
+}
+
+// ParseListFilter builds a filter from query parameters. Unknown parameters
+// are rejected so that saved searches can't silently match everything.
+func ParseListFilter(values url.Values) (ListFilter, error) {
+	var filter ListFilter
+	for key := range values {
+		value := values.Get(key)
+		var err error
+		switch key {
+		case "tag":
+			filter.Tag = value
+		case "mime_type":
+			filter.MimeType = value
+		case "min_size":
+			filter.MinSize, err = strconv.ParseInt(value, 10, 64)
+		case "max_size":
+			filter.MaxSize, err = strconv.ParseInt(value, 10, 64)
+		case "older_than":
+			filter.OlderThan, err = time.ParseDuration(value)
+		case "newer_than":
+			filter.NewerThan, err = time.ParseDuration(value)
+		case "starred":
+			filter.Starred, err = strconv.ParseBool(value)
+		case "status":
+			filter.Status = value
+		case "expiring_within":
+			filter.ExpiringWithin, err = time.ParseDuration(value)
+		case "integrity":
+			filter.Integrity = value
+		default:
+			name, ok := strings.CutPrefix(key, AttributePrefix)
+			if !ok || name == "" {
+				return ListFilter{}, fmt.Errorf("unknown filter %q", key)
+			}
+			if filter.Attributes == nil {
+				filter.Attributes = make(map[string]string)
+			}
+			filter.Attributes[name] = value
+		}
+		if err != nil {
+			return ListFilter{}, fmt.Errorf("invalid %s filter: %w", key, err)
+		}
+	}
+	return filter, nil
+}
+
+// Match reports whether a file satisfies the filter at the given time.
+// Starred is not checked here since it depends on the caller.
+func (f ListFilter) Match(file *File, now time.Time) bool {
+	if f.Tag != "" && file.Tag != f.Tag {
+		return false
+	}
+	if f.Status != "" && file.Status != f.Status {
+		return false
+	}
+	if f.Integrity != "" && (file.Integrity == nil || file.Integrity.Status != f.Integrity) {
+		return false
+	}
+	if f.MimeType != "" {
+		if strings.HasSuffix(f.MimeType, "/") {
+			if !strings.HasPrefix(file.MimeType, f.MimeType) {
+				return false
+			}
+		} else if file.MimeType != f.MimeType {
+			return false
+		}
+	}
+	if f.MinSize > 0 && file.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && file.Size > f.MaxSize {
+		return false
+	}
+	for key, value := range f.Attributes {
+		if got, ok := file.Attributes[key]; !ok || got != value {
+			return false
+		}
+	}
+	age := now.Sub(file.CreatedAt)
+	if f.OlderThan > 0 && age < f.OlderThan {
+		return false
+	}
+	if f.NewerThan > 0 && age > f.NewerThan {
+		return false
+	}
+	if f.ExpiringWithin > 0 && (file.Pinned || file.ExpiresAt.After(now.Add(f.ExpiringWithin))) {
+		return false
+	}
+	return true
+}
+
+// SavedSearch is a named list filter, stored in its query string form
+type SavedSearch struct {
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Filter parses the saved query into a ListFilter
+func (s *SavedSearch) Filter() (ListFilter, error) {
+	values, err := url.ParseQuery(s.Query)
+	if err != nil {
+		return ListFilter{}, fmt.Errorf("invalid query: %w", err)
+	}
+	return ParseListFilter(values)
+}
@@ -0,0 +1,96 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Names of the readiness checks
+const (
+	CheckDatabase  = "database"
+	CheckStorage   = "storage"
+	CheckDiskSpace = "disk_space"
+	CheckScanner   = "scanner"
+)
+
+// pinger is implemented by repositories backed by a database connection
+// and scanners backed by a daemon that can be verified
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// writeProber is implemented by storages that can verify they accept writes
+type writeProber interface {
+	ProbeWrite(ctx context.Context) error
+}
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Name     string  `json:"name"`
+	OK       bool    `json:"ok"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+
+	// FreeBytes is reported by the disk space check
+	FreeBytes *int64 `json:"free_bytes,omitempty"`
+}
+
+// Health reports whether the stash is ready to serve, with the checks that
+// decided it. Checks the backend doesn't support are left out.
+type Health struct {
+	Ready  bool           `json:"ready"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+// CheckHealth verifies the database connection, that the storage accepts
+// writes, that free space is above the upload watermark and, since uploads
+// fail without it, that the virus scanner is up
+func (s *Service) CheckHealth(ctx context.Context) *Health {
+	ctx, span := tracer.Start(ctx, "Service.CheckHealth")
+	defer span.End()
+
+	health := &Health{Ready: true, Checks: []*HealthCheck{}}
+	run := func(name string, check func(*HealthCheck) error) {
+		result := &HealthCheck{Name: name}
+		start := time.Now()
+		err := check(result)
+		result.Duration = float64(time.Since(start).Microseconds()) / 1000
+		result.OK = err == nil
+		if err != nil {
+			result.Error = err.Error()
+			health.Ready = false
+		}
+		health.Checks = append(health.Checks, result)
+	}
+
+	if p, ok := s.repo.(pinger); ok {
+		run(CheckDatabase, func(*HealthCheck) error {
+			return p.Ping(ctx)
+		})
+	}
+	if prober, ok := s.storage.(writeProber); ok {
+		run(CheckStorage, func(*HealthCheck) error {
+			return prober.ProbeWrite(ctx)
+		})
+	}
+	if reporter, ok := s.storage.(freeSpaceReporter); ok {
+		run(CheckDiskSpace, func(result *HealthCheck) error {
+			free, err := reporter.FreeSpace()
+			if err != nil {
+				return err
+			}
+			result.FreeBytes = &free
+			if free < s.watermark {
+				return fmt.Errorf("%d bytes free, below the %d bytes watermark", free, s.watermark)
+			}
+			return nil
+		})
+	}
+	if p, ok := s.scanner.(pinger); ok {
+		run(CheckScanner, func(*HealthCheck) error {
+			return p.Ping(ctx)
+		})
+	}
+	return health
+}
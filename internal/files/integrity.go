@@ -0,0 +1,204 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/metrics"
+)
+
+// Integrity verdicts
+const (
+	IntegrityOK       = "ok"
+	IntegrityMismatch = "mismatch" // the stored content doesn't hash to the checksum
+	IntegrityMissing  = "missing"  // the storage has no content for the file
+)
+
+var (
+	// ErrNoChecksum is returned when verifying a file without a recorded
+	// checksum, such as one whose content hasn't arrived yet
+	ErrNoChecksum = errors.New("file has no checksum to verify against")
+
+	// ErrVerifyFailed is returned when a file's content couldn't be read
+	// to verify it
+	ErrVerifyFailed = errors.New("integrity verification failed")
+)
+
+// IntegrityCheck records the last verification of a file's stored content
+// against the checksum taken on upload
+type IntegrityCheck struct {
+	Status     string    `json:"status"`           // IntegrityOK, IntegrityMismatch or IntegrityMissing
+	Checksum   string    `json:"sha256,omitempty"` // of the stored content, when it doesn't match
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// IsCorrupt reports whether the last verification found the file's content
+// damaged or gone
+func (f *File) IsCorrupt() bool {
+	return f.Integrity != nil && f.Integrity.Status != IntegrityOK
+}
+
+// WithIntegrityMetrics records verifications in the integrity metrics
+func WithIntegrityMetrics(integrity *metrics.Integrity) Option {
+	return func(s *Service) {
+		s.integrity = integrity
+	}
+}
+
+// Verify re-hashes the stored content of a file, records the outcome in its
+// metadata and returns the file with it
+func (s *Service) Verify(ctx context.Context, id string) (*File, error) {
+	ctx, span := tracer.Start(ctx, "Service.Verify")
+	defer span.End()
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if err := s.verify(ctx, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// verify checks the stored content of file against its checksum and
+// records the outcome. Errors reading the storage aren't taken as damage,
+// so an unreachable storage doesn't flag every file.
+func (s *Service) verify(ctx context.Context, file *File) error {
+	if file.Checksum == "" {
+		return ErrNoChecksum
+	}
+
+	check := &IntegrityCheck{Status: IntegrityOK}
+	exists, err := s.storage.Exists(ctx, file.ID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+	}
+	if exists {
+		sum, err := s.hashContent(ctx, file.ID)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+		}
+		if sum != file.Checksum {
+			check.Status = IntegrityMismatch
+			check.Checksum = sum
+		}
+	} else {
+		check.Status = IntegrityMissing
+	}
+	check.VerifiedAt = time.Now()
+
+	if err := s.repo.SetIntegrity(ctx, file.ID, check); err != nil {
+		return fmt.Errorf("failed to record integrity check: %w", err)
+	}
+	file.Integrity = check
+	s.integrity.Verified(check.Status)
+	if check.Status != IntegrityOK {
+		slog.Error("File failed integrity verification", "file_id", file.ID, "name", file.Name, "status", check.Status, "expected", file.Checksum, "actual", check.Checksum)
+	}
+	return nil
+}
+
+// hashContent returns the hex SHA-256 of the content stored under id
+func (s *Service) hashContent(ctx context.Context, id string) (string, error) {
+	content, err := s.storage.GetContent(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("failed to read content: %w", err)
+	}
+	defer content.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", fmt.Errorf("failed to read content: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Scrubber periodically verifies the stored content of a batch of files,
+// those verified longest ago first, so that every file is verified once
+// in a while without reading the whole storage at once
+type Scrubber struct {
+	service  *Service
+	interval time.Duration
+	batch    int
+}
+
+// NewScrubber creates a scrubber verifying up to batch files every interval
+func NewScrubber(service *Service, interval time.Duration, batch int) *Scrubber {
+	return &Scrubber{service: service, interval: interval, batch: batch}
+}
+
+// Run verifies batches until the context is cancelled
+func (sc *Scrubber) Run(ctx context.Context) {
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sc.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce verifies the next batch of files and returns how many of them
+// failed verification
+func (sc *Scrubber) RunOnce(ctx context.Context) int {
+	ctx, span := tracer.Start(ctx, "Scrubber.RunOnce")
+	defer span.End()
+
+	fileList, err := sc.service.repo.List(ctx)
+	if err != nil {
+		slog.Error("Integrity scrub failed", "error", err)
+		return 0
+	}
+
+	// Files are only hashed once their content has arrived; expired ones
+	// are about to be removed anyway
+	now := time.Now()
+	fileList = slices.DeleteFunc(fileList, func(file *File) bool {
+		return file.Checksum == "" || file.IsExpired(now)
+	})
+	slices.SortStableFunc(fileList, func(a, b *File) int {
+		return verifiedAt(a).Compare(verifiedAt(b))
+	})
+
+	verified, failed := 0, 0
+	for _, file := range fileList[:min(sc.batch, len(fileList))] {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := sc.service.verify(ctx, file); err != nil {
+			slog.Error("Integrity verification failed", "file_id", file.ID, "error", err)
+			continue
+		}
+		verified++
+	}
+
+	// Files not verified in this pass keep their last verdict
+	for _, file := range fileList {
+		if file.IsCorrupt() {
+			failed++
+		}
+	}
+	sc.service.integrity.SetCorrupt(failed)
+	slog.Info("Integrity scrub finished", "verified", verified, "corrupt", failed)
+	return failed
+}
+
+// verifiedAt is when a file was last verified, the zero time when never
+func verifiedAt(file *File) time.Time {
+	if file.Integrity == nil {
+		return time.Time{}
+	}
+	return file.Integrity.VerifiedAt
+}
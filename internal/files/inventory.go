@@ -0,0 +1,187 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Inventory snapshot formats
+const (
+	InventoryCSV         = "csv"
+	InventoryOpenMetrics = "openmetrics"
+)
+
+// InventoryOptions control how inventory snapshots are stored
+type InventoryOptions struct {
+	Format string        // InventoryCSV or InventoryOpenMetrics
+	Tag    string        // snapshots are uploaded with this tag, and files with it left out of them
+	TTL    time.Duration // how long snapshots are kept; the default TTL when zero
+}
+
+// SnapshotInventory uploads a listing of every stored file back into the
+// stash, so the latest snapshot is at the tag's latest file and older ones
+// give the inventory's history
+func (s *Service) SnapshotInventory(ctx context.Context, opts InventoryOptions) (*UploadResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.SnapshotInventory")
+	defer span.End()
+
+	fileList, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	var listed []*File
+	now := time.Now()
+	for _, file := range fileList {
+		if file.Tag != opts.Tag && !file.IsExpired(now) {
+			listed = append(listed, file)
+		}
+	}
+
+	var content []byte
+	var name, mimeType string
+	stamp := now.UTC().Format("20060102T150405Z")
+	switch opts.Format {
+	case "", InventoryCSV:
+		content, err = inventoryCSV(listed)
+		name, mimeType = "inventory-"+stamp+".csv", "text/csv"
+	case InventoryOpenMetrics:
+		content = inventoryOpenMetrics(listed, now)
+		name, mimeType = "inventory-"+stamp+".txt", "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	default:
+		return nil, fmt.Errorf("unknown inventory format %q", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Upload(ctx, &UploadRequest{
+		Name:     name,
+		MimeType: mimeType,
+		Tag:      opts.Tag,
+		TTL:      opts.TTL,
+		Content:  bytes.NewReader(content),
+	})
+}
+
+// inventoryCSV lists files as CSV with a header row
+func inventoryCSV(fileList []*File) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "name", "tag", "size", "mime_type", "sha256", "status", "pinned", "created_at", "expires_at"})
+	for _, file := range fileList {
+		w.Write([]string{
+			file.ID,
+			file.Name,
+			file.Tag,
+			strconv.FormatInt(file.Size, 10),
+			file.MimeType,
+			file.Checksum,
+			statusOrActive(file.Status),
+			strconv.FormatBool(file.Pinned),
+			file.CreatedAt.UTC().Format(time.RFC3339),
+			file.ExpiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("failed to write inventory: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// inventoryOpenMetrics lists files as OpenMetrics gauges labelled with their
+// metadata, timestamped with the time of the snapshot
+func inventoryOpenMetrics(fileList []*File, now time.Time) []byte {
+	gauges := []struct {
+		name, help string
+		value      func(*File) string
+	}{
+		{"files_stash_file_size_bytes", "Size of a stored file.", func(f *File) string {
+			return strconv.FormatInt(f.Size, 10)
+		}},
+		{"files_stash_file_created_timestamp_seconds", "When a stored file was uploaded.", func(f *File) string {
+			return strconv.FormatInt(f.CreatedAt.Unix(), 10)
+		}},
+		{"files_stash_file_expires_timestamp_seconds", "When a stored file expires unless pinned.", func(f *File) string {
+			return strconv.FormatInt(f.ExpiresAt.Unix(), 10)
+		}},
+	}
+
+	var buf bytes.Buffer
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	for _, gauge := range gauges {
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n# HELP %s %s\n", gauge.name, gauge.name, gauge.help)
+		for _, file := range fileList {
+			fmt.Fprintf(&buf, "%s{id=%s,name=%s,tag=%s,mime_type=%s,status=%s,pinned=\"%t\"} %s %s\n",
+				gauge.name,
+				metricLabel(file.ID),
+				metricLabel(file.Name),
+				metricLabel(file.Tag),
+				metricLabel(file.MimeType),
+				metricLabel(statusOrActive(file.Status)),
+				file.Pinned,
+				gauge.value(file),
+				timestamp,
+			)
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Bytes()
+}
+
+// metricLabel quotes an OpenMetrics label value
+func metricLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// InventorySnapshotter periodically stores inventory snapshots
+type InventorySnapshotter struct {
+	service  *Service
+	interval time.Duration
+	opts     InventoryOptions
+}
+
+// NewInventorySnapshotter creates a snapshotter storing a snapshot every interval
+func NewInventorySnapshotter(service *Service, interval time.Duration, opts InventoryOptions) *InventorySnapshotter {
+	return &InventorySnapshotter{
+		service:  service,
+		interval: interval,
+		opts:     opts,
+	}
+}
+
+// Run stores snapshots until the context is cancelled
+func (i *InventorySnapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(i.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			i.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce stores a single snapshot. Nothing is stored while the stash is
+// read-only.
+func (i *InventorySnapshotter) RunOnce(ctx context.Context) {
+	if i.service.Mode().ReadOnly {
+		return
+	}
+	result, err := i.service.SnapshotInventory(ctx, i.opts)
+	if err != nil {
+		slog.Error("Inventory snapshot failed", "error", err)
+		return
+	}
+	slog.Info("Inventory snapshot stored", "file_id", result.ID, "size", result.Size)
+}
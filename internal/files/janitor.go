@@ -0,0 +1,75 @@
+package files
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// cleanupTask is a unit of janitor work returning the number of removed items
+type cleanupTask struct {
+	name string
+	run  func(ctx context.Context) (int, error)
+}
+
+// Janitor periodically removes stale data such as expired files
+type Janitor struct {
+	interval time.Duration
+	tasks    []cleanupTask
+}
+
+// NewJanitor creates a janitor that purges expired files, files outside
+// their retention policy, idle uploads, old tombstones and the parts of
+// abandoned multipart uploads, fails stalled uploads and records the day's
+// storage usage for the forecast every interval
+func NewJanitor(service *Service, interval time.Duration) *Janitor {
+	j := &Janitor{interval: interval}
+	j.AddTask("expired files", service.PurgeExpired)
+	j.AddTask("retention", service.ApplyRetention)
+	j.AddTask("idle uploads", service.PurgeIdleUploads)
+	j.AddTask("stalled uploads", service.FailStalledUploads)
+	j.AddTask("tombstones", service.PurgeTombstones)
+	j.AddTask("upload parts", service.PurgeUploadParts)
+	j.AddTask("usage", func(ctx context.Context) (int, error) {
+		return 0, service.RecordUsage(ctx)
+	})
+	return j
+}
+
+// AddTask registers an additional cleanup task run on every pass
+func (j *Janitor) AddTask(name string, run func(ctx context.Context) (int, error)) {
+	j.tasks = append(j.tasks, cleanupTask{name: name, run: run})
+}
+
+// Run performs cleanup passes until the context is cancelled
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce performs a single cleanup pass over all tasks, stopping early
+// when the context is cancelled
+func (j *Janitor) RunOnce(ctx context.Context) {
+	for _, task := range j.tasks {
+		if ctx.Err() != nil {
+			return
+		}
+		removed, err := task.run(ctx)
+		if err != nil {
+			slog.Error("Cleanup task failed", "task", task.name, "error", err)
+			continue
+		}
+		if removed > 0 {
+			slog.Info("Cleanup task removed items", "task", task.name, "removed", removed)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package files
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LinkOptions restrict or alter what a signed download link grants. Every
+// option but the password is covered by the link signature.
+type LinkOptions struct {
+	Range     *ByteRange     // authorizes only this byte range of the file
+	Inline    bool           // asks for inline display instead of an attachment
+	Thumbnail *ThumbnailSize // links to a thumbnail of this size instead of the file
+
+	// Bindings tie a link to the context it's used in. When verifying, they
+	// are taken from the request rather than the link, so a leaked link
+	// fails anywhere else.
+	Method   string // HTTP method the link is valid for; GET when empty
+	ClientIP string // only requests from this client IP may use the link
+	Audience string // only requests presenting this audience may use the link
+
+	// LinkID identifies links issued by CreateLink, which stop working once
+	// revoked
+	LinkID string
+
+	// OneTime makes CreateLink issue a link that works for a single
+	// download. It's stored with the link rather than signed.
+	OneTime bool
+
+	// Password is supplied by the downloader of a password protected file.
+	// It is checked against the file's hash and never signed.
+	Password string
+}
+
+// payload returns the signed representation of the options for a file,
+// covering the request method and any bindings
+func (o LinkOptions) payload(id string) string {
+	method := o.Method
+	if method == "" || method == "HEAD" {
+		method = "GET" // HEAD only reads what GET would
+	}
+
+	payload := "v2|" + method + "|" + o.legacyPayload(id)
+	if o.ClientIP != "" {
+		payload += "|ip=" + o.ClientIP
+	}
+	if o.Audience != "" {
+		payload += "|aud=" + o.Audience
+	}
+	if o.LinkID != "" {
+		payload += "|link=" + o.LinkID
+	}
+	return payload
+}
+
+// legacyPayload returns the representation signed before links were bound
+// to the request method. A link without options signs the bare file ID.
+func (o LinkOptions) legacyPayload(id string) string {
+	payload := id
+	if o.Range != nil {
+		payload += "|bytes=" + o.Range.String()
+	}
+	if o.Inline {
+		payload += "|disposition=inline"
+	}
+	if o.Thumbnail != nil {
+		payload += "|thumbnail=" + o.Thumbnail.String()
+	}
+	return payload
+}
+
+// query returns the URL query parameters carrying the options. The client
+// IP and audience are left out: an IP bound link only says it is bound, and
+// the audience must come from the caller.
+func (o LinkOptions) query() url.Values {
+	values := url.Values{}
+	if o.Range != nil {
+		values.Set("range", o.Range.String())
+	}
+	if o.Inline {
+		values.Set("disposition", "inline")
+	}
+	if o.Thumbnail != nil {
+		values.Set("w", strconv.Itoa(o.Thumbnail.Width))
+		values.Set("h", strconv.Itoa(o.Thumbnail.Height))
+	}
+	if o.ClientIP != "" {
+		values.Set("bind", "ip")
+	}
+	if o.LinkID != "" {
+		values.Set("link", o.LinkID)
+	}
+	return values
+}
+
+// ShortLink maps a short code to a signed download link, so links handed to
+// customers can be served from a separate short domain
+type ShortLink struct {
+	Code      string    `json:"code"`
+	FileID    string    `json:"file_id"`
+	Target    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// shortCodeLength is the number of base32 characters in a short code,
+// giving 50 bits of randomness
+const shortCodeLength = 10
+
+// CreateLink issues a signed download link for a file with the given
+// options on behalf of user. The link gets an ID it can be revoked by.
+func (s *Service) CreateLink(ctx context.Context, user, id string, opts LinkOptions) (*Link, error) {
+	ctx, span := tracer.Start(ctx, "Service.CreateLink")
+	defer span.End()
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	if file.IsExpired(time.Now()) {
+		return nil, ErrExpired
+	}
+
+	if opts.Range != nil && opts.Range.Start >= file.Size {
+		return nil, ErrRangeNotSatisfiable
+	}
+
+	if opts.Thumbnail != nil {
+		if err := opts.Thumbnail.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	opts.LinkID = newLinkID()
+	link := &Link{
+		ID:        opts.LinkID,
+		FileID:    id,
+		CreatedBy: user,
+		CreatedAt: time.Now(),
+		OneTime:   opts.OneTime,
+	}
+	query := opts.query()
+	query.Del("link")
+	link.Options = query.Encode()
+
+	if link.URL, err = s.generateSignedURL(id, opts); err != nil {
+		return nil, err
+	}
+	if err := s.repo.CreateLink(ctx, link); err != nil {
+		return nil, fmt.Errorf("failed to save link: %w", err)
+	}
+
+	return link, nil
+}
+
+// ShortenLink stores a link just issued by CreateLink under a new short
+// code. Revoking the link also breaks the short link.
+func (s *Service) ShortenLink(ctx context.Context, issued *Link) (*ShortLink, error) {
+	ctx, span := tracer.Start(ctx, "Service.ShortenLink")
+	defer span.End()
+
+	link := &ShortLink{
+		Code:      newShortCode(),
+		FileID:    issued.FileID,
+		Target:    issued.URL,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateShortLink(ctx, link); err != nil {
+		return nil, fmt.Errorf("failed to save short link: %w", err)
+	}
+
+	return link, nil
+}
+
+// ResolveShortLink returns the short link stored under code
+func (s *Service) ResolveShortLink(ctx context.Context, code string) (*ShortLink, error) {
+	ctx, span := tracer.Start(ctx, "Service.ResolveShortLink")
+	defer span.End()
+
+	return s.repo.FindShortLink(ctx, code)
+}
+
+// newShortCode returns a random lowercase short link code
+func newShortCode() string {
+	return strings.ToLower(rand.Text()[:shortCodeLength])
+}
+
+// DownloadRange retrieves part of a file using a signature that authorizes
+// only opts.Range. The requested range must lie within the authorized one;
+// its end is clamped to the file size.
+func (s *Service) DownloadRange(ctx context.Context, id string, signature string, opts LinkOptions, requested ByteRange) (*File, io.ReadCloser, ByteRange, error) {
+	ctx, span := tracer.Start(ctx, "Service.DownloadRange")
+	defer span.End()
+
+	if opts.Range == nil {
+		return nil, nil, ByteRange{}, ErrRangeNotSatisfiable
+	}
+
+	link, err := s.verifyLink(ctx, id, opts, signature)
+	if err != nil {
+		return nil, nil, ByteRange{}, err
+	}
+
+	if !opts.Range.Contains(requested) {
+		return nil, nil, ByteRange{}, ErrRangeNotSatisfiable
+	}
+
+	file, content, err := s.download(ctx, id)
+	if err != nil {
+		return nil, nil, ByteRange{}, err
+	}
+	if err := checkPassword(file, opts.Password); err != nil {
+		content.Close()
+		return nil, nil, ByteRange{}, err
+	}
+	if content, err = s.slowStart.admit(file, content, time.Now()); err != nil {
+		return nil, nil, ByteRange{}, err
+	}
+
+	if requested.Start >= file.Size {
+		content.Close()
+		return nil, nil, ByteRange{}, ErrRangeNotSatisfiable
+	}
+	requested.End = min(requested.End, file.Size-1)
+
+	// Skip to the start of the range
+	if seeker, ok := content.(io.Seeker); ok {
+		_, err = seeker.Seek(requested.Start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, content, requested.Start)
+	}
+	if err != nil {
+		content.Close()
+		return nil, nil, ByteRange{}, fmt.Errorf("failed to seek file content: %w", err)
+	}
+
+	use, err := s.useLink(ctx, link, opts)
+	if err != nil {
+		content.Close()
+		return nil, nil, ByteRange{}, err
+	}
+
+	limited := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(content, requested.Length()), content}
+
+	s.metrics.Downloaded(file.Tag, requested.Length())
+	return file, use.wrap(s.track(ctx, file, s.throttle.Load().limit(ctx, limited))), requested, nil
+}
+
+// generateSignedURL creates a signed URL for file access
+func (s *Service) generateSignedURL(id string, opts LinkOptions) (string, error) {
+	path := "/v1/files/" + id
+	if opts.Thumbnail != nil {
+		path += "/thumbnail"
+	}
+
+	query := opts.query()
+	query.Set("signature", s.createSignature(opts.payload(id)))
+	return fmt.Sprintf("%s?%s", path, query.Encode()), nil
+}
+
+// createSignature generates HMAC signature for the given payload
+func (s *Service) createSignature(payload string) string {
+	h := hmac.New(sha256.New, []byte(s.hmacKey))
+	h.Write([]byte(payload))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifySignature validates HMAC signature for a file and link options.
+// Links signed before the method binding are accepted only when the service
+// allows legacy signatures and the request carries no bindings.
+func (s *Service) verifySignature(id string, opts LinkOptions, signature string) bool {
+	expectedSignature := s.createSignature(opts.payload(id))
+	if hmac.Equal([]byte(signature), []byte(expectedSignature)) {
+		return true
+	}
+
+	unbound := opts.ClientIP == "" && opts.Audience == "" && opts.LinkID == ""
+	safe := opts.Method == "" || opts.Method == "GET" || opts.Method == "HEAD"
+	if !s.legacySignatures || !unbound || !safe {
+		return false
+	}
+	legacySignature := s.createSignature(opts.legacyPayload(id))
+	return hmac.Equal([]byte(signature), []byte(legacySignature))
+}
@@ -0,0 +1,137 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// layoutMigrator is implemented by storages that can move content stored
+// under an older layout to their current one
+type layoutMigrator interface {
+	MigrateLayout(ctx context.Context, id string) (bool, error)
+}
+
+// repairer is implemented by storages keeping several copies of content,
+// which can restore copies that went missing
+type repairer interface {
+	Repair(ctx context.Context, id string) (bool, error)
+}
+
+// MigrateStorage moves the content of every file and thumbnail to the
+// storage's current layout and returns how many were moved. Content that
+// wasn't moved yet stays readable, so this can run while serving.
+func (s *Service) MigrateStorage(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.MigrateStorage")
+	defer span.End()
+
+	migrator, ok := s.storage.(layoutMigrator)
+	if !ok {
+		return 0, nil
+	}
+	// Operators switch to read-only to copy the storage away
+	if err := s.CheckWritable(); err != nil {
+		return 0, err
+	}
+
+	migrated, err := s.forEachStorageID(ctx, func(id string) (bool, error) {
+		moved, err := migrator.MigrateLayout(ctx, id)
+		if err != nil {
+			return false, fmt.Errorf("failed to migrate %s: %w", id, err)
+		}
+		return moved, nil
+	})
+	if migrated > 0 {
+		slog.Info("Migrated storage layout", "migrated", migrated)
+	}
+	return migrated, err
+}
+
+// RepairStorage restores the copies of every file and thumbnail that are
+// missing from a mirrored storage and returns how many were restored
+func (s *Service) RepairStorage(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.RepairStorage")
+	defer span.End()
+
+	repairer, ok := s.storage.(repairer)
+	if !ok {
+		return 0, nil
+	}
+	if err := s.CheckWritable(); err != nil {
+		return 0, err
+	}
+
+	repaired, err := s.forEachStorageID(ctx, func(id string) (bool, error) {
+		copied, err := repairer.Repair(ctx, id)
+		if err != nil {
+			return false, fmt.Errorf("failed to repair %s: %w", id, err)
+		}
+		return copied, nil
+	})
+	if repaired > 0 {
+		slog.Info("Repaired storage", "repaired", repaired)
+	}
+	return repaired, err
+}
+
+// StorageIDs returns the IDs of all content the repository refers to: of
+// files, their thumbnails and the parts of multipart uploads. Content
+// stored under any other ID is unreachable.
+func (s *Service) StorageIDs(ctx context.Context) (map[string]bool, error) {
+	ctx, span := tracer.Start(ctx, "Service.StorageIDs")
+	defer span.End()
+
+	ids := make(map[string]bool)
+	if _, err := s.forEachStorageID(ctx, func(id string) (bool, error) {
+		ids[id] = true
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	parts, err := s.repo.ListUploadParts(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upload parts: %w", err)
+	}
+	for _, part := range parts {
+		ids[partStorageID(part.FileID, part.Number)] = true
+	}
+	return ids, nil
+}
+
+// forEachStorageID calls fn with the storage ID of every file and thumbnail
+// and returns how many calls reported true. Only content known to the
+// repository is visited, anything else in the storage (like the database
+// in a data directory) is left alone.
+func (s *Service) forEachStorageID(ctx context.Context, fn func(id string) (bool, error)) (int, error) {
+	files, err := s.repo.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	count := 0
+	visit := func(id string) error {
+		ok, err := fn(id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			count++
+		}
+		return nil
+	}
+	for _, file := range files {
+		if err := visit(file.ID); err != nil {
+			return count, err
+		}
+		thumbs, err := s.repo.ListThumbnails(ctx, file.ID)
+		if err != nil {
+			return count, fmt.Errorf("failed to list thumbnails: %w", err)
+		}
+		for _, thumb := range thumbs {
+			if err := visit(thumb.StorageID); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,99 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrMimeTypeMismatch is returned when the claimed type contradicts the content
+	ErrMimeTypeMismatch = errors.New("claimed content type does not match file content")
+
+	// ErrMimeTypeNotAllowed is returned when a type is denied or not on the allowlist
+	ErrMimeTypeNotAllowed = errors.New("content type not allowed")
+)
+
+// MimePolicy controls which content types are accepted on upload. Entries
+// are exact types or wildcards such as "image/*".
+type MimePolicy struct {
+	RejectMismatch bool     // reject uploads whose claimed type contradicts the sniffed one
+	Allowed        []string // when set, only these claimed types are accepted
+	Denied         []string // types rejected whether claimed or sniffed
+}
+
+// check validates the claimed and detected types of an upload
+func (p MimePolicy) check(claimed, detected string) error {
+	if p.RejectMismatch && !mimeCompatible(claimed, detected) {
+		return ErrMimeTypeMismatch
+	}
+	if mimeMatchesAny(claimed, p.Denied) || mimeMatchesAny(detected, p.Denied) {
+		return ErrMimeTypeNotAllowed
+	}
+	if len(p.Allowed) > 0 && !mimeMatchesAny(claimed, p.Allowed) {
+		return ErrMimeTypeNotAllowed
+	}
+	return nil
+}
+
+// sniffLen is how many of the first bytes of content detectMimeType looks at
+const sniffLen = 512
+
+// detectMimeType sniffs the content type from the first bytes of the content
+func detectMimeType(data []byte) string {
+	return BaseMimeType(http.DetectContentType(data))
+}
+
+// mimeCompatible reports whether a claimed type is plausible for content
+// sniffed as detected. Sniffing only recognizes a limited set of formats,
+// so unknown content and closely related families are given the benefit
+// of the doubt.
+func mimeCompatible(claimed, detected string) bool {
+	claimed = BaseMimeType(claimed)
+	if claimed == "" || claimed == "application/octet-stream" || detected == "application/octet-stream" {
+		return true
+	}
+	if claimed == detected {
+		return true
+	}
+
+	// Text formats are commonly declared with application/ types
+	if strings.HasPrefix(detected, "text/plain") {
+		return strings.HasPrefix(claimed, "text/") ||
+			strings.HasSuffix(claimed, "+json") || strings.HasSuffix(claimed, "+xml") ||
+			slices.Contains([]string{"application/json", "application/xml", "application/javascript", "application/yaml", "application/x-yaml", "application/x-sh"}, claimed)
+	}
+
+	// Many formats are zip or gzip containers (jar, apk, docx, tar.gz, ...)
+	if detected == "application/zip" || detected == "application/x-gzip" {
+		return strings.HasPrefix(claimed, "application/")
+	}
+
+	return false
+}
+
+// mimeMatchesAny reports whether a type matches an exact entry or a "type/*" wildcard
+func mimeMatchesAny(mimeType string, patterns []string) bool {
+	mimeType = BaseMimeType(mimeType)
+	if mimeType == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = BaseMimeType(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if mimeType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseMimeType strips parameters such as charset from a MIME type
+func BaseMimeType(mimeType string) string {
+	base, _, _ := strings.Cut(mimeType, ";")
+	return strings.ToLower(strings.TrimSpace(base))
+}
@@ -0,0 +1,51 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned for changes to files while the stash is read-only
+var ErrReadOnly = errors.New("file stash is read-only")
+
+// Mode controls whether files can change. While read-only, uploads, deletes
+// and metadata changes are refused and expired files are kept, but
+// downloads keep working, so operators can migrate storage without taking
+// downloads offline.
+type Mode struct {
+	ReadOnly bool   `json:"read_only"`
+	Message  string `json:"message,omitempty"` // tells refused clients why, e.g. "storage migration until 14:00 UTC"
+}
+
+// WithMode sets the mode the service starts in
+func WithMode(mode Mode) Option {
+	return func(s *Service) {
+		s.mode.Store(&mode)
+	}
+}
+
+// Mode returns the current mode
+func (s *Service) Mode() Mode {
+	if mode := s.mode.Load(); mode != nil {
+		return *mode
+	}
+	return Mode{}
+}
+
+// SetMode switches the mode at runtime. Changes already in progress finish.
+func (s *Service) SetMode(mode Mode) {
+	s.mode.Store(&mode)
+}
+
+// CheckWritable returns ErrReadOnly, with the mode's message, while the
+// stash is read-only
+func (s *Service) CheckWritable() error {
+	mode := s.Mode()
+	if !mode.ReadOnly {
+		return nil
+	}
+	if mode.Message != "" {
+		return fmt.Errorf("%w: %s", ErrReadOnly, mode.Message)
+	}
+	return ErrReadOnly
+}
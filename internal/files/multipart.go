@@ -0,0 +1,517 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// MaxUploadParts is the highest part number of a multipart upload
+const MaxUploadParts = 10000
+
+var (
+	// ErrInvalidPart is returned for part numbers out of range, and when an
+	// upload is completed without parts numbered from 1 without gaps
+	ErrInvalidPart = errors.New("invalid upload part")
+	// ErrUploadTooLarge is returned when the parts of a multipart upload add
+	// up to more than the multipart limit
+	ErrUploadTooLarge = errors.New("upload is too large")
+)
+
+// WithMultipartLimit caps the size, in bytes, of the content multipart
+// uploads assemble; zero leaves it uncapped
+func WithMultipartLimit(bytes int64) Option {
+	return func(s *Service) {
+		s.multipartLimit = bytes
+	}
+}
+
+// WithUploadIdleTimeout sets how long a registered file waiting for its
+// content may go without activity, a part or content arriving, before the
+// janitor removes it with the parts stored for it; zero keeps idle uploads
+// until the upload timeout fails them
+func WithUploadIdleTimeout(timeout time.Duration) Option {
+	return func(s *Service) {
+		s.uploadIdleTimeout = timeout
+	}
+}
+
+// UploadPart is a piece of the content of a multipart upload, stored on its
+// own until the upload completes
+type UploadPart struct {
+	FileID    string    `json:"-"`
+	Number    int       `json:"number"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MultipartUpload is a registered file whose content is uploaded in parts,
+// in any order and in parallel, and assembled once complete. Its parts tell
+// a client resuming the upload what is left to send; the progress fields
+// let clients show how far along it is and notice when it stalled.
+type MultipartUpload struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Status    string        `json:"status"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	Parts     []*UploadPart `json:"parts"`
+
+	BytesReceived   int64     `json:"bytes_received"`    // by stored parts and those still streaming, or the size of stored content
+	PartsCompleted  int       `json:"parts_completed"`   // parts stored
+	PartsInProgress int       `json:"parts_in_progress"` // parts, or content, streaming now
+	LastActivityAt  time.Time `json:"last_activity_at"`  // when a part was last stored or content received, or the file registered
+}
+
+// partStorageID is where the content of a part is stored, next to the
+// content of the file it's assembled into
+func partStorageID(id string, number int) string {
+	return fmt.Sprintf("%s.part-%d", id, number)
+}
+
+// CreateMultipartUpload registers a file whose content is uploaded in parts
+// with UploadPart. The request's content is ignored.
+func (s *Service) CreateMultipartUpload(ctx context.Context, req *UploadRequest) (*MultipartUpload, error) {
+	ctx, span := tracer.Start(ctx, "Service.CreateMultipartUpload")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+
+	file, err := s.newFile(req)
+	if err != nil {
+		return nil, err
+	}
+	file.MimeType = req.MimeType
+	file.Status = StatusPending
+
+	if err := s.repo.Create(ctx, file); err != nil {
+		return nil, fmt.Errorf("failed to save file metadata: %w", err)
+	}
+	return &MultipartUpload{ID: file.ID, Name: file.Name, Status: file.Status, ExpiresAt: file.ExpiresAt, Parts: []*UploadPart{}}, nil
+}
+
+// GetMultipartUpload returns a multipart upload with the parts uploaded so far
+func (s *Service) GetMultipartUpload(ctx context.Context, id string) (*MultipartUpload, error) {
+	ctx, span := tracer.Start(ctx, "Service.GetMultipartUpload")
+	defer span.End()
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	parts, err := s.repo.ListUploadParts(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upload parts: %w", err)
+	}
+	if parts == nil {
+		parts = []*UploadPart{}
+	}
+
+	upload := &MultipartUpload{ID: file.ID, Name: file.Name, Status: file.Status, ExpiresAt: file.ExpiresAt, Parts: parts}
+	for _, part := range parts {
+		upload.BytesReceived += part.Size
+	}
+	upload.PartsCompleted = len(parts)
+
+	streamed, streams, lastRead := s.progress.report(id)
+	upload.BytesReceived += streamed
+	upload.PartsInProgress = streams
+	upload.LastActivityAt = lastActivity(file, parts, lastRead)
+
+	// The parts of completed uploads are gone once assembled
+	if upload.BytesReceived == 0 && errors.Is(awaitingContent(file), ErrUploadComplete) {
+		upload.BytesReceived = file.Size
+	}
+	return upload, nil
+}
+
+// UploadPart stores a part of a multipart upload, replacing the part with
+// the same number if it was uploaded before, so failed parts can be retried.
+// Parts taking the upload over the multipart limit are refused.
+func (s *Service) UploadPart(ctx context.Context, id string, number int, content io.Reader) (*UploadPart, error) {
+	ctx, span := tracer.Start(ctx, "Service.UploadPart")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+	if number < 1 || number > MaxUploadParts {
+		return nil, fmt.Errorf("%w: part numbers run from 1 to %d", ErrInvalidPart, MaxUploadParts)
+	}
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if err := awaitingContent(file); err != nil {
+		return nil, err
+	}
+
+	if s.multipartLimit > 0 {
+		parts, err := s.repo.ListUploadParts(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list upload parts: %w", err)
+		}
+		remaining := s.multipartLimit
+		for _, part := range parts {
+			if part.Number != number {
+				remaining -= part.Size
+			}
+		}
+		content = &limitedReader{r: content, n: remaining}
+	}
+
+	hash := sha256.New()
+	counter := &byteCounter{}
+	storageID := partStorageID(id, number)
+	content, done := s.progress.track(id, content)
+	_, err = s.storage.Save(ctx, storageID, file.Name, "application/octet-stream", io.TeeReader(content, io.MultiWriter(hash, counter)))
+	done()
+	if err != nil {
+		if errors.Is(err, ErrUploadTooLarge) {
+			s.storage.Delete(context.WithoutCancel(ctx), storageID)
+		}
+		return nil, fmt.Errorf("failed to save upload part: %w", err)
+	}
+
+	part := &UploadPart{
+		FileID:    id,
+		Number:    number,
+		Size:      counter.n,
+		Checksum:  hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.SaveUploadPart(ctx, part); err != nil {
+		s.storage.Delete(context.WithoutCancel(ctx), storageID)
+		return nil, fmt.Errorf("failed to save upload part: %w", err)
+	}
+	return part, nil
+}
+
+// CompleteMultipartUpload assembles the parts of a multipart upload, in part
+// number order, into the content of its file and makes the file available.
+// The assembled content goes through the same checks as any upload; when
+// they fail the parts are kept, so the upload can be fixed and completed.
+// The parts are streamed from storage, never held in memory together.
+func (s *Service) CompleteMultipartUpload(ctx context.Context, id string) (*UploadResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.CompleteMultipartUpload")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if err := awaitingContent(file); err != nil {
+		return nil, err
+	}
+
+	parts, err := s.repo.ListUploadParts(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upload parts: %w", err)
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%w: no parts were uploaded", ErrInvalidPart)
+	}
+	storageIDs := make([]string, len(parts))
+	var size int64
+	for i, part := range parts {
+		if part.Number != i+1 {
+			return nil, fmt.Errorf("%w: part %d is missing", ErrInvalidPart, i+1)
+		}
+		storageIDs[i] = partStorageID(id, part.Number)
+		size += part.Size
+	}
+	if s.multipartLimit > 0 && size > s.multipartLimit {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrUploadTooLarge, size, s.multipartLimit)
+	}
+
+	// Claiming the file makes concurrent completions and uploads fail
+	if err := s.transition(ctx, file, StatusProcessing); err != nil {
+		return nil, ErrUploadInProgress
+	}
+
+	result, err := s.completeWith(ctx, file, func() error {
+		return s.storeParts(ctx, file, storageIDs, size)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.deleteUploadParts(context.WithoutCancel(ctx), id, storageIDs)
+	return result, nil
+}
+
+// PurgeUploadParts removes the parts of multipart uploads that won't
+// complete anymore, because their file failed, expired or was deleted, and
+// returns how many it removed
+func (s *Service) PurgeUploadParts(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.PurgeUploadParts")
+	defer span.End()
+
+	if s.Mode().ReadOnly {
+		return 0, nil
+	}
+	parts, err := s.repo.ListUploadParts(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list upload parts: %w", err)
+	}
+
+	byFile := make(map[string][]string)
+	for _, part := range parts {
+		byFile[part.FileID] = append(byFile[part.FileID], partStorageID(part.FileID, part.Number))
+	}
+	removed := 0
+	for id, storageIDs := range byFile {
+		// Only the parts of files known to be gone are removed; a failing
+		// lookup says nothing about whether the upload is still live
+		file, err := s.repo.FindByID(ctx, id)
+		switch {
+		case err == nil && (file.Status == StatusPending || file.Status == StatusProcessing):
+			continue
+		case err != nil && !errors.Is(err, ErrNotFound):
+			return removed, fmt.Errorf("failed to find file: %w", err)
+		}
+		if err := s.deleteUploadParts(ctx, id, storageIDs); err != nil {
+			return removed, err
+		}
+		removed += len(storageIDs)
+	}
+	return removed, nil
+}
+
+// PurgeIdleUploads removes multipart uploads still waiting for their
+// content that saw no activity within the idle timeout, along with their
+// stored parts and any content left behind, and returns how many it
+// removed. Each leaves a tombstone with ReasonAbandoned. Files registered
+// for their content in one piece have no parts; FailStalledUploads marks
+// them failed instead, keeping them listed.
+func (s *Service) PurgeIdleUploads(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.PurgeIdleUploads")
+	defer span.End()
+
+	if s.uploadIdleTimeout <= 0 || s.Mode().ReadOnly {
+		return 0, nil
+	}
+	fileList, err := s.repo.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	idleSince := time.Now().Add(-s.uploadIdleTimeout)
+	removed := 0
+	for _, file := range fileList {
+		if file.Status != StatusPending {
+			continue
+		}
+		_, streams, lastRead := s.progress.report(file.ID)
+		if streams > 0 {
+			continue
+		}
+		parts, err := s.repo.ListUploadParts(ctx, file.ID)
+		if err != nil {
+			return removed, fmt.Errorf("failed to list upload parts: %w", err)
+		}
+		if len(parts) == 0 || !lastActivity(file, parts, lastRead).Before(idleSince) {
+			continue
+		}
+
+		// Failing the file first makes parts and content arriving meanwhile
+		// refused; losing the race to them keeps the upload
+		if err := s.transition(ctx, file, StatusFailed); err != nil {
+			continue
+		}
+		storageIDs := make([]string, len(parts))
+		for i, part := range parts {
+			storageIDs[i] = partStorageID(file.ID, part.Number)
+		}
+		if err := s.deleteUploadParts(ctx, file.ID, storageIDs); err != nil {
+			return removed, err
+		}
+		if err := s.storage.Delete(ctx, file.ID); err != nil {
+			slog.Error("Failed to delete content of idle upload", "file_id", file.ID, "error", err)
+		}
+		if err := s.repo.Delete(ctx, file.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return removed, fmt.Errorf("failed to delete file metadata: %w", err)
+		}
+		s.bury(ctx, file, "", ReasonAbandoned)
+		removed++
+	}
+	return removed, nil
+}
+
+// lastActivity is when a registered file last saw activity: the latest of
+// its registration, its parts being stored and content read by uploads in
+// flight, as of lastRead
+func lastActivity(file *File, parts []*UploadPart, lastRead time.Time) time.Time {
+	last := file.CreatedAt
+	for _, part := range parts {
+		if part.CreatedAt.After(last) {
+			last = part.CreatedAt
+		}
+	}
+	if lastRead.After(last) {
+		last = lastRead
+	}
+	return last
+}
+
+// storeParts stores the parts of a multipart upload, size bytes in all, as
+// the content of its file. Like storeContent, it sniffs, scans and checks
+// the content before saving it, but reads the parts from storage for each
+// of these instead of holding them in memory.
+func (s *Service) storeParts(ctx context.Context, file *File, storageIDs []string, size int64) error {
+	read := func() *partsReader {
+		return &partsReader{ctx: ctx, storage: s.storage, ids: storageIDs}
+	}
+
+	// Sniff the actual content type from the first bytes
+	head := make([]byte, sniffLen)
+	content := read()
+	n, err := io.ReadFull(content, head)
+	content.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	detected := detectMimeType(head[:n])
+	if err := s.mimePolicy.check(file.MimeType, detected); err != nil {
+		return err
+	}
+	mimeType := file.MimeType
+	if claimed := BaseMimeType(mimeType); claimed == "" || claimed == "application/octet-stream" {
+		mimeType = detected
+	}
+
+	if s.scanner != nil {
+		content := read()
+		err := s.scan(ctx, file, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.checkFreeSpace(size); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	counter := &byteCounter{}
+	content = read()
+	stored, err := s.storage.Save(ctx, file.ID, file.Name, mimeType, io.TeeReader(content, io.MultiWriter(hash, counter)))
+	content.Close()
+	if err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	if counter.n != size {
+		s.storage.Delete(context.WithoutCancel(ctx), file.ID)
+		return fmt.Errorf("%w: parts changed while being assembled", ErrUploadInProgress)
+	}
+
+	file.Size = size
+	file.StoredSize = stored.Size
+	file.MimeType = mimeType
+	file.DetectedMimeType = detected
+	file.Checksum = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// deleteUploadParts removes the content and records of a file's parts
+func (s *Service) deleteUploadParts(ctx context.Context, id string, storageIDs []string) error {
+	for _, storageID := range storageIDs {
+		if err := s.storage.Delete(ctx, storageID); err != nil {
+			slog.Warn("Failed to delete upload part", "storage_id", storageID, "error", err)
+		}
+	}
+	if err := s.repo.DeleteUploadParts(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete upload parts: %w", err)
+	}
+	return nil
+}
+
+// partsReader reads the content of parts one after another, opening each
+// only once the previous one is read
+type partsReader struct {
+	ctx     context.Context
+	storage FileStorage
+	ids     []string
+	current io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.ids) == 0 {
+				return 0, io.EOF
+			}
+			content, err := r.storage.GetContent(r.ctx, r.ids[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed to read upload part: %w", err)
+			}
+			r.current, r.ids = content, r.ids[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the part being read
+func (r *partsReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// limitedReader reads from r until n bytes are read, failing with
+// ErrUploadTooLarge when r holds more
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Tell content ending right at the limit from content going over
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrUploadTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
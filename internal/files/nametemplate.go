@@ -0,0 +1,112 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrFilenameTemplate is returned when an upload's name doesn't follow the
+// filename template of its tag
+var ErrFilenameTemplate = errors.New("filename does not match the tag's template")
+
+// templateDateLayout formats the {date} placeholder
+const templateDateLayout = "2006-01-02"
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+
+	// Placeholder values are single name components, such as 1.4.0-rc1
+	placeholderValue = `[A-Za-z0-9][A-Za-z0-9._+-]*`
+	placeholderDate  = `[0-9]{4}-[0-9]{2}-[0-9]{2}`
+)
+
+// FilenameTemplate describes how the names of a tag's files look, e.g.
+// app-{version}-{date}.tar.gz. {date} stands for the upload's UTC date and
+// every other placeholder for a custom attribute of the same name.
+type FilenameTemplate struct {
+	template string
+	pattern  *regexp.Regexp
+}
+
+// ParseFilenameTemplate parses a template of literal text and {name}
+// placeholders
+func ParseFilenameTemplate(template string) (*FilenameTemplate, error) {
+	if template == "" {
+		return nil, fmt.Errorf("empty filename template")
+	}
+	literals := placeholderPattern.Split(template, -1)
+	for _, literal := range literals {
+		if strings.ContainsAny(literal, "{}/\\") {
+			return nil, fmt.Errorf("invalid filename template %q", template)
+		}
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i, match := range placeholderPattern.FindAllStringSubmatch(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(literals[i]))
+		if match[1] == "date" {
+			pattern.WriteString(placeholderDate)
+		} else {
+			pattern.WriteString(placeholderValue)
+		}
+	}
+	pattern.WriteString(regexp.QuoteMeta(literals[len(literals)-1]) + "$")
+
+	return &FilenameTemplate{template: template, pattern: regexp.MustCompile(pattern.String())}, nil
+}
+
+// String returns the template as it was parsed
+func (t *FilenameTemplate) String() string {
+	return t.template
+}
+
+// Match reports whether a name follows the template
+func (t *FilenameTemplate) Match(name string) bool {
+	return t.pattern.MatchString(name)
+}
+
+// Render fills in the template from attributes and the date of now. It
+// fails when an attribute is missing or isn't a valid name component.
+func (t *FilenameTemplate) Render(attrs map[string]string, now time.Time) (string, bool) {
+	ok := true
+	name := placeholderPattern.ReplaceAllStringFunc(t.template, func(placeholder string) string {
+		field := placeholder[1 : len(placeholder)-1]
+		if field == "date" {
+			return now.UTC().Format(templateDateLayout)
+		}
+		value, found := attrs[field]
+		if !found {
+			ok = false
+		}
+		return value
+	})
+	return name, ok && t.Match(name)
+}
+
+// applyFilenameTemplate checks a file's name against the template of its
+// tag. Names that don't follow it are replaced with the rendered template
+// when the attributes fill it in, and rejected otherwise.
+func (s *Service) applyFilenameTemplate(tag, name string, attrs map[string]string, now time.Time) (string, error) {
+	err := s.checkFilenameTemplate(tag, name)
+	if err == nil {
+		return name, nil
+	}
+	if rendered, ok := s.filenameTemplates[tag].Render(attrs, now); ok {
+		return rendered, nil
+	}
+	return "", err
+}
+
+// checkFilenameTemplate checks a name chosen explicitly against the
+// template of its tag, without rendering the template in its place
+func (s *Service) checkFilenameTemplate(tag, name string) error {
+	template, ok := s.filenameTemplates[tag]
+	if !ok || tag == "" || template.Match(name) {
+		return nil
+	}
+	return fmt.Errorf("%w: %q doesn't follow %s", ErrFilenameTemplate, name, template)
+}
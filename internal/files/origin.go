@@ -0,0 +1,27 @@
+package files
+
+// maxOriginLength bounds each origin field, since clients control them
+const maxOriginLength = 256
+
+// Origin records where an upload came from, to trace which machine
+// produced a file. Which fields are recorded is up to the caller.
+type Origin struct {
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Hostname  string `json:"hostname,omitempty"` // as reported by the client
+}
+
+// normalize returns a copy of the origin with overlong fields truncated,
+// or nil when no field is set
+func (o *Origin) normalize() *Origin {
+	if o == nil || *o == (Origin{}) {
+		return nil
+	}
+	truncate := func(s string) string {
+		if len(s) > maxOriginLength {
+			return s[:maxOriginLength]
+		}
+		return s
+	}
+	return &Origin{IP: truncate(o.IP), UserAgent: truncate(o.UserAgent), Hostname: truncate(o.Hostname)}
+}
@@ -0,0 +1,91 @@
+package files
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	// ErrPasswordRequired is returned when a password protected file is
+	// downloaded without a password
+	ErrPasswordRequired = errors.New("password required")
+
+	// ErrInvalidPassword is returned when the password doesn't match the file's
+	ErrInvalidPassword = errors.New("invalid password")
+)
+
+// Argon2id parameters, following the OWASP recommendation
+const (
+	argonMemory  = 19 * 1024 // KiB
+	argonTime    = 2
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// hashPassword hashes a password with Argon2id and a random salt, encoded in
+// the PHC string format so the parameters can change without breaking
+// existing hashes
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyPassword reports whether a password matches a hash made by hashPassword
+func verifyPassword(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// checkPassword verifies the password a downloader supplied for a file.
+// Files uploaded without a password need none.
+func checkPassword(file *File, password string) error {
+	if file.PasswordHash == "" {
+		return nil
+	}
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	if !verifyPassword(password, file.PasswordHash) {
+		return ErrInvalidPassword
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// warmer is implemented by storages caching content in front of a slower
+// backend, which content can be loaded into ahead of its downloads
+type warmer interface {
+	Warm(ctx context.Context, id string) error
+}
+
+// PrefetchOptions select the tags whose new files are prefetched, so the
+// first wave of downloads after a release doesn't hit cold storage at once
+type PrefetchOptions struct {
+	Tags []string // "*" prefetches the files of every tag
+
+	// PrimeURLs are requested, following redirects, once a file landed, e.g.
+	// to pull it into a CDN. {tag}, {id} and {url}, the file's signed
+	// download path, are filled in.
+	PrimeURLs []string
+	Client    *http.Client
+}
+
+// WithPrefetch prefetches new files of the given tags into the storage's
+// cache and primes URLs with them
+func WithPrefetch(opts PrefetchOptions) Option {
+	return func(s *Service) {
+		s.prefetch = opts
+	}
+}
+
+// prefetchFile warms the cache with a new file and primes the URLs for it
+// in the background, when its tag is prefetched
+func (s *Service) prefetchFile(file *File) {
+	if file.Tag == "" || !(slices.Contains(s.prefetch.Tags, file.Tag) || slices.Contains(s.prefetch.Tags, "*")) {
+		return
+	}
+
+	go func() {
+		ctx, span := tracer.Start(context.Background(), "Service.prefetchFile")
+		defer span.End()
+
+		if cache, ok := s.storage.(warmer); ok {
+			if err := cache.Warm(ctx, file.ID); err != nil {
+				slog.Error("Prefetch failed", "file_id", file.ID, "tag", file.Tag, "error", err)
+			}
+		}
+		if len(s.prefetch.PrimeURLs) == 0 {
+			return
+		}
+		link, err := s.generateSignedURL(file.ID, LinkOptions{})
+		if err != nil {
+			slog.Error("Prefetch failed", "file_id", file.ID, "error", err)
+			return
+		}
+		replacer := strings.NewReplacer("{tag}", url.PathEscape(file.Tag), "{id}", file.ID, "{url}", link)
+		for _, target := range s.prefetch.PrimeURLs {
+			if err := s.prime(ctx, replacer.Replace(target)); err != nil {
+				slog.Error("Priming failed", "file_id", file.ID, "tag", file.Tag, "error", err)
+			}
+		}
+	}()
+}
+
+// prime downloads a URL in full, so the caches on its way hold the response
+func (s *Service) prime(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return fmt.Errorf("invalid prime URL: %w", err)
+	}
+	client := s.prefetch.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("prime %s: unexpected status %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package files
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// uploadProgress follows the content of uploads while it streams in, which
+// isn't recorded anywhere until a part or the whole content is stored
+type uploadProgress struct {
+	mu      sync.Mutex
+	streams map[string]map[*progressReader]struct{} // by file ID
+}
+
+// progressReader counts the bytes read from an upload's content
+type progressReader struct {
+	io.Reader
+	bytes    atomic.Int64
+	lastRead atomic.Int64 // Unix nanoseconds
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.bytes.Add(int64(n))
+		r.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// track follows content uploaded for the file with id until done is called
+func (u *uploadProgress) track(id string, content io.Reader) (tracked io.Reader, done func()) {
+	r := &progressReader{Reader: content}
+	r.lastRead.Store(time.Now().UnixNano())
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.streams == nil {
+		u.streams = make(map[string]map[*progressReader]struct{})
+	}
+	if u.streams[id] == nil {
+		u.streams[id] = make(map[*progressReader]struct{})
+	}
+	u.streams[id][r] = struct{}{}
+
+	return r, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if delete(u.streams[id], r); len(u.streams[id]) == 0 {
+			delete(u.streams, id)
+		}
+	}
+}
+
+// report returns the bytes streamed so far by the uploads in flight for the
+// file with id, how many there are and when the last of them read content
+func (u *uploadProgress) report(id string) (bytes int64, streams int, lastRead time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for r := range u.streams[id] {
+		bytes += r.bytes.Load()
+		if last := time.Unix(0, r.lastRead.Load()); last.After(lastRead) {
+			lastRead = last
+		}
+	}
+	return bytes, len(u.streams[id]), lastRead
+}
@@ -0,0 +1,56 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrRangeNotSatisfiable is returned when a requested byte range is invalid
+// for the file or falls outside the range authorized by a signature
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// ByteRange is an inclusive range of bytes within a file
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// ParseByteRange parses a range in the "start-end" form
+func ParseByteRange(s string) (ByteRange, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return ByteRange{}, fmt.Errorf("invalid byte range %q", s)
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return ByteRange{}, fmt.Errorf("invalid byte range start %q", startStr)
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return ByteRange{}, fmt.Errorf("invalid byte range end %q", endStr)
+	}
+
+	if start < 0 || end < start {
+		return ByteRange{}, fmt.Errorf("invalid byte range %q", s)
+	}
+
+	return ByteRange{Start: start, End: end}, nil
+}
+
+// String formats the range in the "start-end" form
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Length returns the number of bytes covered by the range
+func (r ByteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+// Contains reports whether other lies entirely within the range
+func (r ByteRange) Contains(other ByteRange) bool {
+	return other.Start >= r.Start && other.End <= r.End
+}
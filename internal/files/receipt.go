@@ -0,0 +1,81 @@
+package files
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// ReceiptSigner issues upload receipts as compact JWS tokens signed with
+// Ed25519 (alg "EdDSA"), verifiable offline with the public key
+type ReceiptSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// ReceiptClaims is the payload of an upload receipt
+type ReceiptClaims struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Checksum string `json:"sha256"`
+	Size     int64  `json:"size"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// JWK is the JSON Web Key form of the receipt public key
+type JWK struct {
+	KeyType string `json:"kty"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+}
+
+// NewReceiptSigner creates a signer for the given private key
+func NewReceiptSigner(key ed25519.PrivateKey) *ReceiptSigner {
+	pub := key.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(pub)
+	return &ReceiptSigner{
+		key:   key,
+		keyID: base64.RawURLEncoding.EncodeToString(sum[:8]),
+	}
+}
+
+// Sign returns a compact JWS receipt for a stored file
+func (r *ReceiptSigner) Sign(file *File) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "kid": r.keyID, "typ": "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode receipt header: %w", err)
+	}
+
+	payload, err := json.Marshal(ReceiptClaims{
+		ID:       file.ID,
+		Name:     file.Name,
+		Checksum: file.Checksum,
+		Size:     file.Size,
+		IssuedAt: file.CreatedAt.Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode receipt payload: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(r.key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// PublicJWK returns the public key receipts can be verified with
+func (r *ReceiptSigner) PublicJWK() JWK {
+	pub := r.key.Public().(ed25519.PublicKey)
+	return JWK{
+		KeyType: "OKP",
+		Curve:   "Ed25519",
+		X:       base64.RawURLEncoding.EncodeToString(pub),
+		KeyID:   r.keyID,
+		Use:     "sig",
+		Alg:     "EdDSA",
+	}
+}
@@ -0,0 +1,154 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// ReasonRetention is the reason recorded for files removed by a retention
+// policy
+const ReasonRetention = "retention"
+
+// RetentionPolicy bounds how many files of a tag are kept and for how long.
+// Zero values don't limit anything.
+type RetentionPolicy struct {
+	KeepLast int           // keep only the newest KeepLast files
+	MaxAge   time.Duration // remove files uploaded longer ago than MaxAge
+}
+
+// RetentionPolicies select the policy applied to each file: Tags by the
+// file's tag, then Tagged for other tagged files and Untagged for files
+// without a tag. Searches apply policies to the files matched by saved
+// searches, by name, on top of those of their tags.
+type RetentionPolicies struct {
+	Tags     map[string]RetentionPolicy
+	Tagged   RetentionPolicy
+	Untagged RetentionPolicy
+	Searches map[string]RetentionPolicy
+}
+
+// policy returns the policy applying to files with tag
+func (p RetentionPolicies) policy(tag string) RetentionPolicy {
+	if tag == "" {
+		return p.Untagged
+	}
+	if policy, ok := p.Tags[tag]; ok {
+		return policy
+	}
+	return p.Tagged
+}
+
+// outside returns the files, sorted newest first, that the policy doesn't
+// keep
+func (p RetentionPolicy) outside(files []*File, now time.Time) []*File {
+	if p.KeepLast <= 0 && p.MaxAge <= 0 {
+		return nil
+	}
+	var outside []*File
+	for i, file := range files {
+		tooMany := p.KeepLast > 0 && i >= p.KeepLast
+		tooOld := p.MaxAge > 0 && now.Sub(file.CreatedAt) > p.MaxAge
+		if tooMany || tooOld {
+			outside = append(outside, file)
+		}
+	}
+	return outside
+}
+
+// WithRetention sets the retention policies the janitor applies
+func WithRetention(policies RetentionPolicies) Option {
+	return func(s *Service) {
+		s.retention = policies
+	}
+}
+
+// ApplyRetention removes the active files that fall outside the retention
+// policy of their tag or of a saved search matching them, and returns how
+// many were removed. The newest file of each tag is always kept, so its
+// latest pointer stays valid, and pinned files are never removed. Nothing
+// is removed while the stash is read-only.
+func (s *Service) ApplyRetention(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.ApplyRetention")
+	defer span.End()
+
+	if s.Mode().ReadOnly {
+		return 0, nil
+	}
+
+	fileList, err := s.repo.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	now := time.Now()
+	var active []*File
+	for _, file := range fileList {
+		if file.IsActive() && !file.IsExpired(now) {
+			active = append(active, file)
+		}
+	}
+	slices.SortStableFunc(active, func(a, b *File) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	byTag := make(map[string][]*File)
+	for _, file := range active {
+		byTag[file.Tag] = append(byTag[file.Tag], file)
+	}
+	var doomed []*File
+	policies := make(map[string]string) // the tag or "@" and saved search removing each file
+	doom := func(files []*File, policy string) {
+		for _, file := range files {
+			newest := file.Tag != "" && byTag[file.Tag][0] == file
+			if _, ok := policies[file.ID]; ok || file.Pinned || newest {
+				continue
+			}
+			policies[file.ID] = policy
+			doomed = append(doomed, file)
+		}
+	}
+	for tag, tagged := range byTag {
+		doom(s.retention.policy(tag).outside(tagged, now), tag)
+	}
+	for name, policy := range s.retention.Searches {
+		search, err := s.repo.FindSavedSearch(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			slog.Warn("Retention policy refers to a missing saved search", "search", name)
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to find saved search %s: %w", name, err)
+		}
+		filter, err := search.Filter()
+		if err != nil {
+			return 0, fmt.Errorf("invalid saved search %s: %w", name, err)
+		}
+		// Stars belong to users, so the janitor can't tell which are starred
+		if filter.Starred {
+			slog.Warn("Retention policy refers to a saved search of starred files", "search", name)
+			continue
+		}
+		var matched []*File
+		for _, file := range active {
+			if filter.Match(file, now) {
+				matched = append(matched, file)
+			}
+		}
+		doom(policy.outside(matched, now), "@"+name)
+	}
+
+	removed := 0
+	for _, file := range doomed {
+		if err := s.Delete(ctx, "", file.ID, ReasonRetention); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", file.ID, err)
+		}
+		slog.Info("Removed file by retention policy", "file_id", file.ID, "policy", policies[file.ID])
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,161 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrLinkRevoked is returned for downloads through a revoked link
+	ErrLinkRevoked = errors.New("link has been revoked")
+
+	// ErrLinkUsed is returned for downloads through a one-time link that
+	// was used already
+	ErrLinkUsed = errors.New("link has already been used")
+
+	// ErrLinkCheckFailed is returned when an issued link couldn't be looked
+	// up or used for a reason other than being revoked or used
+	ErrLinkCheckFailed = errors.New("failed to check link")
+)
+
+// Link is a signed download link issued with a server-side ID, so it can be
+// revoked on its own without deleting the file or rotating the HMAC key.
+// Its URL is only known when it's issued.
+type Link struct {
+	ID        string     `json:"id"`
+	FileID    string     `json:"file_id"`
+	Options   string     `json:"options,omitempty"` // query string of the link options
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	OneTime   bool       `json:"one_time,omitempty"` // works for a single download
+	UsedAt    *time.Time `json:"used_at,omitempty"`  // when a one-time link was used
+	URL       string     `json:"-"`
+}
+
+// ListLinks retrieves the links issued for a file, or for every file when
+// fileID is empty, oldest first
+func (s *Service) ListLinks(ctx context.Context, fileID string) ([]*Link, error) {
+	ctx, span := tracer.Start(ctx, "Service.ListLinks")
+	defer span.End()
+
+	links, err := s.repo.ListLinks(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+	return links, nil
+}
+
+// RevokeLink revokes an issued link; downloads through it, or through short
+// links pointing at it, fail with ErrLinkRevoked from then on
+func (s *Service) RevokeLink(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Service.RevokeLink")
+	defer span.End()
+
+	if err := s.repo.DeleteLink(ctx, id); err != nil {
+		return fmt.Errorf("failed to revoke link: %w", err)
+	}
+	return nil
+}
+
+// verifyLink validates the signature of a link and, for links issued with
+// an ID, that the link wasn't revoked or, when one-time, used. It returns
+// the issued link, or nil for links issued without an ID.
+func (s *Service) verifyLink(ctx context.Context, id string, opts LinkOptions, signature string) (*Link, error) {
+	if !s.verifySignature(id, opts, signature) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	if opts.LinkID == "" {
+		return nil, nil
+	}
+
+	link, err := s.repo.FindLink(ctx, opts.LinkID)
+	if errors.Is(err, ErrNotFound) || err == nil && link.FileID != id {
+		return nil, ErrLinkRevoked
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLinkCheckFailed, err)
+	}
+	if link.UsedAt != nil {
+		return nil, ErrLinkUsed
+	}
+	return link, nil
+}
+
+// useLink uses a one-time link once a download through it is authorized,
+// so of concurrent downloads only one gets through; HEAD requests check the
+// link without using it. A client breaking off the download doesn't get
+// the link back: only the server failing before sending anything releases
+// it for another try.
+func (s *Service) useLink(ctx context.Context, link *Link, opts LinkOptions) (*linkUse, error) {
+	if link == nil || !link.OneTime || opts.Method == "HEAD" {
+		return nil, nil
+	}
+	at := time.Now()
+	if err := s.repo.UseLink(ctx, link.ID, at); err != nil {
+		switch {
+		case errors.Is(err, ErrLinkUsed):
+			return nil, ErrLinkUsed
+		case errors.Is(err, ErrNotFound):
+			return nil, ErrLinkRevoked
+		}
+		return nil, fmt.Errorf("%w: %w", ErrLinkCheckFailed, err)
+	}
+	return &linkUse{repo: s.repo, ctx: ctx, id: link.ID, at: at}, nil
+}
+
+// linkUse is a one-time link used by a download; a nil linkUse is that of a
+// link that isn't one-time
+type linkUse struct {
+	repo FileRepository
+	ctx  context.Context // of the download
+	id   string
+	at   time.Time
+}
+
+// release gives the link back after the server failed the download
+func (u *linkUse) release() {
+	if u == nil {
+		return
+	}
+	if err := u.repo.ReleaseLink(context.WithoutCancel(u.ctx), u.id, u.at); err != nil {
+		slog.Error("Failed to release one-time link", "link_id", u.id, "error", err)
+	}
+}
+
+// wrap releases the link when reading content fails before it yields
+// anything while the client is still there
+func (u *linkUse) wrap(content io.ReadCloser) io.ReadCloser {
+	if u == nil {
+		return content
+	}
+	return &linkedContent{ReadCloser: content, use: u}
+}
+
+// linkedContent is the content of a download through a one-time link
+type linkedContent struct {
+	io.ReadCloser
+	use  *linkUse
+	read bool // content was read, or the link released
+}
+
+func (c *linkedContent) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.read && n == 0 && err != nil && err != io.EOF && c.use.ctx.Err() == nil {
+		c.use.release()
+	}
+	if n > 0 || err != nil {
+		c.read = true
+	}
+	return n, err
+}
+
+// newLinkID returns a random lowercase link ID
+func newLinkID() string {
+	return strings.ToLower(rand.Text())
+}
@@ -0,0 +1,89 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Scan verdicts
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+)
+
+// What happens to infected uploads
+const (
+	// ScanActionReject fails the upload without storing the content
+	ScanActionReject = "reject"
+	// ScanActionQuarantine stores the file quarantined, so it can't be
+	// downloaded until an admin releases it
+	ScanActionQuarantine = "quarantine"
+)
+
+var (
+	// ErrInfected is returned when an upload is rejected by the virus scan
+	ErrInfected = errors.New("file is infected")
+
+	// ErrScanFailed is returned when uploaded content couldn't be scanned
+	ErrScanFailed = errors.New("virus scan failed")
+)
+
+// Scanner checks content for malware, returning the name of the malware
+// found or an empty string for clean content
+type Scanner interface {
+	Scan(ctx context.Context, content io.Reader) (string, error)
+}
+
+// ScanResult records the virus scan of a file's content
+type ScanResult struct {
+	Status    string    `json:"status"`              // ScanClean or ScanInfected
+	Signature string    `json:"signature,omitempty"` // the malware found
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// IsInfected reports whether the scan of the file's content found malware
+func (f *File) IsInfected() bool {
+	return f.Scan != nil && f.Scan.Status == ScanInfected
+}
+
+// WithScanner scans uploaded content before it's stored, rejecting or
+// quarantining infected files according to action. Uploads fail while the
+// scanner is unavailable.
+func WithScanner(scanner Scanner, action string) Option {
+	return func(s *Service) {
+		s.scanner = scanner
+		s.scanAction = action
+	}
+}
+
+// scan checks content with the scanner, when there is one, and records the
+// result on the file. Infected content is rejected unless it's to be
+// quarantined.
+func (s *Service) scan(ctx context.Context, file *File, content io.Reader) error {
+	if s.scanner == nil {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "Service.scan")
+	defer span.End()
+
+	signature, err := s.scanner.Scan(ctx, content)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrScanFailed, err)
+	}
+
+	file.Scan = &ScanResult{Status: ScanClean, ScannedAt: time.Now()}
+	if signature == "" {
+		return nil
+	}
+	file.Scan.Status = ScanInfected
+	file.Scan.Signature = signature
+	slog.Warn("Infected upload", "file_id", file.ID, "name", file.Name, "signature", signature, "action", s.scanAction)
+	if s.scanAction != ScanActionQuarantine {
+		return fmt.Errorf("%w: %s", ErrInfected, signature)
+	}
+	return nil
+}
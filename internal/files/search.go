@@ -0,0 +1,72 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Search results are paged, DefaultSearchLimit files at a time unless
+// asked otherwise, and at most MaxSearchLimit
+const (
+	DefaultSearchLimit = 50
+	MaxSearchLimit     = 500
+)
+
+// ErrEmptySearch is returned for search queries without any words
+var ErrEmptySearch = errors.New("search query has no words")
+
+// SearchResult is a page of the files matching a search, best matches
+// first, with the number of matches on all pages
+type SearchResult struct {
+	Files  []*File `json:"files"`
+	Total  int     `json:"total"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+}
+
+// SearchTerms splits a search query into the terms a file must all match.
+// A term matches words of a file's name, tag or attributes starting with
+// it; terms like "v1.2" match the same words in sequence. Terms without
+// letters or digits are dropped.
+func SearchTerms(query string) []string {
+	var terms []string
+	for _, term := range strings.Fields(strings.ToLower(query)) {
+		if strings.IndexFunc(term, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// Search finds the files whose name, tag or custom attributes match the
+// query, ranked by relevance with name matches first, and returns the
+// page of them starting at offset
+func (s *Service) Search(ctx context.Context, query string, limit, offset int) (*SearchResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.Search")
+	defer span.End()
+
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	limit = min(limit, MaxSearchLimit)
+	offset = max(offset, 0)
+
+	matches, err := s.repo.Search(ctx, terms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search files: %w", err)
+	}
+	matches = s.filterExpired(ctx, matches)
+
+	result := &SearchResult{Files: []*File{}, Total: len(matches), Limit: limit, Offset: offset}
+	if offset < len(matches) {
+		result.Files = matches[offset:min(offset+limit, len(matches))]
+	}
+	return result, nil
+}
@@ -2,159 +2,832 @@ package files
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/metrics"
+	"github.com/pavel-fokin/files-stash/internal/notify"
 )
 
 // Service provides application-level file operations
 type Service struct {
-	storage FileStorage
-	repo    FileRepository
-	hmacKey string
-	ttl     time.Duration
+	storage    FileStorage
+	repo       FileRepository
+	hmacKey    string
+	ttl        atomic.Int64 // nanoseconds; see SetDefaultTTL
+	mimePolicy MimePolicy
+	receipts   *ReceiptSigner
+	quota      int64
+	watermark  int64
+	notifier   notify.Notifier
+	metrics    *metrics.Tags
+	integrity  *metrics.Integrity
+	mode       atomic.Pointer[Mode]
+	diffLimit  int64
+
+	filenameTemplates map[string]*FilenameTemplate // by tag
+	prefetch          PrefetchOptions
+	slowStart         *slowStart
+	throttle          atomic.Pointer[throttle]
+	scanner           Scanner
+	scanAction        string
+
+	tombstoneRetention time.Duration
+	retention          RetentionPolicies
+
+	uploadTimeout     time.Duration
+	uploadIdleTimeout time.Duration
+	progress          uploadProgress
+	multipartLimit    int64
+
+	legacySignatures bool
+	staleTagFallback bool
+}
+
+// Option configures optional Service behavior
+type Option func(*Service)
+
+// WithMimePolicy sets the content type policy enforced on upload
+func WithMimePolicy(policy MimePolicy) Option {
+	return func(s *Service) {
+		s.mimePolicy = policy
+	}
+}
+
+// WithReceiptSigner makes uploads return a signed receipt
+func WithReceiptSigner(signer *ReceiptSigner) Option {
+	return func(s *Service) {
+		s.receipts = signer
+	}
+}
+
+// WithNotifier sends events about uploads, deletions, expiries, tag changes
+// and the storage forecast to the notifier
+func WithNotifier(notifier notify.Notifier) Option {
+	return func(s *Service) {
+		s.notifier = notifier
+	}
+}
+
+// WithMetrics records uploads and downloads in per-tag metrics
+func WithMetrics(tags *metrics.Tags) Option {
+	return func(s *Service) {
+		s.metrics = tags
+	}
+}
+
+// WithFilenameTemplates makes uploads to the tags follow their filename
+// templates
+func WithFilenameTemplates(templates map[string]*FilenameTemplate) Option {
+	return func(s *Service) {
+		s.filenameTemplates = templates
+	}
+}
+
+// WithUploadTimeout sets how long a registered file waits for its content
+// before the upload is marked failed; zero waits until the file expires
+func WithUploadTimeout(timeout time.Duration) Option {
+	return func(s *Service) {
+		s.uploadTimeout = timeout
+	}
+}
+
+// WithLegacySignatures keeps accepting download links signed before
+// signatures covered the request method, easing the switch for links
+// already handed out
+func WithLegacySignatures(accept bool) Option {
+	return func(s *Service) {
+		s.legacySignatures = accept
+	}
+}
+
+// WithStaleTagFallback resolves a tag whose latest file expired to the most
+// recent of its files that hasn't, instead of failing until the expired
+// file is purged
+func WithStaleTagFallback(fallback bool) Option {
+	return func(s *Service) {
+		s.staleTagFallback = fallback
+	}
 }
 
 // NewService creates a new file service
-func NewService(storage FileStorage, repo FileRepository, hmacKey string, ttl time.Duration) *Service {
-	return &Service{
+func NewService(storage FileStorage, repo FileRepository, hmacKey string, ttl time.Duration, opts ...Option) *Service {
+	s := &Service{
 		storage: storage,
 		repo:    repo,
 		hmacKey: hmacKey,
-		ttl:     ttl,
 	}
+	s.ttl.Store(int64(ttl))
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// SetDefaultTTL changes how long files uploaded without a TTL of their own
+// live. Files already uploaded keep their expiry.
+func (s *Service) SetDefaultTTL(ttl time.Duration) {
+	s.ttl.Store(int64(ttl))
 }
 
+var (
+	// ErrNotFound is returned when a file doesn't exist, or can't be
+	// accessed in its status
+	ErrNotFound = errors.New("file not found")
+
+	// ErrExpired is returned when a file has expired
+	ErrExpired = errors.New("file has expired")
+
+	// ErrInvalidLink is returned when an external link is not an absolute HTTP(S) URL
+	ErrInvalidLink = errors.New("link must be an absolute http or https URL")
+
+	// ErrInvalidSearch is returned when a saved search has no name or an invalid query
+	ErrInvalidSearch = errors.New("invalid saved search")
+
+	// ErrEmptyComment is returned when a comment has no body
+	ErrEmptyComment = errors.New("comment body is required")
+
+	// ErrUploadComplete is returned when content is uploaded for a
+	// registered file that already has its content
+	ErrUploadComplete = errors.New("file content was already uploaded")
+
+	// ErrUploadInProgress is returned when content is uploaded for a
+	// registered file while another upload of its content is running
+	ErrUploadInProgress = errors.New("file content is being uploaded")
+
+	// ErrUploadFailed is returned when content is uploaded for a registered
+	// file whose upload timed out
+	ErrUploadFailed = errors.New("upload timed out, register the file again")
+
+	// ErrInsufficientStorage is returned when an upload would leave less
+	// free space than the watermark
+	ErrInsufficientStorage = errors.New("insufficient storage")
+
+	// ErrInvalidExpiry is returned when a file is updated to expire in the past
+	ErrInvalidExpiry = errors.New("expiry must be in the future")
+)
+
 // UploadRequest represents a file upload request
 type UploadRequest struct {
-	Name     string
-	MimeType string
-	Tag      string
-	Content  io.Reader
+	Name        string
+	MimeType    string
+	Tag         string
+	Description string
+	Link        string
+	Pinned      bool
+	Public      bool          // allows downloads without a signed link
+	TTL         time.Duration // overrides the default TTL when positive
+	Password    string        // protects downloads when set
+	Attributes  map[string]string
+	Origin      *Origin   // where the upload came from, when recorded
+	Content     io.Reader // ignored by Register
+}
+
+// UpdateRequest represents a change to file metadata. Nil fields are left
+// unchanged. Attributes are merged into the file's, with null values
+// removing attributes.
+type UpdateRequest struct {
+	Name        *string            `json:"name"`
+	Tag         *string            `json:"tag"`
+	Description *string            `json:"description"`
+	Link        *string            `json:"link"`
+	Public      *bool              `json:"public"`
+	ExpiresAt   *time.Time         `json:"expires_at"`
+	Attributes  map[string]*string `json:"attributes"`
 }
 
 // UploadResult represents the result of a file upload
 type UploadResult struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Tag       string    `json:"tag,omitempty"`
-	Size      int64     `json:"size"`
-	MimeType  string    `json:"mime_type"`
-	CreatedAt time.Time `json:"created_at"`
-	ExpiresAt time.Time `json:"expires_at"`
-	URL       string    `json:"url"`
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Tag              string            `json:"tag,omitempty"`
+	Size             int64             `json:"size"`
+	StoredSize       int64             `json:"stored_size,omitempty"`
+	MimeType         string            `json:"mime_type"`
+	DetectedMimeType string            `json:"detected_mime_type,omitempty"`
+	Checksum         string            `json:"sha256,omitempty"`
+	Description      string            `json:"description,omitempty"`
+	Link             string            `json:"link,omitempty"`
+	Pinned           bool              `json:"pinned"`
+	Public           bool              `json:"public,omitempty"`
+	Protected        bool              `json:"password_protected,omitempty"`
+	Attributes       map[string]string `json:"attributes,omitempty"`
+	Origin           *Origin           `json:"origin,omitempty"`
+	Status           string            `json:"status,omitempty"`
+	Scan             *ScanResult       `json:"scan,omitempty"`
+	Integrity        *IntegrityCheck   `json:"integrity,omitempty"`
+	CreatedAt        time.Time         `json:"created_at"`
+	ExpiresAt        time.Time         `json:"expires_at"`
+	URL              string            `json:"url"`
+	UploadURL        string            `json:"upload_url,omitempty"` // where the content of a registered file is PUT
+	Receipt          string            `json:"receipt,omitempty"`
+	Snippets         *Snippets         `json:"snippets,omitempty"`
+}
+
+// Snippets are ready-to-paste shell commands that download an uploaded
+// file, by its signed URL and, for tagged files, as the tag's latest file
+type Snippets struct {
+	Curl       string `json:"curl"`
+	Wget       string `json:"wget"`
+	LatestCurl string `json:"latest_curl,omitempty"`
+	LatestWget string `json:"latest_wget,omitempty"`
+}
+
+// newUploadResult builds an UploadResult from file metadata and its signed URL
+func newUploadResult(file *File, url string) *UploadResult {
+	return &UploadResult{
+		ID:               file.ID,
+		Name:             file.Name,
+		Tag:              file.Tag,
+		Size:             file.Size,
+		StoredSize:       file.StoredSize,
+		MimeType:         file.MimeType,
+		DetectedMimeType: file.DetectedMimeType,
+		Checksum:         file.Checksum,
+		Description:      file.Description,
+		Link:             file.Link,
+		Pinned:           file.Pinned,
+		Public:           file.Public,
+		Protected:        file.PasswordHash != "",
+		Attributes:       file.Attributes,
+		Origin:           file.Origin,
+		Status:           file.Status,
+		Scan:             file.Scan,
+		Integrity:        file.Integrity,
+		CreatedAt:        file.CreatedAt,
+		ExpiresAt:        file.ExpiresAt,
+		URL:              url,
+	}
 }
 
 // Upload stores a file and returns its metadata with a signed URL
-func (s *Service) Upload(req *UploadRequest) (*UploadResult, error) {
-	// Generate unique file ID
-	id := s.generateID()
+func (s *Service) Upload(ctx context.Context, req *UploadRequest) (*UploadResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.Upload")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
 
-	// Calculate file size by reading content
-	size, data, err := s.calculateSize(req.Content)
+	file, err := s.newFile(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate file size: %w", err)
+		return nil, err
+	}
+	if err := s.storeContent(ctx, file, req.MimeType, req.Content); err != nil {
+		return nil, err
+	}
+	if file.IsInfected() {
+		file.Status = StatusQuarantined
 	}
 
-	// Create file metadata
-	now := time.Now()
-	file := &File{
-		ID:        id,
-		Name:      req.Name,
-		Tag:       req.Tag,
-		Size:      size,
-		MimeType:  req.MimeType,
-		CreatedAt: now,
-		ExpiresAt: now.Add(s.ttl),
+	// Save metadata to repository
+	if err := s.repo.Create(ctx, file); err != nil {
+		// Clean up file if metadata save fails, even if the request was cancelled
+		s.storage.Delete(context.WithoutCancel(ctx), file.ID)
+		return nil, fmt.Errorf("failed to save file metadata: %w", err)
 	}
 
-	// Save file to storage
-	_, err = s.storage.Save(id, req.Name, req.MimeType, bytes.NewReader(data))
+	s.notify(notify.EventFileUploaded, fmt.Sprintf("File %s uploaded", file.Name), file)
+	s.metrics.Uploaded(file.Tag, file.Size)
+	s.prefetchFile(file)
+
+	return s.uploadResult(file)
+}
+
+// Register creates the metadata of a file whose content is sent later to
+// the returned upload URL, so clients learn the file ID before the transfer
+// and can retry the transfer on its own. The request's content is ignored.
+func (s *Service) Register(ctx context.Context, req *UploadRequest) (*UploadResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.Register")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+
+	file, err := s.newFile(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to save file: %w", err)
+		return nil, err
 	}
+	file.MimeType = req.MimeType
+	file.Status = StatusPending
 
-	// Save metadata to repository
-	if err := s.repo.Create(file); err != nil {
-		// Clean up file if metadata save fails
-		s.storage.Delete(id)
+	if err := s.repo.Create(ctx, file); err != nil {
 		return nil, fmt.Errorf("failed to save file metadata: %w", err)
 	}
 
-	// Generate signed URL
-	url, err := s.generateSignedURL(id)
+	url, err := s.generateSignedURL(file.ID, LinkOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate signed URL: %w", err)
 	}
 
-	return &UploadResult{
-		ID:        file.ID,
-		Name:      file.Name,
-		Tag:       file.Tag,
-		Size:      file.Size,
-		MimeType:  file.MimeType,
-		CreatedAt: file.CreatedAt,
-		ExpiresAt: file.ExpiresAt,
-		URL:       url,
+	result := newUploadResult(file, url)
+	result.UploadURL = "/v1/files/" + file.ID + "/content?signature=" + s.createSignature(uploadPayload(file.ID))
+	return result, nil
+}
+
+// UploadContent stores the content of a registered file and makes it
+// available. A failed transfer leaves the file pending, so it can be
+// retried with the same upload URL. mimeType is used when the registration
+// didn't claim a content type.
+func (s *Service) UploadContent(ctx context.Context, id, signature, mimeType string, content io.Reader) (*UploadResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.UploadContent")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+
+	expected := s.createSignature(uploadPayload(id))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if err := awaitingContent(file); err != nil {
+		return nil, err
+	}
+
+	// Claiming the file makes concurrent uploads of its content fail
+	if err := s.transition(ctx, file, StatusProcessing); err != nil {
+		return nil, ErrUploadInProgress
+	}
+
+	claimed := file.MimeType
+	if claimed == "" {
+		claimed = mimeType
+	}
+	content, done := s.progress.track(id, content)
+	defer done()
+	return s.completeContent(ctx, file, claimed, content)
+}
+
+// awaitingContent checks that a registered file still waits for its content
+func awaitingContent(file *File) error {
+	switch file.Status {
+	case StatusPending:
+		return nil
+	case StatusProcessing:
+		return ErrUploadInProgress
+	case StatusFailed:
+		return ErrUploadFailed
+	default:
+		return ErrUploadComplete
+	}
+}
+
+// completeContent stores the content of a registered file claimed for
+// processing and makes the file available. On failure the file is pending
+// again, so the upload can be retried.
+func (s *Service) completeContent(ctx context.Context, file *File, claimedMimeType string, content io.Reader) (*UploadResult, error) {
+	return s.completeWith(ctx, file, func() error {
+		return s.storeContent(ctx, file, claimedMimeType, content)
+	})
+}
+
+// completeWith completes a registered file claimed for processing, as
+// completeContent does, with its content stored by store
+func (s *Service) completeWith(ctx context.Context, file *File, store func() error) (*UploadResult, error) {
+	id := file.ID
+	if err := store(); err != nil {
+		// Let the client retry, even if the request was cancelled
+		s.repo.SetStatus(context.WithoutCancel(ctx), id, StatusProcessing, StatusPending)
+		return nil, err
+	}
+
+	// The TTL runs from when the content arrived
+	now := time.Now()
+	file.ExpiresAt = now.Add(file.ExpiresAt.Sub(file.CreatedAt))
+	file.CreatedAt = now
+	file.Status = StatusActive
+	if file.IsInfected() {
+		file.Status = StatusQuarantined
+	}
+
+	if err := s.repo.CompleteUpload(ctx, file); err != nil {
+		// A retry overwrites the content of a file still processing, but the
+		// content of one that failed meanwhile would never be reclaimed
+		cleanupCtx := context.WithoutCancel(ctx)
+		if err := s.repo.SetStatus(cleanupCtx, id, StatusProcessing, StatusPending); err != nil {
+			s.storage.Delete(cleanupCtx, id)
+		}
+		return nil, fmt.Errorf("failed to complete upload: %w", err)
+	}
+
+	s.notify(notify.EventFileUploaded, fmt.Sprintf("File %s uploaded", file.Name), file)
+	s.metrics.Uploaded(file.Tag, file.Size)
+	s.prefetchFile(file)
+
+	return s.uploadResult(file)
+}
+
+// uploadPayload is the signed representation of a file's upload URL. Download
+// payloads never start with "upload|", so the URLs can't be swapped.
+func uploadPayload(id string) string {
+	return "upload|" + id
+}
+
+// newFile builds the metadata of an upload from the request, before its
+// content is known
+func (s *Service) newFile(req *UploadRequest) (*File, error) {
+	if err := validateLink(req.Link); err != nil {
+		return nil, err
+	}
+	if err := validateAttributes(req.Attributes); err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(s.ttl.Load())
+	if req.TTL > 0 {
+		ttl = req.TTL
+	}
+
+	var passwordHash string
+	if req.Password != "" {
+		var err error
+		passwordHash, err = hashPassword(req.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	name, err := s.applyFilenameTemplate(req.Tag, SanitizeFilename(req.Name), req.Attributes, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		ID:           s.generateID(),
+		Name:         name,
+		Tag:          req.Tag,
+		Description:  req.Description,
+		Link:         req.Link,
+		Pinned:       req.Pinned,
+		Public:       req.Public,
+		Status:       StatusActive,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+		PasswordHash: passwordHash,
+		Attributes:   req.Attributes,
+		Origin:       req.Origin.normalize(),
 	}, nil
 }
 
-// GetLatestByTag retrieves the latest file by tag
-func (s *Service) GetLatestByTag(tag string) (*UploadResult, error) {
-	file, err := s.repo.FindByTag(tag)
+// storeContent checks content against the content type policy and the
+// virus scan and saves it, filling in the file's size, content types,
+// checksum and scan result. The content is streamed to storage, counted,
+// hashed and scanned on the way rather than held in memory, so content the
+// scan refuses is deleted again once stored.
+func (s *Service) storeContent(ctx context.Context, file *File, claimedMimeType string, content io.Reader) error {
+	// Sniff the actual content type from the first bytes and check it
+	// against the policy
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read content: %w", err)
+	}
+	head = head[:n]
+	detected := detectMimeType(head)
+	if err := s.mimePolicy.check(claimedMimeType, detected); err != nil {
+		return err
+	}
+
+	// Fall back to the sniffed type when the client didn't claim one
+	mimeType := claimedMimeType
+	if claimed := BaseMimeType(mimeType); claimed == "" || claimed == "application/octet-stream" {
+		mimeType = detected
+	}
+
+	if err := s.checkFreeSpace(int64(n)); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	counter := &byteCounter{}
+	content = io.TeeReader(io.MultiReader(bytes.NewReader(head), content), io.MultiWriter(hash, counter))
+
+	// The scanner reads along as the content is saved
+	var feed *scanFeed
+	var scanned chan error
+	if s.scanner != nil {
+		pr, pw := io.Pipe()
+		feed = &scanFeed{w: pw}
+		scanned = make(chan error, 1)
+		go func() {
+			err := s.scan(ctx, file, pr)
+			pr.Close()
+			scanned <- err
+		}()
+		content = io.TeeReader(content, feed)
+	}
+
+	stored, err := s.storage.Save(ctx, file.ID, file.Name, mimeType, content)
+	if feed != nil {
+		feed.w.CloseWithError(err)
+		if scanErr := <-scanned; scanErr != nil && err == nil {
+			s.storage.Delete(context.WithoutCancel(ctx), file.ID)
+			return scanErr
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to find file by tag: %w", err)
+		return fmt.Errorf("failed to save file: %w", err)
 	}
 
-	if time.Now().After(file.ExpiresAt) {
-		s.storage.Delete(file.ID)
-		s.repo.Delete(file.ID)
-		return nil, fmt.Errorf("file has expired")
+	// The size is only known once saved, so content that took the stash
+	// below the watermark is removed again
+	if err := s.checkFreeSpace(0); err != nil {
+		s.storage.Delete(context.WithoutCancel(ctx), file.ID)
+		return err
 	}
 
-	url, err := s.generateSignedURL(file.ID)
+	file.Size = counter.n
+	file.StoredSize = stored.Size
+	file.MimeType = mimeType
+	file.DetectedMimeType = detected
+	file.Checksum = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// scanFeed passes content on to the scanner until it stops reading, without
+// failing the save the content is teed off from
+type scanFeed struct {
+	w       *io.PipeWriter
+	stopped bool
+}
+
+func (f *scanFeed) Write(p []byte) (int, error) {
+	if !f.stopped {
+		if _, err := f.w.Write(p); err != nil {
+			f.stopped = true
+		}
+	}
+	return len(p), nil
+}
+
+// uploadResult builds the result of an upload with a signed URL and, when
+// enabled, a receipt
+func (s *Service) uploadResult(file *File) (*UploadResult, error) {
+	url, err := s.generateSignedURL(file.ID, LinkOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate signed URL: %w", err)
 	}
 
-	return &UploadResult{
-		ID:        file.ID,
-		Name:      file.Name,
-		Tag:       file.Tag,
-		Size:      file.Size,
-		MimeType:  file.MimeType,
-		CreatedAt: file.CreatedAt,
-		ExpiresAt: file.ExpiresAt,
-		URL:       url,
-	}, nil
+	result := newUploadResult(file, url)
+	if s.receipts != nil {
+		receipt, err := s.receipts.Sign(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign receipt: %w", err)
+		}
+		result.Receipt = receipt
+	}
+
+	return result, nil
 }
 
-// Download retrieves a file by ID with signature verification
-func (s *Service) Download(id string, signature string) (*File, io.ReadCloser, error) {
-	// Verify signature
-	if !s.verifySignature(id, signature) {
-		return nil, nil, fmt.Errorf("invalid signature")
+// ReceiptKey returns the public key upload receipts are signed with, or false
+// when receipts are disabled
+func (s *Service) ReceiptKey() (JWK, bool) {
+	if s.receipts == nil {
+		return JWK{}, false
+	}
+	return s.receipts.PublicJWK(), true
+}
+
+// BatchUploadResult is the outcome of uploading a single file of a batch
+type BatchUploadResult struct {
+	Name  string        `json:"name"`
+	File  *UploadResult `json:"file,omitempty"`
+	Error string        `json:"error,omitempty"`
+
+	err error
+}
+
+// Err returns the error the file failed with, if any
+func (r *BatchUploadResult) Err() error {
+	return r.err
+}
+
+// UploadBatch stores the files next returns, one after the other until it
+// returns nil, so their content can stream in. In atomic mode the first
+// failure removes every file already stored by the batch and is returned as
+// an error; otherwise each file is uploaded independently and failures are
+// reported per file. An error of next ends the batch and is returned, with
+// the files stored so far removed in either mode.
+func (s *Service) UploadBatch(ctx context.Context, next func() (*UploadRequest, error), atomic bool) ([]*BatchUploadResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.UploadBatch")
+	defer span.End()
+
+	var results []*BatchUploadResult
+	rollback := func() {
+		// Roll back even if the request was cancelled
+		for _, uploaded := range results {
+			if uploaded.File != nil {
+				s.Delete(context.WithoutCancel(ctx), "", uploaded.File.ID, "batch rolled back")
+			}
+		}
+	}
+	for {
+		req, err := next()
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if req == nil {
+			return results, nil
+		}
+
+		result, err := s.Upload(ctx, req)
+		if err != nil {
+			if atomic {
+				rollback()
+				return nil, fmt.Errorf("failed to upload %s: %w", req.Name, err)
+			}
+			results = append(results, &BatchUploadResult{Name: req.Name, Error: err.Error(), err: err})
+			continue
+		}
+		results = append(results, &BatchUploadResult{Name: req.Name, File: result})
+	}
+}
+
+// GetLatestByTag retrieves the file that was the latest with the tag at asOf,
+// or right now when asOf is zero. Only files still stored are considered.
+func (s *Service) GetLatestByTag(ctx context.Context, tag string, asOf time.Time) (*UploadResult, error) {
+	ctx, span := tracer.Start(ctx, "Service.GetLatestByTag")
+	defer span.End()
+
+	file, err := s.latestByTag(ctx, tag, asOf)
+	if err != nil {
+		return nil, err
+	}
+
+	url, err := s.generateSignedURL(file.ID, LinkOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signed URL: %w", err)
+	}
+
+	return newUploadResult(file, url), nil
+}
+
+// DownloadLatestByTag retrieves the content of the file that was the latest
+// with the tag at asOf, as following the signed URL of GetLatestByTag would.
+// Protected files still need their password.
+func (s *Service) DownloadLatestByTag(ctx context.Context, tag string, asOf time.Time, password string) (*File, io.ReadCloser, error) {
+	ctx, span := tracer.Start(ctx, "Service.DownloadLatestByTag")
+	defer span.End()
+
+	latest, err := s.latestByTag(ctx, tag, asOf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, content, err := s.download(ctx, latest.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkPassword(file, password); err != nil {
+		content.Close()
+		return nil, nil, err
+	}
+	if content, err = s.slowStart.admit(file, content, time.Now()); err != nil {
+		return nil, nil, err
 	}
 
+	s.metrics.Downloaded(file.Tag, file.Size)
+	return file, s.track(ctx, file, s.throttle.Load().limit(ctx, content)), nil
+}
+
+// latestByTag finds the file that was the latest with the tag at asOf, or
+// right now when asOf is zero, purging it when it expired. With the stale
+// tag fallback, an expired latest file gives way to the most recent of the
+// tag's files that hasn't expired.
+func (s *Service) latestByTag(ctx context.Context, tag string, asOf time.Time) (*File, error) {
+	now := time.Now()
+	if asOf.IsZero() {
+		asOf = now
+	}
+
+	file, err := s.repo.FindByTag(ctx, tag, asOf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find file by tag: %w", err)
+	}
+	if !file.IsExpired(now) {
+		return file, nil
+	}
+
+	s.purge(ctx, file)
+	if !s.staleTagFallback {
+		return nil, ErrExpired
+	}
+	fallback, err := s.repo.FindLatestNonExpiredByTag(ctx, tag, asOf, now)
+	if err != nil {
+		return nil, fmt.Errorf("%w and no earlier file with the tag is left: %w", ErrExpired, err)
+	}
+	slog.Info("Latest file of tag expired, falling back to an earlier one", "tag", tag, "expired_id", file.ID, "file_id", fallback.ID)
+	return fallback, nil
+}
+
+// Download retrieves a file by ID with signature verification. The options
+// must match those the link was signed with. Public files are downloaded
+// without a signature too.
+func (s *Service) Download(ctx context.Context, id string, signature string, opts LinkOptions) (*File, io.ReadCloser, error) {
+	ctx, span := tracer.Start(ctx, "Service.Download")
+	defer span.End()
+
+	link, err := s.verifyLink(ctx, id, opts, signature)
+	if err != nil && !(signature == "" && s.isPublic(ctx, id)) {
+		return nil, nil, err
+	}
+
+	file, content, err := s.download(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkPassword(file, opts.Password); err != nil {
+		content.Close()
+		return nil, nil, err
+	}
+	if content, err = s.slowStart.admit(file, content, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	use, err := s.useLink(ctx, link, opts)
+	if err != nil {
+		content.Close()
+		return nil, nil, err
+	}
+
+	s.metrics.Downloaded(file.Tag, file.Size)
+	return file, use.wrap(s.track(ctx, file, s.throttle.Load().limit(ctx, content))), nil
+}
+
+// isPublic reports whether a file may be downloaded without a signature
+func (s *Service) isPublic(ctx context.Context, id string) bool {
+	file, err := s.repo.FindByID(ctx, id)
+	return err == nil && file.Public
+}
+
+// Open retrieves a file for callers that are already authorized, such as
+// admin API clients, without requiring a signed link
+func (s *Service) Open(ctx context.Context, id string) (*File, io.ReadCloser, error) {
+	ctx, span := tracer.Start(ctx, "Service.Open")
+	defer span.End()
+
+	file, content, err := s.download(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.metrics.Downloaded(file.Tag, file.Size)
+	return file, s.track(ctx, file, s.throttle.Load().limit(ctx, content)), nil
+}
+
+// download loads metadata and content of a non-expired file
+func (s *Service) download(ctx context.Context, id string) (*File, io.ReadCloser, error) {
 	// Check if file exists in repository
-	file, err := s.repo.FindByID(id)
+	file, err := s.repo.FindByID(ctx, id)
 	if err != nil {
 		return nil, nil, fmt.Errorf("file not found: %w", err)
 	}
 
 	// Check if file is expired
-	if time.Now().After(file.ExpiresAt) {
+	if file.IsExpired(time.Now()) {
 		// Clean up expired file
-		s.storage.Delete(id)
-		s.repo.Delete(id)
-		return nil, nil, fmt.Errorf("file has expired")
+		s.purge(ctx, file)
+		return nil, nil, ErrExpired
+	}
+
+	// Registered, quarantined and trashed files can't be downloaded
+	if err := checkDownloadable(file); err != nil {
+		return nil, nil, err
+	}
+
+	// Metadata may outlive its content if storage was cleaned up by hand
+	exists, err := s.storage.Exists(ctx, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check file content: %w", err)
+	}
+	if !exists {
+		return nil, nil, fmt.Errorf("%w: content is missing", ErrNotFound)
 	}
 
 	// Get file content from storage
-	content, err := s.storage.GetContent(id)
+	content, err := s.storage.GetContent(ctx, id)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to retrieve file content: %w", err)
 	}
@@ -162,75 +835,450 @@ func (s *Service) Download(id string, signature string) (*File, io.ReadCloser, e
 	return file, content, nil
 }
 
-// Delete removes a file by ID
-func (s *Service) Delete(id string) error {
+// Delete removes a file by ID, leaving a tombstone recording that user
+// deleted it for reason
+func (s *Service) Delete(ctx context.Context, user, id, reason string) error {
+	ctx, span := tracer.Start(ctx, "Service.Delete")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return err
+	}
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("file not found: %w", err)
+	}
+
+	// Delete cached thumbnails before their metadata goes with the file
+	if err := s.deleteThumbnails(ctx, id); err != nil {
+		return err
+	}
+
 	// Delete from storage
-	if err := s.storage.Delete(id); err != nil {
+	if err := s.storage.Delete(ctx, id); err != nil {
 		return fmt.Errorf("failed to delete file from storage: %w", err)
 	}
 
-	// Delete metadata from repository
-	if err := s.repo.Delete(id); err != nil {
+	// Delete metadata from repository. A concurrent delete of the file may
+	// have got here first, and leaves the tombstone.
+	err = s.repo.Delete(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("file not found: %w", err)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to delete file metadata: %w", err)
 	}
+	s.bury(ctx, file, user, reason)
 
+	s.notify(notify.EventFileDeleted, fmt.Sprintf("File %s deleted", id), map[string]string{"id": id})
 	return nil
 }
 
-// List retrieves all files
-func (s *Service) List() ([]*File, error) {
-	files, err := s.repo.List()
+// Update changes the metadata of a file
+func (s *Service) Update(ctx context.Context, id string, req *UpdateRequest) (*File, error) {
+	ctx, span := tracer.Start(ctx, "Service.Update")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	now := time.Now()
+	previousTag := file.Tag
+	if req.Description != nil {
+		file.Description = *req.Description
+	}
+	if req.Link != nil {
+		if err := validateLink(*req.Link); err != nil {
+			return nil, err
+		}
+		file.Link = *req.Link
+	}
+	if req.Public != nil {
+		file.Public = *req.Public
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return nil, ErrInvalidExpiry
+		}
+		file.ExpiresAt = *req.ExpiresAt
+	}
+	if req.Attributes != nil {
+		attrs := make(map[string]string, len(file.Attributes)+len(req.Attributes))
+		maps.Copy(attrs, file.Attributes)
+		for key, value := range req.Attributes {
+			if value == nil {
+				delete(attrs, key)
+			} else {
+				attrs[key] = *value
+			}
+		}
+		if err := validateAttributes(attrs); err != nil {
+			return nil, err
+		}
+		file.Attributes = attrs
+	}
+
+	// A renamed file must follow the template of its tag, while a retagged
+	// one is renamed after the template when its name doesn't
+	if req.Tag != nil {
+		file.Tag = *req.Tag
+	}
+	if req.Name != nil {
+		file.Name = SanitizeFilename(*req.Name)
+		if err := s.checkFilenameTemplate(file.Tag, file.Name); err != nil {
+			return nil, err
+		}
+	} else if req.Tag != nil {
+		if file.Name, err = s.applyFilenameTemplate(file.Tag, file.Name, file.Attributes, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.repo.Update(ctx, file); err != nil {
+		return nil, fmt.Errorf("failed to update file metadata: %w", err)
+	}
+
+	if file.Tag != previousTag {
+		s.notify(notify.EventTagUpdated, fmt.Sprintf("File %s tagged %q", file.Name, file.Tag), map[string]string{"id": file.ID, "tag": file.Tag, "previous_tag": previousTag})
+	}
+	return file, nil
+}
+
+// Pin exempts a file from expiry until it is unpinned or deleted
+func (s *Service) Pin(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Service.Pin")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return err
+	}
+
+	if err := s.repo.SetPinned(ctx, id, true); err != nil {
+		return fmt.Errorf("failed to pin file: %w", err)
+	}
+	return nil
+}
+
+// Unpin makes a file subject to its regular expiry again
+func (s *Service) Unpin(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Service.Unpin")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return err
+	}
+
+	if err := s.repo.SetPinned(ctx, id, false); err != nil {
+		return fmt.Errorf("failed to unpin file: %w", err)
+	}
+	return nil
+}
+
+// List retrieves the files matching the filter. Starred filters on the
+// files starred by user.
+func (s *Service) List(ctx context.Context, user string, filter ListFilter) ([]*File, error) {
+	ctx, span := tracer.Start(ctx, "Service.List")
+	defer span.End()
+
+	var files []*File
+	var err error
+	if filter.Starred {
+		files, err = s.repo.ListStarred(ctx, user)
+	} else {
+		files, err = s.repo.List(ctx)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to list files: %w", err)
 	}
 
-	// Filter out expired files
+	var matched []*File
+	now := time.Now()
+	for _, file := range s.filterExpired(ctx, files) {
+		if filter.Match(file, now) {
+			matched = append(matched, file)
+		}
+	}
+
+	return matched, nil
+}
+
+// FindByName returns the files with a tag, or the untagged ones for an
+// empty tag, and a name that haven't expired, oldest first
+func (s *Service) FindByName(ctx context.Context, tag, name string) ([]*File, error) {
+	ctx, span := tracer.Start(ctx, "Service.FindByName")
+	defer span.End()
+
+	fileList, err := s.repo.FindByName(ctx, tag, name)
+	if err != nil {
+		return nil, err
+	}
+	fileList = s.filterExpired(ctx, fileList)
+	slices.SortFunc(fileList, func(a, b *File) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	return fileList, nil
+}
+
+// Star bookmarks a file for a user
+func (s *Service) Star(ctx context.Context, user, id string) error {
+	ctx, span := tracer.Start(ctx, "Service.Star")
+	defer span.End()
+
+	if _, err := s.repo.FindByID(ctx, id); err != nil {
+		return fmt.Errorf("file not found: %w", err)
+	}
+
+	if err := s.repo.Star(ctx, user, id); err != nil {
+		return fmt.Errorf("failed to star file: %w", err)
+	}
+	return nil
+}
+
+// Unstar removes a user's bookmark from a file
+func (s *Service) Unstar(ctx context.Context, user, id string) error {
+	ctx, span := tracer.Start(ctx, "Service.Unstar")
+	defer span.End()
+
+	if err := s.repo.Unstar(ctx, user, id); err != nil {
+		return fmt.Errorf("failed to unstar file: %w", err)
+	}
+	return nil
+}
+
+// SaveSearch stores a named list filter given in query string form,
+// replacing any existing search with the same name
+func (s *Service) SaveSearch(ctx context.Context, name, query string) (*SavedSearch, error) {
+	ctx, span := tracer.Start(ctx, "Service.SaveSearch")
+	defer span.End()
+
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidSearch)
+	}
+
+	search := &SavedSearch{Name: name, Query: query, CreatedAt: time.Now()}
+	if _, err := search.Filter(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSearch, err)
+	}
+
+	if err := s.repo.SaveSearch(ctx, search); err != nil {
+		return nil, fmt.Errorf("failed to save search: %w", err)
+	}
+
+	return search, nil
+}
+
+// GetSavedSearch retrieves a saved search by name
+func (s *Service) GetSavedSearch(ctx context.Context, name string) (*SavedSearch, error) {
+	ctx, span := tracer.Start(ctx, "Service.GetSavedSearch")
+	defer span.End()
+
+	search, err := s.repo.FindSavedSearch(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find saved search: %w", err)
+	}
+	return search, nil
+}
+
+// ListSavedSearches retrieves all saved searches
+func (s *Service) ListSavedSearches(ctx context.Context) ([]*SavedSearch, error) {
+	ctx, span := tracer.Start(ctx, "Service.ListSavedSearches")
+	defer span.End()
+
+	searches, err := s.repo.ListSavedSearches(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved searches: %w", err)
+	}
+	return searches, nil
+}
+
+// DeleteSavedSearch removes a saved search by name
+func (s *Service) DeleteSavedSearch(ctx context.Context, name string) error {
+	ctx, span := tracer.Start(ctx, "Service.DeleteSavedSearch")
+	defer span.End()
+
+	if err := s.repo.DeleteSavedSearch(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete saved search: %w", err)
+	}
+	return nil
+}
+
+// AddComment attaches a markdown comment by author to a file
+func (s *Service) AddComment(ctx context.Context, fileID, author, body string) (*Comment, error) {
+	ctx, span := tracer.Start(ctx, "Service.AddComment")
+	defer span.End()
+
+	if strings.TrimSpace(body) == "" {
+		return nil, ErrEmptyComment
+	}
+
+	if _, err := s.repo.FindByID(ctx, fileID); err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	comment := &Comment{
+		ID:        s.generateID(),
+		FileID:    fileID,
+		Author:    author,
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateComment(ctx, comment); err != nil {
+		return nil, fmt.Errorf("failed to save comment: %w", err)
+	}
+
+	return comment, nil
+}
+
+// ListComments retrieves the comments on a file, oldest first
+func (s *Service) ListComments(ctx context.Context, fileID string) ([]*Comment, error) {
+	ctx, span := tracer.Start(ctx, "Service.ListComments")
+	defer span.End()
+
+	if _, err := s.repo.FindByID(ctx, fileID); err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	comments, err := s.repo.ListComments(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list comments: %w", err)
+	}
+	return comments, nil
+}
+
+// DeleteComment removes a comment from a file
+func (s *Service) DeleteComment(ctx context.Context, fileID, id string) error {
+	ctx, span := tracer.Start(ctx, "Service.DeleteComment")
+	defer span.End()
+
+	if err := s.repo.DeleteComment(ctx, fileID, id); err != nil {
+		return fmt.Errorf("failed to delete comment: %w", err)
+	}
+	return nil
+}
+
+// filterExpired drops expired files from the list, cleaning them up
+func (s *Service) filterExpired(ctx context.Context, files []*File) []*File {
 	var validFiles []*File
 	now := time.Now()
 	for _, file := range files {
-		if now.Before(file.ExpiresAt) {
+		if !file.IsExpired(now) {
 			validFiles = append(validFiles, file)
 		} else {
 			// Clean up expired file
-			s.storage.Delete(file.ID)
-			s.repo.Delete(file.ID)
+			s.purge(ctx, file)
 		}
 	}
 
-	return validFiles, nil
+	return validFiles
 }
 
-// generateID creates a unique file identifier
-func (s *Service) generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+// PurgeExpired removes all expired files and returns how many were removed.
+// Nothing is removed while the stash is read-only.
+func (s *Service) PurgeExpired(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.PurgeExpired")
+	defer span.End()
+
+	if s.Mode().ReadOnly {
+		return 0, nil
+	}
+
+	fileIDs, thumbnailIDs, err := s.repo.CleanupExpired(ctx, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean up expired files: %w", err)
+	}
+
+	// Content left behind by a failed delete is unreachable without its
+	// metadata, so deletion errors are only logged
+	for _, id := range append(thumbnailIDs, fileIDs...) {
+		if err := s.storage.Delete(ctx, id); err != nil {
+			slog.Error("Failed to delete expired content", "storage_id", id, "error", err)
+		}
+	}
+	for _, id := range fileIDs {
+		s.notify(notify.EventFileExpired, fmt.Sprintf("File %s expired", id), map[string]string{"id": id})
+	}
+
+	return len(fileIDs), nil
 }
 
-// calculateSize reads the content to determine file size
-func (s *Service) calculateSize(content io.Reader) (int64, []byte, error) {
-	// This is a simplified implementation
-	// In a real scenario, you might want to use a more efficient method
-	data, err := io.ReadAll(content)
+// FailStalledUploads marks registered files whose content didn't arrive
+// within the upload timeout as failed, deletes any content stored for them
+// and returns how many failed. Failed files stay listed until they expire.
+func (s *Service) FailStalledUploads(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.FailStalledUploads")
+	defer span.End()
+
+	if s.uploadTimeout <= 0 || s.Mode().ReadOnly {
+		return 0, nil
+	}
+
+	ids, err := s.repo.FailStalledUploads(ctx, time.Now().Add(-s.uploadTimeout))
 	if err != nil {
-		return 0, nil, err
+		return 0, fmt.Errorf("failed to fail stalled uploads: %w", err)
 	}
-	return int64(len(data)), data, nil
+
+	// A transfer may have stored content before it broke off
+	for _, id := range ids {
+		if err := s.storage.Delete(ctx, id); err != nil {
+			slog.Error("Failed to delete content of failed upload", "file_id", id, "error", err)
+		}
+	}
+
+	return len(ids), nil
 }
 
-// generateSignedURL creates a signed URL for file access
-func (s *Service) generateSignedURL(id string) (string, error) {
-	signature := s.createSignature(id)
-	return fmt.Sprintf("/v1/files/%s?signature=%s", id, signature), nil
+// purge removes an expired file and everything derived from it, ignoring
+// errors since the next access or the janitor will retry. The file is
+// marked expired first, so it stays hidden if removing it fails. Expired
+// files are left alone while the stash is read-only.
+func (s *Service) purge(ctx context.Context, file *File) {
+	if s.Mode().ReadOnly {
+		return
+	}
+	if file.Status != StatusExpired {
+		s.transition(ctx, file, StatusExpired)
+	}
+	s.deleteThumbnails(ctx, file.ID)
+	s.storage.Delete(ctx, file.ID)
+	if err := s.repo.Delete(ctx, file.ID); err == nil {
+		s.bury(ctx, file, "", ReasonExpired)
+		s.notify(notify.EventFileExpired, fmt.Sprintf("File %s expired", file.ID), map[string]string{"id": file.ID})
+	}
 }
 
-// createSignature generates HMAC signature for file ID
-func (s *Service) createSignature(id string) string {
-	h := hmac.New(sha256.New, []byte(s.hmacKey))
-	h.Write([]byte(id))
-	return hex.EncodeToString(h.Sum(nil))
+// notify sends an event in the background so slow sinks don't hold up requests
+func (s *Service) notify(eventType, message string, data any) {
+	if s.notifier == nil {
+		return
+	}
+	event := notify.NewEvent(eventType, message, data)
+	go func() {
+		if err := s.notifier.Notify(context.Background(), event); err != nil {
+			slog.Error("Notification failed", "event", eventType, "error", err)
+		}
+	}()
 }
 
-// verifySignature validates HMAC signature for file ID
-func (s *Service) verifySignature(id string, signature string) bool {
-	expectedSignature := s.createSignature(id)
-	return hmac.Equal([]byte(signature), []byte(expectedSignature))
+// validateLink checks that an optional external link is an absolute HTTP(S) URL
+func validateLink(link string) error {
+	if link == "" {
+		return nil
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidLink
+	}
+	return nil
+}
+
+// generateID creates a unique file identifier
+func (s *Service) generateID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
@@ -0,0 +1,71 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrSlowStart is returned when a newly uploaded file already serves as many
+// concurrent downloads as its slow start allows
+var ErrSlowStart = errors.New("too many concurrent downloads of a new file, retry later")
+
+// slowStart caps the concurrent downloads of each file during the window
+// after its upload, protecting the origin from the rush after a release
+type slowStart struct {
+	window time.Duration
+	limit  int
+
+	mu     sync.Mutex
+	active map[string]int // downloads in flight by file ID
+}
+
+// WithSlowStart allows at most limit concurrent downloads of a file during
+// the window after its upload. A zero window or limit disables the cap.
+func WithSlowStart(window time.Duration, limit int) Option {
+	return func(s *Service) {
+		if window > 0 && limit > 0 {
+			s.slowStart = &slowStart{window: window, limit: limit, active: make(map[string]int)}
+		}
+	}
+}
+
+// admit counts a download of file until content is closed, failing with
+// ErrSlowStart when the file is new and at its cap. Content is closed when
+// the download isn't admitted.
+func (l *slowStart) admit(file *File, content io.ReadCloser, now time.Time) (io.ReadCloser, error) {
+	if l == nil || now.Sub(file.CreatedAt) >= l.window {
+		return content, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[file.ID] >= l.limit {
+		content.Close()
+		return nil, ErrSlowStart
+	}
+	l.active[file.ID]++
+	return &admittedContent{ReadCloser: content, release: func() { l.release(file.ID) }}, nil
+}
+
+// release ends a download admitted for a file
+func (l *slowStart) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[id]--; l.active[id] <= 0 {
+		delete(l.active, id)
+	}
+}
+
+// admittedContent releases its download's slot once closed
+type admittedContent struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (c *admittedContent) Close() error {
+	c.once.Do(c.release)
+	return c.ReadCloser.Close()
+}
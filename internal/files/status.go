@@ -0,0 +1,131 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// File lifecycle states.
+//
+//	pending     registered, waiting for its content
+//	processing  content is being uploaded
+//	active      stored and downloadable
+//	quarantined held back from downloads, e.g. pending review
+//	trashed     deleted by a user but still restorable until it expires
+//	expired     past its expiry and being purged
+//	failed      its content never arrived
+//
+// Only active files can be downloaded; downloads of the others fail with an
+// UnavailableError. Files whose status is empty were stored before statuses
+// existed and are active.
+const (
+	StatusPending     = "pending"
+	StatusProcessing  = "processing"
+	StatusActive      = "active"
+	StatusQuarantined = "quarantined"
+	StatusTrashed     = "trashed"
+	StatusExpired     = "expired"
+	StatusFailed      = "failed"
+)
+
+// transitions lists the states each state may move to. Expired is final:
+// expired files are removed together with their metadata.
+var transitions = map[string][]string{
+	StatusPending:     {StatusProcessing, StatusFailed, StatusExpired},
+	StatusProcessing:  {StatusActive, StatusPending, StatusFailed, StatusExpired},
+	StatusActive:      {StatusQuarantined, StatusTrashed, StatusExpired},
+	StatusQuarantined: {StatusActive, StatusTrashed, StatusExpired},
+	StatusTrashed:     {StatusActive, StatusExpired},
+	StatusFailed:      {StatusExpired},
+}
+
+// ErrInvalidTransition is returned when a file can't move to a status from
+// its current one
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// UnavailableError is returned for downloads of files that exist but can't
+// be downloaded in their status, such as files waiting for their content or
+// quarantined ones. It counts as ErrNotFound for callers that don't tell
+// the two apart.
+type UnavailableError struct {
+	Status string
+}
+
+func (e *UnavailableError) Error() string {
+	return "file is " + e.Status
+}
+
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// CanTransition reports whether a file may move from one status to another
+func CanTransition(from, to string) bool {
+	if from == "" {
+		from = StatusActive
+	}
+	return slices.Contains(transitions[from], to)
+}
+
+// IsActive reports whether the file is stored and downloadable
+func (f *File) IsActive() bool {
+	return f.Status == StatusActive || f.Status == ""
+}
+
+// checkDownloadable fails with an UnavailableError for files that aren't
+// active
+func checkDownloadable(file *File) error {
+	if !file.IsActive() {
+		return &UnavailableError{Status: file.Status}
+	}
+	return nil
+}
+
+// SetStatus moves a file to a status, such as quarantining, trashing or
+// restoring it. Uploads drive the pending, processing and failed states and
+// expiry the expired state, so those can't be set directly.
+func (s *Service) SetStatus(ctx context.Context, id, status string) (*File, error) {
+	ctx, span := tracer.Start(ctx, "Service.SetStatus")
+	defer span.End()
+
+	if err := s.CheckWritable(); err != nil {
+		return nil, err
+	}
+	switch status {
+	case StatusActive, StatusQuarantined, StatusTrashed:
+	default:
+		return nil, fmt.Errorf("%w: status %q can't be set", ErrInvalidTransition, status)
+	}
+
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+	if err := s.transition(ctx, file, status); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// transition moves a file to a status, failing when the transition isn't
+// allowed or the file's status changed since it was loaded
+func (s *Service) transition(ctx context.Context, file *File, status string) error {
+	if !CanTransition(file.Status, status) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, statusOrActive(file.Status), status)
+	}
+	if err := s.repo.SetStatus(ctx, file.ID, file.Status, status); err != nil {
+		return fmt.Errorf("failed to update file status: %w", err)
+	}
+	file.Status = status
+	return nil
+}
+
+// statusOrActive names the status of files stored before statuses existed
+func statusOrActive(status string) string {
+	if status == "" {
+		return StatusActive
+	}
+	return status
+}
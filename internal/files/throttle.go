@@ -0,0 +1,122 @@
+package files
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most content read at once from a throttled download,
+// keeping the waits between reads short and the transfer smooth
+const throttleChunk = 16 * 1024
+
+// throttle limits download bandwidth: each download to perDownload bytes per
+// second and, through the shared total bucket, all downloads together
+type throttle struct {
+	perDownload int64
+	total       *bucket
+}
+
+// WithBandwidthLimits caps each download at perDownload bytes per second and
+// all downloads together at total bytes per second. Zero leaves either
+// unlimited. A client holds one download per connection at a time, so the
+// per download cap is also its per connection cap.
+func WithBandwidthLimits(perDownload, total int64) Option {
+	return func(s *Service) {
+		s.SetBandwidthLimits(perDownload, total)
+	}
+}
+
+// SetBandwidthLimits changes the bandwidth limits at runtime; see
+// WithBandwidthLimits. Downloads in progress keep the limits they started
+// with.
+func (s *Service) SetBandwidthLimits(perDownload, total int64) {
+	if perDownload <= 0 && total <= 0 {
+		s.throttle.Store(nil)
+		return
+	}
+	t := &throttle{perDownload: perDownload}
+	if total > 0 {
+		t.total = newBucket(total)
+	}
+	s.throttle.Store(t)
+}
+
+// limit wraps content so reading it waits for the bandwidth limits, giving
+// up when ctx is done
+func (t *throttle) limit(ctx context.Context, content io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return content
+	}
+	throttled := &throttledContent{ReadCloser: content, ctx: ctx}
+	if t.perDownload > 0 {
+		throttled.buckets = append(throttled.buckets, newBucket(t.perDownload))
+	}
+	if t.total != nil {
+		throttled.buckets = append(throttled.buckets, t.total)
+	}
+	return throttled
+}
+
+// throttledContent waits after each read until the buckets have made up for
+// the bytes read
+type throttledContent struct {
+	io.ReadCloser
+	ctx     context.Context
+	buckets []*bucket
+}
+
+func (c *throttledContent) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := c.ReadCloser.Read(p)
+	for _, b := range c.buckets {
+		if waitErr := b.wait(c.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// bucket is a token bucket refilled at rate bytes per second, holding at
+// most one second worth of bytes
+type bucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens, going into debt if there aren't enough, and sleeps
+// until the debt is paid off
+func (b *bucket) wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate) - float64(n)
+	b.last = now
+	debt := b.tokens
+	b.mu.Unlock()
+
+	if debt >= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(-debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
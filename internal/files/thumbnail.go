@@ -0,0 +1,225 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxThumbnailDimension is the largest width or height a thumbnail may have
+const MaxThumbnailDimension = 2048
+
+// MaxThumbnailSourcePixels is the largest image, in pixels, thumbnails are
+// made of. Decoding holds the whole image in memory, so a small file
+// claiming huge dimensions could exhaust it otherwise.
+const MaxThumbnailSourcePixels = 50_000_000
+
+var (
+	// ErrInvalidThumbnailSize is returned for missing or out of bounds dimensions
+	ErrInvalidThumbnailSize = errors.New("invalid thumbnail size")
+
+	// ErrNotAnImage is returned when a thumbnail is requested for a non-image file
+	ErrNotAnImage = errors.New("file is not a supported image")
+
+	// ErrImageTooLarge is returned when an image has too many pixels to
+	// make a thumbnail of
+	ErrImageTooLarge = errors.New("image is too large for a thumbnail")
+)
+
+// ThumbnailSize is the box a thumbnail is fitted into. A zero dimension is
+// unconstrained, but at least one must be set.
+type ThumbnailSize struct {
+	Width  int
+	Height int
+}
+
+// Validate checks that the size is within bounds
+func (t ThumbnailSize) Validate() error {
+	if t.Width < 0 || t.Height < 0 || (t.Width == 0 && t.Height == 0) ||
+		t.Width > MaxThumbnailDimension || t.Height > MaxThumbnailDimension {
+		return ErrInvalidThumbnailSize
+	}
+	return nil
+}
+
+// String formats the size as "WxH"
+func (t ThumbnailSize) String() string {
+	return fmt.Sprintf("%dx%d", t.Width, t.Height)
+}
+
+// Thumbnail is the metadata of a generated thumbnail cached in storage
+type Thumbnail struct {
+	FileID    string
+	Width     int
+	Height    int
+	StorageID string
+	MimeType  string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// Thumbnail returns a resized version of an image file, generating it and
+// caching it in storage on first request. The signature must have been
+// issued for the same size, which opts.Thumbnail carries along with the
+// request's bindings.
+func (s *Service) Thumbnail(ctx context.Context, id, signature string, opts LinkOptions) (*Thumbnail, io.ReadCloser, error) {
+	ctx, span := tracer.Start(ctx, "Service.Thumbnail")
+	defer span.End()
+
+	if opts.Thumbnail == nil {
+		return nil, nil, ErrInvalidThumbnailSize
+	}
+	size := *opts.Thumbnail
+	if err := size.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	link, err := s.verifyLink(ctx, id, opts, signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Cached thumbnails are only served for files that could be downloaded,
+	// and those of protected files need the password too
+	file, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("file not found: %w", err)
+	}
+	if err := checkDownloadable(file); err != nil {
+		return nil, nil, err
+	}
+	if err := checkPassword(file, opts.Password); err != nil {
+		return nil, nil, err
+	}
+	use, err := s.useLink(ctx, link, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thumb, content, err := s.thumbnail(ctx, id, size)
+	if err != nil {
+		use.release()
+		return nil, nil, err
+	}
+	return thumb, use.wrap(content), nil
+}
+
+// thumbnail returns the cached thumbnail of a file in a size, generating and
+// caching it when there's none
+func (s *Service) thumbnail(ctx context.Context, id string, size ThumbnailSize) (*Thumbnail, io.ReadCloser, error) {
+	// Serve a cached thumbnail when one exists
+	if thumb, err := s.repo.FindThumbnail(ctx, id, size.Width, size.Height); err == nil {
+		content, err := s.storage.GetContent(ctx, thumb.StorageID)
+		if err == nil {
+			return thumb, content, nil
+		}
+	}
+
+	file, content, err := s.download(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer content.Close()
+
+	// Check the dimensions in the header before decoding the pixels, then
+	// decode from the start again
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(content, &header))
+	if err != nil {
+		return nil, nil, ErrNotAnImage
+	}
+	if int64(config.Width)*int64(config.Height) > MaxThumbnailSourcePixels {
+		return nil, nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, config.Width, config.Height)
+	}
+	src, format, err := image.Decode(io.MultiReader(&header, content))
+	if err != nil {
+		return nil, nil, ErrNotAnImage
+	}
+
+	// Keep JPEG as JPEG; everything else is encoded as PNG
+	var buf bytes.Buffer
+	mimeType := "image/png"
+	dst := resizeToFit(src, size)
+	if format == "jpeg" {
+		mimeType = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	thumb := &Thumbnail{
+		FileID:    id,
+		Width:     size.Width,
+		Height:    size.Height,
+		StorageID: fmt.Sprintf("%s.thumb-%s", id, size),
+		MimeType:  mimeType,
+		Size:      int64(buf.Len()),
+		CreatedAt: time.Now(),
+	}
+
+	// Serve without caching while nothing may be written
+	if s.Mode().ReadOnly {
+		return thumb, io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+
+	if _, err := s.storage.Save(ctx, thumb.StorageID, file.Name, mimeType, bytes.NewReader(buf.Bytes())); err != nil {
+		return nil, nil, fmt.Errorf("failed to save thumbnail: %w", err)
+	}
+	if err := s.repo.CreateThumbnail(ctx, thumb); err != nil {
+		s.storage.Delete(context.WithoutCancel(ctx), thumb.StorageID)
+		return nil, nil, fmt.Errorf("failed to save thumbnail metadata: %w", err)
+	}
+
+	return thumb, io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+}
+
+// deleteThumbnails removes every cached thumbnail of a file from storage
+func (s *Service) deleteThumbnails(ctx context.Context, id string) error {
+	thumbs, err := s.repo.ListThumbnails(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to list thumbnails: %w", err)
+	}
+	for _, thumb := range thumbs {
+		if err := s.storage.Delete(ctx, thumb.StorageID); err != nil {
+			return fmt.Errorf("failed to delete thumbnail: %w", err)
+		}
+	}
+	return nil
+}
+
+// resizeToFit scales an image down to fit the size, preserving its aspect
+// ratio. Images that already fit are returned unchanged.
+func resizeToFit(src image.Image, size ThumbnailSize) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	scale := 1.0
+	if size.Width > 0 && width > size.Width {
+		scale = float64(size.Width) / float64(width)
+	}
+	if size.Height > 0 && height > size.Height {
+		scale = min(scale, float64(size.Height)/float64(height))
+	}
+	if scale == 1.0 {
+		return src
+	}
+
+	dstWidth := max(1, int(float64(width)*scale))
+	dstHeight := max(1, int(float64(height)*scale))
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
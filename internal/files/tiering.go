@@ -0,0 +1,115 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// tieredStorage is implemented by storages with a hot and a cold tier,
+// which content can be moved between
+type tieredStorage interface {
+	MoveTier(ctx context.Context, id string, cold bool) (bool, error)
+}
+
+// TieringPolicy selects the files whose content is kept in cold storage:
+// those not downloaded for a while, and large ones. The rest is kept, or
+// brought back, in hot storage.
+type TieringPolicy struct {
+	ColdAfter time.Duration // since the upload or the last download; zero keeps files hot regardless of age
+	ColdSize  int64         // files at least this large go cold right away; zero keeps files hot regardless of size
+}
+
+// isCold reports whether the policy keeps a file last used at lastUsed in
+// cold storage
+func (p TieringPolicy) isCold(file *File, lastUsed, now time.Time) bool {
+	if p.ColdSize > 0 && file.Size >= p.ColdSize {
+		return true
+	}
+	return p.ColdAfter > 0 && now.Sub(lastUsed) >= p.ColdAfter
+}
+
+// ApplyTiering moves the content of every active file to the tier the
+// policy selects for it and returns how many moved. Thumbnails stay hot.
+func (s *Service) ApplyTiering(ctx context.Context, policy TieringPolicy) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.ApplyTiering")
+	defer span.End()
+
+	tiered, ok := s.storage.(tieredStorage)
+	if !ok {
+		return 0, nil
+	}
+	if err := s.CheckWritable(); err != nil {
+		return 0, err
+	}
+
+	fileList, err := s.repo.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+	downloads, err := s.repo.ListDownloads(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list downloads: %w", err)
+	}
+
+	now := time.Now()
+	moved := 0
+	for _, file := range fileList {
+		if ctx.Err() != nil {
+			return moved, ctx.Err()
+		}
+		if !file.IsActive() {
+			continue
+		}
+		lastUsed := file.CreatedAt
+		if last := downloads[file.ID].LastDownloadedAt; last != nil && last.After(lastUsed) {
+			lastUsed = *last
+		}
+
+		cold := policy.isCold(file, lastUsed, now)
+		ok, err := tiered.MoveTier(ctx, file.ID, cold)
+		if err != nil {
+			return moved, fmt.Errorf("failed to move %s: %w", file.ID, err)
+		}
+		if ok {
+			slog.Info("Moved file between storage tiers", "file_id", file.ID, "cold", cold)
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// Tierer periodically moves content between the tiers of the storage
+type Tierer struct {
+	service  *Service
+	interval time.Duration
+	policy   TieringPolicy
+}
+
+// NewTierer creates a tierer applying policy every interval
+func NewTierer(service *Service, interval time.Duration, policy TieringPolicy) *Tierer {
+	return &Tierer{service: service, interval: interval, policy: policy}
+}
+
+// Run applies the policy until the context is cancelled
+func (t *Tierer) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce applies the policy to every file once
+func (t *Tierer) RunOnce(ctx context.Context) {
+	if _, err := t.service.ApplyTiering(ctx, t.policy); err != nil {
+		slog.Error("Storage tiering failed", "error", err)
+	}
+}
@@ -0,0 +1,75 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// WithTombstoneRetention sets how long tombstones of deleted files are kept;
+// zero keeps them forever
+func WithTombstoneRetention(retention time.Duration) Option {
+	return func(s *Service) {
+		s.tombstoneRetention = retention
+	}
+}
+
+// GetTombstone retrieves the tombstone of a deleted file
+func (s *Service) GetTombstone(ctx context.Context, id string) (*Tombstone, error) {
+	ctx, span := tracer.Start(ctx, "Service.GetTombstone")
+	defer span.End()
+
+	tombstone, err := s.repo.FindTombstone(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("tombstone not found: %w", err)
+	}
+	return tombstone, nil
+}
+
+// ListTombstones retrieves the tombstones of deleted files, most recently
+// deleted first
+func (s *Service) ListTombstones(ctx context.Context) ([]*Tombstone, error) {
+	ctx, span := tracer.Start(ctx, "Service.ListTombstones")
+	defer span.End()
+
+	tombstones, err := s.repo.ListTombstones(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tombstones: %w", err)
+	}
+	return tombstones, nil
+}
+
+// PurgeTombstones removes tombstones older than the retention period and
+// returns how many were removed. Nothing is removed while the stash is
+// read-only.
+func (s *Service) PurgeTombstones(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Service.PurgeTombstones")
+	defer span.End()
+
+	if s.tombstoneRetention <= 0 || s.Mode().ReadOnly {
+		return 0, nil
+	}
+
+	removed, err := s.repo.DeleteTombstones(ctx, time.Now().Add(-s.tombstoneRetention))
+	if err != nil {
+		return removed, fmt.Errorf("failed to purge tombstones: %w", err)
+	}
+	return removed, nil
+}
+
+// bury records the tombstone of a file whose metadata was just deleted. The
+// file is gone either way, so failures are only logged.
+func (s *Service) bury(ctx context.Context, file *File, user, reason string) {
+	tombstone := &Tombstone{
+		ID:        file.ID,
+		Name:      file.Name,
+		Tag:       file.Tag,
+		DeletedAt: time.Now(),
+		DeletedBy: user,
+		Reason:    reason,
+	}
+	if err := s.repo.CreateTombstone(ctx, tombstone); err != nil {
+		slog.Error("Failed to record tombstone", "file_id", file.ID, "error", err)
+	}
+}
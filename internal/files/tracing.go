@@ -0,0 +1,6 @@
+package files
+
+import "go.opentelemetry.io/otel"
+
+// tracer creates spans for service operations
+var tracer = otel.Tracer("github.com/pavel-fokin/files-stash/internal/files")
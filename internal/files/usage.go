@@ -0,0 +1,257 @@
+package files
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/notify"
+)
+
+// forecastWindow is how much usage history the growth rate is fitted over
+const forecastWindow = 30 * 24 * time.Hour
+
+// UsageSample is a daily snapshot of stored files, with the bytes they take
+// in storage
+type UsageSample struct {
+	Date  time.Time `json:"date"`
+	Files int       `json:"files"`
+	Bytes int64     `json:"bytes"`
+}
+
+// Stats reports current usage and a projection of when storage runs out.
+// Bytes are those files take in storage, less than their size once
+// compressed. DaysUntilFull is nil while usage isn't growing or there's too
+// little history.
+type Stats struct {
+	Files             int            `json:"files"`
+	Bytes             int64          `json:"bytes"`
+	QuotaBytes        int64          `json:"quota_bytes,omitempty"`
+	DiskFreeBytes     int64          `json:"disk_free_bytes,omitempty"`
+	GrowthBytesPerDay float64        `json:"growth_bytes_per_day"`
+	DaysUntilFull     *float64       `json:"days_until_full"`
+	History           []*UsageSample `json:"history"`
+}
+
+// freeSpaceReporter is implemented by storages that can report remaining capacity
+type freeSpaceReporter interface {
+	FreeSpace() (int64, error)
+}
+
+// WithStorageQuota limits the bytes the forecast projects usage against
+func WithStorageQuota(bytes int64) Option {
+	return func(s *Service) {
+		s.quota = bytes
+	}
+}
+
+// WithFreeSpaceWatermark refuses uploads that would leave less than bytes
+// free on the storage volume, so a full disk can't corrupt the metadata
+// database sharing it. It only applies to storages that report free space.
+func WithFreeSpaceWatermark(bytes int64) Option {
+	return func(s *Service) {
+		s.watermark = bytes
+	}
+}
+
+// checkFreeSpace returns ErrInsufficientStorage when storing size more
+// bytes would cross the free space watermark
+func (s *Service) checkFreeSpace(size int64) error {
+	if s.watermark <= 0 {
+		return nil
+	}
+	reporter, ok := s.storage.(freeSpaceReporter)
+	if !ok {
+		return nil
+	}
+	free, err := reporter.FreeSpace()
+	if err != nil {
+		// Not knowing is no reason to refuse uploads
+		slog.Error("Failed to check free space", "error", err)
+		return nil
+	}
+	if free-size < s.watermark {
+		return ErrInsufficientStorage
+	}
+	return nil
+}
+
+// usage takes today's usage snapshot
+func (s *Service) usage(ctx context.Context) (*UsageSample, error) {
+	files, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	sample := &UsageSample{Date: time.Now().UTC().Truncate(24 * time.Hour)}
+	for _, file := range files {
+		sample.Files++
+		// Files stored before stored sizes were recorded only have a size
+		sample.Bytes += cmp.Or(file.StoredSize, file.Size)
+	}
+	return sample, nil
+}
+
+// RecordUsage stores today's usage snapshot, replacing an earlier one from
+// the same day. The janitor records it on every pass.
+func (s *Service) RecordUsage(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "Service.RecordUsage")
+	defer span.End()
+
+	sample, err := s.usage(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.RecordUsage(ctx, sample); err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+// Stats reports current usage and forecasts, from the recent daily history
+// ending with it, how many days remain until the disk or the quota is
+// exhausted
+func (s *Service) Stats(ctx context.Context) (*Stats, error) {
+	ctx, span := tracer.Start(ctx, "Service.Stats")
+	defer span.End()
+
+	current, err := s.usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := s.repo.ListUsage(ctx, current.Date.Add(-forecastWindow))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list usage history: %w", err)
+	}
+	// Today's sample is taken afresh rather than as last recorded
+	if n := len(history); n > 0 && history[n-1].Date.Equal(current.Date) {
+		history = history[:n-1]
+	}
+	history = append(history, current)
+
+	stats := &Stats{
+		Files:      current.Files,
+		Bytes:      current.Bytes,
+		QuotaBytes: s.quota,
+		History:    history,
+	}
+	if reporter, ok := s.storage.(freeSpaceReporter); ok {
+		if free, err := reporter.FreeSpace(); err == nil {
+			stats.DiskFreeBytes = free
+		}
+	}
+
+	stats.GrowthBytesPerDay = growthRate(history)
+	if stats.GrowthBytesPerDay <= 0 {
+		return stats, nil
+	}
+
+	// The tighter of the disk and quota limits runs out first
+	remaining := int64(-1)
+	if stats.DiskFreeBytes > 0 {
+		remaining = stats.DiskFreeBytes
+	}
+	if s.quota > 0 {
+		if left := max(0, s.quota-current.Bytes); remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	if remaining >= 0 {
+		days := float64(remaining) / stats.GrowthBytesPerDay
+		stats.DaysUntilFull = &days
+	}
+
+	return stats, nil
+}
+
+// growthRate fits a least squares line through the samples and returns its
+// slope in bytes per day, or zero with fewer than two samples
+func growthRate(samples []*UsageSample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+
+	origin := samples[0].Date
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range samples {
+		x := sample.Date.Sub(origin).Hours() / 24
+		y := float64(sample.Bytes)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// UsageMonitor periodically checks the storage forecast and notifies, at
+// most once a day, when storage is forecast to run out within the warning
+// threshold
+type UsageMonitor struct {
+	service   *Service
+	interval  time.Duration
+	threshold float64
+	lastAlert time.Time
+}
+
+// NewUsageMonitor creates a monitor checking the forecast every interval
+func NewUsageMonitor(service *Service, interval time.Duration, thresholdDays float64) *UsageMonitor {
+	return &UsageMonitor{
+		service:   service,
+		interval:  interval,
+		threshold: thresholdDays,
+	}
+}
+
+// Run checks the forecast until the context is cancelled
+func (m *UsageMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	m.RunOnce(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce alerts if the forecast is below the threshold
+func (m *UsageMonitor) RunOnce(ctx context.Context) {
+	stats, err := m.service.Stats(ctx)
+	if err != nil {
+		slog.Error("Storage forecast failed", "error", err)
+		return
+	}
+
+	if stats.DaysUntilFull == nil || *stats.DaysUntilFull >= m.threshold {
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if m.lastAlert.Equal(today) {
+		return
+	}
+
+	slog.Warn("Storage forecast below threshold", "days_until_full", *stats.DaysUntilFull, "threshold_days", m.threshold)
+	if m.service.notifier != nil {
+		message := fmt.Sprintf("Storage is forecast to run out in %.1f days", *stats.DaysUntilFull)
+		event := notify.NewEvent(notify.EventStorageForecast, message, stats)
+		if err := m.service.notifier.Notify(ctx, event); err != nil {
+			slog.Error("Storage forecast notification failed", "error", err)
+			return
+		}
+	}
+	m.lastAlert = today
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fs
+
+import "errors"
+
+// FreeSpace is not supported on this platform
+func (s *Storage) FreeSpace() (int64, error) {
+	return 0, errors.New("free space is not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package fs
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to unprivileged users on the volume
+// holding the data directory
+func (s *Storage) FreeSpace() (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.dataDir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat data directory: %w", err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -1,16 +1,29 @@
 package fs
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/pavel-fokin/files-stash/internal/files"
 )
 
-// Storage implements files.FileStorage using the filesystem
+// tracer creates spans for filesystem storage calls
+var tracer = otel.Tracer("github.com/pavel-fokin/files-stash/internal/fs")
+
+// Storage implements files.FileStorage using the filesystem. Content is
+// sharded into two levels of directories, see path.
 type Storage struct {
 	dataDir string
 }
@@ -23,12 +36,19 @@ func NewStorage(dataDir string) *Storage {
 }
 
 // Save stores a file and returns its metadata
-func (s *Storage) Save(id string, name string, mimeType string, content io.Reader) (*files.File, error) {
+func (s *Storage) Save(ctx context.Context, id string, name string, mimeType string, content io.Reader) (*files.File, error) {
+	ctx, span := tracer.Start(ctx, "Storage.Save", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Create file path
-	filePath := filepath.Join(s.dataDir, id)
+	filePath := s.path(id)
 
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(s.dataDir, 0755); err != nil {
+	// Create shard directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
@@ -40,7 +60,7 @@ func (s *Storage) Save(id string, name string, mimeType string, content io.Reade
 	defer file.Close()
 
 	// Copy content to file
-	size, err := io.Copy(file, content)
+	size, err := io.Copy(file, &contextReader{ctx: ctx, r: content})
 	if err != nil {
 		// Clean up file if copy fails
 		os.Remove(filePath)
@@ -58,30 +78,179 @@ func (s *Storage) Save(id string, name string, mimeType string, content io.Reade
 }
 
 // Delete removes a file by ID
-func (s *Storage) Delete(id string) error {
-	filePath := filepath.Join(s.dataDir, id)
+func (s *Storage) Delete(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Storage.Delete", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
 
-	if err := os.Remove(filePath); err != nil {
-		if os.IsNotExist(err) {
-			return nil // File already deleted
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Content not migrated yet is still in the flat layout
+	for _, filePath := range []string{s.path(id), s.flatPath(id)} {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete file: %w", err)
 		}
-		return fmt.Errorf("failed to delete file: %w", err)
 	}
 
 	return nil
 }
 
 // GetContent returns a reader for the file content
-func (s *Storage) GetContent(id string) (io.ReadCloser, error) {
-	filePath := filepath.Join(s.dataDir, id)
+func (s *Storage) GetContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	ctx, span := tracer.Start(ctx, "Storage.GetContent", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
 
-	file, err := os.Open(filePath)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		file, err = os.Open(s.flatPath(id))
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("file not found")
+			return nil, files.ErrNotFound
 		}
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 
 	return file, nil
 }
+
+// Exists reports whether content is stored under an ID
+func (s *Storage) Exists(ctx context.Context, id string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Storage.Exists", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	for _, filePath := range []string{s.path(id), s.flatPath(id)} {
+		_, err := os.Stat(filePath)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to stat file: %w", err)
+		}
+	}
+
+	return false, nil
+}
+
+// ProbeWrite verifies the data directory accepts writes by creating and
+// removing a temporary file in it
+func (s *Storage) ProbeWrite(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	probe, err := os.CreateTemp(s.dataDir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("failed to create probe file: %w", err)
+	}
+	defer os.Remove(probe.Name())
+
+	if _, err := probe.WriteString("ok"); err != nil {
+		probe.Close()
+		return fmt.Errorf("failed to write probe file: %w", err)
+	}
+	if err := probe.Close(); err != nil {
+		return fmt.Errorf("failed to write probe file: %w", err)
+	}
+	return nil
+}
+
+// MigrateLayout moves content stored in the flat layout, directly in the
+// data directory, to its shard and reports whether there was any to move
+func (s *Storage) MigrateLayout(ctx context.Context, id string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(s.flatPath(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	filePath := s.path(id)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return false, fmt.Errorf("failed to create shard directory: %w", err)
+	}
+	if err := os.Rename(s.flatPath(id), filePath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil // deleted meanwhile
+		}
+		return false, fmt.Errorf("failed to move file: %w", err)
+	}
+
+	return true, nil
+}
+
+// Walk calls fn with the ID and file info of all content in the sharded
+// layout. Anything else in the data directory, like content still in the
+// flat layout or a database kept there, isn't visited.
+func (s *Storage) Walk(ctx context.Context, fn func(id string, info os.FileInfo) error) error {
+	return filepath.WalkDir(s.dataDir, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.dataDir, filePath)
+		depth := strings.Count(rel, string(filepath.Separator))
+		if entry.IsDir() {
+			if depth > 1 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Only content where its ID's shard places it
+		if depth != 2 || !entry.Type().IsRegular() || s.path(entry.Name()) != filePath {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(entry.Name(), info)
+	})
+}
+
+// path returns where content is stored, e.g. 3f/a2/<id> under the data
+// directory, keeping each directory small. The shards are named after the
+// SHA-256 digest of the ID rather than the ID itself, since IDs are
+// timestamps that share their leading digits.
+func (s *Storage) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	shard := hex.EncodeToString(sum[:2])
+	return filepath.Join(s.dataDir, shard[:2], shard[2:], id)
+}
+
+// flatPath returns where content was stored before the sharded layout
+func (s *Storage) flatPath(id string) string {
+	return filepath.Join(s.dataDir, id)
+}
+
+// contextReader stops a copy once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cancellingReader cancels its context after the first read
+type cancellingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (cr *cancellingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p[:1])
+	cr.cancel()
+	return n, err
+}
+
+func TestStorageHonorsContext(t *testing.T) {
+	dataDir := t.TempDir()
+	storage := NewStorage(dataDir)
+
+	t.Run("CancelledMidSave", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		content := &cancellingReader{r: strings.NewReader("partial content"), cancel: cancel}
+
+		_, err := storage.Save(ctx, "partial", "a.txt", "text/plain", content)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// The partial file is removed
+		_, err = os.Stat(storage.path("partial"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		_, err := storage.Save(context.Background(), "kept", "b.txt", "text/plain", strings.NewReader("content"))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		_, err = storage.GetContent(ctx, "kept")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		err = storage.Delete(ctx, "kept")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// The file survived the expired delete
+		_, err = os.Stat(storage.path("kept"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestStorageExists(t *testing.T) {
+	storage := NewStorage(t.TempDir())
+	ctx := context.Background()
+
+	exists, err := storage.Exists(ctx, "1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = storage.Save(ctx, "1", "a.txt", "text/plain", strings.NewReader("content"))
+	require.NoError(t, err)
+	exists, err = storage.Exists(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	require.NoError(t, storage.Delete(ctx, "1"))
+	exists, err = storage.Exists(ctx, "1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestStorageProbeWrite(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, NewStorage(dataDir).ProbeWrite(context.Background()))
+
+	// The probe file is cleaned up
+	entries, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	assert.Error(t, NewStorage(filepath.Join(dataDir, "missing")).ProbeWrite(context.Background()))
+}
+
+func TestStorageShardedLayout(t *testing.T) {
+	dataDir := t.TempDir()
+	storage := NewStorage(dataDir)
+	ctx := context.Background()
+
+	_, err := storage.Save(ctx, "1", "a.txt", "text/plain", strings.NewReader("sharded"))
+	require.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{2}/[0-9a-f]{2}/1$`, filepath.ToSlash(strings.TrimPrefix(storage.path("1"), dataDir+string(filepath.Separator))))
+	_, err = os.Stat(storage.path("1"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dataDir, "1"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Content stored before the sharded layout
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "2"), []byte("flat"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "3"), []byte("flat"), 0o644))
+
+	t.Run("FlatContentIsReadable", func(t *testing.T) {
+		exists, err := storage.Exists(ctx, "2")
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		content, err := storage.GetContent(ctx, "2")
+		require.NoError(t, err)
+		defer content.Close()
+		data, err := io.ReadAll(content)
+		require.NoError(t, err)
+		assert.Equal(t, "flat", string(data))
+	})
+
+	t.Run("FlatContentIsDeleted", func(t *testing.T) {
+		require.NoError(t, storage.Delete(ctx, "3"))
+		exists, err := storage.Exists(ctx, "3")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		moved, err := storage.MigrateLayout(ctx, "2")
+		require.NoError(t, err)
+		assert.True(t, moved)
+		_, err = os.Stat(filepath.Join(dataDir, "2"))
+		assert.True(t, os.IsNotExist(err))
+
+		content, err := storage.GetContent(ctx, "2")
+		require.NoError(t, err)
+		content.Close()
+
+		// Already sharded content and missing content are left alone
+		moved, err = storage.MigrateLayout(ctx, "1")
+		require.NoError(t, err)
+		assert.False(t, moved)
+		moved, err = storage.MigrateLayout(ctx, "missing")
+		require.NoError(t, err)
+		assert.False(t, moved)
+	})
+}
+
+func TestStorageWalk(t *testing.T) {
+	dataDir := t.TempDir()
+	storage := NewStorage(dataDir)
+	ctx := context.Background()
+
+	for _, id := range []string{"1", "2"} {
+		_, err := storage.Save(ctx, id, id+".txt", "text/plain", strings.NewReader("content "+id))
+		require.NoError(t, err)
+	}
+	// Neither flat content, nor a database, nor files outside their shard
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "3"), []byte("flat"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "stash.db"), []byte("db"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(storage.path("1")), "stray"), []byte("stray"), 0o644))
+
+	visited := make(map[string]int64)
+	err := storage.Walk(ctx, func(id string, info os.FileInfo) error {
+		visited[id] = info.Size()
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"1": 9, "2": 9}, visited)
+}
@@ -0,0 +1,1114 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// thumbnailKey identifies a cached thumbnail of a file
+type thumbnailKey struct {
+	fileID        string
+	width, height int
+}
+
+// Repository implements files.FileRepository in memory. Nothing survives a
+// restart, which suits demos and tests.
+type Repository struct {
+	mu         sync.RWMutex
+	files      map[string]files.File
+	stars      map[string]map[string]bool // user -> file IDs
+	searches   map[string]files.SavedSearch
+	comments   map[string][]files.Comment // file ID -> comments, oldest first
+	thumbnails map[thumbnailKey]files.Thumbnail
+	usage      map[string]files.UsageSample // day -> sample
+	shortLinks map[string]files.ShortLink
+	links      map[string]files.Link
+	codes      map[string]files.DownloadCode
+	tombstones map[string]files.Tombstone
+	downloads  map[string]files.DownloadStats
+	accesses   map[string][]files.Access           // file ID -> accesses, oldest first
+	parts      map[string]map[int]files.UploadPart // file ID -> part number -> part
+}
+
+// NewRepository creates an empty in-memory repository
+func NewRepository() *Repository {
+	return &Repository{
+		files:      make(map[string]files.File),
+		stars:      make(map[string]map[string]bool),
+		searches:   make(map[string]files.SavedSearch),
+		comments:   make(map[string][]files.Comment),
+		thumbnails: make(map[thumbnailKey]files.Thumbnail),
+		usage:      make(map[string]files.UsageSample),
+		shortLinks: make(map[string]files.ShortLink),
+		links:      make(map[string]files.Link),
+		codes:      make(map[string]files.DownloadCode),
+		tombstones: make(map[string]files.Tombstone),
+		downloads:  make(map[string]files.DownloadStats),
+		accesses:   make(map[string][]files.Access),
+		parts:      make(map[string]map[int]files.UploadPart),
+	}
+}
+
+// Create stores file metadata
+func (r *Repository) Create(ctx context.Context, file *files.File) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.files[file.ID]; ok {
+		return fmt.Errorf("failed to create file record: duplicate id %q", file.ID)
+	}
+	r.files[file.ID] = *copyFile(*file)
+	return nil
+}
+
+// FindByID retrieves file metadata by ID
+func (r *Repository) FindByID(ctx context.Context, id string) (*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	file, ok := r.files[id]
+	if !ok {
+		return nil, files.ErrNotFound
+	}
+	return copyFile(file), nil
+}
+
+// FindByTag retrieves the latest file metadata by tag among the files
+// created at or before asOf
+func (r *Repository) FindByTag(ctx context.Context, tag string, asOf time.Time) (*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var latest *files.File
+	for _, file := range r.files {
+		if file.Tag != tag || !file.IsActive() || file.CreatedAt.After(asOf) {
+			continue
+		}
+		if latest == nil || file.CreatedAt.After(latest.CreatedAt) {
+			latest = &file
+		}
+	}
+	if latest == nil {
+		return nil, files.ErrNotFound
+	}
+	return copyFile(*latest), nil
+}
+
+// FindLatestNonExpiredByTag retrieves the most recent file with a tag that
+// was created at or before asOf and hasn't expired at now
+func (r *Repository) FindLatestNonExpiredByTag(ctx context.Context, tag string, asOf, now time.Time) (*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var latest *files.File
+	for _, file := range r.files {
+		if file.Tag != tag || !file.IsActive() || file.CreatedAt.After(asOf) || file.IsExpired(now) {
+			continue
+		}
+		if latest == nil || file.CreatedAt.After(latest.CreatedAt) {
+			latest = &file
+		}
+	}
+	if latest == nil {
+		return nil, files.ErrNotFound
+	}
+	return copyFile(*latest), nil
+}
+
+// SetPinned marks a file as pinned or unpinned
+func (r *Repository) SetPinned(ctx context.Context, id string, pinned bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, ok := r.files[id]
+	if !ok {
+		return files.ErrNotFound
+	}
+	file.Pinned = pinned
+	r.files[id] = file
+	return nil
+}
+
+// Update stores the mutable metadata fields of an existing file
+func (r *Repository) Update(ctx context.Context, file *files.File) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.files[file.ID]
+	if !ok {
+		return files.ErrNotFound
+	}
+	stored.Name = file.Name
+	stored.Tag = file.Tag
+	stored.Description = file.Description
+	stored.Link = file.Link
+	stored.Pinned = file.Pinned
+	stored.Public = file.Public
+	stored.ExpiresAt = file.ExpiresAt
+	stored.Attributes = maps.Clone(file.Attributes)
+	r.files[file.ID] = stored
+	return nil
+}
+
+// SetStatus moves a file from one status to another
+func (r *Repository) SetStatus(ctx context.Context, id, from, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.files[id]
+	if !ok || stored.Status != from {
+		return fmt.Errorf("file with status %q not found", from)
+	}
+	stored.Status = to
+	r.files[id] = stored
+	return nil
+}
+
+// SetIntegrity records the outcome of verifying a file's content
+func (r *Repository) SetIntegrity(ctx context.Context, id string, check *files.IntegrityCheck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.files[id]
+	if !ok {
+		return files.ErrNotFound
+	}
+	if check != nil {
+		copied := *check
+		check = &copied
+	}
+	stored.Integrity = check
+	r.files[id] = stored
+	return nil
+}
+
+// CompleteUpload stores the content metadata, status and times of a
+// processing file
+func (r *Repository) CompleteUpload(ctx context.Context, file *files.File) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.files[file.ID]
+	if !ok || stored.Status != files.StatusProcessing {
+		return fmt.Errorf("processing %w", files.ErrNotFound)
+	}
+	stored.Size = file.Size
+	stored.StoredSize = file.StoredSize
+	stored.MimeType = file.MimeType
+	stored.DetectedMimeType = file.DetectedMimeType
+	stored.Checksum = file.Checksum
+	stored.Scan = file.Scan
+	stored.Status = file.Status
+	stored.CreatedAt = file.CreatedAt
+	stored.ExpiresAt = file.ExpiresAt
+	r.files[file.ID] = stored
+	return nil
+}
+
+// FailStalledUploads marks files still pending or processing that were
+// registered before the given time as failed and returns their IDs
+func (r *Repository) FailStalledUploads(ctx context.Context, registeredBefore time.Time) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []string
+	for id, file := range r.files {
+		stalled := file.Status == files.StatusPending || file.Status == files.StatusProcessing
+		if !stalled || !file.CreatedAt.Before(registeredBefore) {
+			continue
+		}
+		file.Status = files.StatusFailed
+		r.files[id] = file
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Delete removes file metadata by ID along with its stars, comments,
+// thumbnails and short links
+func (r *Repository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.files[id]; !ok {
+		return files.ErrNotFound
+	}
+	r.deleteFile(id)
+	return nil
+}
+
+// CleanupExpired removes the metadata of files expired at now, with
+// everything attached to them, and returns the storage IDs of the removed
+// files and of their thumbnails
+func (r *Repository) CleanupExpired(ctx context.Context, now time.Time) (fileIDs, thumbnailIDs []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, file := range r.files {
+		if !file.IsExpired(now) {
+			continue
+		}
+		for key, thumb := range r.thumbnails {
+			if key.fileID == id {
+				thumbnailIDs = append(thumbnailIDs, thumb.StorageID)
+			}
+		}
+		r.deleteFile(id)
+		r.tombstones[id] = files.Tombstone{ID: id, Name: file.Name, Tag: file.Tag, DeletedAt: now, Reason: files.ReasonExpired}
+		fileIDs = append(fileIDs, id)
+	}
+	return fileIDs, thumbnailIDs, nil
+}
+
+// deleteFile removes a file and everything attached to it. The caller must
+// hold r.mu for writing.
+func (r *Repository) deleteFile(id string) {
+	delete(r.files, id)
+	for _, starred := range r.stars {
+		delete(starred, id)
+	}
+	delete(r.comments, id)
+	delete(r.downloads, id)
+	delete(r.accesses, id)
+	for key := range r.thumbnails {
+		if key.fileID == id {
+			delete(r.thumbnails, key)
+		}
+	}
+	for code, link := range r.shortLinks {
+		if link.FileID == id {
+			delete(r.shortLinks, code)
+		}
+	}
+	for linkID, link := range r.links {
+		if link.FileID == id {
+			delete(r.links, linkID)
+		}
+	}
+	for code, downloadCode := range r.codes {
+		if downloadCode.FileID == id {
+			delete(r.codes, code)
+		}
+	}
+}
+
+// FindByName retrieves the metadata of the files with a tag and a name,
+// newest first
+func (r *Repository) FindByName(ctx context.Context, tag, name string) ([]*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.sortedFiles(func(file *files.File) bool { return file.Tag == tag && file.Name == name }), nil
+}
+
+// List retrieves all file metadata, newest first
+func (r *Repository) List(ctx context.Context) ([]*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.sortedFiles(func(*files.File) bool { return true }), nil
+}
+
+// Search retrieves the files matching all terms, like the SQLite full-text
+// index does: each term's words must start words of the name, tag or
+// attributes in sequence. Files with more terms matched in the name rank
+// first, then in the tag, and newest first among equals.
+func (r *Repository) Search(ctx context.Context, terms []string) ([]*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	scores := make(map[string]int)
+	matched := r.sortedFiles(func(file *files.File) bool {
+		var attributes []string
+		for key, value := range file.Attributes {
+			attributes = append(attributes, key, value)
+		}
+		fields := [][]string{searchWords(file.Name), searchWords(file.Tag), searchWords(strings.Join(attributes, " "))}
+
+		score := 0
+		for _, term := range terms {
+			termWords := searchWords(term)
+			i := slices.IndexFunc(fields, func(words []string) bool { return matchWords(words, termWords) })
+			if i < 0 {
+				return false
+			}
+			score += searchWeights[i]
+		}
+		scores[file.ID] = score
+		return true
+	})
+	slices.SortStableFunc(matched, func(a, b *files.File) int {
+		return scores[b.ID] - scores[a.ID]
+	})
+	return matched, nil
+}
+
+// searchWeights are what a term matched in the name, the tag and the
+// attributes adds to a file's score
+var searchWeights = []int{100, 10, 1}
+
+// searchWords splits text into lower case words of letters and digits
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// matchWords reports whether terms follow each other in words, the last
+// one as a prefix
+func matchWords(words, terms []string) bool {
+	for i := 0; i+len(terms) <= len(words); i++ {
+		matched := true
+		for j, term := range terms {
+			word := words[i+j]
+			if word != term && (j < len(terms)-1 || !strings.HasPrefix(word, term)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedFiles returns copies of the files matching keep, newest first.
+// The caller must hold r.mu.
+func (r *Repository) sortedFiles(keep func(*files.File) bool) []*files.File {
+	var fileList []*files.File
+	for _, file := range r.files {
+		if keep(&file) {
+			fileList = append(fileList, copyFile(file))
+		}
+	}
+	slices.SortFunc(fileList, func(a, b *files.File) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return fileList
+}
+
+// copyFile returns a copy of a stored file that doesn't share its attributes
+func copyFile(file files.File) *files.File {
+	file.Attributes = maps.Clone(file.Attributes)
+	if file.Origin != nil {
+		origin := *file.Origin
+		file.Origin = &origin
+	}
+	if file.Scan != nil {
+		scan := *file.Scan
+		file.Scan = &scan
+	}
+	if file.Integrity != nil {
+		integrity := *file.Integrity
+		file.Integrity = &integrity
+	}
+	return &file
+}
+
+// Star marks a file as starred by a user
+func (r *Repository) Star(ctx context.Context, user, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stars[user] == nil {
+		r.stars[user] = make(map[string]bool)
+	}
+	r.stars[user][id] = true
+	return nil
+}
+
+// Unstar removes a user's star from a file
+func (r *Repository) Unstar(ctx context.Context, user, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.stars[user], id)
+	return nil
+}
+
+// ListStarred retrieves metadata of all files starred by a user
+func (r *Repository) ListStarred(ctx context.Context, user string) ([]*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	starred := r.stars[user]
+	return r.sortedFiles(func(file *files.File) bool { return starred[file.ID] }), nil
+}
+
+// SaveSearch stores a saved search, replacing one with the same name
+func (r *Repository) SaveSearch(ctx context.Context, search *files.SavedSearch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.searches[search.Name] = *search
+	return nil
+}
+
+// FindSavedSearch retrieves a saved search by name
+func (r *Repository) FindSavedSearch(ctx context.Context, name string) (*files.SavedSearch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	search, ok := r.searches[name]
+	if !ok {
+		return nil, fmt.Errorf("saved search %w", files.ErrNotFound)
+	}
+	return &search, nil
+}
+
+// ListSavedSearches retrieves all saved searches ordered by name
+func (r *Repository) ListSavedSearches(ctx context.Context) ([]*files.SavedSearch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var searches []*files.SavedSearch
+	for _, search := range r.searches {
+		searches = append(searches, &search)
+	}
+	slices.SortFunc(searches, func(a, b *files.SavedSearch) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return searches, nil
+}
+
+// DeleteSavedSearch removes a saved search by name
+func (r *Repository) DeleteSavedSearch(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.searches[name]; !ok {
+		return fmt.Errorf("saved search %w", files.ErrNotFound)
+	}
+	delete(r.searches, name)
+	return nil
+}
+
+// CreateComment stores a comment on a file
+func (r *Repository) CreateComment(ctx context.Context, comment *files.Comment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.comments[comment.FileID] = append(r.comments[comment.FileID], *comment)
+	return nil
+}
+
+// ListComments retrieves the comments on a file, oldest first
+func (r *Repository) ListComments(ctx context.Context, fileID string) ([]*files.Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var comments []*files.Comment
+	for _, comment := range r.comments[fileID] {
+		comments = append(comments, &comment)
+	}
+	return comments, nil
+}
+
+// DeleteComment removes a comment from a file
+func (r *Repository) DeleteComment(ctx context.Context, fileID, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	comments := r.comments[fileID]
+	i := slices.IndexFunc(comments, func(c files.Comment) bool { return c.ID == id })
+	if i < 0 {
+		return fmt.Errorf("comment %w", files.ErrNotFound)
+	}
+	r.comments[fileID] = slices.Delete(comments, i, i+1)
+	return nil
+}
+
+// CreateThumbnail stores thumbnail metadata, replacing an existing entry for the same size
+func (r *Repository) CreateThumbnail(ctx context.Context, thumb *files.Thumbnail) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.thumbnails[thumbnailKey{thumb.FileID, thumb.Width, thumb.Height}] = *thumb
+	return nil
+}
+
+// FindThumbnail retrieves thumbnail metadata for a file and size
+func (r *Repository) FindThumbnail(ctx context.Context, fileID string, width, height int) (*files.Thumbnail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	thumb, ok := r.thumbnails[thumbnailKey{fileID, width, height}]
+	if !ok {
+		return nil, fmt.Errorf("thumbnail not found")
+	}
+	return &thumb, nil
+}
+
+// ListThumbnails retrieves metadata of all cached thumbnails of a file
+func (r *Repository) ListThumbnails(ctx context.Context, fileID string) ([]*files.Thumbnail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var thumbs []*files.Thumbnail
+	for key, thumb := range r.thumbnails {
+		if key.fileID == fileID {
+			thumbs = append(thumbs, &thumb)
+		}
+	}
+	return thumbs, nil
+}
+
+// usageDayLayout keys usage samples by UTC day
+const usageDayLayout = "2006-01-02"
+
+// RecordUsage stores a daily usage sample, replacing any for the same day
+func (r *Repository) RecordUsage(ctx context.Context, sample *files.UsageSample) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	day := sample.Date.UTC().Format(usageDayLayout)
+	date, err := time.Parse(usageDayLayout, day)
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.usage[day] = files.UsageSample{Date: date, Files: sample.Files, Bytes: sample.Bytes}
+	return nil
+}
+
+// ListUsage retrieves the daily usage samples since a day, oldest first
+func (r *Repository) ListUsage(ctx context.Context, since time.Time) ([]*files.UsageSample, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	from := since.UTC().Format(usageDayLayout)
+	var samples []*files.UsageSample
+	for day, sample := range r.usage {
+		if day >= from {
+			samples = append(samples, &sample)
+		}
+	}
+	slices.SortFunc(samples, func(a, b *files.UsageSample) int {
+		return a.Date.Compare(b.Date)
+	})
+	return samples, nil
+}
+
+// CreateLink stores an issued link
+func (r *Repository) CreateLink(ctx context.Context, link *files.Link) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.links[link.ID]; ok {
+		return fmt.Errorf("failed to create link: duplicate ID %q", link.ID)
+	}
+	stored := *link
+	stored.URL = ""
+	r.links[link.ID] = stored
+	return nil
+}
+
+// FindLink retrieves an issued link by ID
+func (r *Repository) FindLink(ctx context.Context, id string) (*files.Link, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	link, ok := r.links[id]
+	if !ok {
+		return nil, fmt.Errorf("link %w", files.ErrNotFound)
+	}
+	return &link, nil
+}
+
+// ListLinks retrieves the links issued for a file, or for every file when
+// fileID is empty, oldest first
+func (r *Repository) ListLinks(ctx context.Context, fileID string) ([]*files.Link, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var links []*files.Link
+	for _, link := range r.links {
+		if fileID == "" || link.FileID == fileID {
+			links = append(links, &link)
+		}
+	}
+	slices.SortFunc(links, func(a, b *files.Link) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return links, nil
+}
+
+// UseLink marks a one-time link used at the given time. It fails when the
+// link was used already, so only one caller can use it.
+func (r *Repository) UseLink(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	link, ok := r.links[id]
+	if !ok {
+		return fmt.Errorf("link %w", files.ErrNotFound)
+	}
+	if link.UsedAt != nil {
+		return files.ErrLinkUsed
+	}
+	link.UsedAt = &at
+	r.links[id] = link
+	return nil
+}
+
+// ReleaseLink marks a one-time link unused again, unless it was used at
+// another time than the given one
+func (r *Repository) ReleaseLink(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	link, ok := r.links[id]
+	if ok && link.UsedAt != nil && link.UsedAt.Equal(at) {
+		link.UsedAt = nil
+		r.links[id] = link
+	}
+	return nil
+}
+
+// DeleteLink removes an issued link by ID
+func (r *Repository) DeleteLink(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.links[id]; !ok {
+		return fmt.Errorf("link not found")
+	}
+	delete(r.links, id)
+	return nil
+}
+
+// CreateShortLink stores a short link
+func (r *Repository) CreateShortLink(ctx context.Context, link *files.ShortLink) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.shortLinks[link.Code]; ok {
+		return fmt.Errorf("failed to create short link: duplicate code %q", link.Code)
+	}
+	r.shortLinks[link.Code] = *link
+	return nil
+}
+
+// FindShortLink retrieves a short link by code
+func (r *Repository) FindShortLink(ctx context.Context, code string) (*files.ShortLink, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	link, ok := r.shortLinks[code]
+	if !ok {
+		return nil, fmt.Errorf("short link not found")
+	}
+	return &link, nil
+}
+
+// CreateDownloadCode stores a download code, failing with
+// files.ErrCodeTaken when the code exists already
+func (r *Repository) CreateDownloadCode(ctx context.Context, code *files.DownloadCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.codes[code.Code]; ok {
+		return files.ErrCodeTaken
+	}
+	r.codes[code.Code] = *code
+	return nil
+}
+
+// FindDownloadCode retrieves a download code
+func (r *Repository) FindDownloadCode(ctx context.Context, code string) (*files.DownloadCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	found, ok := r.codes[code]
+	if !ok {
+		return nil, fmt.Errorf("download code not found")
+	}
+	return &found, nil
+}
+
+// FindFileDownloadCode retrieves the download code of a file
+func (r *Repository) FindFileDownloadCode(ctx context.Context, fileID string) (*files.DownloadCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, code := range r.codes {
+		if code.FileID == fileID {
+			return &code, nil
+		}
+	}
+	return nil, fmt.Errorf("download code not found")
+}
+
+// RecordDownload counts a completed download of bytes from a file
+func (r *Repository) RecordDownload(ctx context.Context, id string, bytes int64, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.downloads[id]
+	stats.Downloads++
+	stats.BytesServed += bytes
+	stats.LastDownloadedAt = &at
+	r.downloads[id] = stats
+	return nil
+}
+
+// FindDownloads retrieves the download stats of a file, which are zero for
+// files never downloaded
+func (r *Repository) FindDownloads(ctx context.Context, id string) (*files.DownloadStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := r.downloads[id]
+	return &stats, nil
+}
+
+// ListDownloads retrieves the download stats of every file downloaded at
+// least once, by file ID
+func (r *Repository) ListDownloads(ctx context.Context) (map[string]files.DownloadStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return maps.Clone(r.downloads), nil
+}
+
+// RecordAccess adds a download request to the access log of its file
+func (r *Repository) RecordAccess(ctx context.Context, access *files.Access) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.accesses[access.FileID] = append(r.accesses[access.FileID], *access)
+	return nil
+}
+
+// ListAccesses retrieves a page of the access log of a file, latest first,
+// with the number of accesses on all pages
+func (r *Repository) ListAccesses(ctx context.Context, fileID string, limit, offset int) ([]*files.Access, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	logged := r.accesses[fileID]
+	var accesses []*files.Access
+	for i := len(logged) - 1 - offset; i >= 0 && len(accesses) < limit; i-- {
+		access := logged[i]
+		accesses = append(accesses, &access)
+	}
+	return accesses, len(logged), nil
+}
+
+// CreateTombstone stores the tombstone of a deleted file, replacing any
+// earlier one for the same ID
+func (r *Repository) CreateTombstone(ctx context.Context, tombstone *files.Tombstone) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tombstones[tombstone.ID] = *tombstone
+	return nil
+}
+
+// FindTombstone retrieves the tombstone of a deleted file
+func (r *Repository) FindTombstone(ctx context.Context, id string) (*files.Tombstone, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tombstone, ok := r.tombstones[id]
+	if !ok {
+		return nil, fmt.Errorf("tombstone not found")
+	}
+	return &tombstone, nil
+}
+
+// ListTombstones retrieves all tombstones, most recently deleted first
+func (r *Repository) ListTombstones(ctx context.Context) ([]*files.Tombstone, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var tombstones []*files.Tombstone
+	for _, tombstone := range r.tombstones {
+		tombstones = append(tombstones, &tombstone)
+	}
+	slices.SortFunc(tombstones, func(a, b *files.Tombstone) int {
+		return b.DeletedAt.Compare(a.DeletedAt)
+	})
+	return tombstones, nil
+}
+
+// SaveUploadPart stores a part of a multipart upload, replacing the part
+// with the same number
+func (r *Repository) SaveUploadPart(ctx context.Context, part *files.UploadPart) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.parts[part.FileID] == nil {
+		r.parts[part.FileID] = make(map[int]files.UploadPart)
+	}
+	r.parts[part.FileID][part.Number] = *part
+	return nil
+}
+
+// ListUploadParts retrieves the parts of a multipart upload by number, or
+// of every upload when fileID is empty
+func (r *Repository) ListUploadParts(ctx context.Context, fileID string) ([]*files.UploadPart, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var parts []*files.UploadPart
+	for id, byNumber := range r.parts {
+		if fileID != "" && id != fileID {
+			continue
+		}
+		for _, part := range byNumber {
+			parts = append(parts, &part)
+		}
+	}
+	slices.SortFunc(parts, func(a, b *files.UploadPart) int {
+		return cmp.Or(strings.Compare(a.FileID, b.FileID), cmp.Compare(a.Number, b.Number))
+	})
+	return parts, nil
+}
+
+// DeleteUploadParts removes the parts of a multipart upload
+func (r *Repository) DeleteUploadParts(ctx context.Context, fileID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.parts, fileID)
+	return nil
+}
+
+// DeleteTombstones removes tombstones of files deleted before the given
+// time and returns how many were removed
+func (r *Repository) DeleteTombstones(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := 0
+	for id, tombstone := range r.tombstones {
+		if tombstone.DeletedAt.Before(before) {
+			delete(r.tombstones, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,260 @@
+package memory
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository()
+
+	now := time.Now()
+	older := &files.File{ID: "1", Name: "a.txt", Tag: "docs", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}
+	newer := &files.File{ID: "2", Name: "b.txt", Tag: "docs", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, repo.Create(ctx, older))
+	require.NoError(t, repo.Create(ctx, newer))
+	assert.Error(t, repo.Create(ctx, older))
+
+	t.Run("ListNewestFirst", func(t *testing.T) {
+		fileList, err := repo.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, fileList, 2)
+		assert.Equal(t, "2", fileList[0].ID)
+		assert.Equal(t, "1", fileList[1].ID)
+	})
+
+	t.Run("FindByTagAsOf", func(t *testing.T) {
+		latest, err := repo.FindByTag(ctx, "docs", now)
+		require.NoError(t, err)
+		assert.Equal(t, "2", latest.ID)
+
+		earlier, err := repo.FindByTag(ctx, "docs", now.Add(-time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, "1", earlier.ID)
+
+		_, err = repo.FindByTag(ctx, "docs", now.Add(-2*time.Hour))
+		assert.Error(t, err)
+	})
+
+	t.Run("FindLatestNonExpiredByTag", func(t *testing.T) {
+		stale := &files.File{ID: "stale", Name: "c.txt", Tag: "docs", CreatedAt: now.Add(time.Minute), ExpiresAt: now.Add(-time.Minute)}
+		require.NoError(t, repo.Create(ctx, stale))
+		defer repo.Delete(ctx, "stale")
+
+		latest, err := repo.FindByTag(ctx, "docs", now.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, "stale", latest.ID)
+
+		latest, err = repo.FindLatestNonExpiredByTag(ctx, "docs", now.Add(time.Hour), now)
+		require.NoError(t, err)
+		assert.Equal(t, "2", latest.ID)
+
+		_, err = repo.FindLatestNonExpiredByTag(ctx, "docs", now.Add(time.Hour), now.Add(2*time.Hour))
+		assert.Error(t, err)
+	})
+
+	t.Run("UploadParts", func(t *testing.T) {
+		require.NoError(t, repo.SaveUploadPart(ctx, &files.UploadPart{FileID: "up", Number: 2, Size: 5}))
+		require.NoError(t, repo.SaveUploadPart(ctx, &files.UploadPart{FileID: "up", Number: 1, Size: 4}))
+		require.NoError(t, repo.SaveUploadPart(ctx, &files.UploadPart{FileID: "up", Number: 1, Size: 6}))
+
+		parts, err := repo.ListUploadParts(ctx, "up")
+		require.NoError(t, err)
+		require.Len(t, parts, 2)
+		assert.Equal(t, int64(6), parts[0].Size)
+		assert.Equal(t, 2, parts[1].Number)
+
+		require.NoError(t, repo.DeleteUploadParts(ctx, "up"))
+		parts, err = repo.ListUploadParts(ctx, "")
+		require.NoError(t, err)
+		assert.Empty(t, parts)
+	})
+
+	t.Run("ReturnsCopies", func(t *testing.T) {
+		found, err := repo.FindByID(ctx, "1")
+		require.NoError(t, err)
+		found.Name = "changed.txt"
+
+		found, err = repo.FindByID(ctx, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "a.txt", found.Name)
+	})
+
+	t.Run("Accesses", func(t *testing.T) {
+		for status := range 3 {
+			require.NoError(t, repo.RecordAccess(ctx, &files.Access{FileID: "2", At: now, IP: "10.0.0.1", Status: 200 + status}))
+		}
+
+		// Latest first, a page at a time
+		accesses, total, err := repo.ListAccesses(ctx, "2", 2, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+		require.Len(t, accesses, 2)
+		assert.Equal(t, 202, accesses[0].Status)
+		assert.Equal(t, 201, accesses[1].Status)
+
+		accesses, _, err = repo.ListAccesses(ctx, "2", 2, 2)
+		require.NoError(t, err)
+		require.Len(t, accesses, 1)
+		assert.Equal(t, 200, accesses[0].Status)
+
+		accesses, _, err = repo.ListAccesses(ctx, "2", 2, 5)
+		require.NoError(t, err)
+		assert.Empty(t, accesses)
+	})
+
+	t.Run("DeleteCascades", func(t *testing.T) {
+		require.NoError(t, repo.Star(ctx, "admin", "1"))
+		require.NoError(t, repo.RecordAccess(ctx, &files.Access{FileID: "1", At: now, Status: 200}))
+		require.NoError(t, repo.CreateComment(ctx, &files.Comment{ID: "c1", FileID: "1", Body: "note"}))
+		require.NoError(t, repo.CreateShortLink(ctx, &files.ShortLink{Code: "abc", FileID: "1", Target: "/v1/files/1"}))
+
+		require.NoError(t, repo.Delete(ctx, "1"))
+		assert.ErrorIs(t, repo.Delete(ctx, "1"), files.ErrNotFound)
+
+		starred, err := repo.ListStarred(ctx, "admin")
+		require.NoError(t, err)
+		assert.Empty(t, starred)
+		comments, err := repo.ListComments(ctx, "1")
+		require.NoError(t, err)
+		assert.Empty(t, comments)
+		_, err = repo.FindShortLink(ctx, "abc")
+		assert.Error(t, err)
+		_, total, err := repo.ListAccesses(ctx, "1", 10, 0)
+		require.NoError(t, err)
+		assert.Zero(t, total)
+	})
+
+	t.Run("CleanupExpired", func(t *testing.T) {
+		expired := &files.File{ID: "3", Name: "c.txt", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)}
+		require.NoError(t, repo.Create(ctx, expired))
+		require.NoError(t, repo.CreateThumbnail(ctx, &files.Thumbnail{FileID: "3", Width: 8, Height: 8, StorageID: "3.thumb-8x8"}))
+
+		fileIDs, thumbnailIDs, err := repo.CleanupExpired(ctx, now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"3"}, fileIDs)
+		assert.Equal(t, []string{"3.thumb-8x8"}, thumbnailIDs)
+
+		_, err = repo.FindByID(ctx, "3")
+		assert.Error(t, err)
+		_, err = repo.FindByID(ctx, "2")
+		assert.NoError(t, err)
+	})
+
+	t.Run("CompleteUpload", func(t *testing.T) {
+		pending := &files.File{ID: "4", Name: "d.txt", Tag: "drafts", Status: files.StatusPending, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		require.NoError(t, repo.Create(ctx, pending))
+		_, err := repo.FindByTag(ctx, "drafts", now)
+		assert.Error(t, err)
+
+		require.NoError(t, repo.SetStatus(ctx, "4", files.StatusPending, files.StatusProcessing))
+		pending.Status = files.StatusActive
+		pending.Size = 5
+		require.NoError(t, repo.CompleteUpload(ctx, pending))
+		found, err := repo.FindByTag(ctx, "drafts", now)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), found.Size)
+		assert.Error(t, repo.CompleteUpload(ctx, pending))
+	})
+
+	t.Run("Integrity", func(t *testing.T) {
+		check := &files.IntegrityCheck{Status: files.IntegrityMismatch, Checksum: "abc", VerifiedAt: now}
+		require.NoError(t, repo.SetIntegrity(ctx, "2", check))
+		check.Status = files.IntegrityOK
+
+		found, err := repo.FindByID(ctx, "2")
+		require.NoError(t, err)
+		require.NotNil(t, found.Integrity)
+		assert.Equal(t, files.IntegrityMismatch, found.Integrity.Status)
+		assert.Error(t, repo.SetIntegrity(ctx, "missing", check))
+	})
+
+	t.Run("UsageByDay", func(t *testing.T) {
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		require.NoError(t, repo.RecordUsage(ctx, &files.UsageSample{Date: today, Bytes: 1}))
+		require.NoError(t, repo.RecordUsage(ctx, &files.UsageSample{Date: today.Add(time.Hour), Bytes: 2}))
+		require.NoError(t, repo.RecordUsage(ctx, &files.UsageSample{Date: today.AddDate(0, 0, -1), Bytes: 3}))
+
+		samples, err := repo.ListUsage(ctx, today.AddDate(0, 0, -1))
+		require.NoError(t, err)
+		require.Len(t, samples, 2)
+		assert.Equal(t, int64(3), samples[0].Bytes)
+		assert.Equal(t, int64(2), samples[1].Bytes)
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		require.NoError(t, repo.Create(ctx, &files.File{ID: "5", Name: "quarterly-report-2024.pdf", Tag: "finance", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, repo.Create(ctx, &files.File{ID: "6", Name: "notes.txt", Tag: "reports", CreatedAt: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)}))
+		require.NoError(t, repo.Create(ctx, &files.File{ID: "7", Name: "build.log", CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+			Attributes: map[string]string{"commit": "abc123", "branch": "release-v1.2"}}))
+
+		search := func(terms ...string) []string {
+			fileList, err := repo.Search(ctx, terms)
+			require.NoError(t, err)
+			var ids []string
+			for _, file := range fileList {
+				ids = append(ids, file.ID)
+			}
+			return ids
+		}
+
+		// Name matches rank above tag matches
+		assert.Equal(t, []string{"5", "6"}, search("report"))
+		assert.Equal(t, []string{"5"}, search("report", "finance"))
+		assert.Equal(t, []string{"7"}, search("abc"))
+		assert.Equal(t, []string{"7"}, search("release-v1.2"))
+		assert.Empty(t, search("v1.2-release"))
+		assert.Empty(t, search("missing"))
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := repo.List(cancelled)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.ErrorIs(t, repo.Delete(cancelled, "2"), context.Canceled)
+	})
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := NewStorage()
+
+	file, err := storage.Save(ctx, "1", "a.txt", "text/plain", strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("hello world")), file.Size)
+
+	content, err := storage.GetContent(ctx, "1")
+	require.NoError(t, err)
+	defer content.Close()
+
+	// Range downloads seek within the content
+	seeker, ok := content.(io.Seeker)
+	require.True(t, ok)
+	_, err = seeker.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(content)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(rest))
+
+	exists, err := storage.Exists(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	require.NoError(t, storage.Delete(ctx, "1"))
+	_, err = storage.GetContent(ctx, "1")
+	assert.Error(t, err)
+	exists, err = storage.Exists(ctx, "1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,111 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// Storage implements files.FileStorage in memory
+type Storage struct {
+	mu       sync.RWMutex
+	contents map[string][]byte
+}
+
+// NewStorage creates an empty in-memory storage
+func NewStorage() *Storage {
+	return &Storage{
+		contents: make(map[string][]byte),
+	}
+}
+
+// Save stores a file and returns its metadata
+func (s *Storage) Save(ctx context.Context, id string, name string, mimeType string, content io.Reader) (*files.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(&contextReader{ctx: ctx, r: content})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write file content: %w", err)
+	}
+
+	s.mu.Lock()
+	s.contents[id] = data
+	s.mu.Unlock()
+
+	return &files.File{
+		ID:        id,
+		Name:      name,
+		Size:      int64(len(data)),
+		MimeType:  mimeType,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(24 * time.Hour), // Default TTL, will be overridden by service
+	}, nil
+}
+
+// Delete removes a file by ID
+func (s *Storage) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.contents, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// GetContent returns a reader for the file content. The reader also
+// implements io.Seeker, like the files returned by fs.Storage.
+func (s *Storage) GetContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	data, ok := s.contents[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, files.ErrNotFound
+	}
+
+	return readSeekNopCloser{bytes.NewReader(data)}, nil
+}
+
+// Exists reports whether content is stored under an ID
+func (s *Storage) Exists(ctx context.Context, id string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	_, ok := s.contents[id]
+	s.mu.RUnlock()
+	return ok, nil
+}
+
+// readSeekNopCloser adds a no-op Close to a bytes.Reader
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+// contextReader stops a read once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
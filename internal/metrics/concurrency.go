@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Concurrency tracks requests held back by concurrency limits, by kind of
+// request (e.g. upload or download). A nil *Concurrency records nothing.
+type Concurrency struct {
+	inFlight  *prometheus.GaugeVec
+	queued    *prometheus.GaugeVec
+	rejected  *prometheus.CounterVec
+	queueWait *prometheus.HistogramVec
+}
+
+// NewConcurrency creates the concurrency limit metrics
+func NewConcurrency() *Concurrency {
+	return &Concurrency{
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "files_stash_requests_in_flight",
+			Help: "Requests holding a concurrency slot, by kind.",
+		}, []string{"kind"}),
+		queued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "files_stash_requests_queued",
+			Help: "Requests waiting for a concurrency slot, by kind.",
+		}, []string{"kind"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "files_stash_requests_rejected_total",
+			Help: "Requests rejected after waiting too long for a concurrency slot, by kind.",
+		}, []string{"kind"}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "files_stash_request_queue_wait_seconds",
+			Help:    "Time requests waited for a concurrency slot, by kind.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10), // 1ms to 4m
+		}, []string{"kind"}),
+	}
+}
+
+// Register adds the metrics to a registry
+func (c *Concurrency) Register(reg prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{c.inFlight, c.queued, c.rejected, c.queueWait} {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queued records a request starting to wait for a slot
+func (c *Concurrency) Queued(kind string) {
+	if c == nil {
+		return
+	}
+	c.queued.WithLabelValues(kind).Inc()
+}
+
+// Dequeued records a request done waiting after waited, either admitted to
+// a slot or rejected
+func (c *Concurrency) Dequeued(kind string, waited time.Duration, admitted bool) {
+	if c == nil {
+		return
+	}
+	c.queued.WithLabelValues(kind).Dec()
+	c.queueWait.WithLabelValues(kind).Observe(waited.Seconds())
+	if admitted {
+		c.inFlight.WithLabelValues(kind).Inc()
+	} else {
+		c.rejected.WithLabelValues(kind).Inc()
+	}
+}
+
+// Released records a request giving up its slot
+func (c *Concurrency) Released(kind string) {
+	if c == nil {
+		return
+	}
+	c.inFlight.WithLabelValues(kind).Dec()
+}
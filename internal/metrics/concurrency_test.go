@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrency(t *testing.T) {
+	c := NewConcurrency()
+	require.NoError(t, c.Register(prometheus.NewRegistry()))
+
+	c.Queued("upload")
+	c.Queued("upload")
+	assert.Equal(t, 2.0, testutil.ToFloat64(c.queued.WithLabelValues("upload")))
+
+	c.Dequeued("upload", time.Millisecond, true)
+	c.Dequeued("upload", time.Second, false)
+	assert.Equal(t, 0.0, testutil.ToFloat64(c.queued.WithLabelValues("upload")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.inFlight.WithLabelValues("upload")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.rejected.WithLabelValues("upload")))
+
+	c.Released("upload")
+	assert.Equal(t, 0.0, testutil.ToFloat64(c.inFlight.WithLabelValues("upload")))
+
+	var nilConcurrency *Concurrency
+	assert.NotPanics(t, func() {
+		nilConcurrency.Queued("upload")
+		nilConcurrency.Dequeued("upload", 0, true)
+		nilConcurrency.Released("upload")
+	})
+}
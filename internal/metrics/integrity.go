@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Integrity tracks the verification of stored content against the
+// checksums taken on upload. A nil *Integrity records nothing.
+type Integrity struct {
+	verified *prometheus.CounterVec
+	corrupt  prometheus.Gauge
+}
+
+// NewIntegrity creates the integrity verification metrics
+func NewIntegrity() *Integrity {
+	return &Integrity{
+		verified: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "files_stash_integrity_verifications_total",
+			Help: "Files whose stored content was verified, by result (ok, mismatch or missing).",
+		}, []string{"result"}),
+		corrupt: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "files_stash_integrity_corrupt_files",
+			Help: "Files whose content failed its last verification, as of the last scrub.",
+		}),
+	}
+}
+
+// Register adds the metrics to a registry
+func (i *Integrity) Register(reg prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{i.verified, i.corrupt} {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verified records a verification with its result
+func (i *Integrity) Verified(result string) {
+	if i == nil {
+		return
+	}
+	i.verified.WithLabelValues(result).Inc()
+}
+
+// SetCorrupt records how many files failed their last verification
+func (i *Integrity) SetCorrupt(files int) {
+	if i == nil {
+		return
+	}
+	i.corrupt.Set(float64(files))
+}
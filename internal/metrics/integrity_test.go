@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntegrity(t *testing.T) {
+	i := NewIntegrity()
+	require.NoError(t, i.Register(prometheus.NewRegistry()))
+
+	i.Verified("ok")
+	i.Verified("ok")
+	i.Verified("mismatch")
+	assert.Equal(t, 2.0, testutil.ToFloat64(i.verified.WithLabelValues("ok")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(i.verified.WithLabelValues("mismatch")))
+
+	i.SetCorrupt(3)
+	assert.Equal(t, 3.0, testutil.ToFloat64(i.corrupt))
+
+	var nilIntegrity *Integrity
+	assert.NotPanics(t, func() {
+		nilIntegrity.Verified("ok")
+		nilIntegrity.SetCorrupt(1)
+	})
+}
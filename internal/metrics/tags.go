@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label values for files that don't get a tag label of their own
+const (
+	OtherTag    = "other"
+	UntaggedTag = "untagged"
+)
+
+// Tags counts uploads and downloads per file tag. Tags are unbounded user
+// input, so only some get a label of their own to keep label cardinality in
+// check: the allowed tags when an allowlist is given, otherwise the first
+// limit distinct tags seen since startup. Every other tag is counted as
+// "other". A nil *Tags records nothing.
+type Tags struct {
+	allowed map[string]bool
+	limit   int
+
+	mu   sync.Mutex
+	seen map[string]bool
+
+	uploads       *prometheus.CounterVec
+	uploadBytes   *prometheus.CounterVec
+	uploadSizes   *prometheus.HistogramVec
+	downloads     *prometheus.CounterVec
+	downloadBytes *prometheus.CounterVec
+}
+
+// NewTags creates per-tag metrics labelling the allowed tags, or up to limit
+// tags when allowed is empty
+func NewTags(allowed []string, limit int) *Tags {
+	t := &Tags{
+		limit: limit,
+		seen:  make(map[string]bool),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "files_stash_uploads_total",
+			Help: "Files uploaded, by tag.",
+		}, []string{"tag"}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "files_stash_upload_bytes_total",
+			Help: "Bytes uploaded, by tag.",
+		}, []string{"tag"}),
+		uploadSizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "files_stash_upload_size_bytes",
+			Help:    "Size of uploaded files, by tag.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10), // 1 KiB to 256 MiB
+		}, []string{"tag"}),
+		downloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "files_stash_downloads_total",
+			Help: "Files downloaded, by tag.",
+		}, []string{"tag"}),
+		downloadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "files_stash_download_bytes_total",
+			Help: "Bytes served by downloads, by tag.",
+		}, []string{"tag"}),
+	}
+	if len(allowed) > 0 {
+		t.allowed = make(map[string]bool, len(allowed))
+		for _, tag := range allowed {
+			t.allowed[tag] = true
+		}
+	}
+	return t
+}
+
+// Register adds the metrics to a registry
+func (t *Tags) Register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{t.uploads, t.uploadBytes, t.uploadSizes, t.downloads, t.downloadBytes} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Uploaded records an uploaded file
+func (t *Tags) Uploaded(tag string, size int64) {
+	if t == nil {
+		return
+	}
+	label := t.label(tag)
+	t.uploads.WithLabelValues(label).Inc()
+	t.uploadBytes.WithLabelValues(label).Add(float64(size))
+	t.uploadSizes.WithLabelValues(label).Observe(float64(size))
+}
+
+// Downloaded records a download serving size bytes of a file
+func (t *Tags) Downloaded(tag string, size int64) {
+	if t == nil {
+		return
+	}
+	label := t.label(tag)
+	t.downloads.WithLabelValues(label).Inc()
+	t.downloadBytes.WithLabelValues(label).Add(float64(size))
+}
+
+// label returns the label value a tag is counted under
+func (t *Tags) label(tag string) string {
+	if tag == "" {
+		return UntaggedTag
+	}
+	if t.allowed != nil {
+		if t.allowed[tag] {
+			return tag
+		}
+		return OtherTag
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.seen[tag] {
+		if len(t.seen) >= t.limit {
+			return OtherTag
+		}
+		t.seen[tag] = true
+	}
+	return tag
+}
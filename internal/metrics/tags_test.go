@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTags(t *testing.T) {
+	t.Run("Allowlist", func(t *testing.T) {
+		tags := NewTags([]string{"release"}, 0)
+		require.NoError(t, tags.Register(prometheus.NewRegistry()))
+
+		tags.Uploaded("release", 10)
+		tags.Uploaded("nightly", 20)
+		tags.Uploaded("", 30)
+		tags.Downloaded("release", 5)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(tags.uploads.WithLabelValues("release")))
+		assert.Equal(t, 20.0, testutil.ToFloat64(tags.uploadBytes.WithLabelValues(OtherTag)))
+		assert.Equal(t, 30.0, testutil.ToFloat64(tags.uploadBytes.WithLabelValues(UntaggedTag)))
+		assert.Equal(t, 5.0, testutil.ToFloat64(tags.downloadBytes.WithLabelValues("release")))
+		assert.Equal(t, 3, testutil.CollectAndCount(tags.uploads))
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		tags := NewTags(nil, 2)
+		for _, tag := range []string{"a", "b", "c", "a", "d"} {
+			tags.Uploaded(tag, 1)
+		}
+
+		assert.Equal(t, 2.0, testutil.ToFloat64(tags.uploads.WithLabelValues("a")))
+		assert.Equal(t, 1.0, testutil.ToFloat64(tags.uploads.WithLabelValues("b")))
+		assert.Equal(t, 2.0, testutil.ToFloat64(tags.uploads.WithLabelValues(OtherTag)))
+		assert.Equal(t, 3, testutil.CollectAndCount(tags.uploads))
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		var tags *Tags
+		assert.NotPanics(t, func() {
+			tags.Uploaded("a", 1)
+			tags.Downloaded("a", 1)
+		})
+	})
+}
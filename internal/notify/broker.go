@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"context"
+	"sync"
+)
+
+// subscriberBuffer is the number of events a subscriber may fall behind by
+// before it misses events
+const subscriberBuffer = 64
+
+// Broker fans events out to subscribers in the process, such as clients of
+// the event stream. A subscriber that doesn't keep up misses events rather
+// than holding up the others.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+// NewBroker creates a broker without subscribers
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving events from now on, and a function
+// ending the subscription and closing the channel. The channel of a closed
+// broker is closed already.
+func (b *Broker) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(events)
+		return events, func() {}
+	}
+	b.subscribers[events] = struct{}{}
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.subscribers[events]; ok {
+				delete(b.subscribers, events)
+				close(events)
+			}
+		})
+	}
+}
+
+// Close ends every subscription, closing the subscribers' channels
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for events := range b.subscribers {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+// Notify hands the event to every subscriber with room for it
+func (b *Broker) Notify(ctx context.Context, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	ctx := context.Background()
+	broker := NewBroker()
+
+	events, unsubscribe := broker.Subscribe()
+	require.NoError(t, broker.Notify(ctx, NewEvent(EventFileUploaded, "uploaded", nil)))
+	event := <-events
+	assert.Equal(t, EventFileUploaded, event.Type)
+
+	// A subscriber that falls behind misses events instead of blocking
+	for range subscriberBuffer + 10 {
+		require.NoError(t, broker.Notify(ctx, NewEvent(EventFileDeleted, "deleted", nil)))
+	}
+	assert.Len(t, events, subscriberBuffer)
+
+	unsubscribe()
+	unsubscribe()
+	require.NoError(t, broker.Notify(ctx, NewEvent(EventFileDeleted, "deleted", nil)))
+	for range events {
+	}
+	assert.Empty(t, broker.subscribers)
+}
+
+func TestBrokerClose(t *testing.T) {
+	broker := NewBroker()
+	events, unsubscribe := broker.Subscribe()
+
+	// Closing ends the subscriptions, and unsubscribing after it is harmless
+	broker.Close()
+	_, ok := <-events
+	assert.False(t, ok)
+	unsubscribe()
+
+	// Later subscribers get a closed channel
+	late, unsubscribe := broker.Subscribe()
+	_, ok = <-late
+	assert.False(t, ok)
+	unsubscribe()
+	require.NoError(t, broker.Notify(context.Background(), NewEvent(EventFileDeleted, "deleted", nil)))
+}
@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Event types emitted by the server
+const (
+	EventFileUploaded    = "file.uploaded"
+	EventFileDeleted     = "file.deleted"
+	EventFileExpired     = "file.expired"
+	EventTagUpdated      = "tag.updated"
+	EventStorageForecast = "storage.forecast"
+	EventFilesExpiring   = "files.expiring"
+)
+
+// Event is a notification about something that happened in the stash
+type Event struct {
+	Type    string    `json:"event"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	Data    any       `json:"data,omitempty"`
+}
+
+// NewEvent creates an event stamped with the current time
+func NewEvent(eventType, message string, data any) Event {
+	return Event{Type: eventType, Message: message, Time: time.Now(), Data: data}
+}
+
+// Notifier delivers events to a sink such as a webhook or a chat channel
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// NewSink creates a notifier of the given kind: "webhook" posts the event as
+// JSON to target, "slack" posts its message to a Slack compatible incoming
+// webhook at target, "nats" and "kafka" publish it to the NATS subject or
+// Kafka topic at target, "email" mails it through the SMTP server at target
+// and "log" writes it to the server log. HTTP deliveries are signed with
+// secret.
+func NewSink(kind, target, secret string) (Notifier, error) {
+	switch kind {
+	case "webhook":
+		return NewWebhook(target, secret), nil
+	case "slack":
+		return NewChat(target, secret), nil
+	case "nats":
+		sink, err := NewNATS(target)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	case "kafka":
+		sink, err := NewKafka(target)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	case "email":
+		sink, err := NewEmail(target)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	case "log":
+		return Log{}, nil
+	default:
+		return nil, fmt.Errorf("unknown notification sink kind %q", kind)
+	}
+}
+
+// Router delivers each event to the sinks routed for its type and to the
+// sinks routed for "*", which receive every event.
+type Router struct {
+	sinks  map[string]Notifier
+	routes map[string][]string
+}
+
+// NewRouter creates a router over named sinks. routes maps event types (or
+// "*") to sink names; when empty, every event goes to every sink.
+func NewRouter(sinks map[string]Notifier, routes map[string][]string) (*Router, error) {
+	if len(routes) == 0 {
+		all := make([]string, 0, len(sinks))
+		for name := range sinks {
+			all = append(all, name)
+		}
+		routes = map[string][]string{"*": all}
+	}
+
+	for eventType, names := range routes {
+		for _, name := range names {
+			if _, ok := sinks[name]; !ok {
+				return nil, fmt.Errorf("route %q references unknown sink %q", eventType, name)
+			}
+		}
+	}
+
+	return &Router{sinks: sinks, routes: routes}, nil
+}
+
+// ParseSinks parses sink definitions in "name:kind:target" form, e.g.
+// "ops:webhook:https://hooks.example.com/stash", signing with secret
+func ParseSinks(definitions []string, secret string) (map[string]Notifier, error) {
+	sinks := make(map[string]Notifier, len(definitions))
+	for _, definition := range definitions {
+		name, rest, ok := strings.Cut(definition, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid sink %q, expected name:kind:target", definition)
+		}
+		if _, exists := sinks[name]; exists {
+			return nil, fmt.Errorf("duplicate sink %q", name)
+		}
+		kind, target, _ := strings.Cut(rest, ":")
+		sink, err := NewSink(kind, target, secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink %q: %w", name, err)
+		}
+		sinks[name] = sink
+	}
+	return sinks, nil
+}
+
+// Route adds sink to the sinks receiving events of eventType
+func (r *Router) Route(eventType, sinkName string, sink Notifier) {
+	r.sinks[sinkName] = sink
+	r.routes[eventType] = append(r.routes[eventType], sinkName)
+}
+
+// Notify delivers the event to every routed sink, returning the joined
+// errors of the sinks that failed
+func (r *Router) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	notified := make(map[string]bool)
+	for _, name := range append(r.routes[event.Type], r.routes["*"]...) {
+		if notified[name] {
+			continue
+		}
+		notified[name] = true
+		if err := r.sinks[name].Notify(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder collects the types of the events it's notified of
+type recorder struct {
+	events []string
+	err    error
+}
+
+func (r *recorder) Notify(ctx context.Context, event Event) error {
+	r.events = append(r.events, event.Type)
+	return r.err
+}
+
+func TestRouter(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string][]string
+		event  string
+		want   []string // sinks notified
+	}{
+		{
+			name:  "no routes reach every sink",
+			event: EventFileUploaded,
+			want:  []string{"chat", "ops", "bus"},
+		},
+		{
+			name:   "routed type",
+			routes: map[string][]string{EventStorageForecast: {"ops"}, EventFileUploaded: {"bus"}},
+			event:  EventStorageForecast,
+			want:   []string{"ops"},
+		},
+		{
+			name:   "unrouted type",
+			routes: map[string][]string{EventStorageForecast: {"ops"}},
+			event:  EventFileDeleted,
+			want:   nil,
+		},
+		{
+			name:   "wildcard",
+			routes: map[string][]string{"*": {"bus"}, EventStorageForecast: {"ops"}},
+			event:  EventFileDeleted,
+			want:   []string{"bus"},
+		},
+		{
+			name:   "wildcard and routed type",
+			routes: map[string][]string{"*": {"bus"}, EventStorageForecast: {"ops", "chat"}},
+			event:  EventStorageForecast,
+			want:   []string{"chat", "ops", "bus"},
+		},
+		{
+			name:   "sink routed twice is notified once",
+			routes: map[string][]string{"*": {"ops"}, EventTagUpdated: {"ops"}},
+			event:  EventTagUpdated,
+			want:   []string{"ops"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sinks := map[string]*recorder{"chat": {}, "ops": {}, "bus": {}}
+			notifiers := make(map[string]Notifier)
+			for name, sink := range sinks {
+				notifiers[name] = sink
+			}
+			router, err := NewRouter(notifiers, tt.routes)
+			require.NoError(t, err)
+
+			require.NoError(t, router.Notify(context.Background(), NewEvent(tt.event, "", nil)))
+			for name, sink := range sinks {
+				if slices.Contains(tt.want, name) {
+					assert.Equal(t, []string{tt.event}, sink.events, name)
+				} else {
+					assert.Empty(t, sink.events, name)
+				}
+			}
+		})
+	}
+}
+
+func TestRouterUnknownSink(t *testing.T) {
+	_, err := NewRouter(map[string]Notifier{"ops": &recorder{}}, map[string][]string{EventFileUploaded: {"ops", "pager"}})
+	assert.ErrorContains(t, err, `unknown sink "pager"`)
+}
+
+func TestRouterFailures(t *testing.T) {
+	failure := errors.New("unreachable")
+	failing := &recorder{err: failure}
+	working := &recorder{}
+	router, err := NewRouter(map[string]Notifier{"failing": failing, "working": working}, nil)
+	require.NoError(t, err)
+
+	// A failing sink doesn't keep the event from the others
+	err = router.Notify(context.Background(), NewEvent(EventFileExpired, "", nil))
+	assert.ErrorIs(t, err, failure)
+	assert.ErrorContains(t, err, "sink failing")
+	assert.Equal(t, []string{EventFileExpired}, working.events)
+}
+
+func TestRouterRoute(t *testing.T) {
+	ops := &recorder{}
+	router, err := NewRouter(map[string]Notifier{"ops": ops}, map[string][]string{EventStorageForecast: {"ops"}})
+	require.NoError(t, err)
+
+	report := &recorder{}
+	router.Route(EventFilesExpiring, "report", report)
+	require.NoError(t, router.Notify(context.Background(), NewEvent(EventFilesExpiring, "", nil)))
+	assert.Equal(t, []string{EventFilesExpiring}, report.events)
+	assert.Empty(t, ops.events)
+}
+
+func TestParseSinks(t *testing.T) {
+	sinks, err := ParseSinks([]string{"ops:webhook:https://hooks.example.com/stash", "audit:log"}, "secret")
+	require.NoError(t, err)
+	assert.IsType(t, &Webhook{}, sinks["ops"])
+	assert.IsType(t, Log{}, sinks["audit"])
+
+	for _, definitions := range [][]string{
+		{"webhook"},
+		{":log"},
+		{"ops:log", "ops:log"},
+		{"ops:pager:https://pager.example.com"},
+	} {
+		_, err := ParseSinks(definitions, "")
+		assert.Error(t, err, definitions)
+	}
+}
@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// NATS publishes events as JSON to a NATS subject per event type, the
+// configured subject followed by the type, e.g. "stash.file.uploaded", so
+// subscribers pick events with wildcards like "stash.file.>"
+type NATS struct {
+	url     string
+	subject string
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+// NewNATS creates a NATS publisher from a "nats://host:4222/subject"
+// target. The connection is made on the first event and kept.
+func NewNATS(target string) (*NATS, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS target %q, expected nats://host:port/subject", target)
+	}
+	subject := strings.Trim(u.Path, "/")
+	if subject == "" || strings.ContainsAny(subject, " */>") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+	u.Path = ""
+	return &NATS{url: u.String(), subject: subject}, nil
+}
+
+// Notify publishes the event and waits for the server to have it
+func (n *NATS) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	conn, err := n.connect()
+	if err != nil {
+		return err
+	}
+	if err := conn.Publish(n.subject+"."+event.Type, body); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	if err := conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	return nil
+}
+
+// connect returns the connection to NATS, establishing it if needed. The
+// client reconnects by itself once connected.
+func (n *NATS) connect() (*nats.Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn != nil && !n.conn.IsClosed() {
+		return n.conn, nil
+	}
+	conn, err := nats.Connect(n.url, nats.Name("files-stash"), nats.Timeout(publishTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	n.conn = conn
+	return conn, nil
+}
+
+// Kafka publishes events as JSON messages to a Kafka topic, with the event
+// type as message key and "event" header
+type Kafka struct {
+	writer *kafka.Writer
+}
+
+// NewKafka creates a Kafka publisher from a "host:9092|host2:9092/topic"
+// target. Brokers are separated by "|", since commas separate sinks.
+func NewKafka(target string) (*Kafka, error) {
+	brokers, topic, ok := strings.Cut(target, "/")
+	if !ok || brokers == "" || topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("invalid Kafka target %q, expected host:port[|host:port]/topic", target)
+	}
+	return &Kafka{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(brokers, "|")...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		WriteTimeout: publishTimeout,
+	}}, nil
+}
+
+// Notify publishes the event and waits for the brokers to have it
+func (k *Kafka) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	err = k.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(event.Type),
+		Value:   body,
+		Headers: []kafka.Header{{Key: "event", Value: []byte(event.Type)}},
+		Time:    event.Time,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	return nil
+}
+
+// publishTimeout bounds the delivery of an event to a message broker, like
+// the HTTP client timeout does for webhooks
+const publishTimeout = 10 * time.Second
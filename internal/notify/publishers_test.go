@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPublishers(t *testing.T) {
+	for _, target := range []string{"nats://localhost:4222/stash", "tls://nats.example.com:4222/stash.events"} {
+		_, err := NewSink("nats", target, "")
+		assert.NoError(t, err, target)
+	}
+	for _, target := range []string{"localhost:4222/stash", "nats:///stash", "nats://localhost:4222", "nats://localhost:4222/stash.*"} {
+		sink, err := NewSink("nats", target, "")
+		assert.Error(t, err, target)
+		assert.Nil(t, sink, target)
+	}
+
+	for _, target := range []string{"localhost:9092/stash", "kafka1:9092|kafka2:9092/stash"} {
+		_, err := NewSink("kafka", target, "")
+		assert.NoError(t, err, target)
+	}
+	for _, target := range []string{"localhost:9092", "/stash", "localhost:9092/"} {
+		sink, err := NewSink("kafka", target, "")
+		assert.Error(t, err, target)
+		assert.Nil(t, sink, target)
+	}
+}
+
+func TestNATS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	published := make(chan [2]string, 1)
+	go serveNATS(ln, published)
+
+	sink, err := NewNATS("nats://" + ln.Addr().String() + "/stash")
+	require.NoError(t, err)
+	event := NewEvent(EventFileUploaded, "uploaded", map[string]string{"id": "1"})
+	require.NoError(t, sink.Notify(context.Background(), event))
+
+	msg := <-published
+	assert.Equal(t, "stash.file.uploaded", msg[0])
+	var got Event
+	require.NoError(t, json.Unmarshal([]byte(msg[1]), &got))
+	assert.Equal(t, EventFileUploaded, got.Type)
+	assert.Equal(t, map[string]any{"id": "1"}, got.Data)
+}
+
+// serveNATS speaks enough of the NATS protocol to a single client to accept
+// a connection and pass on the messages it publishes
+func serveNATS(ln net.Listener, published chan<- [2]string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, `INFO {"server_id":"test","version":"2.10.0","max_payload":1048576}`+"\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			published <- [2]string{fields[1], string(payload[:size])}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers set on every webhook delivery
+const (
+	HeaderDeliveryID = "X-Files-Stash-Delivery"
+	HeaderTimestamp  = "X-Files-Stash-Timestamp"
+	HeaderSignature  = "X-Files-Stash-Signature"
+)
+
+// SignatureTolerance is how old a delivery may be before receivers should
+// reject it as a possible replay
+const SignatureTolerance = 5 * time.Minute
+
+var (
+	// ErrInvalidSignature is returned when a delivery's signature doesn't match
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+
+	// ErrStaleDelivery is returned when a delivery's timestamp is outside the tolerance
+	ErrStaleDelivery = errors.New("webhook delivery timestamp outside tolerance")
+)
+
+// SigningScheme describes how receivers verify deliveries
+type SigningScheme struct {
+	Algorithm        string            `json:"algorithm"`
+	Headers          map[string]string `json:"headers"`
+	SignedPayload    string            `json:"signed_payload"`
+	SignatureFormat  string            `json:"signature_format"`
+	ToleranceSeconds int               `json:"tolerance_seconds"`
+	Replay           string            `json:"replay_protection"`
+	Events           []string          `json:"events"`
+}
+
+// Scheme is the verification scheme of webhook deliveries
+var Scheme = SigningScheme{
+	Algorithm: "HMAC-SHA256",
+	Headers: map[string]string{
+		HeaderDeliveryID: "unique ID of the delivery",
+		HeaderTimestamp:  "Unix time the delivery was sent, in seconds",
+		HeaderSignature:  "signature of the delivery",
+	},
+	SignedPayload:    "<timestamp>.<delivery ID>.<raw request body>",
+	SignatureFormat:  "sha256=<hex encoded HMAC of the signed payload keyed with the webhook secret>",
+	ToleranceSeconds: int(SignatureTolerance / time.Second),
+	Replay:           "reject deliveries whose timestamp is outside the tolerance and delivery IDs already seen within it",
+	Events:           []string{EventFileUploaded, EventFileDeleted, EventFileExpired, EventTagUpdated, EventStorageForecast, EventFilesExpiring},
+}
+
+// sign sets the delivery headers on a request. The signature is omitted
+// when there is no secret.
+func sign(req *http.Request, body []byte, secret string, now time.Time) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	deliveryID := hex.EncodeToString(id)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req.Header.Set(HeaderDeliveryID, deliveryID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if secret != "" {
+		req.Header.Set(HeaderSignature, signature(secret, timestamp, deliveryID, body))
+	}
+}
+
+// signature computes the signature header value of a delivery
+func signature(secret, timestamp, deliveryID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + deliveryID + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a delivery's signature and that it was sent within the
+// tolerance of now. Receivers should also reject delivery IDs they've
+// already processed.
+func Verify(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get(HeaderTimestamp)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleDelivery
+	}
+	if age := now.Sub(time.Unix(sent, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return ErrStaleDelivery
+	}
+
+	got, ok := strings.CutPrefix(header.Get(HeaderSignature), "sha256=")
+	if !ok {
+		return ErrInvalidSignature
+	}
+	want, _ := strings.CutPrefix(signature(secret, timestamp, header.Get(HeaderDeliveryID), body), "sha256=")
+	if !hmac.Equal([]byte(got), []byte(want)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
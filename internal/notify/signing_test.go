@@ -0,0 +1,53 @@
+package notify
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"event":"file.uploaded"}`)
+
+	signed := func(secret string, at time.Time) http.Header {
+		req, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+		sign(req, body, secret, at)
+		return req.Header
+	}
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		body     []byte
+		expected error
+	}{
+		{name: "valid", header: signed("secret", now), body: body},
+		{name: "within tolerance", header: signed("secret", now.Add(-4*time.Minute)), body: body},
+		{name: "tampered body", header: signed("secret", now), body: []byte(`{"event":"file.deleted"}`), expected: ErrInvalidSignature},
+		{name: "wrong secret", header: signed("other", now), body: body, expected: ErrInvalidSignature},
+		{name: "unsigned", header: signed("", now), body: body, expected: ErrInvalidSignature},
+		{name: "replayed late", header: signed("secret", now.Add(-6*time.Minute)), body: body, expected: ErrStaleDelivery},
+		{name: "from the future", header: signed("secret", now.Add(6*time.Minute)), body: body, expected: ErrStaleDelivery},
+		{name: "missing timestamp", header: http.Header{}, body: body, expected: ErrStaleDelivery},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify("secret", tt.header, tt.body, now)
+			if tt.expected == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.expected)
+			}
+		})
+	}
+
+	t.Run("changed delivery ID", func(t *testing.T) {
+		header := signed("secret", now)
+		header.Set(HeaderDeliveryID, "replayed")
+		assert.ErrorIs(t, Verify("secret", header, body, now), ErrInvalidSignature)
+	})
+}
@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// client is shared by the HTTP based sinks
+var client = &http.Client{Timeout: 10 * time.Second, Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// Webhook posts events as JSON to a URL, signed with secret
+type Webhook struct {
+	url    string
+	secret string
+}
+
+// NewWebhook creates a webhook sink
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{url: url, secret: secret}
+}
+
+// Notify posts the event
+func (h *Webhook) Notify(ctx context.Context, event Event) error {
+	return postJSON(ctx, h.url, h.secret, event)
+}
+
+// Chat posts event messages to a Slack compatible incoming webhook, signed
+// with secret
+type Chat struct {
+	url    string
+	secret string
+}
+
+// NewChat creates a chat sink
+func NewChat(url, secret string) *Chat {
+	return &Chat{url: url, secret: secret}
+}
+
+// Notify posts the event message
+func (c *Chat) Notify(ctx context.Context, event Event) error {
+	return postJSON(ctx, c.url, c.secret, map[string]string{"text": event.Message})
+}
+
+// Log writes events to the server log
+type Log struct{}
+
+// Notify logs the event
+func (Log) Notify(ctx context.Context, event Event) error {
+	slog.InfoContext(ctx, "Notification", "event", event.Type, "message", event.Message)
+	return nil
+}
+
+// postJSON posts a signed JSON body, treating non-2xx responses as errors
+func postJSON(ctx context.Context, url, secret string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sign(req, body, secret, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Switch delivers events to a notifier that can be replaced while events
+// are being delivered, e.g. when the configuration is reloaded
+type Switch struct {
+	current atomic.Pointer[switched]
+}
+
+// switched wraps the current notifier, which atomic.Pointer can't hold as
+// an interface
+type switched struct {
+	notifier Notifier
+}
+
+// NewSwitch creates a switch delivering events to notifier
+func NewSwitch(notifier Notifier) *Switch {
+	s := &Switch{}
+	s.Set(notifier)
+	return s
+}
+
+// Set replaces the notifier. Deliveries already started finish with the
+// one they started with.
+func (s *Switch) Set(notifier Notifier) {
+	s.current.Store(&switched{notifier: notifier})
+}
+
+// Notify delivers the event to the current notifier, if there is one
+func (s *Switch) Notify(ctx context.Context, event Event) error {
+	current := s.current.Load()
+	if current == nil || current.notifier == nil {
+		return nil
+	}
+	return current.notifier.Notify(ctx, event)
+}
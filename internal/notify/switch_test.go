@@ -0,0 +1,31 @@
+package notify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwitch(t *testing.T) {
+	ctx := context.Background()
+	before, after := NewBroker(), NewBroker()
+	beforeEvents, unsubscribe := before.Subscribe()
+	defer unsubscribe()
+	afterEvents, unsubscribe := after.Subscribe()
+	defer unsubscribe()
+
+	s := NewSwitch(before)
+	require.NoError(t, s.Notify(ctx, NewEvent(EventFileUploaded, "uploaded", nil)))
+	s.Set(after)
+	require.NoError(t, s.Notify(ctx, NewEvent(EventFileDeleted, "deleted", nil)))
+
+	assert.Equal(t, EventFileUploaded, (<-beforeEvents).Type)
+	assert.Equal(t, EventFileDeleted, (<-afterEvents).Type)
+	assert.Empty(t, beforeEvents)
+
+	// Without a notifier events are dropped
+	s.Set(nil)
+	assert.NoError(t, s.Notify(ctx, NewEvent(EventFileDeleted, "deleted", nil)))
+}
@@ -0,0 +1,364 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	filesv1 "github.com/pavel-fokin/files-stash/api/files/v1"
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/siem"
+)
+
+// adminUser is the identity of admin token holders, matching the HTTP API
+const adminUser = "admin"
+
+// viewerUser is the identity of viewer token holders, matching the HTTP API
+const viewerUser = "viewer"
+
+// chunkSize is the size of content chunks streamed to download clients
+const chunkSize = 32 * 1024
+
+// viewerMethods are the read-only methods open to viewer token holders
+var viewerMethods = map[string]bool{
+	filesv1.FilesService_Download_FullMethodName:       true,
+	filesv1.FilesService_List_FullMethodName:           true,
+	filesv1.FilesService_GetLatestByTag_FullMethodName: true,
+}
+
+// userKey is the context key of the authenticated caller identity
+type userKey struct{}
+
+// Server implements the FilesService gRPC API on top of files.Service
+type Server struct {
+	filesv1.UnimplementedFilesServiceServer
+	fileService *files.Service
+	maxSize     int64
+}
+
+// Options configure who may call a gRPC server and what they may upload
+type Options struct {
+	AdminToken string
+	// ViewerToken, when set, admits callers to the read-only methods
+	ViewerToken string
+	// MaxSize caps the size of uploads
+	MaxSize int64
+	// Admits, when set, refuses calls from peers at addresses it rejects
+	Admits func(addr net.Addr) bool
+	// TLS, when set, serves the API over TLS
+	TLS *tls.Config
+	// AdminCert, when set, authenticates admins by the verified client
+	// certificates it accepts instead of the admin token, which then only
+	// opens the read-only methods, as on the HTTP API
+	AdminCert func(state tls.ConnectionState) bool
+	// Events receives refused calls and admin calls to methods that change
+	// state
+	Events *siem.Emitter
+}
+
+// NewServer creates a gRPC server exposing the file service to clients
+// holding the admin token, as configured by opts
+func NewServer(fileService *files.Service, opts Options) *grpc.Server {
+	events := opts.Events
+	var serverOpts []grpc.ServerOption
+	if opts.TLS != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(opts.TLS)))
+	}
+	srv := grpc.NewServer(append(serverOpts,
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			user, err := authorize(ctx, info.FullMethod, opts)
+			if err != nil {
+				emit(ctx, events, info.FullMethod, "", err)
+				return nil, err
+			}
+			resp, err := handler(context.WithValue(ctx, userKey{}, user), req)
+			emit(ctx, events, info.FullMethod, user, err)
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			user, err := authorize(ss.Context(), info.FullMethod, opts)
+			if err != nil {
+				emit(ss.Context(), events, info.FullMethod, "", err)
+				return err
+			}
+			err = handler(srv, ss)
+			emit(ss.Context(), events, info.FullMethod, user, err)
+			return err
+		}),
+	)...)
+	filesv1.RegisterFilesServiceServer(srv, &Server{fileService: fileService, maxSize: opts.MaxSize})
+	return srv
+}
+
+// authorize checks the address of the peer and the bearer token in the
+// request metadata and returns the caller identity, rejecting viewers
+// calling methods that change state
+func authorize(ctx context.Context, method string, opts Options) (string, error) {
+	if opts.Admits != nil {
+		if p, ok := peer.FromContext(ctx); !ok || !opts.Admits(p.Addr) {
+			return "", status.Error(codes.PermissionDenied, "address not allowed")
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && opts.AdminCert != nil {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && opts.AdminCert(info.State) {
+			return adminUser, nil
+		}
+	}
+	adminToken, viewerToken := opts.AdminToken, opts.ViewerToken
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", status.Error(codes.Unauthenticated, "missing authorization metadata")
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	switch {
+	case ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1:
+		if opts.AdminCert != nil && !viewerMethods[method] {
+			return "", status.Error(codes.Unauthenticated, "client certificate required")
+		}
+		return adminUser, nil
+	case ok && viewerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(viewerToken)) == 1:
+		if !viewerMethods[method] {
+			return "", status.Error(codes.PermissionDenied, "viewer token is read-only")
+		}
+		return viewerUser, nil
+	default:
+		return "", status.Error(codes.Unauthenticated, "invalid token")
+	}
+}
+
+// emit sends a security event for a refused call, or for an admin call to a
+// method that changes state; read-only calls that went through are skipped
+func emit(ctx context.Context, events *siem.Emitter, method, user string, err error) {
+	event := siem.Event{Protocol: "grpc", User: user, Method: "POST", Path: method}
+	if p, ok := peer.FromContext(ctx); ok {
+		event.RemoteAddr = p.Addr.String()
+	}
+	switch code := status.Code(err); {
+	case code == codes.Unauthenticated && user == "":
+		event.Type = siem.EventAuthFailure
+	case code == codes.PermissionDenied:
+		event.Type = siem.EventPermissionDenied
+	case user == adminUser && !viewerMethods[method]:
+		event.Type = siem.EventAdminAction
+	default:
+		return
+	}
+	event.Status = int(status.Code(err))
+	events.Emit(event)
+}
+
+// userFromContext returns the caller identity set by the interceptor
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// Upload stores a file streamed as a metadata message and content chunks
+func (s *Server) Upload(stream grpc.ClientStreamingServer[filesv1.UploadRequest, filesv1.UploadResponse]) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	meta := first.GetMetadata()
+	if meta == nil {
+		return status.Error(codes.InvalidArgument, "first message must carry metadata")
+	}
+
+	var content bytes.Buffer
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if req.GetMetadata() != nil {
+			return status.Error(codes.InvalidArgument, "metadata must only be sent once")
+		}
+		if int64(content.Len()+len(req.GetChunk())) > s.maxSize {
+			return status.Error(codes.ResourceExhausted, "file too large")
+		}
+		content.Write(req.GetChunk())
+	}
+
+	result, err := s.fileService.Upload(stream.Context(), &files.UploadRequest{
+		Name:        meta.GetName(),
+		MimeType:    meta.GetMimeType(),
+		Tag:         meta.GetTag(),
+		Description: meta.GetDescription(),
+		Link:        meta.GetLink(),
+		Pinned:      meta.GetPinned(),
+		TTL:         meta.GetTtl().AsDuration(),
+		Content:     &content,
+	})
+	if err != nil {
+		slog.Error("gRPC upload failed", "error", err, "filename", meta.GetName())
+		return uploadError(err)
+	}
+
+	return stream.SendAndClose(&filesv1.UploadResponse{
+		File:    resultToProto(result),
+		Url:     result.URL,
+		Receipt: result.Receipt,
+	})
+}
+
+// Download streams a file's metadata followed by its content in chunks
+func (s *Server) Download(req *filesv1.DownloadRequest, stream grpc.ServerStreamingServer[filesv1.DownloadResponse]) error {
+	file, content, err := s.fileService.Open(stream.Context(), req.GetId())
+	if err != nil {
+		return status.Error(codes.NotFound, "file not found")
+	}
+	defer content.Close()
+
+	if err := stream.Send(&filesv1.DownloadResponse{Data: &filesv1.DownloadResponse_File{File: toProto(file)}}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := content.Read(buf)
+		if n > 0 {
+			chunk := &filesv1.DownloadResponse{Data: &filesv1.DownloadResponse_Chunk{Chunk: buf[:n]}}
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			slog.Error("gRPC download failed", "error", err, "file_id", req.GetId())
+			return status.Error(codes.Internal, "failed to read file")
+		}
+	}
+}
+
+// List returns the files matching the request filter
+func (s *Server) List(ctx context.Context, req *filesv1.ListRequest) (*filesv1.ListResponse, error) {
+	fileList, err := s.fileService.List(ctx, userFromContext(ctx), files.ListFilter{
+		Tag:       req.GetTag(),
+		MimeType:  req.GetMimeType(),
+		MinSize:   req.GetMinSize(),
+		MaxSize:   req.GetMaxSize(),
+		OlderThan: req.GetOlderThan().AsDuration(),
+		NewerThan: req.GetNewerThan().AsDuration(),
+		Starred:   req.GetStarred(),
+	})
+	if err != nil {
+		slog.Error("gRPC list failed", "error", err)
+		return nil, status.Error(codes.Internal, "failed to list files")
+	}
+
+	resp := &filesv1.ListResponse{Files: make([]*filesv1.File, 0, len(fileList))}
+	for _, file := range fileList {
+		resp.Files = append(resp.Files, toProto(file))
+	}
+	return resp, nil
+}
+
+// Delete removes a file
+func (s *Server) Delete(ctx context.Context, req *filesv1.DeleteRequest) (*filesv1.DeleteResponse, error) {
+	if err := s.fileService.Delete(ctx, userFromContext(ctx), req.GetId(), ""); err != nil {
+		slog.Error("gRPC delete failed", "error", err, "file_id", req.GetId())
+		if errors.Is(err, files.ErrReadOnly) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, status.Error(codes.NotFound, "delete failed")
+	}
+	return &filesv1.DeleteResponse{}, nil
+}
+
+// GetLatestByTag returns the latest file with a tag and its signed URL
+func (s *Server) GetLatestByTag(ctx context.Context, req *filesv1.GetLatestByTagRequest) (*filesv1.GetLatestByTagResponse, error) {
+	var asOf time.Time
+	if req.GetAsOf() != nil {
+		asOf = req.GetAsOf().AsTime()
+	}
+
+	result, err := s.fileService.GetLatestByTag(ctx, req.GetTag(), asOf)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "file not found")
+	}
+
+	return &filesv1.GetLatestByTagResponse{File: resultToProto(result), Url: result.URL}, nil
+}
+
+// uploadError maps upload validation errors to gRPC status codes
+func uploadError(err error) error {
+	switch {
+	case errors.Is(err, files.ErrInvalidLink):
+		return status.Error(codes.InvalidArgument, files.ErrInvalidLink.Error())
+	case errors.Is(err, files.ErrInvalidAttribute), errors.Is(err, files.ErrFilenameTemplate):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, files.ErrMimeTypeMismatch):
+		return status.Error(codes.InvalidArgument, files.ErrMimeTypeMismatch.Error())
+	case errors.Is(err, files.ErrMimeTypeNotAllowed):
+		return status.Error(codes.InvalidArgument, files.ErrMimeTypeNotAllowed.Error())
+	case errors.Is(err, files.ErrReadOnly):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, files.ErrInsufficientStorage):
+		return status.Error(codes.ResourceExhausted, files.ErrInsufficientStorage.Error())
+	case errors.Is(err, files.ErrInfected):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, files.ErrScanFailed):
+		return status.Error(codes.Unavailable, files.ErrScanFailed.Error())
+	default:
+		return status.Error(codes.Internal, "upload failed")
+	}
+}
+
+// toProto converts file metadata to its protobuf message
+func toProto(file *files.File) *filesv1.File {
+	return &filesv1.File{
+		Id:               file.ID,
+		Name:             file.Name,
+		Tag:              file.Tag,
+		Size:             file.Size,
+		MimeType:         file.MimeType,
+		DetectedMimeType: file.DetectedMimeType,
+		Sha256:           file.Checksum,
+		Description:      file.Description,
+		Link:             file.Link,
+		Pinned:           file.Pinned,
+		Status:           file.Status,
+		CreatedAt:        timestamppb.New(file.CreatedAt),
+		ExpiresAt:        timestamppb.New(file.ExpiresAt),
+	}
+}
+
+// resultToProto converts the file metadata of an upload result
+func resultToProto(result *files.UploadResult) *filesv1.File {
+	return toProto(&files.File{
+		ID:               result.ID,
+		Name:             result.Name,
+		Tag:              result.Tag,
+		Size:             result.Size,
+		MimeType:         result.MimeType,
+		DetectedMimeType: result.DetectedMimeType,
+		Checksum:         result.Checksum,
+		Description:      result.Description,
+		Link:             result.Link,
+		Pinned:           result.Pinned,
+		Status:           result.Status,
+		CreatedAt:        result.CreatedAt,
+		ExpiresAt:        result.ExpiresAt,
+	})
+}
@@ -0,0 +1,245 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	filesv1 "github.com/pavel-fokin/files-stash/api/files/v1"
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/memory"
+)
+
+const (
+	adminToken  = "test-token"
+	viewerToken = "viewer-token"
+)
+
+func setupTestClient(t *testing.T) filesv1.FilesServiceClient {
+	return setupTestClientWithOptions(t, nil)
+}
+
+// setupTestClientWithOptions lets the caller adjust the default server
+// options before the server is built
+func setupTestClientWithOptions(t *testing.T, configure func(opts *Options)) filesv1.FilesServiceClient {
+	fileService := files.NewService(memory.NewStorage(), memory.NewRepository(), "test-key", 5*time.Minute)
+	opts := Options{AdminToken: adminToken, ViewerToken: viewerToken, MaxSize: 1024}
+	if configure != nil {
+		configure(&opts)
+	}
+	srv := NewServer(fileService, opts)
+
+	listener := bufconn.Listen(1024 * 1024)
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return filesv1.NewFilesServiceClient(conn)
+}
+
+func authorized() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+adminToken)
+}
+
+func upload(t *testing.T, client filesv1.FilesServiceClient, meta *filesv1.UploadMetadata, chunks ...string) (*filesv1.UploadResponse, error) {
+	stream, err := client.Upload(authorized())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&filesv1.UploadRequest{Data: &filesv1.UploadRequest_Metadata{Metadata: meta}}))
+	for _, chunk := range chunks {
+		require.NoError(t, stream.Send(&filesv1.UploadRequest{Data: &filesv1.UploadRequest_Chunk{Chunk: []byte(chunk)}}))
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestFilesService(t *testing.T) {
+	client := setupTestClient(t)
+
+	uploaded, err := upload(t, client, &filesv1.UploadMetadata{Name: "notes.txt", Tag: "docs"}, "hello ", "grpc")
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", uploaded.GetFile().GetName())
+	assert.Equal(t, int64(len("hello grpc")), uploaded.GetFile().GetSize())
+	assert.Contains(t, uploaded.GetUrl(), "/v1/files/"+uploaded.GetFile().GetId())
+
+	t.Run("Download", func(t *testing.T) {
+		stream, err := client.Download(authorized(), &filesv1.DownloadRequest{Id: uploaded.GetFile().GetId()})
+		require.NoError(t, err)
+
+		first, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "notes.txt", first.GetFile().GetName())
+
+		var content bytes.Buffer
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			content.Write(msg.GetChunk())
+		}
+		assert.Equal(t, "hello grpc", content.String())
+	})
+
+	t.Run("List", func(t *testing.T) {
+		resp, err := client.List(authorized(), &filesv1.ListRequest{Tag: "docs"})
+		require.NoError(t, err)
+		require.Len(t, resp.GetFiles(), 1)
+		assert.Equal(t, uploaded.GetFile().GetId(), resp.GetFiles()[0].GetId())
+
+		resp, err = client.List(authorized(), &filesv1.ListRequest{Tag: "other"})
+		require.NoError(t, err)
+		assert.Empty(t, resp.GetFiles())
+	})
+
+	t.Run("GetLatestByTag", func(t *testing.T) {
+		resp, err := client.GetLatestByTag(authorized(), &filesv1.GetLatestByTagRequest{Tag: "docs"})
+		require.NoError(t, err)
+		assert.Equal(t, uploaded.GetFile().GetId(), resp.GetFile().GetId())
+		assert.Equal(t, uploaded.GetUrl(), resp.GetUrl())
+
+		_, err = client.GetLatestByTag(authorized(), &filesv1.GetLatestByTagRequest{
+			Tag:  "docs",
+			AsOf: timestamppb.New(uploaded.GetFile().GetCreatedAt().AsTime().Add(-time.Hour)),
+		})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		_, err := client.Delete(authorized(), &filesv1.DeleteRequest{Id: uploaded.GetFile().GetId()})
+		require.NoError(t, err)
+
+		stream, err := client.Download(authorized(), &filesv1.DownloadRequest{Id: uploaded.GetFile().GetId()})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+func TestFilesServiceErrors(t *testing.T) {
+	client := setupTestClient(t)
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		_, err := client.List(context.Background(), &filesv1.ListRequest{})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong")
+		_, err = client.List(ctx, &filesv1.ListRequest{})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		_, err := upload(t, client, &filesv1.UploadMetadata{Name: "big.bin"}, string(make([]byte, 1025)))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("InvalidLink", func(t *testing.T) {
+		_, err := upload(t, client, &filesv1.UploadMetadata{Name: "a.txt", Link: "ftp://example.com"}, "content")
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestViewerToken(t *testing.T) {
+	client := setupTestClient(t)
+
+	uploaded, err := upload(t, client, &filesv1.UploadMetadata{Name: "notes.txt", Tag: "docs"}, "content")
+	require.NoError(t, err)
+
+	viewer := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+viewerToken)
+
+	resp, err := client.List(viewer, &filesv1.ListRequest{Tag: "docs"})
+	require.NoError(t, err)
+	assert.Len(t, resp.GetFiles(), 1)
+
+	_, err = client.GetLatestByTag(viewer, &filesv1.GetLatestByTagRequest{Tag: "docs"})
+	assert.NoError(t, err)
+
+	stream, err := client.Download(viewer, &filesv1.DownloadRequest{Id: uploaded.GetFile().GetId()})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	_, err = client.Delete(viewer, &filesv1.DeleteRequest{Id: uploaded.GetFile().GetId()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	uploadStream, err := client.Upload(viewer)
+	require.NoError(t, err)
+	_, err = uploadStream.CloseAndRecv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAdmits(t *testing.T) {
+	var admit atomic.Bool
+	client := setupTestClientWithOptions(t, func(opts *Options) {
+		opts.Admits = func(net.Addr) bool { return admit.Load() }
+	})
+
+	// Refused before the token is checked
+	_, err := client.List(authorized(), &filesv1.ListRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	stream, err := client.Upload(authorized())
+	require.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	admit.Store(true)
+	_, err = client.List(authorized(), &filesv1.ListRequest{})
+	assert.NoError(t, err)
+}
+
+func TestAdminCert(t *testing.T) {
+	opts := Options{
+		AdminToken:  adminToken,
+		ViewerToken: viewerToken,
+		AdminCert:   func(state tls.ConnectionState) bool { return len(state.VerifiedChains) > 0 },
+	}
+	withPeer := func(authInfo credentials.AuthInfo, token string) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: authInfo})
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+		}
+		return ctx
+	}
+	verified := credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}}
+	unverified := credentials.TLSInfo{}
+
+	user, err := authorize(withPeer(verified, ""), filesv1.FilesService_Delete_FullMethodName, opts)
+	require.NoError(t, err)
+	assert.Equal(t, adminUser, user)
+
+	// The admin token no longer changes anything on its own
+	_, err = authorize(withPeer(unverified, adminToken), filesv1.FilesService_Delete_FullMethodName, opts)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	user, err = authorize(withPeer(unverified, adminToken), filesv1.FilesService_List_FullMethodName, opts)
+	require.NoError(t, err)
+	assert.Equal(t, adminUser, user)
+
+	user, err = authorize(withPeer(unverified, viewerToken), filesv1.FilesService_List_FullMethodName, opts)
+	require.NoError(t, err)
+	assert.Equal(t, viewerUser, user)
+}
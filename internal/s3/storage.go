@@ -0,0 +1,294 @@
+// Package s3 stores content in S3 compatible object storage.
+package s3
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// tracer creates spans for object storage calls
+var tracer = otel.Tracer("github.com/pavel-fokin/files-stash/internal/s3")
+
+// AWS Signature Version 4, which requests are signed with
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4DateFormat = "20060102T150405Z"
+
+	// unsignedPayload leaves the body out of the signature, so it can be
+	// streamed instead of hashed up front
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// errNotFound is returned for missing objects, like the other storages do
+var errNotFound = files.ErrNotFound
+
+// Config locates a bucket and holds the keys requests are signed with
+type Config struct {
+	Endpoint        string // e.g. "https://s3.eu-central-1.amazonaws.com" or "http://minio:9000"
+	Region          string // "us-east-1" when empty
+	Bucket          string
+	Prefix          string // prepended to object keys, e.g. "stash/"
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Storage implements files.FileStorage with the objects of a bucket,
+// addressed path-style so any S3 compatible service works
+type Storage struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	prefix   string
+	key      string
+	secret   string
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewStorage creates a storage in the configured bucket, sending requests
+// with client
+func NewStorage(cfg Config, client *http.Client) (*Storage, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	return &Storage{
+		endpoint: endpoint,
+		region:   cmp.Or(cfg.Region, "us-east-1"),
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+		key:      cfg.AccessKeyID,
+		secret:   cfg.SecretAccessKey,
+		client:   client,
+		now:      time.Now,
+	}, nil
+}
+
+// Save uploads content as the object of id. Objects are uploaded in a
+// single request, which needs the length up front: content that can't seek
+// to tell it is read into memory first.
+func (s *Storage) Save(ctx context.Context, id, name, mimeType string, content io.Reader) (*files.File, error) {
+	ctx, span := tracer.Start(ctx, "Storage.Save", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
+
+	body, size, err := sizedBody(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file content: %w", err)
+	}
+	req, err := s.request(ctx, http.MethodPut, id, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", cmp.Or(mimeType, "application/octet-stream"))
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload object: %w", err)
+	}
+	resp.Body.Close()
+
+	return &files.File{
+		ID:        id,
+		Name:      name,
+		Size:      size,
+		MimeType:  mimeType,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(24 * time.Hour), // Default TTL, will be overridden by service
+	}, nil
+}
+
+// GetContent streams the object of id
+func (s *Storage) GetContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	ctx, span := tracer.Start(ctx, "Storage.GetContent", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
+
+	req, err := s.request(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object: %w", err)
+	}
+	return resp.Body, nil
+}
+
+// Exists reports whether the object of id exists
+func (s *Storage) Exists(ctx context.Context, id string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Storage.Exists", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
+
+	req, err := s.request(ctx, http.MethodHead, id, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check object: %w", err)
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Delete removes the object of id. Deleting a missing object succeeds.
+func (s *Storage) Delete(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Storage.Delete", trace.WithAttributes(attribute.String("file.id", id)))
+	defer span.End()
+
+	req, err := s.request(ctx, http.MethodDelete, id, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// request builds a request for the object of id
+func (s *Storage) request(ctx context.Context, method, id string, body io.Reader) (*http.Request, error) {
+	target := *s.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + s.bucket + "/" + s.prefix + id
+	target.RawPath = escapePath(target.Path)
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return req, nil
+}
+
+// do signs and sends a request, turning error responses into errors
+func (s *Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+
+	// Error responses tell their code, except to HEAD requests
+	var s3err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3err); err != nil || s3err.Code == "" {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil, fmt.Errorf("%s: %s", s3err.Code, s3err.Message)
+}
+
+// sign adds the Signature Version 4 headers to a request
+func (s *Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format(sigV4DateFormat)
+	scope := strings.Join([]string{amzDate[:8], s.region, "s3", "aws4_request"}, "/")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // no query
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + s.secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", sigV4Algorithm, s.key, scope, signedHeaders, signature))
+}
+
+// sizedBody returns content with its length, reading it into memory when
+// it can't seek to find out
+func sizedBody(content io.Reader) (io.Reader, int64, error) {
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := seeker.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, 0, err
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, 0, err
+			}
+			// Hide the seeker, so the transport reads only what it was told
+			return io.LimitReader(seeker, end-start), end - start, nil
+		}
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// escapePath percent-encodes everything but unreserved characters and
+// slashes, as object keys are in signed paths
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBucket serves the objects of one bucket, failing unsigned requests
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/20260102/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") ||
+		r.Header.Get("X-Amz-Date") != "20260102T030405Z" {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(data)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b.objects[r.URL.Path] = data
+		b.types[r.URL.Path] = r.Header.Get("Content-Type")
+	case http.MethodGet, http.MethodHead:
+		data, ok := b.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(b.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string][]byte), types: make(map[string]string)}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	storage, err := NewStorage(Config{
+		Endpoint:        server.URL,
+		Region:          "eu-west-1",
+		Bucket:          "stash",
+		Prefix:          "cold/",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	}, server.Client())
+	require.NoError(t, err)
+	storage.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	ctx := context.Background()
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		file, err := storage.Save(ctx, "a", "a.txt", "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), file.Size)
+		assert.Equal(t, "hello", string(bucket.objects["/stash/cold/a"]))
+		assert.Equal(t, "text/plain", bucket.types["/stash/cold/a"])
+
+		exists, err := storage.Exists(ctx, "a")
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		content, err := storage.GetContent(ctx, "a")
+		require.NoError(t, err)
+		defer content.Close()
+		data, err := io.ReadAll(content)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	})
+
+	t.Run("SeekableContent", func(t *testing.T) {
+		content := strings.NewReader("skip:rest")
+		content.Seek(5, io.SeekStart)
+		file, err := storage.Save(ctx, "b", "b.txt", "", content)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), file.Size)
+		assert.Equal(t, "rest", string(bucket.objects["/stash/cold/b"]))
+		assert.Equal(t, "application/octet-stream", bucket.types["/stash/cold/b"])
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		exists, err := storage.Exists(ctx, "missing")
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		_, err = storage.GetContent(ctx, "missing")
+		assert.ErrorContains(t, err, "file not found")
+
+		assert.NoError(t, storage.Delete(ctx, "missing"))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, storage.Delete(ctx, "a"))
+		exists, err := storage.Exists(ctx, "a")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("ErrorResponse", func(t *testing.T) {
+		storage.now = time.Now
+		_, err := storage.GetContent(ctx, "b")
+		assert.ErrorContains(t, err, "AccessDenied: Access Denied")
+	})
+}
+
+func TestNewStorageValidates(t *testing.T) {
+	_, err := NewStorage(Config{Endpoint: "s3.example.com", Bucket: "stash"}, http.DefaultClient)
+	assert.Error(t, err)
+	_, err = NewStorage(Config{Endpoint: "https://s3.example.com"}, http.DefaultClient)
+	assert.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+const accessContextKey contextKey = "access"
+
+// logAccesses adds the requests of the download routes it wraps to the
+// access log of the file they're for, however they're answered. Handlers
+// name the file with noteAccess once they know it.
+func logAccesses(cfg *Config, fileService *files.Service, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var fileID string
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r.WithContext(context.WithValue(r.Context(), accessContextKey, &fileID)))
+		if fileID == "" {
+			return
+		}
+
+		access := &files.Access{
+			FileID:    fileID,
+			At:        start,
+			IP:        clientIP(cfg, r),
+			UserAgent: r.UserAgent(),
+			Bytes:     wrapped.bytesWritten,
+			Status:    wrapped.statusCode,
+		}
+		if err := fileService.RecordAccess(context.WithoutCancel(r.Context()), access); err != nil {
+			slog.Error("Failed to record access", "file_id", fileID, "error", err)
+		}
+	}
+}
+
+// noteAccess names the file a download request is for, for logAccesses
+func noteAccess(ctx context.Context, fileID string) {
+	if noted, ok := ctx.Value(accessContextKey).(*string); ok {
+		*noted = fileID
+	}
+}
+
+// fileAccesses lists the download requests of a file, latest first, a page
+// of limit accesses from offset at a time
+func fileAccesses(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		query := r.URL.Query()
+		var limit, offset int
+		var err error
+		if v := query.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("offset"); v != "" {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+
+		log, err := fileService.AccessLog(r.Context(), id, limit, offset)
+		if errors.Is(err, files.ErrNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to list accesses", "error", err, "file_id", id)
+			http.Error(w, "Failed to list accesses", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(log); err != nil {
+			slog.Error("Failed to encode response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// useACME has srv serve TLS with certificates obtained and renewed over
+// ACME for cfg.ACMEHosts, answering TLS-ALPN challenges itself. When
+// cfg.ACMEHTTPAddr is set, a plain HTTP listener there answers HTTP-01
+// challenges and redirects everything else to HTTPS.
+func useACME(cfg *Config, srv *http.Server) error {
+	if cfg.TLSCertFile != "" {
+		return fmt.Errorf("ACME hosts and a TLS certificate file are mutually exclusive")
+	}
+	if cfg.ACMECacheDir == "" {
+		return fmt.Errorf("ACME needs a cache directory for its account and certificates")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	}
+
+	// Keep the client certificate settings, if any
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = &tls.Config{}
+	}
+	srv.TLSConfig.GetCertificate = manager.GetCertificate
+	srv.TLSConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	srv.Addr = cfg.ACMEAddr
+
+	if cfg.ACMEHTTPAddr != "" {
+		listener, err := net.Listen("tcp", cfg.ACMEHTTPAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for HTTP: %w", err)
+		}
+		redirect := &http.Server{
+			Handler:           manager.HTTPHandler(nil),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("Starting HTTP redirect server", "addr", listener.Addr().String())
+			if err := redirect.Serve(listener); err != nil {
+				slog.Error("HTTP redirect server failed", "error", err)
+			}
+		}()
+	}
+	return nil
+}
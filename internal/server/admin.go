@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// publicRoutes are the routes left on the public listener when the admin
+// surface has a listener of its own: health checks and what signed URLs,
+// download codes and the unauthenticated tag downloads point at
+var publicRoutes = []string{
+	"/healthz",
+	"GET /readyz",
+	"GET /v1/receipts/key",
+	"GET /v1/files/{id}",
+	"PUT /v1/files/{id}/content",
+	"GET /v1/files/latest/{tag}",
+	"GET /v1/files/latest/{tag}/content",
+	"GET /s/{code}",
+}
+
+// publicOnly answers 404 to requests for routes of the admin surface, as
+// if they didn't exist, and sends the rest to next
+func publicOnly(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); isPublicRoute(pattern, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// isPublicRoute reports whether a request, routed to pattern, stays on the
+// public listener. Thumbnails are signed like downloads, but share their
+// pattern with subresources needing a token.
+func isPublicRoute(pattern string, r *http.Request) bool {
+	if slices.Contains(publicRoutes, pattern) {
+		return true
+	}
+	if pattern == "GET /v1/files/{id}/{resource}" {
+		return path.Base(r.URL.Path) == "thumbnail"
+	}
+	// Only the short link domain is routed by host
+	route := pattern
+	if _, after, ok := strings.Cut(pattern, " "); ok {
+		route = after
+	}
+	return route != "" && !strings.HasPrefix(route, "/")
+}
+
+// newAdminServer creates the server of the admin listener, with the limits
+// of the public one
+func newAdminServer(cfg *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/notify"
+	"github.com/pavel-fokin/files-stash/internal/sftp"
+	"github.com/pavel-fokin/files-stash/internal/siem"
+)
+
+// job is work done in the background until the context is cancelled
+type job func(ctx context.Context)
+
+// App is the stash as a whole: its servers, the background jobs and what
+// they share, such as the repository, from NewApp until Stop
+type App struct {
+	cfg    *Config
+	server *http.Server
+	admin  *http.Server // serves cfg.AdminListen, when set
+	grpc   *grpc.Server // serves cfg.GRPCAddr, when set
+	sftp   *sftp.Server // serves cfg.SFTPAddr, when set
+
+	repo   files.FileRepository
+	events *siem.Emitter
+	broker *notify.Broker
+
+	ctx  context.Context // of the background jobs
+	stop context.CancelFunc
+	jobs sync.WaitGroup
+
+	addr net.Addr
+	errs chan error
+}
+
+// background runs the job until the app stops
+func (a *App) background(run job) {
+	a.jobs.Go(func() { run(a.ctx) })
+}
+
+// Start listens on the configured addresses and serves in the background.
+// Servers that fail later report it on Err.
+func (a *App) Start() error {
+	listener, err := Listen(a.cfg, a.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	listeners := []net.Listener{listener}
+	fail := func(format string, err error) error {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return fmt.Errorf(format, err)
+	}
+	var adminListener, grpcListener, sftpListener net.Listener
+	if a.admin != nil {
+		if adminListener, err = listen(a.cfg.AdminListen); err != nil {
+			return fail("failed to listen for the admin server: %w", err)
+		}
+		listeners = append(listeners, adminListener)
+	}
+	if a.grpc != nil {
+		if grpcListener, err = net.Listen("tcp", a.cfg.GRPCAddr); err != nil {
+			return fail("failed to listen for gRPC: %w", err)
+		}
+		listeners = append(listeners, grpcListener)
+	}
+	if a.sftp != nil {
+		if sftpListener, err = net.Listen("tcp", a.cfg.SFTPAddr); err != nil {
+			return fail("failed to listen for SFTP: %w", err)
+		}
+	}
+	a.addr = listener.Addr()
+
+	tls := a.cfg.TLSCertFile != "" || len(a.cfg.ACMEHosts) > 0
+	slog.Info("Starting server", "addr", listener.Addr().String(), "tls", tls)
+	go a.serve("server", func() error {
+		switch {
+		case a.cfg.TLSCertFile != "":
+			return a.server.ServeTLS(listener, a.cfg.TLSCertFile, a.cfg.TLSKeyFile)
+		case tls:
+			// Certificates come from the ACME manager
+			return a.server.ServeTLS(listener, "", "")
+		default:
+			return a.server.Serve(listener)
+		}
+	})
+	if adminListener != nil {
+		slog.Info("Starting admin server", "addr", adminListener.Addr().String())
+		go a.serve("admin server", func() error { return a.admin.Serve(adminListener) })
+	}
+	if grpcListener != nil {
+		slog.Info("Starting gRPC server", "addr", grpcListener.Addr().String())
+		go a.serve("gRPC server", func() error { return a.grpc.Serve(grpcListener) })
+	}
+	if sftpListener != nil {
+		slog.Info("Starting SFTP server", "addr", sftpListener.Addr().String())
+		go a.serve("SFTP server", func() error { return a.sftp.Serve(sftpListener) })
+	}
+	return nil
+}
+
+// serve runs a server until it's shut down, reporting any other end on Err
+func (a *App) serve(name string, serve func() error) {
+	if err := serve(); err != nil && err != http.ErrServerClosed {
+		a.errs <- fmt.Errorf("%s failed: %w", name, err)
+	}
+}
+
+// Err receives the error of a server that stopped serving on its own
+func (a *App) Err() <-chan error {
+	return a.errs
+}
+
+// Addr returns the address the server listens on, once started
+func (a *App) Addr() net.Addr {
+	return a.addr
+}
+
+// Stop shuts the app down. The servers stop accepting connections and the
+// requests and SFTP transfers in progress are drained, until ctx is done; then the background
+// jobs are stopped and waited for, and the repository is closed.
+func (a *App) Stop(ctx context.Context) error {
+	var errs []error
+
+	// Event streams last as long as their clients stay, so they're ended
+	// rather than waited for
+	a.broker.Close()
+
+	servers := []*http.Server{a.server}
+	if a.admin != nil {
+		servers = append(servers, a.admin)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+				mu.Unlock()
+			}
+		})
+	}
+	if a.grpc != nil {
+		wg.Go(func() {
+			stopped := make(chan struct{})
+			go func() {
+				a.grpc.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				a.grpc.Stop()
+			}
+		})
+	}
+	if a.sftp != nil {
+		wg.Go(func() {
+			if err := a.sftp.Shutdown(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("failed to end SFTP sessions: %w", err))
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	a.stop()
+	stopped := make(chan struct{})
+	go func() {
+		a.jobs.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("background jobs didn't stop: %w", ctx.Err()))
+	}
+
+	if a.events != nil {
+		if err := a.events.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close SIEM events: %w", err))
+		}
+	}
+	if closer, ok := a.repo.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close repository: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
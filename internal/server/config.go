@@ -0,0 +1,265 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v10"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// envPrefix starts the name of every configuration variable
+const envPrefix = "FILES_STASH_"
+
+// ConfigError lists every problem found in a configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+// LoadConfig parses the Config from environ, on top of the settings of the
+// config file at path, when there is one, and on top of the deployment
+// profile's presets. Problems with the settings are reported all at once,
+// as a ConfigError.
+//
+// Config files are YAML, or TOML when named *.toml. Their keys are the
+// names of the configuration variables without the FILES_STASH_ prefix, in
+// lower case, e.g. max_size for FILES_STASH_MAX_SIZE. Lists are written as
+// lists and maps, such as route_timeouts, as maps.
+func LoadConfig(path string, environ map[string]string) (*Config, error) {
+	var problems ConfigError
+	if path != "" {
+		settings, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys := configKeys()
+		merged := make(map[string]string, len(settings)+len(environ))
+		for _, key := range slices.Sorted(maps.Keys(settings)) {
+			name := envPrefix + strings.ToUpper(key)
+			if !keys[name] {
+				problems = append(problems, fmt.Sprintf("unknown setting %q in %s", key, path))
+				continue
+			}
+			merged[name] = settings[key]
+		}
+		maps.Copy(merged, environ)
+		environ = merged
+	}
+
+	withProfile, err := ProfileEnvironment(environ)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		environ = withProfile
+	}
+
+	cfg := &Config{}
+	if err := env.ParseWithOptions(cfg, env.Options{Environment: environ}); err != nil {
+		var aggregate env.AggregateError
+		if !errors.As(err, &aggregate) {
+			return nil, err
+		}
+		for _, err := range aggregate.Errors {
+			problems = append(problems, describeEnvError(err, environ))
+		}
+	}
+	problems = append(problems, cfg.validate()...)
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return cfg, nil
+}
+
+// validate checks the settings the environment parses but New would refuse
+func (cfg *Config) validate() []string {
+	var problems []string
+	switch cfg.Backend {
+	case "", "disk":
+		if cfg.DataDir == "" || cfg.DBPath == "" {
+			problems = append(problems, "the disk backend requires FILES_STASH_DATA_DIR and FILES_STASH_DB_PATH")
+		}
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("FILES_STASH_BACKEND must be disk or memory, not %q", cfg.Backend))
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		problems = append(problems, "FILES_STASH_TLS_CERT_FILE and FILES_STASH_TLS_KEY_FILE must be set together")
+	}
+	if cfg.GRPCAddr != "" && cfg.ClientCAFile != "" && cfg.TLSCertFile == "" && len(cfg.ACMEHosts) == 0 {
+		problems = append(problems, "FILES_STASH_GRPC_ADDR with FILES_STASH_CLIENT_CA_FILE requires FILES_STASH_TLS_CERT_FILE or FILES_STASH_ACME_HOSTS")
+	}
+	if cfg.SFTPAddr != "" && cfg.SFTPHostKeyFile == "" {
+		problems = append(problems, "FILES_STASH_SFTP_ADDR requires FILES_STASH_SFTP_HOST_KEY_FILE")
+	}
+	if cfg.WebhookSecret == "" && cfg.sendsWebhooks() {
+		problems = append(problems, errWebhookSecret.Error())
+	}
+	if cfg.ColdStorageBucket != "" && cfg.ColdStorageEndpoint == "" {
+		problems = append(problems, "FILES_STASH_COLD_STORAGE_BUCKET requires FILES_STASH_COLD_STORAGE_ENDPOINT")
+	}
+	if cfg.ShortLinkBaseURL != "" {
+		if base, err := url.Parse(cfg.ShortLinkBaseURL); err != nil || base.Hostname() == "" {
+			problems = append(problems, fmt.Sprintf("FILES_STASH_SHORT_LINK_BASE_URL must be an absolute URL, not %q", cfg.ShortLinkBaseURL))
+		}
+	}
+	if cfg.ClamAVAddr != "" && cfg.ClamAVAction != files.ScanActionReject && cfg.ClamAVAction != files.ScanActionQuarantine {
+		problems = append(problems, fmt.Sprintf("FILES_STASH_CLAMAV_ACTION must be %s or %s, not %q", files.ScanActionReject, files.ScanActionQuarantine, cfg.ClamAVAction))
+	}
+	if _, err := parsePrefixes(cfg.TrustedProxies); err != nil {
+		problems = append(problems, fmt.Sprintf("FILES_STASH_TRUSTED_PROXIES is invalid: %v", err))
+	}
+	if _, err := parsePrefixes(cfg.FetchAllowCIDRs); err != nil {
+		problems = append(problems, fmt.Sprintf("FILES_STASH_FETCH_ALLOW_CIDRS is invalid: %v", err))
+	}
+	problems = append(problems, cfg.validateUploadTokens()...)
+	for _, field := range cfg.OriginFields {
+		if !slices.Contains(originFields, field) {
+			problems = append(problems, fmt.Sprintf("FILES_STASH_ORIGIN_FIELDS has unknown field %q, expected some of %s", field, strings.Join(originFields, ", ")))
+		}
+	}
+	for _, tag := range slices.Sorted(maps.Keys(cfg.FilenameTemplates)) {
+		if _, err := files.ParseFilenameTemplate(cfg.FilenameTemplates[tag]); err != nil {
+			problems = append(problems, fmt.Sprintf("FILES_STASH_FILENAME_TEMPLATES has an invalid template for %q: %v", tag, err))
+		}
+	}
+	return problems
+}
+
+// errWebhookSecret refuses webhook notifications that receivers couldn't
+// verify
+var errWebhookSecret = errors.New("FILES_STASH_WEBHOOK_SECRET is required to sign webhook notifications")
+
+// sendsWebhooks reports whether any notification is delivered by HTTP,
+// signed with WebhookSecret
+func (cfg *Config) sendsWebhooks() bool {
+	for _, definition := range cfg.NotifySinks {
+		_, rest, _ := strings.Cut(definition, ":")
+		if kind, _, _ := strings.Cut(rest, ":"); kind == "webhook" || kind == "slack" {
+			return true
+		}
+	}
+	return cfg.ForecastWebhookURL != "" || cfg.ExpiringReportWebhookURL != "" || cfg.ExpiringReportSlackURL != ""
+}
+
+// describeEnvError words an error parsing the environment in terms of the
+// variable it's about
+func describeEnvError(err error, environ map[string]string) string {
+	var notSet env.EnvVarIsNotSetError
+	var parse env.ParseError
+	switch {
+	case errors.As(err, &notSet):
+		return notSet.Key + " is required"
+	case errors.As(err, &parse):
+		name := configVariable(parse.Name)
+		return fmt.Sprintf("%s has an invalid value %q: %v", name, environ[name], parse.Err)
+	default:
+		return err.Error()
+	}
+}
+
+// configKeys returns the names of the variables the Config is parsed from
+func configKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeFor[Config]()
+	for i := range t.NumField() {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ","); name != "" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
+
+// configVariable returns the name of the variable a Config field is parsed
+// from
+func configVariable(fieldName string) string {
+	field, ok := reflect.TypeFor[Config]().FieldByName(fieldName)
+	if !ok {
+		return fieldName
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+	return name
+}
+
+// readConfigFile reads the settings of a config file as the values of the
+// variables they stand for
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var document map[string]any
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		_, err = toml.Decode(string(data), &document)
+	} else {
+		err = yaml.Unmarshal(data, &document)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	settings := make(map[string]string, len(document))
+	for key, value := range document {
+		if settings[key], err = settingValue(value); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %s: %w", path, key, err)
+		}
+	}
+	return settings, nil
+}
+
+// settingValue formats a value of a config file the way the environment
+// spells it: lists separated by commas and maps as key:value pairs
+func settingValue(value any) (string, error) {
+	switch v := value.(type) {
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			if !isScalar(item) {
+				return "", fmt.Errorf("lists can only hold plain values")
+			}
+			items[i], _ = settingValue(item)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			if !isScalar(v[key]) {
+				return "", fmt.Errorf("maps can only hold plain values")
+			}
+			item, _ := settingValue(v[key])
+			pairs = append(pairs, key+":"+item)
+		}
+		return strings.Join(pairs, ","), nil
+	case nil:
+		return "", nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// isScalar reports whether a value of a config file is neither a list nor
+// a map
+func isScalar(value any) bool {
+	switch value.(type) {
+	case []any, map[string]any:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Defaults for the CORS settings left empty
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Range", "X-Files-Stash-Audience"}
+	defaultCORSExposed = []string{"Content-Disposition", "Content-Length", "Content-Range", "ETag", "Location", fileIDHeader}
+)
+
+// cors lets browser apps on the allowed origins call the stash: it answers
+// preflight requests itself, since routes only match their own methods,
+// and adds the CORS headers to the responses of actual requests. Requests
+// from other origins get no CORS headers, so browsers refuse to share the
+// responses with them.
+func cors(cfg *Config, next http.Handler) http.Handler {
+	if len(cfg.CORSAllowedOrigins) == 0 {
+		return next
+	}
+	anyOrigin := slices.Contains(cfg.CORSAllowedOrigins, "*")
+	methods := strings.Join(orDefault(cfg.CORSAllowedMethods, defaultCORSMethods), ", ")
+	headers := strings.Join(orDefault(cfg.CORSAllowedHeaders, defaultCORSHeaders), ", ")
+	exposed := strings.Join(orDefault(cfg.CORSExposedHeaders, defaultCORSExposed), ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !anyOrigin && !slices.Contains(cfg.CORSAllowedOrigins, origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// With credentials, browsers refuse a wildcard origin
+		if anyOrigin && !cfg.CORSAllowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.CORSAllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			if cfg.CORSMaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", exposed)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// orDefault returns values, or defaults when there are none
+func orDefault(values, defaults []string) []string {
+	if len(values) == 0 {
+		return defaults
+	}
+	return values
+}
@@ -0,0 +1,582 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// davPrefix is where the WebDAV view of the stash is mounted
+const davPrefix = "/dav"
+
+// errUploadAborted fails uploads their client left unfinished
+var errUploadAborted = errors.New("upload aborted")
+
+// davReadMethods are the WebDAV methods that don't change anything
+var davReadMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND"}
+
+// davHandler serves the stash over WebDAV as a virtual directory tree: a
+// directory per tag holding its files, with untagged files at the root.
+// When several files in a directory share a name, the oldest keeps it and
+// the others are listed as "<id>_<name>", so a file keeps its name as
+// others come and go. Viewers see files that aren't
+// password protected; when cfg.WebDAVWritable is set, admins can also
+// upload (PUT), delete and rename (MOVE) files, and holders of an upload
+// token or upload JWT can upload within its policy, but nothing else.
+func davHandler(cfg *Config, creds *credentials, fileService *files.Service) http.Handler {
+	locks := webdav.NewMemLS()
+	return davAuth(creds, func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		policy := uploadPolicyFromContext(r.Context())
+		if policy != nil && (!cfg.WebDAVWritable || r.Method != http.MethodPut) {
+			http.Error(w, "Upload tokens may only upload", http.StatusForbidden)
+			return
+		}
+		// webdav answers any failure to create a file with 404, so refusals
+		// by the policy are answered here, where they can say why
+		if tag, base, err := splitDAVPath(strings.TrimPrefix(r.URL.Path, davPrefix)); policy != nil && err == nil {
+			if err := policy.admit(&files.UploadRequest{Name: base, Tag: tag}); err != nil {
+				writeUploadPolicyError(w, err)
+				return
+			}
+		}
+		writable := cfg.WebDAVWritable && (user == adminUser || policy != nil)
+		if !writable && !slices.Contains(davReadMethods, r.Method) {
+			http.Error(w, "WebDAV access is read-only", http.StatusForbidden)
+			return
+		}
+		handler := &webdav.Handler{
+			Prefix: davPrefix,
+			FileSystem: &davFS{
+				fileService: fileService,
+				viewer:      user != adminUser,
+				writable:    writable,
+				origin:      uploadOrigin(cfg, r),
+				policy:      policy,
+			},
+			LockSystem: locks,
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					slog.Error("WebDAV request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+				}
+			},
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// davAuth admits callers as the API does, with the token sent either as a
+// bearer token or as the password of basic auth; the user name is ignored.
+// When client certificates are required, admins are known by theirs.
+// Holders of an upload token or upload JWT are admitted with its policy.
+func davAuth(creds *credentials, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !creds.networks.admits(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		user := creds.user(r)
+		var identity string
+		if creds.clientCerts {
+			if user == adminUser {
+				user = ""
+			}
+			if id, ok := clientIdentity(r); ok && (len(creds.certIdentities) == 0 || slices.Contains(creds.certIdentities, id)) {
+				user, identity = adminUser, id
+			}
+		}
+		ctx := r.Context()
+		if user == "" {
+			if policy, ok := creds.uploadPolicy(r); ok {
+				user = "upload:" + policy.name
+				ctx = context.WithValue(ctx, uploadPolicyContextKey, policy)
+			}
+		}
+		if user == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="files-stash"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		recordUser(ctx, user, identity)
+		ctx = context.WithValue(ctx, userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// davFS implements webdav.FileSystem over the file service for one request
+type davFS struct {
+	fileService *files.Service
+	viewer      bool // hides password protected files
+	writable    bool
+	origin      *files.Origin
+	maxSize     int64         // of uploads when positive, for callers without a body limit
+	policy      *uploadPolicy // uploads are admitted by, when not nil
+}
+
+// davDir is the listing of a directory, with entries by name
+type davDir struct {
+	name    string
+	modTime time.Time
+	files   map[string]*files.File
+}
+
+// listing returns the root directory and the tag directories
+func (d *davFS) listing(ctx context.Context) (*davDir, map[string]*davDir, error) {
+	fileList, err := d.fileService.List(ctx, userFromContext(ctx), files.ListFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	// Oldest first, so the oldest file of a name gets it
+	slices.SortFunc(fileList, func(a, b *files.File) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+
+	root := &davDir{name: "/", files: make(map[string]*files.File)}
+	tags := make(map[string]*davDir)
+	for _, file := range fileList {
+		if !d.visible(file) {
+			continue
+		}
+		dir := root
+		if file.Tag != "" {
+			if dir = tags[file.Tag]; dir == nil {
+				dir = &davDir{name: file.Tag, files: make(map[string]*files.File)}
+				tags[file.Tag] = dir
+			}
+		}
+		name := davName(file.Name)
+		if _, taken := dir.files[name]; taken {
+			name = file.ID + "_" + name
+		}
+		dir.files[name] = file
+		if file.CreatedAt.After(dir.modTime) {
+			dir.modTime = file.CreatedAt
+		}
+		if file.CreatedAt.After(root.modTime) {
+			root.modTime = file.CreatedAt
+		}
+	}
+	return root, tags, nil
+}
+
+// visible reports whether the file is listed to the caller
+func (d *davFS) visible(file *files.File) bool {
+	return file.IsActive() && (!d.viewer || file.PasswordHash == "")
+}
+
+// lookup finds the file named base in the directory of a tag, or the root
+// for "", without listing every file: "<id>_<name>" is looked up by its ID
+// and other names by the files holding them. Names that stand for another,
+// such as those of files whose name has a slash, are only in the listing.
+func (d *davFS) lookup(ctx context.Context, tag, base string) (*files.File, error) {
+	// holder finds the file that keeps a name, the oldest visible one
+	holder := func(name string) (*files.File, error) {
+		named, err := d.fileService.FindByName(ctx, tag, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range named {
+			if d.visible(file) {
+				return file, nil
+			}
+		}
+		return nil, nil
+	}
+
+	if id, name, ok := strings.Cut(base, "_"); ok {
+		meta, err := d.fileService.GetMetadata(ctx, id)
+		if err == nil && meta.File.Tag == tag && davName(meta.File.Name) == name && d.visible(meta.File) {
+			held, err := holder(meta.File.Name)
+			if err != nil {
+				return nil, err
+			}
+			if held != nil && held.ID != meta.File.ID {
+				return meta.File, nil
+			}
+		} else if err != nil && !errors.Is(err, files.ErrNotFound) && !errors.Is(err, files.ErrExpired) {
+			return nil, err
+		}
+	}
+	held, err := holder(base)
+	if err != nil || held != nil {
+		return held, err
+	}
+	return nil, os.ErrNotExist
+}
+
+// davName makes a file name usable as a path element
+func davName(name string) string {
+	return strings.ReplaceAll(cmp.Or(name, "unnamed"), "/", "_")
+}
+
+// splitDAVPath splits a path into its directory, a tag or "" for the root,
+// and its base name
+func splitDAVPath(name string) (dir, base string, err error) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	switch len(parts) {
+	case 1:
+		return "", parts[0], nil
+	case 2:
+		return parts[0], parts[1], nil
+	default:
+		return "", "", os.ErrNotExist
+	}
+}
+
+// resolve finds the directory or file at name. Files are looked up on
+// their own; only directories need the listing.
+func (d *davFS) resolve(ctx context.Context, name string) (*davDir, *files.File, error) {
+	dir, base, err := splitDAVPath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if base != "" {
+		file, err := d.lookup(ctx, dir, base)
+		if err == nil {
+			return nil, file, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+	root, tags, err := d.listing(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case dir == "" && base == "":
+		return root, nil, nil
+	case dir == "":
+		if tag, ok := tags[base]; ok {
+			return tag, nil, nil
+		}
+		if file, ok := root.files[base]; ok {
+			return nil, file, nil
+		}
+	default:
+		if tag, ok := tags[dir]; ok {
+			if file, ok := tag.files[base]; ok {
+				return nil, file, nil
+			}
+		}
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if !d.writable {
+		return os.ErrPermission
+	}
+	// Tag directories exist as long as they hold files, so there's nothing
+	// to create; clients go on to upload into them
+	if dir, base, err := splitDAVPath(name); err != nil || dir != "" || base == "" {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return d.create(ctx, name)
+	}
+
+	dir, file, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		return newDAVDirFile(ctx, d, dir)
+	}
+	return &storedFile{ctx: ctx, fileService: d.fileService, file: file}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	if !d.writable {
+		return os.ErrPermission
+	}
+	dir, file, err := d.resolve(ctx, name)
+	if err != nil {
+		return err
+	}
+	// Deleting a whole tag is left to the API, where it's deliberate
+	if dir != nil {
+		return os.ErrPermission
+	}
+	return d.fileService.Delete(ctx, userFromContext(ctx), file.ID, "")
+}
+
+// Rename moves a file to another name or tag directory
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	if !d.writable {
+		return os.ErrPermission
+	}
+	dir, file, err := d.resolve(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if dir != nil {
+		return os.ErrPermission
+	}
+	tag, base, err := splitDAVPath(newName)
+	if err != nil || base == "" {
+		return os.ErrPermission
+	}
+	_, err = d.fileService.Update(ctx, file.ID, &files.UpdateRequest{Name: &base, Tag: &tag})
+	return err
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	dir, file, err := d.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		return dir.info(), nil
+	}
+	return davFileInfo{file: file}, nil
+}
+
+// create starts uploading a file to name, with the content written to the
+// returned file
+func (d *davFS) create(ctx context.Context, name string) (webdav.File, error) {
+	if !d.writable {
+		return nil, os.ErrPermission
+	}
+	tag, base, err := splitDAVPath(name)
+	if err != nil || base == "" {
+		return nil, os.ErrPermission
+	}
+
+	reader, writer := io.Pipe()
+	req := &files.UploadRequest{
+		Name:     base,
+		MimeType: mime.TypeByExtension(path.Ext(base)),
+		Tag:      tag,
+		Origin:   d.origin,
+		Content:  reader,
+	}
+	if err := d.policy.admit(req); err != nil {
+		slog.Warn("Upload refused by token policy", "error", err, "filename", base)
+		return nil, os.ErrPermission
+	}
+	upload := &davUpload{name: base, writer: writer, maxSize: d.maxSize, done: make(chan error, 1)}
+	go func() {
+		_, err := d.fileService.Upload(ctx, req)
+		reader.CloseWithError(cmp.Or(err, io.ErrClosedPipe))
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+func (dir *davDir) info() os.FileInfo {
+	return davDirInfo{name: dir.name, modTime: dir.modTime}
+}
+
+// davDirFile is an open directory, read through Readdir
+type davDirFile struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+}
+
+func newDAVDirFile(ctx context.Context, d *davFS, dir *davDir) (*davDirFile, error) {
+	f := &davDirFile{info: dir.info()}
+	if dir.name == "/" {
+		_, tags, err := d.listing(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			f.entries = append(f.entries, tag.info())
+		}
+	}
+	for name, file := range dir.files {
+		f.entries = append(f.entries, davFileInfo{name: name, file: file})
+	}
+	slices.SortFunc(f.entries, func(a, b os.FileInfo) int { return strings.Compare(a.Name(), b.Name()) })
+	return f, nil
+}
+
+func (f *davDirFile) Close() error                                 { return nil }
+func (f *davDirFile) Read(p []byte) (int, error)                   { return 0, fs.ErrInvalid }
+func (f *davDirFile) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrInvalid }
+func (f *davDirFile) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (f *davDirFile) Stat() (os.FileInfo, error)                   { return f.info, nil }
+
+func (f *davDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+// storedFile is an open stored file, served by WebDAV and the S3 gateway.
+// Content is opened on the first read and reopened after seeking, skipping
+// to the offset, since downloads are streamed from the start.
+type storedFile struct {
+	ctx         context.Context
+	fileService *files.Service
+	file        *files.File
+
+	offset  int64
+	content io.ReadCloser
+}
+
+func (f *storedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.file.Size {
+		return 0, io.EOF
+	}
+	if f.content == nil {
+		_, content, err := f.fileService.Open(f.ctx, f.file.ID)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, content, f.offset); err != nil {
+			content.Close()
+			return 0, fmt.Errorf("failed to seek file content: %w", err)
+		}
+		f.content = content
+	}
+	n, err := f.content.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *storedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.file.Size
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if offset != f.offset && f.content != nil {
+		f.content.Close()
+		f.content = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *storedFile) Close() error {
+	if f.content == nil {
+		return nil
+	}
+	return f.content.Close()
+}
+
+func (f *storedFile) Readdir(count int) ([]os.FileInfo, error) { return nil, fs.ErrInvalid }
+func (f *storedFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *storedFile) Stat() (os.FileInfo, error)               { return davFileInfo{file: f.file}, nil }
+
+// davUpload is a file being uploaded, finished when closed
+type davUpload struct {
+	name    string
+	writer  *io.PipeWriter
+	written int64
+	maxSize int64 // when positive
+	done    chan error
+}
+
+// Write adds to the content, failing the upload once it's larger than
+// maxSize
+func (u *davUpload) Write(p []byte) (int, error) {
+	if u.maxSize > 0 && u.written+int64(len(p)) > u.maxSize {
+		err := fmt.Errorf("file larger than %d bytes", u.maxSize)
+		u.writer.CloseWithError(err)
+		return 0, err
+	}
+	n, err := u.writer.Write(p)
+	u.written += int64(n)
+	return n, err
+}
+
+// Close ends the content and returns the outcome of the upload
+func (u *davUpload) Close() error {
+	u.writer.Close()
+	if err := <-u.done; err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	return nil
+}
+
+// Abort fails the upload, for clients gone before finishing it
+func (u *davUpload) Abort() {
+	u.writer.CloseWithError(errUploadAborted)
+	<-u.done
+}
+
+func (u *davUpload) Read(p []byte) (int, error)                   { return 0, os.ErrPermission }
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrInvalid }
+func (u *davUpload) Readdir(count int) ([]os.FileInfo, error)     { return nil, fs.ErrInvalid }
+
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	return davFileInfo{name: u.name, file: &files.File{Name: u.name, Size: u.written, CreatedAt: time.Now()}}, nil
+}
+
+// davFileInfo describes a stored file, listed under name when it differs
+// from the file's own
+type davFileInfo struct {
+	name string
+	file *files.File
+}
+
+func (i davFileInfo) Name() string       { return cmp.Or(i.name, davName(i.file.Name)) }
+func (i davFileInfo) Size() int64        { return i.file.Size }
+func (i davFileInfo) Mode() fs.FileMode  { return 0o444 }
+func (i davFileInfo) ModTime() time.Time { return i.file.CreatedAt }
+func (i davFileInfo) IsDir() bool        { return false }
+func (i davFileInfo) Sys() any           { return nil }
+
+// ContentType implements webdav.ContentTyper, so content isn't sniffed
+func (i davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if i.file.MimeType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.file.MimeType, nil
+}
+
+// ETag implements webdav.ETager with the content checksum
+func (i davFileInfo) ETag(ctx context.Context) (string, error) {
+	if i.file.Checksum == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.file.Checksum + `"`, nil
+}
+
+// davDirInfo describes a virtual directory
+type davDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i davDirInfo) Name() string       { return i.name }
+func (i davDirInfo) Size() int64        { return 0 }
+func (i davDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (i davDirInfo) ModTime() time.Time { return i.modTime }
+func (i davDirInfo) IsDir() bool        { return true }
+func (i davDirInfo) Sys() any           { return nil }
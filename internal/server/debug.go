@@ -0,0 +1,37 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// started is when the process started, reported as its uptime
+var started = time.Now()
+
+func init() {
+	// expvar already publishes cmdline and memstats
+	expvar.Publish("runtime", expvar.Func(func() any {
+		return map[string]any{
+			"goroutines":     runtime.NumGoroutine(),
+			"cpus":           runtime.NumCPU(),
+			"gomaxprocs":     runtime.GOMAXPROCS(0),
+			"go_version":     runtime.Version(),
+			"uptime_seconds": time.Since(started).Seconds(),
+		}
+	}))
+}
+
+// debugHandlers routes the pprof profiles and the expvar runtime stats,
+// each wrapped with guard
+func debugHandlers(mux *http.ServeMux, guard func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("GET /debug/pprof/", guard(pprof.Index))
+	mux.HandleFunc("GET /debug/pprof/cmdline", guard(pprof.Cmdline))
+	mux.HandleFunc("GET /debug/pprof/profile", guard(pprof.Profile))
+	mux.HandleFunc("GET /debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("POST /debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("GET /debug/pprof/trace", guard(pprof.Trace))
+	mux.HandleFunc("GET /debug/vars", guard(expvar.Handler().ServeHTTP))
+}
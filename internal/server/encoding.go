@@ -0,0 +1,99 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// minEncodedSize is the size below which compressing a download doesn't pay
+// for the encoding overhead
+const minEncodedSize = 512
+
+// Content codings downloads are compressed with, in order of preference
+var downloadEncodings = []string{"zstd", "gzip"}
+
+// encodeDownload compresses the download of file when its content type is
+// compressible and the client accepts a supported content coding. It sets
+// the response headers and returns the writer for the content, with a
+// function finishing the encoding once the content is written.
+func encodeDownload(w http.ResponseWriter, r *http.Request, cfg *Config, file *files.File) (io.Writer, func()) {
+	if !cfg.DownloadCompression || file.Size < minEncodedSize || !matchesMimeType(file.MimeType, cfg.CompressibleMimeTypes) {
+		return w, func() {}
+	}
+	// Whatever the client accepts, others may get another coding
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var encoder io.WriteCloser
+	switch negotiateEncoding(r.Header.Values("Accept-Encoding")) {
+	case "zstd":
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			return w, func() {}
+		}
+		w.Header().Set("Content-Encoding", "zstd")
+		encoder = zw
+	case "gzip":
+		w.Header().Set("Content-Encoding", "gzip")
+		encoder = gzip.NewWriter(w)
+	default:
+		return w, func() {}
+	}
+	// The encoded length isn't known up front
+	w.Header().Del("Content-Length")
+	return encoder, func() { encoder.Close() }
+}
+
+// negotiateEncoding picks the supported content coding an Accept-Encoding
+// header prefers, or "" for none. Equal preferences are broken by
+// downloadEncodings' order.
+func negotiateEncoding(accept []string) string {
+	weights := make(map[string]float64)
+	for _, header := range accept {
+		for _, item := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			weight := 1.0
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				var err error
+				if weight, err = strconv.ParseFloat(q, 64); err != nil {
+					continue
+				}
+			}
+			weights[strings.ToLower(strings.TrimSpace(coding))] = weight
+		}
+	}
+
+	best, bestWeight := "", 0.0
+	for _, coding := range downloadEncodings {
+		weight, ok := weights[coding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best, bestWeight = coding, weight
+		}
+	}
+	return best
+}
+
+// matchesMimeType reports whether a content type is in a list whose entries
+// may use wildcards like "text/*"
+func matchesMimeType(mimeType string, patterns []string) bool {
+	mimeType = files.BaseMimeType(mimeType)
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if mimeType == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/notify"
+)
+
+// eventKeepAlive is how often an idle event stream gets a comment, so
+// proxies don't close it
+const eventKeepAlive = 15 * time.Second
+
+// eventStream streams stash events as Server-Sent Events until the client
+// goes away. The types query parameter takes a comma-separated list of
+// event types to receive instead of all of them.
+func eventStream(cfg *Config, broker *notify.Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var types []string
+		if v := r.URL.Query().Get("types"); v != "" {
+			types = strings.Split(v, ",")
+		}
+
+		events, unsubscribe := broker.Subscribe()
+		defer unsubscribe()
+
+		// The stream outlives any write timeout of the server
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			slog.Error("Event stream can't be flushed", "error", err)
+			return
+		}
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case event, ok := <-events:
+				if !ok {
+					// The server is shutting down
+					return
+				}
+				if types != nil && !slices.Contains(types, event.Type) {
+					continue
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					slog.Error("Failed to encode event", "event", event.Type, "error", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
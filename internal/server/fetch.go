@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// errFetchForbidden refuses server-side fetches of addresses on the
+// stash's own host or network, such as cloud metadata endpoints
+var errFetchForbidden = errors.New("url points to a loopback, link-local or private address")
+
+// fetchGuard keeps server-side fetches to public addresses, and those of
+// FetchAllowCIDRs
+type fetchGuard struct {
+	allow    []netip.Prefix
+	resolver *net.Resolver
+	dialer   *net.Dialer
+}
+
+// newFetchClient creates the client of server-side fetches. It connects
+// directly, not through a proxy from the environment, to the addresses it
+// has checked, and checks those of redirects before following them.
+func newFetchClient(cfg *Config) *http.Client {
+	allow, _ := parsePrefixes(cfg.FetchAllowCIDRs) // validated by New
+	guard := &fetchGuard{allow: allow, resolver: net.DefaultResolver, dialer: &net.Dialer{}}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = guard.dialContext
+	return &http.Client{
+		Timeout:       cfg.FetchTimeout,
+		Transport:     otelhttp.NewTransport(transport),
+		CheckRedirect: guard.checkRedirect,
+	}
+}
+
+// permits reports whether fetches may connect to addr
+func (g *fetchGuard) permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range g.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() && !addr.IsMulticast()
+}
+
+// resolve returns the addresses of host, failing when any of them isn't
+// permitted
+func (g *fetchGuard) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, err := g.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if !g.permits(addr) {
+			return nil, fmt.Errorf("%w: %s is %s", errFetchForbidden, host, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// dialContext connects to the addresses the host resolved to and were
+// checked, so another lookup can't swap in a different one
+func (g *fetchGuard) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := g.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = g.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// checkRedirect follows up to 10 redirects, as the default client does, to
+// permitted addresses
+func (g *fetchGuard) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	_, err := g.resolve(req.Context(), req.URL.Hostname())
+	return err
+}
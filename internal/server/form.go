@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// maxFormValueBytes caps the fields of an upload form, besides its files,
+// as net/http does for forms it parses
+const maxFormValueBytes = 10 << 20
+
+var (
+	// errFormTooLarge is returned for upload forms whose fields are too large
+	errFormTooLarge = errors.New("multipart form fields too large")
+
+	// errInvalidForm is returned for upload forms that can't be parsed
+	errInvalidForm = errors.New("failed to parse multipart form")
+
+	// errFieldAfterFile is returned for upload forms with fields after a
+	// file, which arrive too late to describe it
+	errFieldAfterFile = errors.New("form fields must precede the files")
+
+	// errTagCount is returned for batches with several tags, but not one
+	// for each file
+	errTagCount = errors.New("number of tags must match number of files")
+)
+
+// uploadForm is the multipart form of an upload, read in one pass as it
+// streams in: its fields first, then its files one at a time
+type uploadForm struct {
+	values url.Values // fields of the body
+	query  url.Values
+	reader *multipart.Reader
+	next   *multipart.Part // first file part, read to find the end of the fields
+	done   bool
+}
+
+// formFile is a file part of an upload form
+type formFile struct {
+	name     string
+	mimeType string
+	content  io.Reader
+}
+
+// readUploadForm reads the fields of the multipart form of an upload, up
+// to its first file part. The files are read with nextFile, streaming
+// their content to the service instead of holding it in memory, so the
+// fields describing them must precede them.
+func readUploadForm(r *http.Request) (*uploadForm, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{values: make(url.Values), query: r.URL.Query(), reader: reader}
+	remaining := int64(maxFormValueBytes)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			form.done = true
+			return form, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			form.next = part
+			return form, nil
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, remaining+1))
+		if err != nil {
+			return nil, err
+		}
+		if remaining -= int64(len(value)); remaining < 0 {
+			return nil, errFormTooLarge
+		}
+		form.values.Add(part.FormName(), string(value))
+		part.Close()
+	}
+}
+
+// value returns the first value of a field of the body or else of the query
+// string, as r.FormValue does
+func (f *uploadForm) value(key string) string {
+	if values := f.values[key]; len(values) > 0 {
+		return values[0]
+	}
+	return f.query.Get(key)
+}
+
+// nextFile returns the next part of the "file" field, or nil at the end of
+// the form. Its content must be read before the next one is asked for.
+// Other file parts are skipped.
+func (f *uploadForm) nextFile() (*formFile, error) {
+	for {
+		part := f.next
+		f.next = nil
+		if part == nil {
+			if f.done {
+				return nil, nil
+			}
+			var err error
+			if part, err = f.reader.NextPart(); err == io.EOF {
+				f.done = true
+				return nil, nil
+			} else if err != nil {
+				return nil, formError(err)
+			}
+		}
+
+		switch {
+		case part.FileName() == "":
+			return nil, errFieldAfterFile
+		case part.FormName() == "file":
+			return &formFile{
+				name:     part.FileName(),
+				mimeType: part.Header.Get("Content-Type"),
+				content:  &formReader{part},
+			}, nil
+		}
+	}
+}
+
+// formReader reads the content of a file part, telling errors of the form
+// from those of storing the content
+type formReader struct {
+	part *multipart.Part
+}
+
+func (r *formReader) Read(p []byte) (int, error) {
+	n, err := r.part.Read(p)
+	if err != nil && err != io.EOF {
+		err = formError(err)
+	}
+	return n, err
+}
+
+// formError marks an error reading an upload form, keeping a body over
+// its size limit recognizable
+func formError(err error) error {
+	return fmt.Errorf("%w: %w", errInvalidForm, err)
+}
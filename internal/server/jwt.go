@@ -0,0 +1,343 @@
+package server
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking token lifetimes
+const jwtLeeway = time.Minute
+
+// jwksRefreshInterval is how often the JWKS is fetched again, and the least
+// time between fetches prompted by tokens signed with an unknown key
+const jwksRefreshInterval = time.Hour
+
+// jwksMinRefreshInterval keeps tokens with made up key IDs from having the
+// JWKS fetched on every request
+const jwksMinRefreshInterval = time.Minute
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwtVerifier authenticates bearer tokens issued by an identity provider.
+// Tokens are HS256 signed with a shared secret or RS256 signed with a key
+// of the provider's JWKS, and grant the role their scopes map to, or the
+// uploads of an upload token under the namespace of their namespace claim.
+type jwtVerifier struct {
+	secret         []byte
+	keys           *jwks
+	issuer         string
+	audience       string
+	scopeClaim     string
+	adminScope     string
+	viewerScope    string
+	uploadScope    string
+	namespaceClaim string
+	now            func() time.Time
+}
+
+// newJWTVerifier creates a verifier from the JWT settings of cfg, or returns
+// nil when neither a secret nor a JWKS URL is configured
+func newJWTVerifier(cfg *Config) *jwtVerifier {
+	if cfg.JWTSecret == "" && cfg.JWKSURL == "" {
+		return nil
+	}
+	v := &jwtVerifier{
+		issuer:         cfg.JWTIssuer,
+		audience:       cfg.JWTAudience,
+		scopeClaim:     cmp.Or(cfg.JWTScopeClaim, "scope"),
+		adminScope:     cmp.Or(cfg.JWTAdminScope, "stash:admin"),
+		viewerScope:    cmp.Or(cfg.JWTViewerScope, "stash:read"),
+		uploadScope:    cmp.Or(cfg.JWTUploadScope, "stash:upload"),
+		namespaceClaim: cfg.JWTNamespaceClaim,
+		now:            time.Now,
+	}
+	if cfg.JWTSecret != "" {
+		v.secret = []byte(cfg.JWTSecret)
+	}
+	if cfg.JWKSURL != "" {
+		v.keys = &jwks{url: cfg.JWKSURL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return v
+}
+
+// verify checks the token's signature and claims, and returns the user its
+// scopes make it: adminUser or viewerUser
+func (v *jwtVerifier) verify(token string) (string, error) {
+	claims, err := v.claims(token)
+	if err != nil {
+		return "", err
+	}
+	scopes := claimStrings(claims[v.scopeClaim])
+	switch {
+	case slices.Contains(scopes, v.adminScope):
+		return adminUser, nil
+	case slices.Contains(scopes, v.viewerScope):
+		return viewerUser, nil
+	default:
+		return "", fmt.Errorf("%w: no stash scope", errInvalidToken)
+	}
+}
+
+// uploadPolicy checks the token's signature and claims, and returns the
+// policy of a token granting uploads but not the admin's role, named after
+// its subject. With a namespace claim configured, the token's files are
+// stored under the namespace it holds, and tokens without one are refused.
+func (v *jwtVerifier) uploadPolicy(token string) (*uploadPolicy, error) {
+	claims, err := v.claims(token)
+	if err != nil {
+		return nil, err
+	}
+	scopes := claimStrings(claims[v.scopeClaim])
+	if slices.Contains(scopes, v.adminScope) || !slices.Contains(scopes, v.uploadScope) {
+		return nil, fmt.Errorf("%w: no upload scope", errInvalidToken)
+	}
+	subject, _ := claims["sub"].(string)
+	policy := &uploadPolicy{name: "jwt:" + subject}
+	if v.namespaceClaim != "" {
+		namespace, _ := claims[v.namespaceClaim].(string)
+		if policy.namespace = strings.Trim(namespace, "/"); policy.namespace == "" {
+			return nil, fmt.Errorf("%w: no namespace", errInvalidToken)
+		}
+	}
+	return policy, nil
+}
+
+// claims checks the token's signature, lifetime, issuer and audience, and
+// returns its claims
+func (v *jwtVerifier) claims(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	signed := parts[0] + "." + parts[1]
+
+	switch {
+	case header.Alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errInvalidToken
+		}
+	case header.Alg == "RS256" && v.keys != nil:
+		key, err := v.keys.key(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the lifetime, issuer and audience of a token
+func (v *jwtVerifier) checkClaims(claims map[string]any) error {
+	now := v.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no expiry", errInvalidToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	}
+	if v.audience != "" && !slices.Contains(claimStrings(claims["aud"]), v.audience) {
+		return fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// claimStrings reads a claim holding either a space-separated string, as
+// OAuth scopes are, or a list of strings
+func claimStrings(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []any:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// jwks holds the RSA keys of a JSON Web Key Set, fetched when first needed
+// and again every jwksRefreshInterval or when a token names a key it
+// doesn't have, so keys the provider rotates in are picked up. Fetches run
+// outside the lock, one at a time: requests needing a key the set lacks
+// wait for the fetch in flight, the others go on with the keys at hand.
+type jwks struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	fetchErr  error         // of the last fetch
+	fetching  chan struct{} // closed when the fetch in flight is done
+}
+
+// key returns the key with the given ID, or the only key when the token
+// names none
+func (k *jwks) key(kid string) (*rsa.PublicKey, error) {
+	k.mu.Lock()
+	key, ok := k.lookup(kid)
+	due := time.Since(k.fetchedAt) > jwksRefreshInterval ||
+		!ok && time.Since(k.fetchedAt) > jwksMinRefreshInterval
+	fetching := k.refresh(due)
+	k.mu.Unlock()
+
+	// A known key stays good while the set is refreshed
+	if ok {
+		return key, nil
+	}
+	if fetching != nil {
+		<-fetching
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	if k.fetchErr != nil {
+		return nil, k.fetchErr
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+}
+
+// refresh returns the channel closed once the fetch in flight is done,
+// starting one when due, or nil when none is in flight. k.mu must be held.
+func (k *jwks) refresh(due bool) chan struct{} {
+	if k.fetching != nil || !due {
+		return k.fetching
+	}
+	fetching := make(chan struct{})
+	k.fetching = fetching
+	k.fetchedAt = time.Now()
+	go func() {
+		keys, err := k.fetch()
+		k.mu.Lock()
+		if err == nil {
+			k.keys = keys
+		}
+		k.fetchErr = err
+		k.fetching = nil
+		k.mu.Unlock()
+		close(fetching)
+	}()
+	return fetching
+}
+
+// lookup finds a key among the fetched ones
+func (k *jwks) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// fetch returns the keys published at the JWKS URL
+func (k *jwks) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
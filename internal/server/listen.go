@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor systemd passes sockets in
+var listenFdsStart = 3
+
+// unixSocketMode lets a local proxy in the service's group connect
+const unixSocketMode = 0o660
+
+// Listen creates the listener the server accepts connections on, as
+// configured by cfg.Listen:
+//
+//   - "tcp://host:port", or just "host:port", listens on a TCP address
+//   - "unix:///run/files-stash.sock" listens on a unix socket, replacing a
+//     stale socket left at the path
+//   - "systemd" takes the socket passed by systemd socket activation, and
+//     "systemd:name" the one named so by FileDescriptorName=
+//
+// Without cfg.Listen the server's own address is used.
+func Listen(cfg *Config, addr string) (net.Listener, error) {
+	target := cfg.Listen
+	if target == "" {
+		target = addr
+	}
+	return listen(target)
+}
+
+// listen creates a listener on target, in any of the forms Listen accepts
+func listen(target string) (net.Listener, error) {
+	switch scheme, rest, _ := strings.Cut(target, ":"); {
+	case strings.HasPrefix(target, "unix://"):
+		return listenUnix(strings.TrimPrefix(target, "unix://"))
+	case strings.HasPrefix(target, "tcp://"):
+		return net.Listen("tcp", strings.TrimPrefix(target, "tcp://"))
+	case scheme == "systemd":
+		return listenSystemd(rest)
+	default:
+		return net.Listen("tcp", target)
+	}
+}
+
+// listenUnix listens on a unix socket at path
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("unix socket path is empty")
+	}
+	// A socket left by a previous run would make listening fail
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// listenSystemd returns the socket passed by systemd with the given name,
+// or the first one when name is empty. The activation variables are
+// cleared, so processes started by the server don't take them as theirs.
+func listenSystemd(name string) (net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+
+	index := 0
+	if name != "" {
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		index = -1
+		for i, n := range names {
+			if n == name && i < count {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+		}
+	}
+
+	file := os.NewFile(uintptr(listenFdsStart+index), "systemd:"+name)
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket passed by systemd isn't a listener: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// NewLogger creates the stash's logger writing to w in the configured
+// format, at the configured level. The returned level can be changed while
+// the logger is in use.
+func NewLogger(w io.Writer, cfg *Config) (*slog.Logger, *slog.LevelVar, error) {
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level %q: %w", cfg.LogLevel, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.LogFormat {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), level, nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), level, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid log format %q, expected json or text", cfg.LogFormat)
+	}
+}
+
+// logLevelRequest is the body of POST /v1/admin/log-level
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+func getLogLevel(level *slog.LevelVar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(logLevelRequest{Level: level.Level().String()}); err != nil {
+			slog.Error("Failed to encode response", "error", err)
+		}
+	}
+}
+
+// setLogLevel changes the log level until the next change or restart
+func setLogLevel(level *slog.LevelVar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req logLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var changed slog.Level
+		if err := changed.UnmarshalText([]byte(req.Level)); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid log level %q", req.Level), http.StatusBadRequest)
+			return
+		}
+
+		level.Set(changed)
+		slog.Info("Log level changed", "level", changed.String())
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(logLevelRequest{Level: changed.String()}); err != nil {
+			slog.Error("Failed to encode response", "error", err)
+		}
+	}
+}
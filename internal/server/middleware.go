@@ -0,0 +1,713 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/metrics"
+	"github.com/pavel-fokin/files-stash/internal/siem"
+)
+
+// adminUser is the identity of callers authenticated with the admin token
+const adminUser = "admin"
+
+// viewerUser is the identity of callers authenticated with the viewer token
+const viewerUser = "viewer"
+
+// contextKey is the type of keys for values stored in a request context
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// userFromContext returns the authenticated caller identity
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey).(string)
+	return user
+}
+
+// credentials authenticate API callers by the bearer token they send: the
+// admin or viewer token, or a JWT from the identity provider when one is
+// configured
+type credentials struct {
+	adminToken  string
+	viewerToken string
+	jwt         *jwtVerifier
+
+	// uploadTokens only admit uploads, within their policy
+	uploadTokens map[string]*uploadPolicy
+
+	// clientCerts has admin routes admit callers by a verified client
+	// certificate instead, from one of certIdentities when it isn't empty
+	clientCerts    bool
+	certIdentities []string
+
+	// networks, when not nil, restricts the addresses callers may come from
+	networks *networkFilter
+}
+
+// newCredentials creates the credentials configured in cfg
+func newCredentials(cfg *Config) (*credentials, error) {
+	networks, err := newNetworkFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{
+		adminToken:     cfg.AdminToken,
+		viewerToken:    cfg.ViewerToken,
+		uploadTokens:   uploadPolicies(cfg),
+		jwt:            newJWTVerifier(cfg),
+		clientCerts:    cfg.ClientCAFile != "",
+		certIdentities: cfg.AdminCertIdentities,
+		networks:       networks,
+	}, nil
+}
+
+// requestToken returns the token r carries, as a bearer token or as the
+// password of basic auth, which is what most WebDAV clients support
+func requestToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, _ = r.BasicAuth()
+	}
+	return token
+}
+
+// user returns the user the token of r authenticates, or "" when it
+// authenticates no one
+func (c *credentials) user(r *http.Request) string {
+	token := requestToken(r)
+	switch {
+	case token == "":
+		return ""
+	case token == c.adminToken:
+		return adminUser
+	case c.viewerToken != "" && token == c.viewerToken:
+		return viewerUser
+	case c.jwt != nil:
+		user, err := c.jwt.verify(token)
+		if err != nil {
+			slog.Debug("Bearer token refused", "error", err)
+		}
+		return user
+	default:
+		return ""
+	}
+}
+
+// auth admits admins: callers holding the admin token or, when client
+// certificates are required, presenting one from an admitted identity.
+// Viewers are known but not allowed, so they are refused as forbidden.
+func auth(creds *credentials, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !creds.networks.admits(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var identity string
+		if creds.clientCerts {
+			var ok bool
+			if identity, ok = clientIdentity(r); !ok {
+				http.Error(w, "Client certificate required", http.StatusUnauthorized)
+				return
+			}
+			if len(creds.certIdentities) > 0 && !slices.Contains(creds.certIdentities, identity) {
+				recordUser(r.Context(), "", identity)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		} else if user := creds.user(r); user != adminUser {
+			if user == viewerUser {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		recordUser(r.Context(), adminUser, identity)
+		ctx := context.WithValue(r.Context(), userContextKey, adminUser)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// view admits callers holding either the admin token or, when configured,
+// the read-only viewer token. It guards routes that list, search and mint
+// links; anything that uploads, deletes or changes state stays behind auth.
+func view(creds *credentials, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !creds.networks.admits(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		user := creds.user(r)
+		if user == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		recordUser(r.Context(), user, "")
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// networkFilter admits callers by the address they come from: none in the
+// deny list, and only those in the allow list when it isn't empty
+type networkFilter struct {
+	cfg   *Config
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// newNetworkFilter creates the filter for the admin allow and deny lists
+// of cfg, or returns nil when both are empty
+func newNetworkFilter(cfg *Config) (*networkFilter, error) {
+	if len(cfg.AdminAllowCIDRs) == 0 && len(cfg.AdminDenyCIDRs) == 0 {
+		return nil, nil
+	}
+	f := &networkFilter{cfg: cfg}
+	var err error
+	if f.allow, err = parsePrefixes(cfg.AdminAllowCIDRs); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes(cfg.AdminDenyCIDRs); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parsePrefixes parses CIDR prefixes, taking a bare address as a prefix
+// holding just that address
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// admits reports whether the client of r may call the routes the filter
+// guards. A nil filter admits everyone.
+func (f *networkFilter) admits(r *http.Request) bool {
+	if f == nil {
+		return true
+	}
+	return f.admitsIP(clientIP(f.cfg, r))
+}
+
+// admitsAddr reports whether a peer connecting from addr, such as a gRPC
+// or SFTP client, may call the API. A nil filter admits everyone.
+func (f *networkFilter) admitsAddr(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+	return f.admitsIP(normalizeIP(addr.String()))
+}
+
+// admitsIP reports whether a client at ip passes the lists
+func (f *networkFilter) admitsIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	contains := func(prefix netip.Prefix) bool { return prefix.Contains(addr) }
+	if slices.ContainsFunc(f.deny, contains) {
+		return false
+	}
+	return len(f.allow) == 0 || slices.ContainsFunc(f.allow, contains)
+}
+
+// clientIdentity returns the identity of the verified client certificate of
+// r: its subject common name, or else its first DNS name or email address
+func clientIdentity(r *http.Request) (string, bool) {
+	return certIdentity(r.TLS)
+}
+
+// admitsCert reports whether a connection's verified client certificate
+// authenticates an admin, as auth does for HTTP
+func (c *credentials) admitsCert(state tls.ConnectionState) bool {
+	identity, ok := certIdentity(&state)
+	return ok && (len(c.certIdentities) == 0 || slices.Contains(c.certIdentities, identity))
+}
+
+// certIdentity returns the identity of the verified client certificate of
+// a TLS connection, as clientIdentity does
+func certIdentity(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName, true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], true
+	default:
+		return "", false
+	}
+}
+
+// writable refuses requests that change files with 503 while the stash is
+// read-only, before an upload body is read
+func writable(fileService *files.Service, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := fileService.CheckWritable(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// concurrencyLimit admits a fixed number of requests of a kind at once.
+// Requests beyond it queue for up to wait and are then refused with 429.
+type concurrencyLimit struct {
+	kind    string
+	slots   chan struct{}
+	wait    time.Duration
+	metrics *metrics.Concurrency
+}
+
+// newConcurrencyLimit creates a limit of size requests, or nil, which
+// admits every request, when size isn't positive
+func newConcurrencyLimit(kind string, size int, wait time.Duration, m *metrics.Concurrency) *concurrencyLimit {
+	if size <= 0 {
+		return nil
+	}
+	return &concurrencyLimit{kind: kind, slots: make(chan struct{}, size), wait: wait, metrics: m}
+}
+
+// admit runs next once a slot is free
+func (l *concurrencyLimit) admit(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l.metrics.Queued(l.kind)
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			l.metrics.Dequeued(l.kind, time.Since(start), false)
+			slog.Warn("Too many concurrent requests", "kind", l.kind, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(l.wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too many concurrent %ss, retry later", l.kind), http.StatusTooManyRequests)
+			return
+		case <-r.Context().Done():
+			l.metrics.Dequeued(l.kind, time.Since(start), false)
+			return
+		}
+		l.metrics.Dequeued(l.kind, time.Since(start), true)
+		defer func() {
+			<-l.slots
+			l.metrics.Released(l.kind)
+		}()
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+func limitBody(next http.Handler, limit func() int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxSize := limit()
+
+		// Create a limited reader that will return an error if the limit is exceeded
+		limitedReader := http.MaxBytesReader(w, r.Body, maxSize)
+		r.Body = limitedReader
+
+		// For multipart requests, parse the form to trigger size validation
+		if r.Header.Get("Content-Type") == "multipart/form-data" {
+			if err := r.ParseMultipartForm(maxSize); err != nil {
+				if err.Error() == "http: request body too large" {
+					http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+			}
+		} else {
+			// For non-multipart requests, we need to read the body to trigger the size check
+			// We'll read it into a buffer and then create a new reader for the next handler
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				if err.Error() == "http: request body too large" {
+					http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(strings.NewReader(string(body)))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamBody limits the body of routes that store it as it arrives, so
+// their progress can be followed; they answer a body over the limit with
+// 413 themselves once they read that far
+func streamBody(next http.Handler, limit func() int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unlimited sends requests for the given route patterns straight to next,
+// around the body limit applied by limited. Those routes read their body as
+// it arrives instead.
+func unlimited(mux *http.ServeMux, limited, next http.Handler, patterns ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); slices.Contains(patterns, pattern) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// requestStats collects per-request measurements reported by the logging middleware
+type requestStats struct {
+	mu          sync.Mutex
+	storageWait time.Duration
+	user        string
+	identity    string
+}
+
+const statsContextKey contextKey = "stats"
+
+// recordStorageWait adds time spent waiting on storage to the request stats
+func recordStorageWait(ctx context.Context, d time.Duration) {
+	if stats, ok := ctx.Value(statsContextKey).(*requestStats); ok {
+		stats.mu.Lock()
+		stats.storageWait += d
+		stats.mu.Unlock()
+	}
+}
+
+// recordUser notes the authenticated caller, and the identity of its client
+// certificate if any, in the request stats, for the middleware running
+// outside the route that authenticated it
+func recordUser(ctx context.Context, user, identity string) {
+	if stats, ok := ctx.Value(statsContextKey).(*requestStats); ok {
+		stats.mu.Lock()
+		stats.user = user
+		stats.identity = identity
+		stats.mu.Unlock()
+	}
+}
+
+// securityEvents sends refused requests, and requests by the admin that may
+// change state, to the SIEM. It runs inside loggingMiddleware, which sets
+// up the request stats the auth middleware records the caller in.
+func securityEvents(next http.Handler, events *siem.Emitter) http.Handler {
+	if events == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r)
+
+		var user, identity string
+		if stats, ok := r.Context().Value(statsContextKey).(*requestStats); ok {
+			stats.mu.Lock()
+			user, identity = stats.user, stats.identity
+			stats.mu.Unlock()
+		}
+
+		event := siem.Event{
+			Protocol:   "http",
+			User:       user,
+			Identity:   identity,
+			RemoteAddr: r.RemoteAddr,
+			ClientIP:   loggedClientIP(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     wrapped.statusCode,
+		}
+		switch {
+		case wrapped.statusCode == http.StatusUnauthorized:
+			event.Type = siem.EventAuthFailure
+		case wrapped.statusCode == http.StatusForbidden:
+			event.Type = siem.EventPermissionDenied
+		case user == adminUser && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			event.Type = siem.EventAdminAction
+		default:
+			return
+		}
+		events.Emit(event)
+	})
+}
+
+// timedReader records the time spent in Read calls as storage wait
+type timedReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (tr *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tr.ReadCloser.Read(p)
+	recordStorageWait(tr.ctx, time.Since(start))
+	return n, err
+}
+
+// redactQuery hides the password of protected files in a logged query string
+func redactQuery(rawQuery string) string {
+	query, _ := url.ParseQuery(rawQuery) // keeps the pairs that parsed
+	if !query.Has("password") {
+		return rawQuery
+	}
+	query.Set("password", "REDACTED")
+	return query.Encode()
+}
+
+// loggedClientIP returns the client IP realIP resolved for r, or else the
+// address the request came from
+func loggedClientIP(r *http.Request) string {
+	if c, ok := r.Context().Value(clientContextKey).(client); ok {
+		return c.ip
+	}
+	return normalizeIP(r.RemoteAddr)
+}
+
+// loggingMiddleware logs HTTP requests with structured logging. Requests
+// taking longer than slowThreshold are logged again as warnings with
+// transfer and storage details; a zero threshold disables this.
+func loggingMiddleware(next http.Handler, slowThreshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Create a response writer wrapper to capture status code
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		stats := &requestStats{}
+		r = r.WithContext(context.WithValue(r.Context(), statsContextKey, stats))
+
+		// Process the request
+		next.ServeHTTP(wrapped, r)
+
+		// Calculate response time
+		duration := time.Since(start)
+
+		// Log the request with structured data
+		slog.Info("HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", redactQuery(r.URL.RawQuery),
+			"status", wrapped.statusCode,
+			"duration_ms", duration.Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+			"client_ip", loggedClientIP(r),
+			"user_agent", r.UserAgent(),
+		)
+
+		if slowThreshold > 0 && duration > slowThreshold {
+			stats.mu.Lock()
+			storageWait := stats.storageWait
+			stats.mu.Unlock()
+
+			slog.Warn("Slow HTTP request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", wrapped.statusCode,
+				"duration_ms", duration.Milliseconds(),
+				"bytes_read", r.ContentLength,
+				"bytes_written", wrapped.bytesWritten,
+				"storage_wait_ms", storageWait.Milliseconds(),
+				"remote_addr", r.RemoteAddr,
+				"client_ip", loggedClientIP(r),
+				"user_agent", r.UserAgent(),
+			)
+		}
+	})
+}
+
+// responseWriter wraps http.ResponseWriter to capture status code and body size
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// tracing starts a server span for each request, named after the route
+// pattern it matches so spans group by endpoint rather than by raw path.
+func tracing(next http.Handler, mux *http.ServeMux) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if _, pattern := mux.Handler(r); pattern != "" {
+				return pattern
+			}
+			return r.Method
+		}),
+	)
+}
+
+// deadline bounds each request by the timeout configured for its route
+// pattern, falling back to defaultTimeout; a zero timeout disables the
+// deadline. Handlers see the deadline on their context. If a handler hasn't
+// started responding when it expires, the client gets a 503; responses
+// already streaming are left to finish, unlike http.TimeoutHandler which
+// buffers the whole body.
+func deadline(mux *http.ServeMux, defaultTimeout time.Duration, routeTimeouts map[string]time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		timeout, ok := routeTimeouts[pattern]
+		if !ok {
+			timeout = defaultTimeout
+		}
+		if timeout <= 0 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, h: make(http.Header), ctx: ctx}
+		done := make(chan struct{})
+		panicChan := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicChan <- p
+				}
+			}()
+			mux.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			panic(p)
+		case <-done:
+			// The handler may have returned after its late response was refused
+			tw.mu.Lock()
+			if tw.timedOut && !tw.wroteHeader {
+				http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+			}
+			tw.mu.Unlock()
+		case <-ctx.Done():
+			tw.mu.Lock()
+			if !tw.wroteHeader {
+				tw.timedOut = true
+				slog.Warn("Request timed out", "method", r.Method, "pattern", pattern, "timeout", timeout)
+				http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+			}
+			timedOut := tw.timedOut
+			tw.mu.Unlock()
+
+			// A handler that is already streaming owns the writer until it returns
+			if !timedOut {
+				select {
+				case p := <-panicChan:
+					panic(p)
+				case <-done:
+				}
+			}
+		}
+	})
+}
+
+// timeoutWriter guards a ResponseWriter shared with a handler that may
+// outlive its deadline. Headers are kept apart until the response starts.
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	h           http.Header
+	ctx         context.Context
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	// A response not started by the deadline belongs to the timeout reply,
+	// even if the handler gets here before the middleware notices
+	if tw.ctx.Err() != nil {
+		tw.timedOut = true
+		return
+	}
+	tw.wroteHeader = true
+	maps.Copy(tw.w.Header(), tw.h)
+	tw.w.WriteHeader(code)
+}
+
+// Flush sends buffered data to the client, unless the deadline took over
+// the response
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(http.StatusOK)
+	if tw.timedOut {
+		return
+	}
+	http.NewResponseController(tw.w).Flush()
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return tw.w.Write(b)
+}
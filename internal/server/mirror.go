@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// mirrorPrefix is where the stash is served for mirroring
+const mirrorPrefix = "/mirror"
+
+// mirrorEntry is a file or tag directory of a mirror listing
+type mirrorEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir,omitempty"`
+	ID      string    `json:"id,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// Href links to the entry from the listing it's in. The ./ keeps names
+// with a colon from reading as a URL scheme.
+func (e mirrorEntry) Href() string {
+	if e.Dir {
+		return "./" + url.PathEscape(e.Name) + "/"
+	}
+	return "./" + url.PathEscape(e.Name)
+}
+
+// mirrorListing is a directory of the mirror, as JSON
+type mirrorListing struct {
+	Path    string        `json:"path"`
+	Entries []mirrorEntry `json:"entries"`
+}
+
+var mirrorIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Last modified</th><th>Size</th><th>SHA-256</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{.ModTime.Format "2006-01-02T15:04:05Z"}}</td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.SHA256}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// mirrorHandler serves the stash read-only in the directory layout of
+// WebDAV, for tools that mirror a directory from an HTTP server, such as
+// rclone's http backend:
+//
+//	rclone sync :http: ./release --http-url https://stash.example.com/mirror/release/ \
+//		--http-headers "Authorization,Bearer $TOKEN"
+//
+// GET /mirror/ lists the tag directories and the untagged files, and
+// GET /mirror/{tag}/ the files of a tag, with the tag path escaped as one
+// segment. rclone skips links whose names hold a slash, so it mirrors tags
+// with slashes only when pointed at the tag directory itself. Listings are
+// HTML indexes of links, or JSON with ?format=json. Files are named as in
+// WebDAV: when several share a name, the oldest keeps it and the others are
+// listed as "<id>_<name>", so names are stable. Entries are sorted by name
+// and carry the size, the modification time, which is the upload time to
+// the second, and the SHA-256 checksum of each file, so listing the same
+// files gives the same listing. GET and HEAD /mirror/{tag}/{name} serve
+// the content with Content-Length, Last-Modified and the checksum as ETag.
+// Listings, by their ETag, and content answer conditional requests with
+// 304 Not Modified; content also serves ranges.
+func mirrorHandler(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "html" && format != "json" {
+			http.Error(w, "Invalid format", http.StatusBadRequest)
+			return
+		}
+		var segments []string
+		for segment := range strings.SplitSeq(strings.TrimPrefix(r.URL.EscapedPath(), mirrorPrefix+"/"), "/") {
+			unescaped, err := url.PathUnescape(segment)
+			if err != nil {
+				http.Error(w, "Invalid path", http.StatusBadRequest)
+				return
+			}
+			segments = append(segments, unescaped)
+		}
+
+		dav := &davFS{fileService: fileService, viewer: userFromContext(r.Context()) != adminUser}
+
+		// Files are looked up on their own, so mirroring a directory
+		// doesn't list the stash for each of its files
+		var tag, base string
+		switch {
+		case len(segments) == 1:
+			base = segments[0]
+		case len(segments) == 2 && segments[1] != "":
+			tag, base = segments[0], segments[1]
+		}
+		if base != "" {
+			file, err := dav.lookup(r.Context(), tag, base)
+			if err == nil {
+				serveMirrorFile(w, r, fileService, file)
+				return
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				slog.Error("Failed to find mirrored file", "tag", tag, "name", base, "error", err)
+				http.Error(w, "Failed to find file", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		root, tags, err := dav.listing(r.Context())
+		if err != nil {
+			slog.Error("Failed to list mirror", "error", err)
+			http.Error(w, "Failed to list files", http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case len(segments) == 1 && segments[0] == "":
+			entries := mirrorEntries(root)
+			for _, tag := range tags {
+				entries = append(entries, mirrorEntry{Name: tag.name, Dir: true, ModTime: mirrorTime(tag.modTime)})
+			}
+			serveMirrorListing(w, r, format, mirrorPrefix+"/", entries)
+		case len(segments) == 1:
+			if file, ok := root.files[segments[0]]; ok {
+				serveMirrorFile(w, r, fileService, file)
+			} else if _, ok := tags[segments[0]]; ok {
+				// Directories end with a slash, for relative links to resolve
+				http.Redirect(w, r, mirrorPrefix+"/"+url.PathEscape(segments[0])+"/", http.StatusMovedPermanently)
+			} else {
+				http.NotFound(w, r)
+			}
+		case len(segments) == 2 && tags[segments[0]] != nil:
+			dir := tags[segments[0]]
+			if segments[1] == "" {
+				serveMirrorListing(w, r, format, mirrorPrefix+"/"+url.PathEscape(dir.name)+"/", mirrorEntries(dir))
+			} else if file, ok := dir.files[segments[1]]; ok {
+				serveMirrorFile(w, r, fileService, file)
+			} else {
+				http.NotFound(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// mirrorEntries returns the files of a directory as listing entries
+func mirrorEntries(dir *davDir) []mirrorEntry {
+	entries := make([]mirrorEntry, 0, len(dir.files))
+	for name, file := range dir.files {
+		entries = append(entries, mirrorEntry{
+			Name:    name,
+			ID:      file.ID,
+			Size:    file.Size,
+			ModTime: mirrorTime(file.CreatedAt),
+			SHA256:  file.Checksum,
+		})
+	}
+	return entries
+}
+
+// mirrorTime is a modification time as Last-Modified gives it, so
+// listings agree with the headers of the content
+func mirrorTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// serveMirrorListing serves a listing sorted by name, with its checksum as
+// ETag. Listings have no Last-Modified: removing a file doesn't make a
+// directory newer.
+func serveMirrorListing(w http.ResponseWriter, r *http.Request, format, path string, entries []mirrorEntry) {
+	slices.SortFunc(entries, func(a, b mirrorEntry) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.ID, b.ID))
+	})
+
+	var body bytes.Buffer
+	listing := mirrorListing{Path: path, Entries: entries}
+	var err error
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(&body).Encode(listing)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = mirrorIndex.Execute(&body, listing)
+	}
+	if err != nil {
+		slog.Error("Failed to encode mirror listing", "path", path, "error", err)
+		http.Error(w, "Failed to encode listing", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body.Bytes())
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body.Bytes()))
+}
+
+// serveMirrorFile serves the content of a file with its checksum as ETag
+func serveMirrorFile(w http.ResponseWriter, r *http.Request, fileService *files.Service, file *files.File) {
+	content := &storedFile{ctx: r.Context(), fileService: fileService, file: file}
+	defer content.Close()
+	if file.Checksum != "" {
+		w.Header().Set("ETag", `"`+file.Checksum+`"`)
+	}
+	w.Header().Set("Content-Type", cmp.Or(file.MimeType, "application/octet-stream"))
+	http.ServeContent(w, r, "", mirrorTime(file.CreatedAt), content)
+}
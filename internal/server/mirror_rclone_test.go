@@ -0,0 +1,103 @@
+//go:build rclone
+
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rclonehttp "github.com/rclone/rclone/backend/http"
+	"github.com/rclone/rclone/backend/local"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMirrorRclone mirrors the stash with rclone's http backend, as the
+// mirror documents. It pulls in rclone, so it only runs with -tags rclone.
+func TestMirrorRclone(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploadTestFile(t, ts, "app.txt", "old release", map[string]string{"tag": "release"})
+	newer := uploadTestFile(t, ts, "app.txt", "new release", map[string]string{"tag": "release"})
+	uploadTestFile(t, ts, "notes.txt", "untagged", nil)
+	uploadTestFile(t, ts, "build.log", "nightly", map[string]string{"tag": "ci/nightly"})
+	uploadTestFile(t, ts, "secret.txt", "classified", map[string]string{"password": "hunter2"})
+
+	// rclone syncs path into dir and returns the tree synced, keyed by the
+	// slash separated path of each file
+	rclone := func(t *testing.T, path, token, dir string) map[string]string {
+		ctx := context.Background()
+		src, err := rclonehttp.NewFs(ctx, "stash", "", configmap.Simple{
+			"url":     ts.URL + path,
+			"headers": "Authorization,Bearer " + token,
+		})
+		require.NoError(t, err)
+		dst, err := local.NewFs(ctx, "local", dir, configmap.Simple{})
+		require.NoError(t, err)
+		require.NoError(t, sync.Sync(ctx, dst, src, false))
+
+		tree := make(map[string]string)
+		err = filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(dir, file)
+			tree[filepath.ToSlash(name)] = string(content)
+			return err
+		})
+		require.NoError(t, err)
+		return tree
+	}
+
+	t.Run("Sync", func(t *testing.T) {
+		// rclone doesn't follow the link to ci%2Fnightly/, as its name holds
+		// a slash
+		assert.Equal(t, map[string]string{
+			"notes.txt":       "untagged",
+			"release/app.txt": "old release",
+			"release/" + newer["id"].(string) + "_app.txt": "new release",
+		}, rclone(t, "/mirror/", "viewer-token", t.TempDir()))
+
+		// Password protected files are only mirrored for admins
+		admin := rclone(t, "/mirror/", adminToken, t.TempDir())
+		assert.Equal(t, "classified", admin["secret.txt"])
+		assert.Len(t, admin, 4)
+	})
+
+	t.Run("SlashedTag", func(t *testing.T) {
+		assert.Equal(t, map[string]string{"build.log": "nightly"},
+			rclone(t, "/mirror/ci%2Fnightly/", "viewer-token", t.TempDir()))
+	})
+
+	t.Run("Resync", func(t *testing.T) {
+		// Files keep their names as others of the same name come and go, so
+		// syncing again only fetches and removes what changed
+		dir := t.TempDir()
+		rclone(t, "/mirror/release/", "viewer-token", dir)
+
+		newest := uploadTestFile(t, ts, "app.txt", "newest release", map[string]string{"tag": "release"})
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+newer["id"].(string), nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		assert.Equal(t, map[string]string{
+			"app.txt":                          "old release",
+			newest["id"].(string) + "_app.txt": "newest release",
+		}, rclone(t, "/mirror/release/", "viewer-token", dir))
+	})
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// Multipart uploads send the content of large files in parts, which can be
+// uploaded in parallel and retried on their own:
+//
+//	POST /v1/uploads                       registers the file, like POST /v1/files/register
+//	PUT  /v1/uploads/{id}/parts/{number}   uploads part 1, 2, ... in the request body
+//	GET  /v1/uploads/{id}                  reports progress and lists the parts uploaded so far, to resume
+//	POST /v1/uploads/{id}/complete         assembles the parts into the file's content
+//
+// Each part is bounded by MaxSize like any request body, and the parts of
+// an upload together by MultipartMaxSize. GET
+// /v1/uploads/{id} reports the progress of files registered with POST
+// /v1/files/register too, while their content is uploaded in one request.
+
+func createMultipartUpload(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := readRegisterRequest(w, r, cfg)
+		if !ok {
+			return
+		}
+
+		upload, err := fileService.CreateMultipartUpload(r.Context(), req)
+		if err != nil {
+			slog.Error("Create multipart upload failed", "error", err, "filename", req.Name)
+			writeUploadError(w, err)
+			return
+		}
+		slog.Info("Created multipart upload", "file_id", upload.ID, "filename", upload.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/v1/uploads/"+upload.ID)
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(upload); err != nil {
+			slog.Error("Failed to encode response", "error", err)
+		}
+	}
+}
+
+func getMultipartUpload(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		upload, err := fileService.GetMultipartUpload(r.Context(), id)
+		if err != nil {
+			slog.Error("Get multipart upload failed", "error", err, "file_id", id)
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(upload); err != nil {
+			slog.Error("Failed to encode response", "error", err)
+		}
+	}
+}
+
+func uploadPart(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		number, err := strconv.Atoi(r.PathValue("number"))
+		if err != nil {
+			http.Error(w, "Invalid part number", http.StatusBadRequest)
+			return
+		}
+		slog.Info("Uploading part", "file_id", id, "part", number)
+
+		start := time.Now()
+		part, err := fileService.UploadPart(r.Context(), id, number, r.Body)
+		recordStorageWait(r.Context(), time.Since(start))
+		if err != nil {
+			slog.Error("Upload part failed", "error", err, "file_id", id, "part", number)
+			writeContentError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(part); err != nil {
+			slog.Error("Failed to encode response", "error", err)
+		}
+	}
+}
+
+func completeMultipartUpload(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		slog.Info("Completing multipart upload", "file_id", id)
+
+		start := time.Now()
+		result, err := fileService.CompleteMultipartUpload(r.Context(), id)
+		recordStorageWait(r.Context(), time.Since(start))
+		if err != nil {
+			slog.Error("Complete multipart upload failed", "error", err, "file_id", id)
+			writeContentError(w, err)
+			return
+		}
+		result.URL = absoluteURL(cfg, r, result.URL)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Failed to encode response", "error", err)
+		}
+	}
+}
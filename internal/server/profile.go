@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// profiles are presets for common deployment topologies, selected with
+// FILES_STASH_PROFILE. Each sets configuration variables that aren't set
+// explicitly.
+var profiles = map[string]map[string]string{
+	// Clients connect directly, so forwarded headers are spoofable and slow
+	// clients have to be bounded by the server itself
+	"standalone": {
+		"FILES_STASH_TRUST_FORWARDED_HEADERS": "false",
+		"FILES_STASH_READ_HEADER_TIMEOUT":     "10s",
+		"FILES_STASH_READ_TIMEOUT":            "15m",
+		"FILES_STASH_WRITE_TIMEOUT":           "30m",
+		"FILES_STASH_IDLE_TIMEOUT":            "60s",
+		"FILES_STASH_MAX_HEADER_BYTES":        "65536",
+	},
+	// nginx sets X-Forwarded-* and buffers request bodies before passing
+	// them on. Idle connections outlive nginx's upstream keepalive_timeout
+	// of 60s, so nginx never reuses one the server is closing, and headers
+	// fit nginx's default large_client_header_buffers of 4 8k.
+	"behind-nginx": {
+		"FILES_STASH_TRUST_FORWARDED_HEADERS": "true",
+		"FILES_STASH_READ_HEADER_TIMEOUT":     "5s",
+		"FILES_STASH_READ_TIMEOUT":            "5m",
+		"FILES_STASH_WRITE_TIMEOUT":           "30m",
+		"FILES_STASH_IDLE_TIMEOUT":            "75s",
+		"FILES_STASH_MAX_HEADER_BYTES":        "32768",
+	},
+	// CDNs pull large files over long lived origin connections and reject
+	// request bodies over 100 MB. Links must name the CDN's hostname, not
+	// the origin's the CDN forwards, so FILES_STASH_BASE_URL is required.
+	"cdn": {
+		"FILES_STASH_TRUST_FORWARDED_HEADERS": "true",
+		"FILES_STASH_READ_HEADER_TIMEOUT":     "5s",
+		"FILES_STASH_READ_TIMEOUT":            "5m",
+		"FILES_STASH_WRITE_TIMEOUT":           "1h",
+		"FILES_STASH_IDLE_TIMEOUT":            "10m",
+		"FILES_STASH_MAX_HEADER_BYTES":        "65536",
+		"FILES_STASH_MAX_SIZE":                "100000000",
+	},
+}
+
+// profileRequires lists the variables a profile can't choose a value for
+var profileRequires = map[string][]string{
+	"cdn": {"FILES_STASH_BASE_URL"},
+}
+
+// ProfileEnvironment returns the environment to parse the Config from: the
+// given one with the variables of the profile named by FILES_STASH_PROFILE
+// added. Variables already set keep their value.
+func ProfileEnvironment(environ map[string]string) (map[string]string, error) {
+	name := environ["FILES_STASH_PROFILE"]
+	if name == "" {
+		return environ, nil
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(profiles)), ", "))
+	}
+	for _, key := range profileRequires[name] {
+		if environ[key] == "" {
+			return nil, fmt.Errorf("profile %q requires %s", name, key)
+		}
+	}
+
+	merged := maps.Clone(profile)
+	maps.Copy(merged, environ)
+	return merged, nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+const clientContextKey contextKey = "client"
+
+// client is who a request comes from
+type client struct {
+	ip        string
+	forwarded bool // the request's forwarded headers are trusted
+}
+
+// realIP resolves the client of each request, for the handlers and
+// middleware it wraps to find with clientIP and requestClient
+func realIP(next http.Handler, cfg *Config, proxies []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientContextKey, resolveClient(cfg, proxies, r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the IP address of the client of r
+func clientIP(cfg *Config, r *http.Request) string {
+	return requestClient(cfg, r).ip
+}
+
+// requestClient returns the client of r, as resolved by realIP, or else
+// resolves it
+func requestClient(cfg *Config, r *http.Request) client {
+	if c, ok := r.Context().Value(clientContextKey).(client); ok {
+		return c
+	}
+	proxies, _ := parsePrefixes(cfg.TrustedProxies) // validated by New
+	return resolveClient(cfg, proxies, r)
+}
+
+// resolveClient finds the client of r. With trusted proxies, only requests
+// from one of them have their forwarded headers trusted, and the client is
+// the last address in X-Forwarded-For that isn't a trusted proxy, since
+// each proxy appends the address it got the request from and anything
+// before is what the client claims. Without them, the client is always the
+// peer: TrustForwardedHeaders trusts X-Forwarded-Proto and Host for links,
+// but an address anyone can send is no client IP.
+func resolveClient(cfg *Config, proxies []netip.Prefix, r *http.Request) client {
+	peer := normalizeIP(r.RemoteAddr)
+	trusted := func(value string) bool {
+		addr, err := netip.ParseAddr(value)
+		return err == nil && slices.ContainsFunc(proxies, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+	}
+
+	var hops []string
+	for hop := range strings.SplitSeq(r.Header.Get("X-Forwarded-For"), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, normalizeIP(hop))
+		}
+	}
+	xRealIP := normalizeIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+
+	switch {
+	case len(proxies) == 0:
+		return client{ip: peer, forwarded: cfg.TrustForwardedHeaders}
+	case !trusted(peer):
+		return client{ip: peer}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !trusted(hops[i]) {
+			return client{ip: hops[i], forwarded: true}
+		}
+	}
+	// Every hop is a proxy of ours, so the request started behind them
+	if xRealIP != "" {
+		return client{ip: xRealIP, forwarded: true}
+	}
+	if len(hops) > 0 {
+		return client{ip: hops[0], forwarded: true}
+	}
+	return client{ip: peer, forwarded: true}
+}
+
+// normalizeIP strips the port from an address and unmaps IPv4-mapped IPv6
+// addresses, leaving values that don't parse as they are
+func normalizeIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return addr
+	}
+	return ip.Unmap().String()
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// Bounds of the QR code image size, in pixels
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// fileQR issues a signed download link for a file and returns it encoded as
+// a PNG QR code, so the file can be fetched by scanning it with a phone. The
+// link takes the same options as those of POST /v1/files/{id}/links and
+// shows up among them.
+func fileQR(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		size := defaultQRSize
+		if v := r.URL.Query().Get("size"); v != "" {
+			var err error
+			if size, err = strconv.Atoi(v); err != nil || size < minQRSize || size > maxQRSize {
+				http.Error(w, "Invalid size", http.StatusBadRequest)
+				return
+			}
+		}
+
+		opts, err := parseLinkOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := r.URL.Query().Get("one_time"); v != "" {
+			if opts.OneTime, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "Invalid one_time", http.StatusBadRequest)
+				return
+			}
+		}
+
+		link, err := fileService.CreateLink(r.Context(), userFromContext(r.Context()), id, opts)
+		if err != nil {
+			slog.Error("Create QR code link failed", "error", err, "file_id", id)
+			if errors.Is(err, files.ErrRangeNotSatisfiable) {
+				http.Error(w, "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			http.Error(w, "Create QR code failed", http.StatusNotFound)
+			return
+		}
+
+		png, err := qrcode.Encode(qrURL(cfg, r, link.URL), qrcode.Medium, size)
+		if err != nil {
+			slog.Error("Encode QR code failed", "error", err, "file_id", id)
+			http.Error(w, "Create QR code failed", http.StatusInternalServerError)
+			return
+		}
+
+		// The code carries a live link
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(png)
+	}
+}
+
+// qrURL resolves a link for a QR code. A phone can't follow a relative
+// link, so without a base URL it's resolved against the request's host.
+func qrURL(cfg *Config, r *http.Request, link string) string {
+	resolved := absoluteURL(cfg, r, link)
+	if !strings.HasPrefix(resolved, "/") {
+		return resolved
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + resolved
+}
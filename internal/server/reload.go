@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/notify"
+)
+
+// reloadableSettings are the Config fields a running server applies when
+// the configuration is reloaded; changing any other takes a restart
+var reloadableSettings = []string{
+	"TTL",
+	"MaxSize",
+	"DownloadRateLimit",
+	"TotalDownloadRateLimit",
+	"LogLevel",
+	"NotifySinks",
+	"NotifyRoutes",
+	"WebhookSecret",
+	"ForecastWebhookURL",
+	"ExpiringReportWebhookURL",
+	"ExpiringReportSlackURL",
+}
+
+// notificationSettings are the reloadable settings the notifier is built from
+var notificationSettings = []string{
+	"NotifySinks",
+	"NotifyRoutes",
+	"WebhookSecret",
+	"ForecastWebhookURL",
+	"ExpiringReportWebhookURL",
+	"ExpiringReportSlackURL",
+}
+
+// configReloader reloads the configuration from the config file when the
+// file changes or the process gets SIGHUP, and applies the reloadable
+// settings that changed
+type configReloader struct {
+	path     string
+	interval time.Duration
+	environ  map[string]string
+	apply    func(next *Config, changed map[string]bool) error
+
+	current *Config // as last applied
+	modTime time.Time
+}
+
+// newConfigReloader creates a reloader for the config file of cfg, calling
+// apply with the reloaded configuration and the names of the reloadable
+// settings that changed
+func newConfigReloader(cfg *Config, apply func(next *Config, changed map[string]bool) error) *configReloader {
+	r := &configReloader{
+		path:     cfg.ConfigFile,
+		interval: cfg.ConfigWatchInterval,
+		environ:  env.ToMap(os.Environ()),
+		apply:    apply,
+		current:  cfg.settings(),
+	}
+	r.modTime, _ = r.stat()
+	return r
+}
+
+// Run reloads the configuration until the context is cancelled
+func (r *configReloader) Run(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	var ticks <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			r.RunOnce(ctx)
+		case <-ticks:
+			if modTime, err := r.stat(); err == nil && !modTime.Equal(r.modTime) {
+				r.RunOnce(ctx)
+			}
+		}
+	}
+}
+
+// RunOnce reloads the configuration, logs what changed and applies it. An
+// invalid configuration is logged and leaves the current one in place.
+func (r *configReloader) RunOnce(ctx context.Context) {
+	r.modTime, _ = r.stat()
+
+	next, err := LoadConfig(r.path, r.environ)
+	var invalid ConfigError
+	if errors.As(err, &invalid) {
+		for _, problem := range invalid {
+			slog.Error("Invalid configuration, keeping the current one", "problem", problem)
+		}
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to reload configuration, keeping the current one", "error", err)
+		return
+	}
+
+	changed := make(map[string]bool)
+	applied := *r.current
+	for _, change := range diffConfig(r.current, next) {
+		if !slices.Contains(reloadableSettings, change.field) {
+			slog.Warn("Configuration setting changed, takes a restart", "setting", change.variable, "from", change.from, "to", change.to)
+			continue
+		}
+		slog.Info("Configuration setting changed", "setting", change.variable, "from", change.from, "to", change.to)
+		changed[change.field] = true
+		reflect.ValueOf(&applied).Elem().FieldByName(change.field).Set(reflect.ValueOf(next).Elem().FieldByName(change.field))
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	if err := r.apply(&applied, changed); err != nil {
+		slog.Error("Failed to apply configuration, keeping the current one", "error", err)
+		return
+	}
+	r.current = &applied
+	slog.Info("Configuration reloaded", "changed", len(changed))
+}
+
+// stat returns when the config file was last modified
+func (r *configReloader) stat() (time.Time, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// applyConfig applies the changed reloadable settings of next to a running
+// server. Requests in progress finish with the settings they started with.
+func applyConfig(cfg, next *Config, changed map[string]bool, fileService *files.Service, notifications *notify.Switch, broker *notify.Broker, logLevel *slog.LevelVar) error {
+	// Settings that can fail are checked before anything changes
+	var level slog.Level
+	if changed["LogLevel"] {
+		if err := level.UnmarshalText([]byte(next.LogLevel)); err != nil {
+			return fmt.Errorf("invalid log level %q: %w", next.LogLevel, err)
+		}
+	}
+	var notifier *notify.Router
+	if slices.ContainsFunc(notificationSettings, func(field string) bool { return changed[field] }) {
+		var err error
+		if notifier, err = newNotifier(next, broker); err != nil {
+			return fmt.Errorf("failed to configure notifications: %w", err)
+		}
+	}
+
+	if changed["TTL"] {
+		fileService.SetDefaultTTL(next.TTL)
+	}
+	if changed["MaxSize"] {
+		cfg.live.maxSize.Store(next.MaxSize)
+	}
+	if changed["DownloadRateLimit"] || changed["TotalDownloadRateLimit"] {
+		fileService.SetBandwidthLimits(next.DownloadRateLimit, next.TotalDownloadRateLimit)
+	}
+	if changed["LogLevel"] {
+		logLevel.Set(level)
+	}
+	if notifier != nil {
+		notifications.Set(notifier)
+	}
+	return nil
+}
+
+// settings returns a copy of the configuration without its live settings
+func (cfg *Config) settings() *Config {
+	settings := *cfg
+	settings.live = nil
+	return &settings
+}
+
+// configChange is a setting that differs between two configurations
+type configChange struct {
+	field    string
+	variable string
+	from, to string
+}
+
+// diffConfig lists the settings that differ between two configurations,
+// with the values of secrets hidden
+func diffConfig(from, to *Config) []configChange {
+	var changes []configChange
+	t := reflect.TypeFor[Config]()
+	before, after := reflect.ValueOf(from).Elem(), reflect.ValueOf(to).Elem()
+	for i := range t.NumField() {
+		variable, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ",")
+		if variable == "" || sameSetting(before.Field(i), after.Field(i)) {
+			continue
+		}
+		change := configChange{field: t.Field(i).Name, variable: variable, from: "REDACTED", to: "REDACTED"}
+		if !isSecretSetting(variable) {
+			change.from, change.to = fmt.Sprint(before.Field(i).Interface()), fmt.Sprint(after.Field(i).Interface())
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// sameSetting reports whether two values of a setting are equal, counting
+// unset and empty lists and maps as equal
+func sameSetting(a, b reflect.Value) bool {
+	if (a.Kind() == reflect.Slice || a.Kind() == reflect.Map) && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// isSecretSetting reports whether the variable may hold a credential, which
+// is kept out of the log. Webhook URLs and sink targets often embed one.
+func isSecretSetting(variable string) bool {
+	for _, word := range []string{"TOKEN", "KEY", "SECRET", "PASSWORD", "URL", "SINKS"} {
+		if strings.Contains(variable, word) {
+			return true
+		}
+	}
+	return false
+}
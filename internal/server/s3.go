@@ -0,0 +1,464 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// s3Prefix is where the S3 compatible gateway is mounted
+const s3Prefix = "/s3"
+
+// s3KeyAttribute holds the full object key of files uploaded through the
+// gateway, since file names can't contain slashes
+const s3KeyAttribute = "s3.key"
+
+// s3MaxKeys is the default and largest page of object listings
+const s3MaxKeys = 1000
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3Error is an error response in the S3 format
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+var (
+	s3ErrAccessDenied   = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	s3ErrNoSuchKey      = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	s3ErrNotImplemented = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+)
+
+func s3ErrInvalidRequest(message string) *s3Error {
+	return &s3Error{http.StatusBadRequest, "InvalidRequest", message}
+}
+
+// s3Handler serves a minimal S3 API with path-style addressing, e.g.
+// "/s3/{bucket}/{key}", where buckets are tags and objects are the newest
+// file of each key in a tag. Buckets exist as long as they hold files.
+// Requests must be signed with AWS Signature Version 4 using the
+// configured access key; clients sign with any region.
+func s3Handler(cfg *Config, fileService *files.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sig, s3err := parseSigV4(r)
+		if s3err == nil && !hmac.Equal([]byte(sig.accessKey), []byte(cfg.S3AccessKeyID)) {
+			s3err = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."}
+		}
+		if s3err == nil {
+			s3err = sig.verify(r, cfg.S3SecretAccessKey, time.Now())
+		}
+		if s3err != nil {
+			writeS3Error(w, r, s3err)
+			return
+		}
+		recordUser(r.Context(), adminUser, "")
+		ctx := context.WithValue(r.Context(), userContextKey, adminUser)
+		r = r.WithContext(ctx)
+
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, s3Prefix+"/"), "/")
+		switch {
+		case bucket == "" && r.Method == http.MethodGet:
+			listBuckets(w, r, fileService)
+		case bucket == "":
+			writeS3Error(w, r, s3ErrNotImplemented)
+		case key == "":
+			serveBucket(w, r, fileService, bucket)
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			getObject(w, r, fileService, bucket, key)
+		case r.Method == http.MethodPut:
+			putObject(cfg, w, r, fileService, sig, bucket, key)
+		case r.Method == http.MethodDelete:
+			deleteObject(w, r, fileService, bucket, key)
+		default:
+			writeS3Error(w, r, s3ErrNotImplemented)
+		}
+	}
+}
+
+// writeS3Error sends an S3 error response; HEAD responses have no body
+func writeS3Error(w http.ResponseWriter, r *http.Request, s3err *s3Error) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3err.Status)
+		return
+	}
+	body := struct {
+		XMLName xml.Name `xml:"Error"`
+		*s3Error
+		Resource string `xml:"Resource"`
+	}{s3Error: s3err, Resource: r.URL.Path}
+	writeXML(w, s3err.Status, body)
+}
+
+func writeXML(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// s3Object is the newest file stored under a key
+type s3Object struct {
+	key  string
+	file *files.File
+}
+
+// s3Key returns the object key of a file
+func s3Key(file *files.File) string {
+	return cmp.Or(file.Attributes[s3KeyAttribute], file.Name)
+}
+
+// s3Objects returns the objects in a bucket, sorted by key
+func s3Objects(ctx context.Context, fileService *files.Service, bucket string) ([]s3Object, error) {
+	fileList, err := fileService.List(ctx, userFromContext(ctx), files.ListFilter{Tag: bucket})
+	if err != nil {
+		return nil, err
+	}
+	newest := make(map[string]*files.File)
+	for _, file := range fileList {
+		if !file.IsActive() || file.Tag != bucket {
+			continue
+		}
+		key := s3Key(file)
+		if current, ok := newest[key]; !ok || file.CreatedAt.After(current.CreatedAt) {
+			newest[key] = file
+		}
+	}
+	objects := make([]s3Object, 0, len(newest))
+	for key, file := range newest {
+		objects = append(objects, s3Object{key: key, file: file})
+	}
+	slices.SortFunc(objects, func(a, b s3Object) int { return strings.Compare(a.key, b.key) })
+	return objects, nil
+}
+
+// findS3Object returns the object stored under key, or nil
+func findS3Object(ctx context.Context, fileService *files.Service, bucket, key string) (*files.File, error) {
+	objects, err := s3Objects(ctx, fileService, bucket)
+	if err != nil {
+		return nil, err
+	}
+	i, found := slices.BinarySearchFunc(objects, key, func(o s3Object, key string) int { return strings.Compare(o.key, key) })
+	if !found {
+		return nil, nil
+	}
+	return objects[i].file, nil
+}
+
+func listBuckets(w http.ResponseWriter, r *http.Request, fileService *files.Service) {
+	fileList, err := fileService.List(r.Context(), userFromContext(r.Context()), files.ListFilter{})
+	if err != nil {
+		slog.Error("Failed to list buckets", "error", err)
+		writeS3Error(w, r, &s3Error{http.StatusInternalServerError, "InternalError", "Failed to list buckets"})
+		return
+	}
+	created := make(map[string]time.Time)
+	for _, file := range fileList {
+		if file.Tag == "" {
+			continue
+		}
+		if at, ok := created[file.Tag]; !ok || file.CreatedAt.Before(at) {
+			created[file.Tag] = file.CreatedAt
+		}
+	}
+
+	type bucket struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID string `xml:"ID"`
+		} `xml:"Owner"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace}
+	result.Owner.ID = adminUser
+	for _, name := range slices.Sorted(maps.Keys(created)) {
+		result.Buckets = append(result.Buckets, bucket{Name: name, CreationDate: created[name].UTC().Format(time.RFC3339)})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// serveBucket handles requests on a bucket: listing its objects and
+// answering the checks clients make before using it
+func serveBucket(w http.ResponseWriter, r *http.Request, fileService *files.Service, bucket string) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut:
+		// Buckets are tags, which exist once they hold files
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && query.Has("location"):
+		writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3Namespace})
+	case r.Method == http.MethodGet && !slices.ContainsFunc(s3Subresources, query.Has):
+		listObjects(w, r, fileService, bucket)
+	default:
+		writeS3Error(w, r, s3ErrNotImplemented)
+	}
+}
+
+// s3Subresources are the bucket queries the gateway doesn't implement
+var s3Subresources = []string{"acl", "cors", "delete", "lifecycle", "policy", "tagging", "uploads", "versioning", "versions", "website"}
+
+// s3Contents describes an object in a listing
+type s3Contents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listObjects implements ListObjects and, with list-type=2, ListObjectsV2
+func listObjects(w http.ResponseWriter, r *http.Request, fileService *files.Service, bucket string) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid max-keys"})
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	// Listing resumes after the marker, the start-after key or the key in
+	// the continuation token
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid continuation token"})
+				return
+			}
+			after = string(decoded)
+		}
+	}
+
+	objects, err := s3Objects(r.Context(), fileService, bucket)
+	if err != nil {
+		slog.Error("Failed to list objects", "bucket", bucket, "error", err)
+		writeS3Error(w, r, &s3Error{http.StatusInternalServerError, "InternalError", "Failed to list objects"})
+		return
+	}
+
+	var contents []s3Contents
+	var prefixes []s3CommonPrefix
+	var last string
+	truncated := false
+	for _, object := range objects {
+		if !strings.HasPrefix(object.key, prefix) || object.key <= after {
+			continue
+		}
+		// Keys below a delimiter after the prefix roll up into a common
+		// prefix, listed once
+		entry := object.key
+		if delimiter != "" {
+			if i := strings.Index(object.key[len(prefix):], delimiter); i >= 0 {
+				entry = object.key[:len(prefix)+i+len(delimiter)]
+				if entry == last {
+					continue
+				}
+			}
+		}
+		if len(contents)+len(prefixes) >= maxKeys {
+			truncated = true
+			break
+		}
+		if entry != object.key {
+			prefixes = append(prefixes, s3CommonPrefix{Prefix: entry})
+			last = entry
+			continue
+		}
+		last = entry
+		contents = append(contents, s3Contents{
+			Key:          object.key,
+			LastModified: object.file.CreatedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         s3ETag(object.file),
+			Size:         object.file.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+	for i := range contents {
+		contents[i].Key = encode(contents[i].Key)
+	}
+	for i := range prefixes {
+		prefixes[i].Prefix = encode(prefixes[i].Prefix)
+	}
+
+	result := struct {
+		XMLName               xml.Name         `xml:"ListBucketResult"`
+		Xmlns                 string           `xml:"xmlns,attr"`
+		Name                  string           `xml:"Name"`
+		Prefix                string           `xml:"Prefix"`
+		Delimiter             string           `xml:"Delimiter,omitempty"`
+		EncodingType          string           `xml:"EncodingType,omitempty"`
+		MaxKeys               int              `xml:"MaxKeys"`
+		IsTruncated           bool             `xml:"IsTruncated"`
+		Marker                *string          `xml:"Marker"`
+		NextMarker            string           `xml:"NextMarker,omitempty"`
+		KeyCount              *int             `xml:"KeyCount"`
+		StartAfter            string           `xml:"StartAfter,omitempty"`
+		ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+		Contents              []s3Contents     `xml:"Contents"`
+		CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+	}{
+		Xmlns:        s3Namespace,
+		Name:         bucket,
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		EncodingType: query.Get("encoding-type"),
+		MaxKeys:      maxKeys,
+		IsTruncated:  truncated,
+	}
+	if v2 {
+		count := len(contents) + len(prefixes)
+		result.KeyCount = &count
+		result.StartAfter = encode(query.Get("start-after"))
+		result.ContinuationToken = query.Get("continuation-token")
+		if truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := encode(query.Get("marker"))
+		result.Marker = &marker
+		if truncated {
+			result.NextMarker = encode(last)
+		}
+	}
+	result.Contents, result.CommonPrefixes = contents, prefixes
+	writeXML(w, http.StatusOK, result)
+}
+
+// s3ETag is the entity tag of an object. It's the SHA-256 checksum rather
+// than the MD5 S3 uses, which clients recognize as not being an MD5.
+func s3ETag(file *files.File) string {
+	return `"` + file.Checksum + `"`
+}
+
+func getObject(w http.ResponseWriter, r *http.Request, fileService *files.Service, bucket, key string) {
+	file, err := findS3Object(r.Context(), fileService, bucket, key)
+	if err != nil {
+		slog.Error("Failed to find object", "bucket", bucket, "key", key, "error", err)
+		writeS3Error(w, r, &s3Error{http.StatusInternalServerError, "InternalError", "Failed to find object"})
+		return
+	}
+	if file == nil {
+		writeS3Error(w, r, s3ErrNoSuchKey)
+		return
+	}
+
+	content := &storedFile{ctx: r.Context(), fileService: fileService, file: file}
+	defer content.Close()
+	w.Header().Set("ETag", s3ETag(file))
+	w.Header().Set("Content-Type", cmp.Or(file.MimeType, "application/octet-stream"))
+	http.ServeContent(w, r, "", file.CreatedAt, content)
+}
+
+func putObject(cfg *Config, w http.ResponseWriter, r *http.Request, fileService *files.Service, sig *sigV4, bucket, key string) {
+	if r.Header.Get("X-Amz-Copy-Source") != "" || r.URL.Query().Has("uploadId") {
+		writeS3Error(w, r, s3ErrNotImplemented)
+		return
+	}
+	body, s3err := sig.payload(r, cfg.S3SecretAccessKey)
+	if s3err != nil {
+		writeS3Error(w, r, s3err)
+		return
+	}
+
+	// Conditional writes let clients such as terraform take locks
+	if r.Header.Get("If-None-Match") == "*" {
+		existing, err := findS3Object(r.Context(), fileService, bucket, key)
+		if err == nil && existing != nil {
+			writeS3Error(w, r, &s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold"})
+			return
+		}
+	}
+
+	result, err := fileService.Upload(r.Context(), &files.UploadRequest{
+		Name:       key,
+		MimeType:   r.Header.Get("Content-Type"),
+		Tag:        bucket,
+		Attributes: map[string]string{s3KeyAttribute: key},
+		Origin:     uploadOrigin(cfg, r),
+		Content:    bytes.NewReader(body),
+	})
+	if err != nil {
+		slog.Error("S3 upload failed", "bucket", bucket, "key", key, "error", err)
+		switch {
+		case errors.Is(err, files.ErrReadOnly):
+			writeS3Error(w, r, &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", err.Error()})
+		case errors.Is(err, files.ErrInsufficientStorage):
+			writeS3Error(w, r, &s3Error{http.StatusInsufficientStorage, "InsufficientStorage", err.Error()})
+		case errors.Is(err, files.ErrMimeTypeNotAllowed), errors.Is(err, files.ErrMimeTypeMismatch), errors.Is(err, files.ErrInfected):
+			writeS3Error(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", err.Error()})
+		case errors.Is(err, files.ErrScanFailed):
+			writeS3Error(w, r, &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", files.ErrScanFailed.Error()})
+		default:
+			writeS3Error(w, r, &s3Error{http.StatusInternalServerError, "InternalError", "Upload failed"})
+		}
+		return
+	}
+	w.Header().Set("ETag", `"`+result.Checksum+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteObject removes every version of an object, so it's gone as S3
+// clients expect. Deleting a missing object succeeds.
+func deleteObject(w http.ResponseWriter, r *http.Request, fileService *files.Service, bucket, key string) {
+	fileList, err := fileService.List(r.Context(), userFromContext(r.Context()), files.ListFilter{Tag: bucket})
+	if err != nil {
+		slog.Error("Failed to list objects", "bucket", bucket, "error", err)
+		writeS3Error(w, r, &s3Error{http.StatusInternalServerError, "InternalError", "Failed to delete object"})
+		return
+	}
+	for _, file := range fileList {
+		if file.Tag != bucket || s3Key(file) != key {
+			continue
+		}
+		if err := fileService.Delete(r.Context(), userFromContext(r.Context()), file.ID, ""); err != nil {
+			slog.Error("Failed to delete object", "bucket", bucket, "key", key, "error", err)
+			writeS3Error(w, r, &s3Error{http.StatusInternalServerError, "InternalError", "Failed to delete object"})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
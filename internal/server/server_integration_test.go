@@ -1,20 +1,71 @@
-
 package server
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
 	"io"
+	"log/slog"
+	"maps"
+	"math/big"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	filesv1 "github.com/pavel-fokin/files-stash/api/files/v1"
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/fs"
+	"github.com/pavel-fokin/files-stash/internal/notify"
+	"github.com/pavel-fokin/files-stash/internal/sqlite"
+	pkgsftp "github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -22,33 +73,61 @@ const (
 	hmacKey    = "test-key"
 )
 
-func setupTestServer(t *testing.T) (*http.Server, func()) {
-	dataDir, err := os.MkdirTemp("", "files-stash-test")
-	require.NoError(t, err)
-
-	dbPath := filepath.Join(dataDir, "test.db")
+func setupTestServer(t *testing.T) *http.Server {
+	return setupTestServerWithConfig(t, nil)
+}
 
+// setupTestServerWithConfig creates a test server backed by memory, letting
+// the caller adjust the default test configuration before it's built.
+func setupTestServerWithConfig(t *testing.T, configure func(cfg *Config)) *http.Server {
 	cfg := &Config{
 		AdminToken: adminToken,
-		DataDir:    dataDir,
 		HmacKey:    hmacKey,
 		MaxSize:    1024,
 		TTL:        5 * time.Minute,
-		DBPath:     dbPath,
+		Backend:    "memory",
+	}
+	if configure != nil {
+		configure(cfg)
 	}
 
-	srv := New(cfg)
+	return New(cfg, new(slog.LevelVar))
+}
 
-	cleanup := func() {
-		os.RemoveAll(dataDir)
+// startTestApp starts an app on a free port, stopped when the test ends
+func startTestApp(t *testing.T, configure func(cfg *Config)) *App {
+	cfg := &Config{
+		AdminToken: adminToken,
+		HmacKey:    hmacKey,
+		MaxSize:    1024,
+		TTL:        5 * time.Minute,
+		Backend:    "memory",
+		Listen:     "127.0.0.1:0",
 	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	app := NewApp(cfg, new(slog.LevelVar))
+	require.NoError(t, app.Start())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		app.Stop(ctx)
+	})
+	return app
+}
 
-	return srv, cleanup
+// onDisk switches a test configuration to the disk backend, for tests that
+// inspect the data directory or database
+func onDisk(t *testing.T, cfg *Config) {
+	cfg.Backend = "disk"
+	cfg.DataDir = t.TempDir()
+	cfg.DBPath = filepath.Join(cfg.DataDir, "test.db")
 }
 
 func TestIntegration(t *testing.T) {
-	srv, cleanup := setupTestServer(t)
-	defer cleanup()
+	srv := setupTestServer(t)
 
 	ts := httptest.NewServer(srv.Handler)
 	defer ts.Close()
@@ -117,11 +196,11 @@ func TestIntegration(t *testing.T) {
 	t.Run("Upload with tag", func(t *testing.T) {
 		body := new(bytes.Buffer)
 		writer := multipart.NewWriter(body)
+		writer.WriteField("tag", "latest")
 		part, err := writer.CreateFormFile("file", "test.txt")
 		require.NoError(t, err)
 		_, err = io.WriteString(part, "tagged file content")
 		require.NoError(t, err)
-		writer.WriteField("tag", "latest")
 		writer.Close()
 
 		req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
@@ -190,3 +269,6766 @@ func TestIntegration(t *testing.T) {
 		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 	})
 }
+
+// uploadTestFile uploads content as a multipart form with the given extra fields
+// and returns the decoded upload result.
+func uploadTestFile(t *testing.T, ts *httptest.Server, name, content string, fields map[string]string) map[string]any {
+	return uploadTestFileWithType(t, ts, name, "application/octet-stream", content, fields)
+}
+
+// uploadTestFileWithType is like uploadTestFile but sets the part's content type
+func uploadTestFileWithType(t *testing.T, ts *httptest.Server, name, mimeType, content string, fields map[string]string) map[string]any {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		require.NoError(t, writer.WriteField(k, v))
+	}
+	header := make(textproto.MIMEHeader)
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, escaped))
+	header.Set("Content-Type", mimeType)
+	part, err := writer.CreatePart(header)
+	require.NoError(t, err)
+	_, err = io.WriteString(part, content)
+	require.NoError(t, err)
+	writer.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var result map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result
+}
+
+// adminRequest performs a request authenticated with the admin token
+// postTestFile uploads a file as admin and returns the response whatever
+// its status, for tests expecting the upload to be refused
+func postTestFile(t *testing.T, ts *httptest.Server, name, content string, fields map[string]string) *http.Response {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		require.NoError(t, writer.WriteField(k, v))
+	}
+	part, err := writer.CreateFormFile("file", name)
+	require.NoError(t, err)
+	_, err = io.WriteString(part, content)
+	require.NoError(t, err)
+	writer.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func adminRequest(t *testing.T, method, url string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestPinnedFiles(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.TTL = time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	pinned := uploadTestFile(t, ts, "release.txt", "release", map[string]string{"pinned": "true"})
+	assert.Equal(t, true, pinned["pinned"])
+	unpinned := uploadTestFile(t, ts, "build.txt", "build", nil)
+	assert.Equal(t, false, unpinned["pinned"])
+
+	time.Sleep(5 * time.Millisecond)
+
+	t.Run("Pinned file survives expiry", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + pinned["url"].(string))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Unpinned file expires", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + unpinned["url"].(string))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+	})
+
+	t.Run("Unpin makes file expire", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+pinned["id"].(string)+"/pin", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp, err := http.Get(ts.URL + pinned["url"].(string))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+	})
+
+	t.Run("Pin unknown file", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/missing/pin", nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestRangeLinks(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "segments.txt", "0123456789abcdef", nil)
+	id := uploaded["id"].(string)
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?range=4-9", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var link struct {
+		URL string `json:"url"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+	resp.Body.Close()
+
+	download := func(t *testing.T, url, rangeHeader string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("Authorized range", func(t *testing.T) {
+		resp, body := download(t, ts.URL+link.URL, "")
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "456789", body)
+		assert.Equal(t, "bytes 4-9/16", resp.Header.Get("Content-Range"))
+	})
+
+	t.Run("Sub-range within authorized range", func(t *testing.T) {
+		resp, body := download(t, ts.URL+link.URL, "bytes=6-")
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "6789", body)
+	})
+
+	t.Run("Range outside authorization", func(t *testing.T) {
+		resp, _ := download(t, ts.URL+link.URL, "bytes=0-9")
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	})
+
+	t.Run("Tampered range", func(t *testing.T) {
+		tampered := strings.Replace(link.URL, "range=4-9", "range=0-15", 1)
+		resp, _ := download(t, ts.URL+tampered, "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Range beyond file size", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?range=100-200", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	})
+}
+
+func TestMultiFileUpload(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("tag", "tag-a")
+	writer.WriteField("tag", "tag-b")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		part, err := writer.CreateFormFile("file", name)
+		require.NoError(t, err)
+		_, err = io.WriteString(part, "content of "+name)
+		require.NoError(t, err)
+	}
+	writer.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var results []struct {
+		Name string `json:"name"`
+		File struct {
+			Tag string `json:"tag"`
+			URL string `json:"url"`
+		} `json:"file"`
+		Error string `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&results))
+	require.Len(t, results, 2)
+	assert.Equal(t, "a.txt", results[0].Name)
+	assert.Equal(t, "tag-a", results[0].File.Tag)
+	assert.Equal(t, "b.txt", results[1].Name)
+	assert.Equal(t, "tag-b", results[1].File.Tag)
+
+	for _, result := range results {
+		resp, err := http.Get(ts.URL + result.File.URL)
+		require.NoError(t, err)
+		content, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+result.Name, string(content))
+	}
+}
+
+func TestUploadForm(t *testing.T) {
+	srv := setupTestServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	post := func(query, contentType string, body io.Reader) *http.Response {
+		req, err := http.NewRequest("POST", ts.URL+"/v1/files"+query, body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("fields before the file", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		require.NoError(t, writer.WriteField("tag", "reports"))
+		require.NoError(t, writer.WriteField("description", "Weekly report"))
+		other, err := writer.CreateFormFile("attachment", "ignored.txt")
+		require.NoError(t, err)
+		io.WriteString(other, "ignored")
+		part, err := writer.CreateFormFile("file", "report.txt")
+		require.NoError(t, err)
+		io.WriteString(part, "report")
+		writer.Close()
+
+		resp := post("?pinned=true", writer.FormDataContentType(), body)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, "report.txt", result["name"])
+		assert.Equal(t, "reports", result["tag"])
+		assert.Equal(t, "Weekly report", result["description"])
+		assert.Equal(t, true, result["pinned"])
+		assert.Equal(t, float64(len("report")), result["size"])
+	})
+
+	t.Run("fields after the file", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "late.txt")
+		require.NoError(t, err)
+		io.WriteString(part, "report")
+		require.NoError(t, writer.WriteField("tag", "late-reports"))
+		writer.Close()
+
+		resp := post("", writer.FormDataContentType(), body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		// The file streamed in before the field is removed again
+		resp = adminRequest(t, "GET", ts.URL+"/v1/files/latest/late-reports", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		resp = adminRequest(t, "GET", ts.URL+"/v1/files", nil)
+		defer resp.Body.Close()
+		listing, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.NotContains(t, string(listing), "late.txt")
+	})
+
+	t.Run("over the size limit", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "large.bin")
+		require.NoError(t, err)
+		io.WriteString(part, strings.Repeat("x", 2048))
+		writer.Close()
+
+		resp := post("", writer.FormDataContentType(), body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("not a form", func(t *testing.T) {
+		resp := post("", "text/plain", strings.NewReader("content"))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestFileAnnotations(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "app.apk", "apk", map[string]string{
+		"description": "nightly build",
+		"link":        "https://ci.example.com/runs/42",
+	})
+	assert.Equal(t, "nightly build", uploaded["description"])
+	assert.Equal(t, "https://ci.example.com/runs/42", uploaded["link"])
+	id := uploaded["id"].(string)
+
+	t.Run("Update description", func(t *testing.T) {
+		resp := adminRequest(t, "PATCH", ts.URL+"/v1/files/"+id, strings.NewReader(`{"description":"crashes on login"}`))
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Reject invalid link", func(t *testing.T) {
+		resp := adminRequest(t, "PATCH", ts.URL+"/v1/files/"+id, strings.NewReader(`{"link":"javascript:alert(1)"}`))
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("List shows annotations", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files", nil)
+		defer resp.Body.Close()
+
+		var list []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		require.Len(t, list, 1)
+		assert.Equal(t, "crashes on login", list[0]["description"])
+		assert.Equal(t, "https://ci.example.com/runs/42", list[0]["link"])
+	})
+}
+
+func TestStarredFiles(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	starred := uploadTestFile(t, ts, "keep.txt", "keep", nil)
+	uploadTestFile(t, ts, "other.txt", "other", nil)
+	id := starred["id"].(string)
+
+	listStarred := func(t *testing.T) []map[string]any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?starred=true", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var list []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		return list
+	}
+
+	resp := adminRequest(t, "PUT", ts.URL+"/v1/files/"+id+"/star", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	list := listStarred(t)
+	require.Len(t, list, 1)
+	assert.Equal(t, id, list[0]["id"])
+
+	resp = adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id+"/star", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, listStarred(t))
+
+	resp = adminRequest(t, "PUT", ts.URL+"/v1/files/missing/star", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSavedSearches(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploadTestFile(t, ts, "small.txt", "x", map[string]string{"tag": "reports"})
+	large := uploadTestFile(t, ts, "large.txt", "0123456789", map[string]string{"tag": "reports"})
+	uploadTestFile(t, ts, "other.txt", "0123456789", map[string]string{"tag": "other"})
+
+	listIDs := func(t *testing.T, query string) []string {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?"+query, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var list []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		var ids []string
+		for _, f := range list {
+			ids = append(ids, f["id"].(string))
+		}
+		return ids
+	}
+
+	t.Run("Filter by query parameters", func(t *testing.T) {
+		assert.Equal(t, []string{large["id"].(string)}, listIDs(t, "tag=reports&min_size=5"))
+	})
+
+	t.Run("Reject unknown filter", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?colour=red", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Save and apply search", func(t *testing.T) {
+		resp := adminRequest(t, "PUT", ts.URL+"/v1/searches/large-reports", strings.NewReader(`{"query":"tag=reports&min_size=5"}`))
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		assert.Equal(t, []string{large["id"].(string)}, listIDs(t, "search=large-reports"))
+	})
+
+	t.Run("Reject invalid saved query", func(t *testing.T) {
+		resp := adminRequest(t, "PUT", ts.URL+"/v1/searches/broken", strings.NewReader(`{"query":"min_size=lots"}`))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Delete search", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/searches/large-reports", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = adminRequest(t, "GET", ts.URL+"/v1/files?search=large-reports", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestFetchFromURL(t *testing.T) {
+	// The remote server listens on loopback, which fetches must be let reach
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.FetchAllowCIDRs = []string{"127.0.0.1"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/artifacts/app.tar.gz":
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Write([]byte("remote content"))
+		case "/huge.bin":
+			w.Write(bytes.Repeat([]byte("x"), 2048))
+		case "/moved":
+			http.Redirect(w, r, "/artifacts/app.tar.gz", http.StatusFound)
+		case "/metadata":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer remote.Close()
+
+	fetch := func(t *testing.T, body string) *http.Response {
+		return adminRequest(t, "POST", ts.URL+"/v1/files/fetch", strings.NewReader(body))
+	}
+
+	t.Run("Fetch and download", func(t *testing.T) {
+		resp := fetch(t, `{"url":"`+remote.URL+`/artifacts/app.tar.gz","tag":"remote","ttl":"1h"}`)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var result struct {
+			Name      string    `json:"name"`
+			Tag       string    `json:"tag"`
+			MimeType  string    `json:"mime_type"`
+			CreatedAt time.Time `json:"created_at"`
+			ExpiresAt time.Time `json:"expires_at"`
+			URL       string    `json:"url"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, "app.tar.gz", result.Name)
+		assert.Equal(t, "remote", result.Tag)
+		assert.Equal(t, "application/gzip", result.MimeType)
+		assert.Equal(t, time.Hour, result.ExpiresAt.Sub(result.CreatedAt))
+
+		download, err := http.Get(ts.URL + result.URL)
+		require.NoError(t, err)
+		defer download.Body.Close()
+		content, err := io.ReadAll(download.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "remote content", string(content))
+	})
+
+	t.Run("Remote error", func(t *testing.T) {
+		resp := fetch(t, `{"url":"`+remote.URL+`/missing"}`)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("Remote file too large", func(t *testing.T) {
+		resp := fetch(t, `{"url":"`+remote.URL+`/huge.bin"}`)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("Invalid url", func(t *testing.T) {
+		resp := fetch(t, `{"url":"file:///etc/passwd"}`)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Redirects", func(t *testing.T) {
+		resp := fetch(t, `{"url":"`+remote.URL+`/moved"}`)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// Redirects are checked like the url itself
+		resp = fetch(t, `{"url":"`+remote.URL+`/metadata"}`)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "private address")
+	})
+}
+
+func TestFetchRefusesLocalAddresses(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer remote.Close()
+	port := remote.Listener.Addr().(*net.TCPAddr).Port
+
+	for _, source := range []string{
+		remote.URL,
+		fmt.Sprintf("http://localhost:%d/", port),
+		fmt.Sprintf("http://[::1]:%d/", port),
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/",
+		"http://192.168.1.1/",
+		"http://0.0.0.0/",
+	} {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/fetch", strings.NewReader(`{"url":"`+source+`"}`))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, source)
+	}
+}
+
+func TestFileComments(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "build.apk", "apk", nil)
+	commentsURL := ts.URL + "/v1/files/" + uploaded["id"].(string) + "/comments"
+
+	resp := adminRequest(t, "POST", commentsURL, strings.NewReader(`{"body":"**crashes** on login"}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var comment struct {
+		ID     string `json:"id"`
+		Author string `json:"author"`
+		Body   string `json:"body"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&comment))
+	resp.Body.Close()
+	assert.Equal(t, "admin", comment.Author)
+	assert.Equal(t, "**crashes** on login", comment.Body)
+
+	resp = adminRequest(t, "POST", commentsURL, strings.NewReader(`{"body":"  "}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = adminRequest(t, "GET", commentsURL, nil)
+	var comments []map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&comments))
+	resp.Body.Close()
+	require.Len(t, comments, 1)
+
+	resp = adminRequest(t, "DELETE", commentsURL+"/"+comment.ID, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = adminRequest(t, "DELETE", commentsURL+"/"+comment.ID, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestInlineDisposition(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.InlineMimeTypes = []string{"text/plain", "image/png"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	inlineLink := func(t *testing.T, id string) string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?disposition=inline", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var link struct {
+			URL string `json:"url"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+		return link.URL
+	}
+
+	text := uploadTestFileWithType(t, ts, "notes.txt", "text/plain; charset=utf-8", "notes", nil)
+	html := uploadTestFileWithType(t, ts, "page.html", "text/html", "<script></script>", nil)
+
+	t.Run("Allowed type is inline", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + inlineLink(t, text["id"].(string)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `inline; filename="notes.txt"`, resp.Header.Get("Content-Disposition"))
+		assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	})
+
+	t.Run("Unsafe type stays attachment", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + inlineLink(t, html["id"].(string)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `attachment; filename="page.html"`, resp.Header.Get("Content-Disposition"))
+	})
+
+	t.Run("Disposition is covered by signature", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + text["url"].(string) + "&disposition=inline")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestThumbnails(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	var img bytes.Buffer
+	require.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+	uploaded := uploadTestFileWithType(t, ts, "wide.png", "image/png", img.String(), nil)
+	id := uploaded["id"].(string)
+
+	thumbnailLink := func(t *testing.T, id, size string) string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?thumbnail="+size, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var link struct {
+			URL string `json:"url"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+		return link.URL
+	}
+
+	link := thumbnailLink(t, id, "20x20")
+	assert.Contains(t, link, "/v1/files/"+id+"/thumbnail?")
+
+	for _, attempt := range []string{"Generate thumbnail", "Serve cached thumbnail"} {
+		t.Run(attempt, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + link)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+			thumb, err := png.Decode(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, image.Rect(0, 0, 20, 10), thumb.Bounds())
+		})
+	}
+
+	t.Run("Signature bound to size", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + strings.Replace(link, "w=20", "w=40", 1))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Non-image file", func(t *testing.T) {
+		text := uploadTestFile(t, ts, "notes.txt", "not an image", nil)
+		resp, err := http.Get(ts.URL + thumbnailLink(t, text["id"].(string), "20x20"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
+
+	t.Run("Missing dimension", func(t *testing.T) {
+		// Leaving out a dimension is the same as setting it to zero
+		link := strings.Replace(thumbnailLink(t, id, "0x20"), "&w=0", "", 1)
+		require.NotContains(t, link, "w=")
+		resp, err := http.Get(ts.URL + link)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		thumb, err := png.Decode(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 40, 20), thumb.Bounds())
+	})
+
+	t.Run("Too many pixels", func(t *testing.T) {
+		// A tiny PNG whose header claims 100000x100000 pixels
+		var small bytes.Buffer
+		require.NoError(t, png.Encode(&small, image.NewGray(image.Rect(0, 0, 1, 1))))
+		data := small.Bytes()
+		ihdr := data[8+8 : 8+8+13]
+		binary.BigEndian.PutUint32(ihdr[0:4], 100000)
+		binary.BigEndian.PutUint32(ihdr[4:8], 100000)
+		binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+
+		huge := uploadTestFileWithType(t, ts, "huge.png", "image/png", string(data), nil)
+		resp, err := http.Get(ts.URL + thumbnailLink(t, huge["id"].(string), "20x20"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	})
+
+	t.Run("Delete removes cached thumbnails", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		thumbs, err := filepath.Glob(filepath.Join(dataDir, "*", "*", id+".thumb-*"))
+		require.NoError(t, err)
+		assert.Empty(t, thumbs)
+	})
+}
+
+func TestJanitorPurgesExpiredFiles(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+		cfg.TTL = time.Millisecond
+		cfg.CleanupInterval = 5 * time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	expiring := uploadTestFile(t, ts, "expiring.txt", "gone soon", nil)
+	pinned := uploadTestFile(t, ts, "pinned.txt", "stays", map[string]string{"pinned": "true"})
+
+	storage := fs.NewStorage(dataDir)
+	assert.Eventually(t, func() bool {
+		exists, err := storage.Exists(context.Background(), expiring["id"].(string))
+		return err == nil && !exists
+	}, time.Second, 5*time.Millisecond)
+
+	exists, err := storage.Exists(context.Background(), pinned["id"].(string))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestIntegrityVerification(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+		cfg.IntegrityScrubInterval = 20 * time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	intact := uploadTestFile(t, ts, "intact.txt", "intact", nil)["id"].(string)
+	damaged := uploadTestFile(t, ts, "damaged.txt", "original", nil)["id"].(string)
+	lost := uploadTestFile(t, ts, "lost.txt", "lost", nil)["id"].(string)
+
+	storage := fs.NewStorage(dataDir)
+	_, err := storage.Save(context.Background(), damaged, "damaged.txt", "text/plain", strings.NewReader("bitrot"))
+	require.NoError(t, err)
+	require.NoError(t, storage.Delete(context.Background(), lost))
+
+	verify := func(t *testing.T, id string) (int, map[string]any) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/admin/verify/"+id, nil)
+		defer resp.Body.Close()
+		var file map[string]any
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&file))
+		}
+		return resp.StatusCode, file
+	}
+
+	t.Run("OnDemand", func(t *testing.T) {
+		status, file := verify(t, intact)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "ok", file["integrity"].(map[string]any)["status"])
+
+		status, file = verify(t, damaged)
+		require.Equal(t, http.StatusOK, status)
+		integrity := file["integrity"].(map[string]any)
+		assert.Equal(t, "mismatch", integrity["status"])
+		sum := sha256.Sum256([]byte("bitrot"))
+		assert.Equal(t, hex.EncodeToString(sum[:]), integrity["sha256"])
+
+		status, file = verify(t, lost)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "missing", file["integrity"].(map[string]any)["status"])
+
+		status, _ = verify(t, "unknown")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("ListFlagged", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?integrity=mismatch", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var listed []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+		require.Len(t, listed, 1)
+		assert.Equal(t, damaged, listed[0]["id"])
+	})
+
+	t.Run("Scrub", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			resp := adminRequest(t, "GET", ts.URL+"/metrics", nil)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return strings.Contains(string(body), "files_stash_integrity_corrupt_files 2")
+		}, 2*time.Second, 20*time.Millisecond)
+	})
+}
+
+func TestMissingContent(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+	require.NoError(t, fs.NewStorage(dataDir).Delete(context.Background(), uploaded["id"].(string)))
+
+	resp, err := http.Get(ts.URL + uploaded["url"].(string))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMimeTypeValidation(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.RejectMimeMismatch = true
+		cfg.DeniedMimeTypes = []string{"text/html", "application/x-msdownload"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	upload := func(t *testing.T, name, mimeType, content string) *http.Response {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, name))
+		if mimeType != "" {
+			header.Set("Content-Type", mimeType)
+		}
+		part, err := writer.CreatePart(header)
+		require.NoError(t, err)
+		io.WriteString(part, content)
+		writer.Close()
+
+		req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Detected type is stored", func(t *testing.T) {
+		resp := upload(t, "data.bin", "", "%PDF-1.7 document")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, "application/pdf", result["mime_type"])
+		assert.Equal(t, "application/pdf", result["detected_mime_type"])
+	})
+
+	t.Run("Compatible claimed type is kept", func(t *testing.T) {
+		resp := upload(t, "config.json", "application/json", `{"key": "value"}`)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, "application/json", result["mime_type"])
+		assert.Equal(t, "text/plain", result["detected_mime_type"])
+	})
+
+	t.Run("Mismatched type is rejected", func(t *testing.T) {
+		resp := upload(t, "fake.png", "image/png", "just some text")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
+
+	t.Run("Denied sniffed type is rejected", func(t *testing.T) {
+		resp := upload(t, "page.txt", "", "<html><body>hi</body></html>")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
+}
+
+func TestFilenameSanitization(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, `C:\builds\résumé "final".txt`, "cv", nil)
+	assert.Equal(t, `résumé "final".txt`, uploaded["name"])
+
+	resp, err := http.Get(ts.URL + uploaded["url"].(string))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t,
+		`attachment; filename="r_sum_ _final_.txt"; filename*=UTF-8''r%C3%A9sum%C3%A9%20%22final%22.txt`,
+		resp.Header.Get("Content-Disposition"))
+}
+
+func TestUploadReceipts(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "receipt.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ReceiptKeyFile = keyFile
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "build.txt", "build output", nil)
+	sum := sha256.Sum256([]byte("build output"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), uploaded["sha256"])
+
+	receipt, ok := uploaded["receipt"].(string)
+	require.True(t, ok, "upload should return a receipt")
+
+	// Fetch the public key and verify the receipt offline
+	resp, err := http.Get(ts.URL + "/v1/receipts/key")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Kid string `json:"kid"`
+		} `json:"keys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "OKP", jwks.Keys[0].Kty)
+	assert.Equal(t, "Ed25519", jwks.Keys[0].Crv)
+	pub, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	require.NoError(t, err)
+
+	parts := strings.Split(receipt, ".")
+	require.Len(t, parts, 3)
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	assert.True(t, ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig))
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"alg":"EdDSA","kid":%q,"typ":"JWT"}`, jwks.Keys[0].Kid), string(header))
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, uploaded["id"], claims["id"])
+	assert.Equal(t, uploaded["sha256"], claims["sha256"])
+	assert.Equal(t, float64(len("build output")), claims["size"])
+
+	// A tampered payload no longer verifies
+	tampered := base64.RawURLEncoding.EncodeToString(bytes.Replace(payload, []byte(`"size":12`), []byte(`"size":13`), 1))
+	assert.False(t, ed25519.Verify(pub, []byte(parts[0]+"."+tampered), sig))
+
+	t.Run("Disabled", func(t *testing.T) {
+		srv := setupTestServer(t)
+
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := uploadTestFile(t, ts, "build.txt", "build output", nil)
+		assert.NotContains(t, uploaded, "receipt")
+
+		resp, err := http.Get(ts.URL + "/v1/receipts/key")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestTagAsOf(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	first := uploadTestFile(t, ts, "app-v1.tar", "v1", map[string]string{"tag": "release"})
+	second := uploadTestFile(t, ts, "app-v2.tar", "v2", map[string]string{"tag": "release"})
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	latest := func(query string) *http.Response {
+		resp, err := client.Get(ts.URL + "/v1/files/latest/release" + query)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := latest("")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, second["url"], resp.Header.Get("Location"))
+
+	resp = latest("?as_of=" + url.QueryEscape(first["created_at"].(string)))
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, first["url"], resp.Header.Get("Location"))
+
+	resp = latest("?as_of=" + url.QueryEscape(second["created_at"].(string)))
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, second["url"], resp.Header.Get("Location"))
+
+	// Before the tag was first used there was no latest file
+	createdAt, err := time.Parse(time.RFC3339Nano, first["created_at"].(string))
+	require.NoError(t, err)
+	resp = latest("?as_of=" + url.QueryEscape(createdAt.Add(-time.Hour).Format(time.RFC3339)))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = latest("?as_of=yesterday")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestTagContent(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	first := uploadTestFile(t, ts, "app-v1.txt", "v1", map[string]string{"tag": "release"})
+	second := uploadTestFile(t, ts, "app-v2.txt", "v2", map[string]string{"tag": "release"})
+	uploadTestFile(t, ts, "secret.txt", "secret", map[string]string{"tag": "private", "password": "hunter2"})
+
+	// No redirect is followed, so clients that don't follow them work too
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(t *testing.T, path string) (*http.Response, string) {
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("Latest", func(t *testing.T) {
+		resp, body := get(t, "/v1/files/latest/release/content")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "v2", body)
+		assert.Equal(t, "2", resp.Header.Get("Content-Length"))
+		assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+		assert.Equal(t, `attachment; filename="app-v2.txt"`, resp.Header.Get("Content-Disposition"))
+		assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+		assert.Equal(t, second["id"], resp.Header.Get("X-Files-Stash-File-Id"))
+	})
+
+	t.Run("AsOf", func(t *testing.T) {
+		resp, body := get(t, "/v1/files/latest/release/content?as_of="+url.QueryEscape(first["created_at"].(string)))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "v1", body)
+
+		resp, _ = get(t, "/v1/files/latest/release/content?as_of=yesterday")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Password", func(t *testing.T) {
+		resp, _ := get(t, "/v1/files/latest/private/content")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp, body := get(t, "/v1/files/latest/private/content?password=hunter2")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "secret", body)
+	})
+
+	t.Run("UnknownTag", func(t *testing.T) {
+		resp, _ := get(t, "/v1/files/latest/unknown/content")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("RangeOption", func(t *testing.T) {
+		resp, _ := get(t, "/v1/files/latest/release/content?range=0-0")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestStaleTagFallback(t *testing.T) {
+	setup := func(t *testing.T, fallback bool) *httptest.Server {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.StaleTagFallback = fallback
+		})
+		ts := httptest.NewServer(srv.Handler)
+		t.Cleanup(ts.Close)
+
+		for _, path := range []string{"/v1/files/v1.txt?tag=release&ttl=1h", "/v1/files/v2.txt?tag=release&ttl=1ms"} {
+			resp := adminRequest(t, "PUT", ts.URL+path, strings.NewReader(path))
+			resp.Body.Close()
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+		}
+		time.Sleep(5 * time.Millisecond)
+		return ts
+	}
+	latest := func(t *testing.T, ts *httptest.Server) (int, string) {
+		resp, err := http.Get(ts.URL + "/v1/files/latest/release/content")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("Fallback", func(t *testing.T) {
+		ts := setup(t, true)
+		status, body := latest(t, ts)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "v1.txt")
+	})
+
+	t.Run("NoFallback", func(t *testing.T) {
+		ts := setup(t, false)
+		status, _ := latest(t, ts)
+		assert.Equal(t, http.StatusGone, status)
+
+		// The expired file was purged, so the tag moved back
+		status, body := latest(t, ts)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "v1.txt")
+	})
+}
+
+func TestAbsoluteURLs(t *testing.T) {
+	t.Run("BaseURL", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.BaseURL = "https://files.example.com/stash/"
+		})
+
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := uploadTestFile(t, ts, "test.txt", "content", map[string]string{"tag": "base"})
+		assert.Regexp(t, `^https://files\.example\.com/stash/v1/files/\d+\?signature=`, uploaded["url"])
+
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get(ts.URL + "/v1/files/latest/base")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, uploaded["url"], resp.Header.Get("Location"))
+
+		resp = adminRequest(t, "POST", ts.URL+"/v1/files/"+uploaded["id"].(string)+"/links", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var link map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+		assert.Regexp(t, `^https://files\.example\.com/stash/v1/files/`, link["url"])
+	})
+
+	forwardedUpload := func(t *testing.T, ts *httptest.Server) map[string]any {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "test.txt")
+		require.NoError(t, err)
+		_, err = io.WriteString(part, "content")
+		require.NoError(t, err)
+		writer.Close()
+
+		req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "proxy.example.com, internal:8080")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	t.Run("ForwardedHeaders", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.TrustForwardedHeaders = true
+		})
+
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := forwardedUpload(t, ts)
+		assert.Regexp(t, `^https://proxy\.example\.com/v1/files/\d+\?signature=`, uploaded["url"])
+	})
+
+	t.Run("UntrustedForwardedHeaders", func(t *testing.T) {
+		srv := setupTestServer(t)
+
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := forwardedUpload(t, ts)
+		assert.Regexp(t, `^/v1/files/\d+\?signature=`, uploaded["url"])
+	})
+}
+
+func TestStorageForecast(t *testing.T) {
+	alerts := make(chan map[string]any, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		alerts <- payload
+	}))
+	defer webhook.Close()
+
+	var dbPath string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.StorageQuota = 30
+		cfg.UsageSampleInterval = 10 * time.Millisecond
+		cfg.ForecastWebhookURL = webhook.URL
+		cfg.WebhookSecret = "webhook-secret"
+		cfg.ForecastWarningDays = 7
+		onDisk(t, cfg)
+		dbPath = cfg.DBPath
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// Usage grew by 5 bytes a day, reaching 10 of 30 bytes today
+	uploadTestFile(t, ts, "a.txt", "0123456789", nil)
+	repo, err := sqlite.NewRepository(dbPath)
+	require.NoError(t, err)
+	defer repo.Close()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	require.NoError(t, repo.RecordUsage(context.Background(), &files.UsageSample{Date: today.AddDate(0, 0, -2), Bytes: 0}))
+	require.NoError(t, repo.RecordUsage(context.Background(), &files.UsageSample{Date: today.AddDate(0, 0, -1), Files: 1, Bytes: 5}))
+
+	resp := adminRequest(t, "GET", ts.URL+"/v1/stats", nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var stats struct {
+		Files             int      `json:"files"`
+		Bytes             int64    `json:"bytes"`
+		QuotaBytes        int64    `json:"quota_bytes"`
+		GrowthBytesPerDay float64  `json:"growth_bytes_per_day"`
+		DaysUntilFull     *float64 `json:"days_until_full"`
+		History           []any    `json:"history"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, 1, stats.Files)
+	assert.Equal(t, int64(10), stats.Bytes)
+	assert.Equal(t, int64(30), stats.QuotaBytes)
+	assert.InDelta(t, 5, stats.GrowthBytesPerDay, 0.001)
+	require.NotNil(t, stats.DaysUntilFull)
+	assert.InDelta(t, 4, *stats.DaysUntilFull, 0.001)
+	assert.Len(t, stats.History, 3)
+
+	// Reading stats doesn't record usage; the janitor does
+	recorded, err := repo.ListUsage(context.Background(), today.AddDate(0, 0, -7))
+	require.NoError(t, err)
+	assert.Len(t, recorded, 2)
+
+	// The monitor warns once a day when the forecast is below the threshold
+	select {
+	case alert := <-alerts:
+		assert.Equal(t, "storage.forecast", alert["event"])
+		assert.Contains(t, alert["message"], "4.0 days")
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a forecast warning webhook")
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, alerts)
+}
+
+func TestUsageRecording(t *testing.T) {
+	var dbPath string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.Compression = true
+		cfg.CleanupInterval = 5 * time.Millisecond
+		onDisk(t, cfg)
+		dbPath = cfg.DBPath
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	log := strings.Repeat("INFO request served\n", 30)
+	uploaded := uploadTestFile(t, ts, "build.log", log, nil)
+	stored := int64(uploaded["stored_size"].(float64))
+	require.Less(t, stored, int64(len(log)))
+
+	// Usage counts the bytes files take in storage
+	resp := adminRequest(t, "GET", ts.URL+"/v1/stats", nil)
+	defer resp.Body.Close()
+	var stats struct {
+		Bytes int64 `json:"bytes"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, stored, stats.Bytes)
+
+	// The janitor records the day's usage
+	repo, err := sqlite.NewRepository(dbPath)
+	require.NoError(t, err)
+	defer repo.Close()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	assert.Eventually(t, func() bool {
+		recorded, err := repo.ListUsage(context.Background(), today)
+		return err == nil && len(recorded) == 1 && recorded[0].Files == 1 && recorded[0].Bytes == stored
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestExpiringFiles(t *testing.T) {
+	receiver := func() (*httptest.Server, chan map[string]any) {
+		received := make(chan map[string]any, 10)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload map[string]any
+			json.NewDecoder(r.Body).Decode(&payload)
+			received <- payload
+		})), received
+	}
+	webhook, reports := receiver()
+	defer webhook.Close()
+	slack, messages := receiver()
+	defer slack.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.TTL = 720 * time.Hour
+		cfg.ExpiringReportInterval = 50 * time.Millisecond
+		cfg.ExpiringReportWindow = 24 * time.Hour
+		cfg.ExpiringReportWebhookURL = webhook.URL
+		cfg.ExpiringReportSlackURL = slack.URL
+		cfg.WebhookSecret = "webhook-secret"
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	put := func(t *testing.T, path string) {
+		resp := adminRequest(t, "PUT", ts.URL+path, strings.NewReader("data"))
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	put(t, "/v1/files/later.txt?ttl=12h")
+	put(t, "/v1/files/soon.txt?ttl=1h")
+	put(t, "/v1/files/kept.txt")
+	uploadTestFile(t, ts, "pinned.txt", "data", map[string]string{"pinned": "true"})
+
+	t.Run("List", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?expiring_within=24h", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var listed []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+		var names []string
+		for _, file := range listed {
+			names = append(names, file["name"].(string))
+		}
+		assert.ElementsMatch(t, []string{"later.txt", "soon.txt"}, names)
+	})
+
+	t.Run("InvalidWindow", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?expiring_within=soon", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		select {
+		case report := <-reports:
+			assert.Equal(t, "files.expiring", report["event"])
+			data := report["data"].(map[string]any)
+			assert.EqualValues(t, 8, data["bytes"])
+			expiring := data["files"].([]any)
+			require.Len(t, expiring, 2)
+			assert.Equal(t, "soon.txt", expiring[0].(map[string]any)["name"])
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected an expiring files webhook")
+		}
+
+		select {
+		case message := <-messages:
+			assert.Equal(t, "2 files expire within 24h0m0s: soon.txt, later.txt", message["text"])
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected an expiring files chat message")
+		}
+	})
+}
+
+func TestNotifications(t *testing.T) {
+	receiver := func() (*httptest.Server, chan map[string]any) {
+		received := make(chan map[string]any, 10)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload map[string]any
+			json.NewDecoder(r.Body).Decode(&payload)
+			received <- payload
+		}))
+		return srv, received
+	}
+	next := func(t *testing.T, received chan map[string]any) map[string]any {
+		select {
+		case payload := <-received:
+			return payload
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected a notification")
+			return nil
+		}
+	}
+
+	webhook, webhookEvents := receiver()
+	defer webhook.Close()
+	chat, chatMessages := receiver()
+	defer chat.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.NotifySinks = []string{"ops:webhook:" + webhook.URL, "chat:slack:" + chat.URL}
+		cfg.WebhookSecret = "webhook-secret"
+		cfg.NotifyRoutes = map[string]string{"*": "ops", "file.uploaded": "chat"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "report.txt", "content", nil)
+	event := next(t, webhookEvents)
+	assert.Equal(t, "file.uploaded", event["event"])
+	assert.Equal(t, "File report.txt uploaded", event["message"])
+	assert.Equal(t, uploaded["id"], event["data"].(map[string]any)["id"])
+	assert.Equal(t, map[string]any{"text": "File report.txt uploaded"}, next(t, chatMessages))
+
+	resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+uploaded["id"].(string), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	event = next(t, webhookEvents)
+	assert.Equal(t, "file.deleted", event["event"])
+
+	// Deletions aren't routed to chat
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, chatMessages)
+}
+
+func TestWebhookSigning(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{header: r.Header.Clone(), body: body}
+	}))
+	defer webhook.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.NotifySinks = []string{"ops:webhook:" + webhook.URL}
+		cfg.WebhookSecret = "webhook-secret"
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	next := func() delivery {
+		select {
+		case d := <-deliveries:
+			return d
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected a webhook delivery")
+			return delivery{}
+		}
+	}
+
+	uploadTestFile(t, ts, "a.txt", "content", nil)
+	first := next()
+	assert.NoError(t, notify.Verify("webhook-secret", first.header, first.body, time.Now()))
+	assert.ErrorIs(t, notify.Verify("wrong-secret", first.header, first.body, time.Now()), notify.ErrInvalidSignature)
+	assert.ErrorIs(t, notify.Verify("webhook-secret", first.header, first.body, time.Now().Add(time.Hour)), notify.ErrStaleDelivery)
+
+	uploadTestFile(t, ts, "b.txt", "content", nil)
+	second := next()
+	assert.NoError(t, notify.Verify("webhook-secret", second.header, second.body, time.Now()))
+	assert.NotEmpty(t, first.header.Get(notify.HeaderDeliveryID))
+	assert.NotEqual(t, first.header.Get(notify.HeaderDeliveryID), second.header.Get(notify.HeaderDeliveryID))
+
+	// The verification scheme is documented publicly
+	resp, err := http.Get(ts.URL + "/v1/docs/webhooks")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var scheme map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&scheme))
+	assert.Equal(t, "HMAC-SHA256", scheme["algorithm"])
+	assert.Contains(t, scheme["headers"], notify.HeaderSignature)
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploadTestFile(t, ts, "a.txt", "content", nil)
+
+	spanNames := func() []string {
+		var names []string
+		for _, span := range recorder.Ended() {
+			names = append(names, span.Name())
+		}
+		return names
+	}
+	assert.Eventually(t, func() bool {
+		return slices.Contains(spanNames(), "POST /v1/files")
+	}, time.Second, 10*time.Millisecond)
+
+	names := spanNames()
+	assert.Contains(t, names, "Service.Upload")
+	assert.Contains(t, names, "Storage.Save")
+	assert.Contains(t, names, "sqlite.query")
+
+	// Service, storage and SQL spans belong to the request's trace
+	var traceID string
+	for _, span := range recorder.Ended() {
+		if span.Name() == "POST /v1/files" {
+			traceID = span.SpanContext().TraceID().String()
+		}
+	}
+	for _, span := range recorder.Ended() {
+		if span.Name() == "Service.Upload" || span.Name() == "Storage.Save" {
+			assert.Equal(t, traceID, span.SpanContext().TraceID().String(), span.Name())
+		}
+	}
+}
+
+func TestViewerToken(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "content", map[string]string{"tag": "docs"})
+	id := uploaded["id"].(string)
+
+	viewerRequest := func(method, url string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, url, body)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer viewer-token")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, viewerRequest("GET", ts.URL+"/v1/files?tag=docs", nil).StatusCode)
+		assert.Equal(t, http.StatusOK, viewerRequest("GET", ts.URL+"/v1/stats", nil).StatusCode)
+		assert.Equal(t, http.StatusOK, viewerRequest("GET", ts.URL+"/v1/searches", nil).StatusCode)
+		assert.Equal(t, http.StatusOK, viewerRequest("GET", ts.URL+"/v1/files/"+id+"/comments", nil).StatusCode)
+		assert.Equal(t, http.StatusCreated, viewerRequest("POST", ts.URL+"/v1/files/"+id+"/links", nil).StatusCode)
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, viewerRequest("POST", ts.URL+"/v1/files", nil).StatusCode)
+		assert.Equal(t, http.StatusForbidden, viewerRequest("DELETE", ts.URL+"/v1/files/"+id, nil).StatusCode)
+		assert.Equal(t, http.StatusForbidden, viewerRequest("PATCH", ts.URL+"/v1/files/"+id, strings.NewReader(`{"description":"x"}`)).StatusCode)
+		assert.Equal(t, http.StatusForbidden, viewerRequest("PUT", ts.URL+"/v1/searches/mine", strings.NewReader(`{"query":"tag=docs"}`)).StatusCode)
+		assert.Equal(t, http.StatusForbidden, viewerRequest("POST", ts.URL+"/v1/files/"+id+"/pin", nil).StatusCode)
+
+		// Nothing the viewer attempted took effect
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?tag=docs", nil)
+		defer resp.Body.Close()
+		var list []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		assert.Len(t, list, 1)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		srv := setupTestServer(t)
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		req, err := http.NewRequest("GET", ts.URL+"/v1/files", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer ")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestShortLinkDomain(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ShortLinkBaseURL = "https://dl.example.com"
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "short content", nil)
+	id := uploaded["id"].(string)
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links", nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var link map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+	assert.Contains(t, link["url"], "/v1/files/"+id)
+	require.Regexp(t, `^https://dl\.example\.com/s/[a-z2-7]+$`, link["short_url"])
+	code := strings.TrimPrefix(link["short_url"], "https://dl.example.com/s/")
+
+	// get requests a path on the test server as if it were sent to host
+	get := func(host, path string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("ServesFile", func(t *testing.T) {
+		resp := get("dl.example.com", "/s/"+code)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "short content", string(body))
+	})
+
+	t.Run("UnknownCode", func(t *testing.T) {
+		resp := get("dl.example.com", "/s/unknown")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("APINotExposed", func(t *testing.T) {
+		resp := get("dl.example.com", "/healthz")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = get("dl.example.com", "/v1/files/latest/docs")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// Short links are only served on the short domain
+		resp = get("files.internal", "/s/"+code)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("DeletedFile", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = get("dl.example.com", "/s/"+code)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestDownloadCodes(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "coded content", nil)
+	id := uploaded["id"].(string)
+
+	createCode := func(t *testing.T, fileID string) map[string]string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+fileID+"/code", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var code map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&code))
+		return code
+	}
+	get := func(t *testing.T, path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code := createCode(t, id)
+	require.Regexp(t, `^[0-9A-HJKMNP-TV-Z]{6}$`, code["code"])
+	assert.Equal(t, "/s/"+code["code"], code["url"])
+
+	t.Run("SameCodePerFile", func(t *testing.T) {
+		assert.Equal(t, code["code"], createCode(t, id)["code"])
+	})
+
+	t.Run("ServesFile", func(t *testing.T) {
+		status, body := get(t, "/s/"+code["code"])
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "coded content", body)
+	})
+
+	t.Run("TypedLoosely", func(t *testing.T) {
+		typed := strings.ToLower(code["code"][:3] + "-" + code["code"][3:])
+		typed = strings.NewReplacer("0", "o", "1", "l").Replace(typed)
+		status, body := get(t, "/s/"+typed)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "coded content", body)
+	})
+
+	t.Run("UnknownCode", func(t *testing.T) {
+		status, _ := get(t, "/s/UUUUUU")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("UnknownFile", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/unknown/code", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("DeletedFile", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		status, _ := get(t, "/s/"+code["code"])
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+}
+
+func TestFileQRCode(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "scanned content", nil)
+	id := uploaded["id"].(string)
+
+	t.Run("PNG", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files/"+id+"/qr?size=128&one_time=true", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+		img, err := png.Decode(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, 128, img.Bounds().Dx())
+
+		// The encoded link is issued like any other
+		resp = adminRequest(t, "GET", ts.URL+"/v1/links?file_id="+id, nil)
+		defer resp.Body.Close()
+		var links []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&links))
+		require.Len(t, links, 1)
+		assert.Equal(t, true, links[0]["one_time"])
+	})
+
+	t.Run("InvalidSize", func(t *testing.T) {
+		for _, size := range []string{"big", "16", "4096"} {
+			resp := adminRequest(t, "GET", ts.URL+"/v1/files/"+id+"/qr?size="+size, nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, size)
+		}
+	})
+
+	t.Run("UnknownFile", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files/unknown/qr", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/v1/files/" + id + "/qr")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestPublicFiles(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	public := uploadTestFile(t, ts, "notes.txt", "release notes", map[string]string{"public": "true"})
+	assert.Equal(t, true, public["public"])
+	private := uploadTestFile(t, ts, "secret.txt", "secret", nil)
+	assert.NotContains(t, private, "public")
+
+	get := func(t *testing.T, method, url string) (int, string) {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("Unsigned", func(t *testing.T) {
+		status, body := get(t, "GET", ts.URL+"/v1/files/"+public["id"].(string))
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "release notes", body)
+
+		status, _ = get(t, "HEAD", ts.URL+"/v1/files/"+public["id"].(string))
+		assert.Equal(t, http.StatusOK, status)
+
+		status, _ = get(t, "GET", ts.URL+"/v1/files/"+private["id"].(string))
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("WrongSignature", func(t *testing.T) {
+		// A signature that is given still has to be valid
+		status, _ := get(t, "GET", ts.URL+"/v1/files/"+public["id"].(string)+"?signature=bogus")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("Raw", func(t *testing.T) {
+		req, err := http.NewRequest("PUT", ts.URL+"/v1/files/build.txt?public=1", strings.NewReader("public build"))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+
+		status, body := get(t, "GET", ts.URL+"/v1/files/"+result["id"].(string))
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "public build", body)
+	})
+
+	t.Run("Toggle", func(t *testing.T) {
+		resp := adminRequest(t, "PATCH", ts.URL+"/v1/files/"+public["id"].(string), strings.NewReader(`{"public": false}`))
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		status, _ := get(t, "GET", ts.URL+"/v1/files/"+public["id"].(string))
+		assert.Equal(t, http.StatusNotFound, status)
+		status, _ = get(t, "GET", ts.URL+public["url"].(string))
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("InvalidFlag", func(t *testing.T) {
+		resp := postTestFile(t, ts, "a.txt", "content", map[string]string{"public": "maybe"})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestPublicFileExpiry(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.TTL = 50 * time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	public := uploadTestFile(t, ts, "notes.txt", "release notes", map[string]string{"public": "true"})
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(ts.URL + "/v1/files/" + public["id"].(string))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestFileErrors(t *testing.T) {
+	var dbPath string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dbPath = cfg.DBPath
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	status := func(method, path string) int {
+		resp := adminRequest(t, method, ts.URL+path, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, status("POST", "/v1/files/missing/pin"))
+		assert.Equal(t, http.StatusNotFound, status("DELETE", "/v1/files/missing/pin"))
+		assert.Equal(t, http.StatusNotFound, status("PUT", "/v1/files/missing/star"))
+		assert.Equal(t, http.StatusNotFound, status("GET", "/v1/files/missing/metadata"))
+		assert.Equal(t, http.StatusNotFound, status("GET", "/v1/files/missing/comments"))
+		assert.Equal(t, http.StatusNotFound, status("DELETE", "/v1/files/missing/comments/missing"))
+		assert.Equal(t, http.StatusNotFound, status("POST", "/v1/files/missing/links"))
+		assert.Equal(t, http.StatusNotFound, status("GET", "/v1/files/latest/missing"))
+	})
+
+	t.Run("Server error", func(t *testing.T) {
+		id := uploadTestFile(t, ts, "a.txt", "content", nil)["id"].(string)
+
+		db, err := sql.Open("sqlite", dbPath)
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Exec(`DROP TABLE stars`)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusInternalServerError, status("PUT", "/v1/files/"+id+"/star"))
+		assert.Equal(t, http.StatusInternalServerError, status("DELETE", "/v1/files/"+id+"/star"))
+	})
+}
+
+func TestDeleteFile(t *testing.T) {
+	deleteFile := func(ts *httptest.Server, id string) int {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		ts := httptest.NewServer(setupTestServer(t).Handler)
+		defer ts.Close()
+
+		assert.Equal(t, http.StatusNotFound, deleteFile(ts, "missing"))
+
+		id := uploadTestFile(t, ts, "report.txt", "report", nil)["id"].(string)
+		assert.Equal(t, http.StatusNoContent, deleteFile(ts, id))
+		assert.Equal(t, http.StatusNotFound, deleteFile(ts, id))
+	})
+
+	t.Run("Idempotent", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.IdempotentDelete = true
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		id := uploadTestFile(t, ts, "report.txt", "report", nil)["id"].(string)
+		assert.Equal(t, http.StatusNoContent, deleteFile(ts, id))
+		assert.Equal(t, http.StatusNoContent, deleteFile(ts, id))
+		assert.Equal(t, http.StatusNoContent, deleteFile(ts, "missing"))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		ts := httptest.NewServer(setupTestServer(t).Handler)
+		defer ts.Close()
+
+		id := uploadTestFile(t, ts, "report.txt", "report", nil)["id"].(string)
+		statuses := make(chan int, 8)
+		var wg sync.WaitGroup
+		for range cap(statuses) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				statuses <- deleteFile(ts, id)
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		deleted := 0
+		for status := range statuses {
+			if status == http.StatusNoContent {
+				deleted++
+				continue
+			}
+			assert.Equal(t, http.StatusNotFound, status)
+		}
+		assert.Equal(t, 1, deleted)
+	})
+}
+
+func TestEventStream(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// subscribe opens an event stream and returns a function reading the
+	// type and data of its next event
+	subscribe := func(t *testing.T, query string) func() (string, map[string]any) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/v1/events"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		reader := bufio.NewReader(resp.Body)
+		return func() (string, map[string]any) {
+			var eventType string
+			var event map[string]any
+			for {
+				line, err := reader.ReadString('\n')
+				require.NoError(t, err)
+				line = strings.TrimSuffix(line, "\n")
+				switch {
+				case strings.HasPrefix(line, "event: "):
+					eventType = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+				case line == "" && eventType != "":
+					return eventType, event["data"].(map[string]any)
+				}
+			}
+		}
+	}
+
+	t.Run("FileEvents", func(t *testing.T) {
+		next := subscribe(t, "")
+		deletes := subscribe(t, "?types=file.deleted")
+
+		uploaded := uploadTestFile(t, ts, "a.txt", "content", map[string]string{"tag": "nightly"})
+		id := uploaded["id"].(string)
+		eventType, data := next()
+		assert.Equal(t, "file.uploaded", eventType)
+		assert.Equal(t, id, data["id"])
+
+		resp := adminRequest(t, "PATCH", ts.URL+"/v1/files/"+id, strings.NewReader(`{"tag": "release"}`))
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		eventType, data = next()
+		assert.Equal(t, "tag.updated", eventType)
+		assert.Equal(t, "release", data["tag"])
+		assert.Equal(t, "nightly", data["previous_tag"])
+
+		resp = adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		eventType, data = next()
+		assert.Equal(t, "file.deleted", eventType)
+		assert.Equal(t, id, data["id"])
+
+		// The filtered stream only got the delete
+		eventType, data = deletes()
+		assert.Equal(t, "file.deleted", eventType)
+		assert.Equal(t, id, data["id"])
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/v1/events")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestWebUI(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// The bare mount point redirects to the UI's directory
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(ts.URL + "/ui")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 3, resp.StatusCode/100)
+	assert.Equal(t, "/ui/", resp.Header.Get("Location"))
+
+	// The page itself is public; it authenticates API calls with the token
+	resp, err = http.Get(ts.URL + "/ui/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "<title>files-stash</title>")
+
+	resp, err = http.Get(ts.URL + "/ui/missing.js")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUploadSnippets(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.BaseURL = "https://files.example.com"
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	upload := func(query string) map[string]any {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		require.NoError(t, writer.WriteField("tag", "nightly build"))
+		part, err := writer.CreateFormFile("file", "it's.txt")
+		require.NoError(t, err)
+		_, err = io.WriteString(part, "content")
+		require.NoError(t, err)
+		writer.Close()
+
+		req, err := http.NewRequest("POST", ts.URL+"/v1/files"+query, body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	assert.NotContains(t, upload(""), "snippets")
+
+	result := upload("?verbose=1")
+	require.Contains(t, result, "snippets")
+	snippets := result["snippets"].(map[string]any)
+	url := result["url"].(string)
+	require.True(t, strings.HasPrefix(url, "https://files.example.com/v1/files/"))
+
+	assert.Equal(t, `curl -fL -o 'it'\''s.txt' '`+url+`'`, snippets["curl"])
+	assert.Equal(t, `wget -O 'it'\''s.txt' '`+url+`'`, snippets["wget"])
+	assert.Equal(t, `curl -fLJO 'https://files.example.com/v1/files/latest/nightly%20build'`, snippets["latest_curl"])
+	assert.Equal(t, `wget --content-disposition 'https://files.example.com/v1/files/latest/nightly%20build'`, snippets["latest_wget"])
+}
+
+func TestSignatureBindings(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+	id := uploaded["id"].(string)
+
+	mint := func(query string) string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?"+query, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var link map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+		return link["url"]
+	}
+	fetch := func(method, link string, header http.Header) int {
+		req, err := http.NewRequest(method, ts.URL+link, nil)
+		require.NoError(t, err)
+		maps.Copy(req.Header, header)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("Method", func(t *testing.T) {
+		link := uploaded["url"].(string)
+		assert.Equal(t, http.StatusOK, fetch("GET", link, nil))
+		assert.Equal(t, http.StatusOK, fetch("HEAD", link, nil))
+	})
+
+	t.Run("ClientIP", func(t *testing.T) {
+		link := mint("bind_ip=127.0.0.1")
+		assert.Contains(t, link, "bind=ip")
+		assert.NotContains(t, link, "127.0.0.1")
+		assert.Equal(t, http.StatusOK, fetch("GET", link, nil))
+
+		link = mint("bind_ip=10.0.0.1")
+		assert.Equal(t, http.StatusNotFound, fetch("GET", link, nil))
+
+		// Dropping the binding from the link breaks the signature
+		assert.Equal(t, http.StatusNotFound, fetch("GET", strings.Replace(link, "bind=ip&", "", 1), nil))
+
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?bind_ip=nope", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Audience", func(t *testing.T) {
+		link := mint("audience=ci")
+		assert.NotContains(t, link, "ci")
+		assert.Equal(t, http.StatusNotFound, fetch("GET", link, nil))
+		assert.Equal(t, http.StatusNotFound, fetch("GET", link, http.Header{"X-Files-Stash-Audience": {"other"}}))
+		assert.Equal(t, http.StatusOK, fetch("GET", link, http.Header{"X-Files-Stash-Audience": {"ci"}}))
+	})
+
+	t.Run("ForwardedClientIP", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.TrustedProxies = []string{"127.0.0.1"}
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+uploaded["id"].(string)+"/links?bind_ip=203.0.113.7", nil)
+		defer resp.Body.Close()
+		var link map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+
+		req, err := http.NewRequest("GET", ts.URL+link["url"], nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		got, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		got.Body.Close()
+		assert.Equal(t, http.StatusOK, got.StatusCode)
+	})
+
+	t.Run("UntrustedClientIP", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.TrustForwardedHeaders = true
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+uploaded["id"].(string)+"/links?bind_ip=203.0.113.7", nil)
+		defer resp.Body.Close()
+		var link map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+
+		// Without trusted proxies, the client is the peer whatever it claims
+		req, err := http.NewRequest("GET", ts.URL+link["url"], nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Real-IP", "203.0.113.7")
+		got, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		got.Body.Close()
+		assert.Equal(t, http.StatusNotFound, got.StatusCode)
+	})
+
+	t.Run("TrustedProxies", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+uploaded["id"].(string)+"/links?bind_ip=203.0.113.7", nil)
+		defer resp.Body.Close()
+		var link map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+
+		fetch := func(forwardedFor string) int {
+			req, err := http.NewRequest("GET", ts.URL+link["url"], nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+			got, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			got.Body.Close()
+			return got.StatusCode
+		}
+
+		// The client is the address the outermost trusted proxy got the
+		// request from, whatever the client claims before it
+		assert.Equal(t, http.StatusOK, fetch("203.0.113.7, 10.0.0.2"))
+		assert.Equal(t, http.StatusOK, fetch("198.51.100.9, 203.0.113.7, 10.0.0.2"))
+		assert.Equal(t, http.StatusNotFound, fetch("203.0.113.7, 198.51.100.9"))
+	})
+}
+
+func TestLegacySignatures(t *testing.T) {
+	// legacyLink signs the bare file ID, as links were signed before
+	// signatures covered the request method
+	legacyLink := func(id string) string {
+		mac := hmac.New(sha256.New, []byte(hmacKey))
+		mac.Write([]byte(id))
+		return "/v1/files/" + id + "?signature=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for _, accept := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Accept=%v", accept), func(t *testing.T) {
+			srv := setupTestServerWithConfig(t, func(cfg *Config) {
+				cfg.AcceptLegacySignatures = accept
+			})
+			ts := httptest.NewServer(srv.Handler)
+			defer ts.Close()
+
+			uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+			resp, err := http.Get(ts.URL + legacyLink(uploaded["id"].(string)))
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			want := http.StatusNotFound
+			if accept {
+				want = http.StatusOK
+			}
+			assert.Equal(t, want, resp.StatusCode)
+
+			// Links issued now verify either way
+			resp, err = http.Get(ts.URL + uploaded["url"].(string))
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestPasswordProtectedDownloads(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "secret.txt", "classified", map[string]string{"password": "hunter2"})
+	assert.Equal(t, true, uploaded["password_protected"])
+	link := uploaded["url"].(string)
+
+	fetch := func(link string, header http.Header) (int, string) {
+		req, err := http.NewRequest("GET", ts.URL+link, nil)
+		require.NoError(t, err)
+		maps.Copy(req.Header, header)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		status, _ := fetch(link, nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Wrong", func(t *testing.T) {
+		status, _ := fetch(link+"&password=wrong", nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		status, body := fetch(link+"&password=hunter2", nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "classified", body)
+	})
+
+	t.Run("Header", func(t *testing.T) {
+		status, body := fetch(link, http.Header{"X-Files-Stash-Password": {"hunter2"}})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "classified", body)
+	})
+
+	t.Run("StillNeedsSignature", func(t *testing.T) {
+		status, _ := fetch("/v1/files/"+uploaded["id"].(string)+"?signature=bad&password=hunter2", nil)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("UnprotectedFiles", func(t *testing.T) {
+		plain := uploadTestFile(t, ts, "plain.txt", "open", nil)
+		assert.Nil(t, plain["password_protected"])
+		status, _ := fetch(plain["url"].(string), nil)
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("HashNotListed", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files", nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.NotContains(t, string(body), "argon2id")
+		assert.NotContains(t, string(body), "hunter2")
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.MetricsTags = []string{"release"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	released := uploadTestFile(t, ts, "a.txt", "content", map[string]string{"tag": "release"})
+	uploadTestFile(t, ts, "b.txt", "other content", map[string]string{"tag": "build-1234"})
+
+	resp, err := http.Get(ts.URL + released["url"].(string))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Metrics need a token
+	resp, err = http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = adminRequest(t, "GET", ts.URL+"/metrics", nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `files_stash_uploads_total{tag="release"} 1`)
+	assert.Contains(t, string(body), `files_stash_uploads_total{tag="other"} 1`)
+	assert.Contains(t, string(body), `files_stash_download_bytes_total{tag="release"} 7`)
+	assert.NotContains(t, string(body), "build-1234")
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+	id := uploaded["id"].(string)
+
+	setMode := func(body string) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/admin/mode", strings.NewReader(body))
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	setMode(`{"read_only": true, "message": "storage migration"}`)
+
+	resp := adminRequest(t, "GET", ts.URL+"/v1/admin/mode", nil)
+	var mode map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&mode))
+	resp.Body.Close()
+	assert.Equal(t, true, mode["read_only"])
+	assert.Equal(t, "storage migration", mode["message"])
+
+	t.Run("UploadsAndDeletesRefused", func(t *testing.T) {
+		resp := postTestFile(t, ts, "b.txt", "content", nil)
+		message, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Contains(t, string(message), "storage migration")
+
+		resp = adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+
+	t.Run("DownloadsWork", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + uploaded["url"].(string))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("NeedsAdminToken", func(t *testing.T) {
+		resp, err := http.Post(ts.URL+"/v1/admin/mode", "application/json", strings.NewReader(`{"read_only": false}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Writable", func(t *testing.T) {
+		setMode(`{"read_only": false}`)
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+}
+
+func TestReadOnlyConfig(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ReadOnly = true
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/files/fetch", strings.NewReader(`{"url": "http://example.com/a.txt"}`))
+	message, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, string(message), files.ErrReadOnly.Error())
+}
+
+func TestRegisteredUploads(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/files/register", strings.NewReader(`{"name": "report.txt", "tag": "reports", "ttl": "1h"}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var registered map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&registered))
+	resp.Body.Close()
+
+	id := registered["id"].(string)
+	assert.Equal(t, "pending", registered["status"])
+	uploadURL := registered["upload_url"].(string)
+	assert.Contains(t, uploadURL, "/v1/files/"+id+"/content?signature=")
+
+	put := func(url, body string) *http.Response {
+		req, err := http.NewRequest("PUT", ts.URL+url, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("PendingUntilUploaded", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + registered["url"].(string))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		assert.Equal(t, "pending", resp.Header.Get("X-Files-Stash-Reason"))
+
+		resp, err = http.Get(ts.URL + "/v1/files/latest/reports")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = adminRequest(t, "GET", ts.URL+"/v1/files", nil)
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		resp.Body.Close()
+		require.Len(t, fileList, 1)
+		assert.Equal(t, "pending", fileList[0]["status"])
+	})
+
+	t.Run("InvalidSignature", func(t *testing.T) {
+		resp := put("/v1/files/"+id+"/content?signature=bad", "report")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Upload", func(t *testing.T) {
+		resp := put(uploadURL, "quarterly report")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var uploaded map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&uploaded))
+		assert.Equal(t, id, uploaded["id"])
+		assert.Equal(t, "active", uploaded["status"])
+		assert.Equal(t, float64(len("quarterly report")), uploaded["size"])
+
+		download, err := http.Get(ts.URL + registered["url"].(string))
+		require.NoError(t, err)
+		defer download.Body.Close()
+		body, err := io.ReadAll(download.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "quarterly report", string(body))
+	})
+
+	t.Run("OnlyOnce", func(t *testing.T) {
+		resp := put(uploadURL, "overwrite")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("NameRequired", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/register", strings.NewReader(`{}`))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestMultipartUpload(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/uploads", strings.NewReader(`{"name": "big.bin", "mime_type": "text/plain", "tag": "builds"}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var upload map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+	resp.Body.Close()
+
+	id := upload["id"].(string)
+	assert.Equal(t, "pending", upload["status"])
+	assert.Equal(t, "/v1/uploads/"+id, resp.Header.Get("Location"))
+
+	// Each part may be as large as MaxSize, so the file can be larger
+	parts := []string{strings.Repeat("a", 1000), strings.Repeat("b", 1000), "tail"}
+	putPart := func(number int, body string) *http.Response {
+		return adminRequest(t, "PUT", fmt.Sprintf("%s/v1/uploads/%s/parts/%d", ts.URL, id, number), strings.NewReader(body))
+	}
+	complete := func() *http.Response {
+		return adminRequest(t, "POST", ts.URL+"/v1/uploads/"+id+"/complete", nil)
+	}
+	storedParts := func() []string {
+		stored, err := filepath.Glob(filepath.Join(dataDir, "*", "*", id+".part-*"))
+		require.NoError(t, err)
+		return stored
+	}
+	getUpload := func() map[string]any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/uploads/"+id, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var upload map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+		return upload
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp, err := http.Post(ts.URL+"/v1/uploads", "application/json", strings.NewReader(`{"name": "x"}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("InvalidPartNumber", func(t *testing.T) {
+		for _, number := range []int{0, files.MaxUploadParts + 1} {
+			resp := putPart(number, "x")
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("ParallelParts", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := len(parts) - 1; i >= 1; i-- {
+			wg.Go(func() {
+				resp := putPart(i+1, parts[i])
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			})
+		}
+		wg.Wait()
+	})
+
+	t.Run("MissingPart", func(t *testing.T) {
+		resp := complete()
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		uploaded := getUpload()["parts"].([]any)
+		require.Len(t, uploaded, 2)
+		assert.Len(t, storedParts(), 2)
+		assert.Equal(t, float64(2), uploaded[0].(map[string]any)["number"])
+
+		// A failed part is uploaded again, replacing what arrived of it
+		resp := putPart(1, "partial")
+		resp.Body.Close()
+		resp = putPart(1, parts[0])
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var part map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&part))
+		assert.Equal(t, float64(len(parts[0])), part["size"])
+		sum := sha256.Sum256([]byte(parts[0]))
+		assert.Equal(t, hex.EncodeToString(sum[:]), part["sha256"])
+	})
+
+	content := strings.Join(parts, "")
+
+	t.Run("Complete", func(t *testing.T) {
+		resp := complete()
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, id, result["id"])
+		assert.Equal(t, "active", result["status"])
+		assert.Equal(t, float64(len(content)), result["size"])
+		sum := sha256.Sum256([]byte(content))
+		assert.Equal(t, hex.EncodeToString(sum[:]), result["sha256"])
+
+		download, err := http.Get(ts.URL + result["url"].(string))
+		require.NoError(t, err)
+		defer download.Body.Close()
+		body, err := io.ReadAll(download.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(body))
+
+		completed := getUpload()
+		assert.Equal(t, "active", completed["status"])
+		assert.Empty(t, completed["parts"])
+		assert.Empty(t, storedParts())
+	})
+
+	t.Run("OnlyOnce", func(t *testing.T) {
+		resp := complete()
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = putPart(4, "more")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("UnknownUpload", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/uploads/unknown", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestMultipartUploadLimit(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.MultipartMaxSize = 1500
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/uploads", strings.NewReader(`{"name": "big.bin"}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var upload map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+	resp.Body.Close()
+	id := upload["id"].(string)
+
+	putPart := func(number int, body string) int {
+		resp := adminRequest(t, "PUT", fmt.Sprintf("%s/v1/uploads/%s/parts/%d", ts.URL, id, number), strings.NewReader(body))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, putPart(1, strings.Repeat("a", 1000)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, putPart(2, strings.Repeat("b", 1000)))
+	// A part replaced doesn't count against its replacement
+	assert.Equal(t, http.StatusOK, putPart(1, strings.Repeat("a", 1000)))
+	assert.Equal(t, http.StatusOK, putPart(2, strings.Repeat("b", 500)))
+
+	resp = adminRequest(t, "POST", ts.URL+"/v1/uploads/"+id+"/complete", nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var result map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, float64(1500), result["size"])
+}
+
+func TestUploadProgress(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.MaxSize = 1 << 20
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	getUpload := func(id string) map[string]any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/uploads/"+id, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var upload map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+		return upload
+	}
+	// stream sends content through a pipe, so the test decides when it ends
+	stream := func(method, url string, authorize bool) (*io.PipeWriter, <-chan int) {
+		body, writer := io.Pipe()
+		req, err := http.NewRequest(method, url, body)
+		require.NoError(t, err)
+		if authorize {
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+		}
+		status := make(chan int, 1)
+		go func() {
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		return writer, status
+	}
+
+	t.Run("Multipart", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/uploads", strings.NewReader(`{"name": "big.bin"}`))
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var created map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		resp.Body.Close()
+		id := created["id"].(string)
+
+		upload := getUpload(id)
+		assert.Equal(t, float64(0), upload["bytes_received"])
+		assert.Equal(t, float64(0), upload["parts_completed"])
+		registeredAt := upload["last_activity_at"].(string)
+
+		resp = adminRequest(t, "PUT", ts.URL+"/v1/uploads/"+id+"/parts/1", strings.NewReader(strings.Repeat("a", 100)))
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		upload = getUpload(id)
+		assert.Equal(t, float64(100), upload["bytes_received"])
+		assert.Equal(t, float64(1), upload["parts_completed"])
+		assert.Equal(t, float64(0), upload["parts_in_progress"])
+		assert.NotEqual(t, registeredAt, upload["last_activity_at"])
+
+		// Bytes of a part still streaming count before it's stored; the
+		// client buffers what it sends, so more than its buffer is written
+		writer, status := stream("PUT", ts.URL+"/v1/uploads/"+id+"/parts/2", true)
+		_, err := writer.Write([]byte(strings.Repeat("b", 10000)))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			upload := getUpload(id)
+			return upload["bytes_received"].(float64) > 100 && upload["parts_in_progress"] == float64(1)
+		}, 2*time.Second, 10*time.Millisecond)
+		require.NoError(t, writer.Close())
+		require.Equal(t, http.StatusOK, <-status)
+
+		upload = getUpload(id)
+		assert.Equal(t, float64(10100), upload["bytes_received"])
+		assert.Equal(t, float64(2), upload["parts_completed"])
+		assert.Equal(t, float64(0), upload["parts_in_progress"])
+
+		// Parts over the limit are refused as they stream in
+		resp = adminRequest(t, "PUT", ts.URL+"/v1/uploads/"+id+"/parts/3", strings.NewReader(strings.Repeat("c", 1<<20+1)))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Equal(t, upload["bytes_received"], getUpload(id)["bytes_received"])
+
+		resp = adminRequest(t, "POST", ts.URL+"/v1/uploads/"+id+"/complete", nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// The parts are gone, but the content is all there
+		upload = getUpload(id)
+		assert.Equal(t, "active", upload["status"])
+		assert.Equal(t, float64(10100), upload["bytes_received"])
+	})
+
+	t.Run("Register", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/register", strings.NewReader(`{"name": "report.txt"}`))
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var registered map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&registered))
+		resp.Body.Close()
+		id := registered["id"].(string)
+
+		writer, status := stream("PUT", ts.URL+registered["upload_url"].(string), false)
+		_, err := writer.Write([]byte(strings.Repeat("c", 10000)))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			upload := getUpload(id)
+			return upload["status"] == "processing" && upload["bytes_received"].(float64) > 0 && upload["parts_in_progress"] == float64(1)
+		}, 2*time.Second, 10*time.Millisecond)
+		require.NoError(t, writer.Close())
+		require.Equal(t, http.StatusOK, <-status)
+
+		upload := getUpload(id)
+		assert.Equal(t, "active", upload["status"])
+		assert.Equal(t, float64(10000), upload["bytes_received"])
+		assert.Equal(t, float64(0), upload["parts_in_progress"])
+	})
+}
+
+func TestStalledUploadsFail(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+		// Long enough to store the partial content before the upload fails
+		cfg.UploadTimeout = 200 * time.Millisecond
+		cfg.CleanupInterval = 5 * time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/files/register", strings.NewReader(`{"name": "stalled.bin"}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var registered map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&registered))
+	resp.Body.Close()
+	id := registered["id"].(string)
+
+	// Content left behind by a transfer that broke off
+	storage := fs.NewStorage(dataDir)
+	_, err := storage.Save(context.Background(), id, "stalled.bin", "application/octet-stream", strings.NewReader("part"))
+	require.NoError(t, err)
+
+	listFailed := func() []map[string]any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?status=failed", nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		return fileList
+	}
+	assert.Eventually(t, func() bool {
+		return len(listFailed()) == 1
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, id, listFailed()[0]["id"])
+
+	// The content is deleted after the upload is marked failed
+	assert.Eventually(t, func() bool {
+		exists, err := storage.Exists(context.Background(), id)
+		return err == nil && !exists
+	}, time.Second, 5*time.Millisecond)
+
+	req, err := http.NewRequest("PUT", ts.URL+registered["upload_url"].(string), strings.NewReader("late"))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestStalledUploadsWithDefaults(t *testing.T) {
+	dataDir := t.TempDir()
+	dbPath := filepath.Join(dataDir, "test.db")
+	cfg, err := LoadConfig("", map[string]string{
+		"FILES_STASH_ADMIN_TOKEN":      adminToken,
+		"FILES_STASH_HMAC_KEY":         hmacKey,
+		"FILES_STASH_MAX_SIZE":         "1024",
+		"FILES_STASH_TTL":              "24h",
+		"FILES_STASH_DATA_DIR":         dataDir,
+		"FILES_STASH_DB_PATH":          dbPath,
+		"FILES_STASH_CLEANUP_INTERVAL": "5ms",
+	})
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(New(cfg, new(slog.LevelVar)).Handler)
+	defer ts.Close()
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/files/register", strings.NewReader(`{"name": "stalled.bin"}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var registered map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&registered))
+	resp.Body.Close()
+	id := registered["id"].(string)
+
+	// Registered past both the idle timeout and the upload timeout
+	db, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+	registeredAt := time.Now().Add(-cfg.UploadTimeout - time.Minute).UTC().Format("2006-01-02 15:04:05.000000000Z")
+	_, err = db.Exec(`UPDATE files SET created_at = ? WHERE id = ?`, registeredAt, id)
+	require.NoError(t, err)
+
+	// The upload is marked failed and stays listed, rather than purged as idle
+	assert.Eventually(t, func() bool {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?status=failed", nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		json.NewDecoder(resp.Body).Decode(&fileList)
+		return len(fileList) == 1 && fileList[0]["id"] == id
+	}, 2*time.Second, 10*time.Millisecond)
+
+	resp = adminRequest(t, "GET", ts.URL+"/v1/tombstones/"+id, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestIdleUploadsPurged(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+		cfg.UploadTimeout = 0
+		cfg.UploadIdleTimeout = 300 * time.Millisecond
+		cfg.CleanupInterval = 5 * time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	createUpload := func(name string) string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/uploads", strings.NewReader(`{"name": "`+name+`"}`))
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var upload map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+		return upload["id"].(string)
+	}
+	putPart := func(id string, number int) int {
+		resp := adminRequest(t, "PUT", fmt.Sprintf("%s/v1/uploads/%s/parts/%d", ts.URL, id, number), strings.NewReader("part"))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	uploadStatus := func(id string) int {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/uploads/"+id, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	storedParts := func(id string) []string {
+		stored, err := filepath.Glob(filepath.Join(dataDir, "*", "*", id+".part-*"))
+		require.NoError(t, err)
+		return stored
+	}
+
+	idle := createUpload("idle.bin")
+	require.Equal(t, http.StatusOK, putPart(idle, 1))
+	require.Len(t, storedParts(idle), 1)
+
+	// Parts keep arriving for an active upload, each well within the timeout
+	active := createUpload("active.bin")
+	for number := 1; number <= 8; number++ {
+		require.Equal(t, http.StatusOK, putPart(active, number))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, http.StatusNotFound, uploadStatus(idle))
+	assert.Empty(t, storedParts(idle))
+	assert.Equal(t, http.StatusOK, uploadStatus(active))
+	assert.Len(t, storedParts(active), 8)
+
+	resp := adminRequest(t, "GET", ts.URL+"/v1/tombstones/"+idle, nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var tombstone map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tombstone))
+	assert.Equal(t, files.ReasonAbandoned, tombstone["reason"])
+
+	// The active upload goes too once it stops
+	assert.Eventually(t, func() bool {
+		return uploadStatus(active) == http.StatusNotFound
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Empty(t, storedParts(active))
+}
+
+func TestFreeSpaceWatermark(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		cfg.MinFreeSpace = 1 << 62 // more than any disk has
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := postTestFile(t, ts, "a.txt", "content", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+	// Nothing was stored
+	resp = adminRequest(t, "GET", ts.URL+"/v1/files", nil)
+	var fileList []map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+	resp.Body.Close()
+	assert.Empty(t, fileList)
+}
+
+func TestFileStatus(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+	id := uploaded["id"].(string)
+	assert.Equal(t, "active", uploaded["status"])
+
+	setStatus := func(status string) int {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/status", strings.NewReader(`{"status": "`+status+`"}`))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	var reason string
+	download := func() int {
+		resp, err := http.Get(ts.URL + uploaded["url"].(string))
+		require.NoError(t, err)
+		resp.Body.Close()
+		reason = resp.Header.Get("X-Files-Stash-Reason")
+		return resp.StatusCode
+	}
+	listByStatus := func(status string) []map[string]any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?status="+status, nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		return fileList
+	}
+
+	t.Run("quarantined files can't be downloaded", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, setStatus("quarantined"))
+		assert.Equal(t, http.StatusLocked, download())
+		assert.Equal(t, "quarantined", reason)
+		assert.Len(t, listByStatus("quarantined"), 1)
+		assert.Empty(t, listByStatus("active"))
+	})
+
+	t.Run("trashed files can be restored", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, setStatus("trashed"))
+		assert.Equal(t, http.StatusNotFound, download())
+		assert.Empty(t, reason)
+
+		require.Equal(t, http.StatusOK, setStatus("active"))
+		assert.Equal(t, http.StatusOK, download())
+	})
+
+	t.Run("invalid transitions are refused", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, setStatus("active"))
+		assert.Equal(t, http.StatusConflict, setStatus("pending"))
+		assert.Equal(t, http.StatusConflict, setStatus("expired"))
+	})
+
+	t.Run("unknown file", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/missing/status", strings.NewReader(`{"status": "trashed"}`))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestStorageLayoutMigration(t *testing.T) {
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+	id := uploaded["id"].(string)
+
+	// Move the content back to where it was stored before sharding
+	storage := fs.NewStorage(dataDir)
+	require.NoError(t, storage.Delete(context.Background(), id))
+	flat := filepath.Join(dataDir, id)
+	require.NoError(t, os.WriteFile(flat, []byte("content"), 0o644))
+
+	download := func() string {
+		resp, err := http.Get(ts.URL + uploaded["url"].(string))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Equal(t, "content", download())
+
+	migrate := func() map[string]int {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/admin/storage/migrate", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result map[string]int
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+	assert.Equal(t, map[string]int{"migrated": 1}, migrate())
+	assert.Equal(t, map[string]int{"migrated": 0}, migrate())
+
+	_, err := os.Stat(flat)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "content", download())
+
+	// The database next to the content isn't touched
+	_, err = os.Stat(filepath.Join(dataDir, "test.db"))
+	assert.NoError(t, err)
+}
+
+func TestStorageTiering(t *testing.T) {
+	// Another stash's S3 gateway stands in for the object storage
+	const accessKey, secretKey = "cold-access-key", "cold-secret-key"
+	coldSrv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.S3AccessKeyID = accessKey
+		cfg.S3SecretAccessKey = secretKey
+	})
+	coldTS := httptest.NewServer(coldSrv.Handler)
+	defer coldTS.Close()
+
+	var dataDir string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		dataDir = cfg.DataDir
+		cfg.ColdStorageEndpoint = coldTS.URL + "/s3"
+		cfg.ColdStorageBucket = "tier"
+		cfg.ColdStoragePrefix = "stash/"
+		cfg.ColdStorageAccessKeyID = accessKey
+		cfg.ColdStorageSecretAccessKey = secretKey
+		cfg.TierColdAfter = 500 * time.Millisecond
+		cfg.TierColdSize = 100
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	small := uploadTestFile(t, ts, "small.txt", "small", nil)
+	large := uploadTestFile(t, ts, "large.txt", strings.Repeat("large", 40), nil)
+
+	tier := func() int {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/admin/storage/tier", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result map[string]int
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result["moved"]
+	}
+	isHot := func(file map[string]any) bool {
+		exists, err := fs.NewStorage(dataDir).Exists(context.Background(), file["id"].(string))
+		require.NoError(t, err)
+		return exists
+	}
+	coldObjects := func() []string {
+		resp := adminRequest(t, "GET", coldTS.URL+"/v1/files?tag=tier", nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		var keys []string
+		for _, file := range fileList {
+			keys = append(keys, file["attributes"].(map[string]any)["s3.key"].(string))
+		}
+		return keys
+	}
+	download := func(file map[string]any) string {
+		resp, err := http.Get(ts.URL + file["url"].(string))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("LargeFilesGoCold", func(t *testing.T) {
+		assert.Equal(t, 1, tier())
+		assert.True(t, isHot(small))
+		assert.False(t, isHot(large))
+		assert.Equal(t, []string{"stash/" + large["id"].(string)}, coldObjects())
+
+		// Downloads fetch cold content transparently
+		assert.Equal(t, strings.Repeat("large", 40), download(large))
+		assert.Equal(t, 0, tier())
+	})
+
+	t.Run("IdleFilesGoCold", func(t *testing.T) {
+		time.Sleep(600 * time.Millisecond)
+		assert.Equal(t, 1, tier())
+		assert.False(t, isHot(small))
+		assert.Equal(t, "small", download(small))
+	})
+
+	t.Run("DownloadedFilesComeBack", func(t *testing.T) {
+		// The download is recorded once it's served
+		assert.Eventually(t, func() bool { return tier() == 1 }, time.Second, 10*time.Millisecond)
+		assert.True(t, isHot(small))
+		assert.Equal(t, []string{"stash/" + large["id"].(string)}, coldObjects())
+	})
+
+	t.Run("DeleteRemovesColdContent", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+large["id"].(string), nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Empty(t, coldObjects())
+	})
+}
+
+func TestFileDiff(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.DiffMaxSize = 64
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	diff := func(a, b, format string) (int, string) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files/diff?a="+a+"&b="+b+"&format="+format, nil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("text files get a unified diff", func(t *testing.T) {
+		a := uploadTestFile(t, ts, "a.txt", "one\ntwo\nthree\n", nil)
+		b := uploadTestFile(t, ts, "b.txt", "one\n2\nthree\nfour", nil)
+
+		status, body := diff(a["id"].(string), b["id"].(string), "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "--- a/a.txt\n+++ b/b.txt\n@@ -1,3 +1,4 @@\n one\n-two\n+2\n three\n+four\n\\ No newline at end of file\n", body)
+
+		status, body = diff(a["id"].(string), a["id"].(string), "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Empty(t, body)
+	})
+
+	t.Run("JSON files get a structural diff", func(t *testing.T) {
+		a := uploadTestFileWithType(t, ts, "a.json", "application/json", `{"name": "x", "tags": [1, 2], "old": true}`, nil)
+		b := uploadTestFileWithType(t, ts, "b.json", "application/json", `{"name": "y", "tags": [1, 2, 3], "new": null}`, nil)
+
+		status, body := diff(a["id"].(string), b["id"].(string), "")
+		require.Equal(t, http.StatusOK, status)
+		var result struct {
+			Changes []files.JSONChange `json:"changes"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &result))
+		assert.Equal(t, []files.JSONChange{
+			{Path: "/name", Op: "changed", Old: json.RawMessage(`"x"`), New: json.RawMessage(`"y"`)},
+			{Path: "/new", Op: "added", New: json.RawMessage(`null`)},
+			{Path: "/old", Op: "removed", Old: json.RawMessage(`true`)},
+			{Path: "/tags/2", Op: "added", New: json.RawMessage(`3`)},
+		}, result.Changes)
+
+		status, body = diff(a["id"].(string), b["id"].(string), "unified")
+		require.Equal(t, http.StatusOK, status)
+		assert.True(t, strings.HasPrefix(body, "--- a/a.json\n"))
+	})
+
+	t.Run("files over the limit are refused", func(t *testing.T) {
+		a := uploadTestFile(t, ts, "a.txt", strings.Repeat("x", 65), nil)
+		b := uploadTestFile(t, ts, "b.txt", "x", nil)
+
+		status, _ := diff(a["id"].(string), b["id"].(string), "")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	})
+
+	t.Run("binary files are refused", func(t *testing.T) {
+		a := uploadTestFile(t, ts, "a.bin", "\x00\x01", nil)
+		b := uploadTestFile(t, ts, "b.txt", "x", nil)
+
+		status, _ := diff(a["id"].(string), b["id"].(string), "")
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+
+	t.Run("unknown file", func(t *testing.T) {
+		b := uploadTestFile(t, ts, "b.txt", "x", nil)
+
+		status, _ := diff("missing", b["id"].(string), "")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	source := httptest.NewServer(setupTestServer(t).Handler)
+	defer source.Close()
+	var targetDir string
+	target := httptest.NewServer(setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		targetDir = cfg.DataDir
+	}).Handler)
+	defer target.Close()
+
+	plain := uploadTestFile(t, source, "a.txt", "content", map[string]string{"tag": "release"})
+	protected := uploadTestFile(t, source, "b.txt", "secret", map[string]string{"password": "hunter2"})
+	resp := adminRequest(t, "POST", source.URL+"/v1/files/"+plain["id"].(string)+"/comments", strings.NewReader(`{"body": "looks good"}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = adminRequest(t, "GET", source.URL+"/v1/admin/export", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/gzip", resp.Header.Get("Content-Type"))
+	export, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	importExport := func(body []byte) (int, map[string]int) {
+		resp := adminRequest(t, "POST", target.URL+"/v1/admin/import", bytes.NewReader(body))
+		defer resp.Body.Close()
+		var result map[string]int
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp.StatusCode, result
+	}
+	listTarget := func() []map[string]any {
+		resp := adminRequest(t, "GET", target.URL+"/v1/files", nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		return fileList
+	}
+
+	t.Run("truncated exports are refused", func(t *testing.T) {
+		status, _ := importExport(export[:len(export)/2])
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Empty(t, listTarget())
+	})
+
+	t.Run("files move with their metadata", func(t *testing.T) {
+		status, result := importExport(export)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, map[string]int{"imported": 2, "skipped": 0}, result)
+		assert.Len(t, listTarget(), 2)
+
+		// Links signed by the source keep working, as both share the key
+		resp, err := http.Get(target.URL + plain["url"].(string))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "content", string(body))
+
+		resp, err = http.Get(target.URL + protected["url"].(string))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		resp, err = http.Get(target.URL + protected["url"].(string) + "&password=hunter2")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = adminRequest(t, "GET", target.URL+"/v1/files/"+plain["id"].(string)+"/comments", nil)
+		var comments []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&comments))
+		resp.Body.Close()
+		require.Len(t, comments, 1)
+		assert.Equal(t, "looks good", comments[0]["body"])
+	})
+
+	t.Run("importing again skips existing files", func(t *testing.T) {
+		status, result := importExport(export)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, map[string]int{"imported": 0, "skipped": 2}, result)
+	})
+
+	t.Run("IDs escaping the data directory are refused", func(t *testing.T) {
+		id := "../../../escaped"
+		var archive bytes.Buffer
+		gw := gzip.NewWriter(&archive)
+		tw := tar.NewWriter(gw)
+		checksums := make(map[string]string)
+		write := func(name, content string) {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(content))}))
+			_, err := io.WriteString(tw, content)
+			require.NoError(t, err)
+			sum := sha256.Sum256([]byte(content))
+			checksums[name] = hex.EncodeToString(sum[:])
+		}
+		write("files/escaped.json", `{"file": {"id": "`+id+`", "name": "escaped.txt"}}`)
+		write("blobs/"+id, "hostile")
+		manifest, err := json.Marshal(map[string]any{"version": 1, "checksums": checksums})
+		require.NoError(t, err)
+		write("manifest.json", string(manifest))
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+
+		status, _ := importExport(archive.Bytes())
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.NoFileExists(t, filepath.Join(filepath.Dir(targetDir), "escaped"))
+	})
+
+	t.Run("requires the admin token", func(t *testing.T) {
+		resp, err := http.Get(source.URL + "/v1/admin/export")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestInventorySnapshots(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.InventoryFormat = "csv"
+		cfg.InventoryTag = "inventory"
+		cfg.InventoryTTL = time.Hour
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "content", map[string]string{"tag": "release"})
+
+	snapshot := func() string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/admin/inventory", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// The latest snapshot is the tag's latest file
+		resp, err := http.Get(ts.URL + "/v1/files/latest/inventory")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	first := snapshot()
+	lines := strings.Split(strings.TrimSpace(first), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, "id,name,tag,size,mime_type,sha256,status,pinned,created_at,expires_at", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], uploaded["id"].(string)+",a.txt,release,7,"))
+
+	// Snapshots leave out earlier snapshots
+	assert.Len(t, strings.Split(strings.TrimSpace(snapshot()), "\n"), 2)
+
+	resp := adminRequest(t, "GET", ts.URL+"/v1/files?tag=inventory", nil)
+	var fileList []map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+	resp.Body.Close()
+	assert.Len(t, fileList, 2)
+}
+
+func TestFileAttributes(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	arm := uploadTestFile(t, ts, "app-arm64.tar.gz", "arm", map[string]string{"attr.commit": "abc123", "attr.arch": "arm64"})
+	assert.Equal(t, map[string]any{"commit": "abc123", "arch": "arm64"}, arm["attributes"])
+	uploadTestFile(t, ts, "app-amd64.tar.gz", "amd", map[string]string{"attr.commit": "abc123", "attr.arch": "amd64"})
+	uploadTestFile(t, ts, "plain.txt", "plain", nil)
+
+	list := func(query string) []map[string]any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?"+query, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		return fileList
+	}
+
+	t.Run("Filter", func(t *testing.T) {
+		assert.Len(t, list("attr.commit=abc123"), 2)
+		matched := list("attr.commit=abc123&attr.arch=arm64")
+		require.Len(t, matched, 1)
+		assert.Equal(t, arm["id"], matched[0]["id"])
+		assert.Equal(t, map[string]any{"commit": "abc123", "arch": "arm64"}, matched[0]["attributes"])
+		assert.Empty(t, list("attr.commit=def456"))
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		resp := postTestFile(t, ts, "bad.txt", "bad", map[string]string{"attr.bad key": "value"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestFilenameTemplates(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.FilenameTemplates = map[string]string{"release": "app-{version}-{date}.tar.gz"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	t.Run("Conforming", func(t *testing.T) {
+		result := uploadTestFile(t, ts, "app-1.4.0-rc1-2026-01-31.tar.gz", "release", map[string]string{"tag": "release"})
+		assert.Equal(t, "app-1.4.0-rc1-2026-01-31.tar.gz", result["name"])
+	})
+
+	t.Run("Rendered", func(t *testing.T) {
+		result := uploadTestFile(t, ts, "build.tgz", "release", map[string]string{"tag": "release", "attr.version": "1.5.0"})
+		assert.Equal(t, "app-1.5.0-"+time.Now().UTC().Format("2006-01-02")+".tar.gz", result["name"])
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		resp := postTestFile(t, ts, "build.tgz", "release", map[string]string{"tag": "release"})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("OtherTags", func(t *testing.T) {
+		result := uploadTestFile(t, ts, "build.tgz", "nightly", map[string]string{"tag": "nightly"})
+		assert.Equal(t, "build.tgz", result["name"])
+	})
+}
+
+func TestUpdateFileMetadata(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		cfg.FilenameTemplates = map[string]string{"release": "app-{version}.tar.gz"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "app.tar.gz", "release", map[string]string{"tag": "nightly", "attr.arch": "arm64", "attr.commit": "abc123"})
+	id := uploaded["id"].(string)
+
+	patch := func(t *testing.T, body string) (int, map[string]any) {
+		resp := adminRequest(t, "PATCH", ts.URL+"/v1/files/"+id, strings.NewReader(body))
+		defer resp.Body.Close()
+		var file map[string]any
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&file))
+		}
+		return resp.StatusCode, file
+	}
+
+	t.Run("Retag", func(t *testing.T) {
+		// The release template needs a version
+		status, _ := patch(t, `{"tag":"release"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		status, file := patch(t, `{"tag":"release","attributes":{"version":"2.0.0","commit":null}}`)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "release", file["tag"])
+		assert.Equal(t, "app-2.0.0.tar.gz", file["name"])
+		assert.Equal(t, map[string]any{"arch": "arm64", "version": "2.0.0"}, file["attributes"])
+
+		resp, err := http.Get(ts.URL + "/v1/files/latest/release")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		status, _ := patch(t, `{"name":"other.tar.gz"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		status, file := patch(t, `{"name":"app-2.0.1.tar.gz"}`)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "app-2.0.1.tar.gz", file["name"])
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		status, file := patch(t, `{"ttl":"720h"}`)
+		require.Equal(t, http.StatusOK, status)
+		expiresAt, err := time.Parse(time.RFC3339Nano, file["expires_at"].(string))
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(720*time.Hour), expiresAt, time.Minute)
+
+		status, _ = patch(t, `{"expires_at":"2001-01-01T00:00:00Z"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+		status, _ = patch(t, `{"ttl":"-1h"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Persisted", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?attr.version=2.0.0", nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		require.Len(t, fileList, 1)
+		assert.Equal(t, "app-2.0.1.tar.gz", fileList[0]["name"])
+		assert.Equal(t, "release", fileList[0]["tag"])
+	})
+}
+
+func TestPrefetch(t *testing.T) {
+	primed := make(chan string, 10)
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primed <- r.URL.Path
+	}))
+	defer cdn.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.CacheSize = 1 << 20
+		cfg.PrefetchTags = []string{"release"}
+		cfg.PrefetchURLs = []string{cdn.URL + "/v1/files/latest/{tag}", cdn.URL + "/files/{id}"}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploadTestFile(t, ts, "nightly.txt", "nightly", map[string]string{"tag": "nightly"})
+	release := uploadTestFile(t, ts, "release.txt", "release", map[string]string{"tag": "release"})
+
+	var paths []string
+	for range 2 {
+		select {
+		case path := <-primed:
+			paths = append(paths, path)
+		case <-time.After(5 * time.Second):
+			t.Fatal("prefetch didn't prime the CDN")
+		}
+	}
+	assert.ElementsMatch(t, []string{"/v1/files/latest/release", "/files/" + release["id"].(string)}, paths)
+
+	// Only the prefetched tag primes the CDN
+	select {
+	case path := <-primed:
+		t.Fatalf("unexpected priming request for %s", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/files/latest/release")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "release", string(body))
+}
+
+func TestSlowStart(t *testing.T) {
+	const size = 32 << 20
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.MaxSize = 2 * size
+		cfg.SlowStartWindow = time.Hour
+		cfg.SlowStartLimit = 1
+		cfg.SlowStartRetryAfter = 2 * time.Second
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "release.bin", strings.Repeat("x", size), nil)
+	url := ts.URL + uploaded["url"].(string)
+
+	// The first download stays in flight while its body isn't read
+	first, err := http.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, first.StatusCode)
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// Finishing the first download frees its slot
+	n, err := io.Copy(io.Discard, first.Body)
+	require.NoError(t, err)
+	first.Body.Close()
+	assert.EqualValues(t, size, n)
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(url)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRawPutUpload(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	put := func(t *testing.T, path, contentType, body string) *http.Response {
+		req, err := http.NewRequest("PUT", ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Upload", func(t *testing.T) {
+		resp := put(t, "/v1/files/notes.json?tag=docs&attr.commit=abc123&ttl=1h", "application/json", `{"a":1}`)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, "notes.json", result["name"])
+		assert.Equal(t, "docs", result["tag"])
+		assert.Equal(t, "application/json", result["mime_type"])
+		assert.EqualValues(t, 7, result["size"])
+		assert.Equal(t, map[string]any{"commit": "abc123"}, result["attributes"])
+
+		download, err := http.Get(ts.URL + "/v1/files/latest/docs")
+		require.NoError(t, err)
+		defer download.Body.Close()
+		body, err := io.ReadAll(download.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"a":1}`, string(body))
+	})
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		req, err := http.NewRequest("PUT", ts.URL+"/v1/files/a.txt", strings.NewReader("a"))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("InvalidTTL", func(t *testing.T) {
+		resp := put(t, "/v1/files/a.txt?ttl=soon", "text/plain", "a")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		resp := put(t, "/v1/files/a.txt", "text/plain", strings.Repeat("a", 2048))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+}
+
+func TestTombstones(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.CleanupInterval = 5 * time.Millisecond
+		cfg.TombstoneRetention = 0
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	getTombstone := func(t *testing.T, id string) (int, map[string]any) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/tombstones/"+id, nil)
+		defer resp.Body.Close()
+		var tombstone map[string]any
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&tombstone))
+		}
+		return resp.StatusCode, tombstone
+	}
+
+	deleted := uploadTestFile(t, ts, "report.txt", "report", map[string]string{"tag": "reports"})
+	deletedID := deleted["id"].(string)
+
+	t.Run("Delete", func(t *testing.T) {
+		status, _ := getTombstone(t, deletedID)
+		assert.Equal(t, http.StatusNotFound, status)
+
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+deletedID+"?reason=leaked", nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		status, tombstone := getTombstone(t, deletedID)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "report.txt", tombstone["name"])
+		assert.Equal(t, "reports", tombstone["tag"])
+		assert.Equal(t, "admin", tombstone["deleted_by"])
+		assert.Equal(t, "leaked", tombstone["reason"])
+		assert.NotEmpty(t, tombstone["deleted_at"])
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		id := uploadTestFile(t, ts, "short.txt", "short", nil)["id"].(string)
+		expiresAt := time.Now().Add(100 * time.Millisecond).Format(time.RFC3339Nano)
+		resp := adminRequest(t, "PATCH", ts.URL+"/v1/files/"+id, strings.NewReader(`{"expires_at":"`+expiresAt+`"}`))
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var tombstone map[string]any
+		require.Eventually(t, func() bool {
+			var status int
+			status, tombstone = getTombstone(t, id)
+			return status == http.StatusOK
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "short.txt", tombstone["name"])
+		assert.Equal(t, "expired", tombstone["reason"])
+		assert.Nil(t, tombstone["deleted_by"])
+	})
+
+	t.Run("List", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/tombstones", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var tombstones []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&tombstones))
+		require.Len(t, tombstones, 2)
+		// Most recently deleted first
+		assert.Equal(t, "short.txt", tombstones[0]["name"])
+		assert.Equal(t, deletedID, tombstones[1]["id"])
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/v1/tombstones")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestTombstoneRetention(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.CleanupInterval = 5 * time.Millisecond
+		cfg.TombstoneRetention = 50 * time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	id := uploadTestFile(t, ts, "a.txt", "a", nil)["id"].(string)
+	resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.Eventually(t, func() bool {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/tombstones/"+id, nil)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusNotFound
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestDownloadAnalytics(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	used := uploadTestFile(t, ts, "app.tar.gz", "release", map[string]string{"tag": "releases"})
+	unused := uploadTestFile(t, ts, "old.tar.gz", "old release", map[string]string{"tag": "releases"})
+	uploadTestFile(t, ts, "notes.txt", "notes", nil)
+	usedID := used["id"].(string)
+
+	download := func() {
+		resp, err := http.Get(ts.URL + used["url"].(string))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	metadata := func(t *testing.T, id string) map[string]any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files/"+id+"/metadata", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var metadata map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&metadata))
+		return metadata
+	}
+
+	t.Run("Metadata", func(t *testing.T) {
+		before := metadata(t, usedID)
+		assert.Equal(t, "app.tar.gz", before["name"])
+		assert.EqualValues(t, 0, before["downloads"])
+		assert.Nil(t, before["last_downloaded_at"])
+
+		download()
+		download()
+		assert.Eventually(t, func() bool {
+			return metadata(t, usedID)["downloads"] == float64(2)
+		}, time.Second, 10*time.Millisecond)
+		after := metadata(t, usedID)
+		assert.EqualValues(t, 2*len("release"), after["bytes_served"])
+		assert.NotEmpty(t, after["last_downloaded_at"])
+
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files/missing/metadata", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("AdminStats", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/admin/stats?tag=releases", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var report struct {
+			Downloads   int64            `json:"downloads"`
+			BytesServed int64            `json:"bytes_served"`
+			Files       []map[string]any `json:"files"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		assert.EqualValues(t, 2, report.Downloads)
+		assert.EqualValues(t, 2*len("release"), report.BytesServed)
+		require.Len(t, report.Files, 2)
+		// Most downloaded first, with files never downloaded included
+		assert.Equal(t, usedID, report.Files[0]["id"])
+		assert.EqualValues(t, 2, report.Files[0]["downloads"])
+		assert.Equal(t, unused["id"], report.Files[1]["id"])
+		assert.EqualValues(t, 0, report.Files[1]["downloads"])
+	})
+
+	t.Run("InvalidFilter", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/admin/stats?bogus=1", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("ViewerForbidden", func(t *testing.T) {
+		req, err := http.NewRequest("GET", ts.URL+"/v1/admin/stats", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer viewer-token")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestLinkRevocation(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ShortLinkBaseURL = "https://dl.example.com"
+		cfg.ViewerToken = "viewer-token"
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "shared content", nil)
+	id := uploaded["id"].(string)
+	other := uploadTestFile(t, ts, "b.txt", "other content", nil)
+
+	createLink := func(t *testing.T, fileID, query string) map[string]string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+fileID+"/links?"+query, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var link map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+		require.NotEmpty(t, link["id"])
+		return link
+	}
+	get := func(t *testing.T, host, url string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		if host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	revoked := createLink(t, id, "")
+	kept := createLink(t, id, "disposition=inline")
+	createLink(t, other["id"].(string), "")
+
+	t.Run("List", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/links?file_id="+id, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var links []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&links))
+		require.Len(t, links, 2)
+		assert.Equal(t, revoked["id"], links[0]["id"])
+		assert.Equal(t, "admin", links[0]["created_by"])
+		assert.Equal(t, kept["id"], links[1]["id"])
+		assert.Equal(t, "disposition=inline", links[1]["options"])
+		assert.NotContains(t, links[1], "url")
+
+		resp = adminRequest(t, "GET", ts.URL+"/v1/links", nil)
+		defer resp.Body.Close()
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&links))
+		assert.Len(t, links, 3)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, get(t, "", ts.URL+revoked["url"]))
+
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/links/"+revoked["id"], nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		assert.Equal(t, http.StatusGone, get(t, "", ts.URL+revoked["url"]))
+		assert.Equal(t, http.StatusGone, get(t, "dl.example.com", ts.URL+strings.TrimPrefix(revoked["short_url"], "https://dl.example.com")))
+
+		// Other links to the file and the file itself are left alone
+		assert.Equal(t, http.StatusOK, get(t, "", ts.URL+kept["url"]))
+		assert.Equal(t, http.StatusOK, get(t, "dl.example.com", ts.URL+strings.TrimPrefix(kept["short_url"], "https://dl.example.com")))
+		assert.Equal(t, http.StatusOK, get(t, "", ts.URL+uploaded["url"].(string)))
+
+		resp = adminRequest(t, "GET", ts.URL+"/v1/links?file_id="+id, nil)
+		defer resp.Body.Close()
+		var links []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&links))
+		require.Len(t, links, 1)
+		assert.Equal(t, kept["id"], links[0]["id"])
+	})
+
+	t.Run("SwappedLinkID", func(t *testing.T) {
+		// The link ID is signed, so a revoked link can't borrow a live one's
+		swapped := strings.Replace(revoked["url"], "link="+revoked["id"], "link="+kept["id"], 1)
+		assert.Equal(t, http.StatusNotFound, get(t, "", ts.URL+swapped))
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/links/"+revoked["id"], nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		req, err := http.NewRequest("DELETE", ts.URL+"/v1/links/"+kept["id"], nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("ViewerForbidden", func(t *testing.T) {
+		// Viewers mint links, but revoking them is the admin's
+		req, err := http.NewRequest("DELETE", ts.URL+"/v1/links/"+kept["id"], nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer viewer-token")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, http.StatusOK, get(t, "", ts.URL+kept["url"]))
+	})
+}
+
+func TestOneTimeLinks(t *testing.T) {
+	srv := setupTestServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "a.txt", "secret content", nil)
+	id := uploaded["id"].(string)
+
+	createLink := func(t *testing.T, query string) map[string]string {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?"+query, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var link map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+		return link
+	}
+	request := func(t *testing.T, method, url string) int {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("SingleDownload", func(t *testing.T) {
+		link := createLink(t, "one_time=true")
+
+		// HEAD checks the link without using it
+		assert.Equal(t, http.StatusOK, request(t, "HEAD", ts.URL+link["url"]))
+		assert.Equal(t, http.StatusOK, request(t, "GET", ts.URL+link["url"]))
+		assert.Equal(t, http.StatusGone, request(t, "GET", ts.URL+link["url"]))
+		assert.Equal(t, http.StatusGone, request(t, "HEAD", ts.URL+link["url"]))
+
+		resp := adminRequest(t, "GET", ts.URL+"/v1/links?file_id="+id, nil)
+		defer resp.Body.Close()
+		var links []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&links))
+		require.Len(t, links, 1)
+		assert.Equal(t, true, links[0]["one_time"])
+		assert.NotEmpty(t, links[0]["used_at"])
+	})
+
+	t.Run("ConcurrentDownloads", func(t *testing.T) {
+		link := createLink(t, "one_time=true")
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 10)
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- request(t, "GET", ts.URL+link["url"])
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		succeeded := 0
+		for code := range codes {
+			if code == http.StatusOK {
+				succeeded++
+			} else {
+				assert.Equal(t, http.StatusGone, code)
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	})
+
+	t.Run("Reusable", func(t *testing.T) {
+		link := createLink(t, "")
+		assert.Equal(t, http.StatusOK, request(t, "GET", ts.URL+link["url"]))
+		assert.Equal(t, http.StatusOK, request(t, "GET", ts.URL+link["url"]))
+	})
+
+	t.Run("InvalidFlag", func(t *testing.T) {
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?one_time=maybe", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestOneTimeLinkFailures(t *testing.T) {
+	var dbPath string
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		cfg.MaxSize = 1 << 20
+		cfg.DownloadRateLimit = 8 << 10
+		dbPath = cfg.DBPath
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// Downloading takes a few seconds
+	uploaded := uploadTestFile(t, ts, "a.txt", strings.Repeat("slow content ", 5000), nil)
+	id := uploaded["id"].(string)
+	resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?one_time=true", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var link map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+	resp.Body.Close()
+
+	t.Run("AbandonedDownload", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + link["url"])
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = io.ReadFull(resp.Body, make([]byte, 10))
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		// Breaking off doesn't give the link back
+		time.Sleep(200 * time.Millisecond)
+		resp, err = http.Get(ts.URL + link["url"])
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+	})
+
+	t.Run("ServerFailure", func(t *testing.T) {
+		// Generating a thumbnail of text fails before anything is sent
+		resp := adminRequest(t, "POST", ts.URL+"/v1/files/"+id+"/links?one_time=true&thumbnail=20x20", nil)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var thumbnail map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&thumbnail))
+		resp.Body.Close()
+
+		for range 2 {
+			resp, err := http.Get(ts.URL + thumbnail["url"])
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+		}
+	})
+
+	t.Run("FailedCheck", func(t *testing.T) {
+		db, err := sql.Open("sqlite", dbPath)
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Exec(`DROP TABLE links`)
+		require.NoError(t, err)
+
+		resp, err := http.Get(ts.URL + link["url"])
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	})
+}
+
+func TestRetentionPolicies(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.CleanupInterval = 5 * time.Millisecond
+		cfg.RetentionKeepLast = map[string]int{"nightly": 2}
+		cfg.RetentionMaxAge = map[string]time.Duration{"*": 100 * time.Millisecond}
+		cfg.RetentionUntaggedMaxAge = 100 * time.Millisecond
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	listIDs := func(t *testing.T, query string) []string {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?"+query, nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		var ids []string
+		for _, file := range fileList {
+			ids = append(ids, file["id"].(string))
+		}
+		return ids
+	}
+	// latest returns the ID of the file the tag's latest pointer redirects to
+	latest := func(t *testing.T, tag string) string {
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get(ts.URL + "/v1/files/latest/" + tag)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		location, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+		return strings.TrimPrefix(location.Path, "/v1/files/")
+	}
+
+	t.Run("KeepLast", func(t *testing.T) {
+		var ids []string
+		for i := range 4 {
+			ids = append(ids, uploadTestFile(t, ts, fmt.Sprintf("build-%d.tar.gz", i), "build", map[string]string{"tag": "nightly"})["id"].(string))
+		}
+
+		// The tag also falls under the "*" max age, so only the newest stays
+		assert.Eventually(t, func() bool {
+			return slices.Equal(listIDs(t, "tag=nightly"), ids[3:])
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, ids[3], latest(t, "nightly"))
+
+		resp := adminRequest(t, "GET", ts.URL+"/v1/tombstones/"+ids[0], nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var tombstone map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&tombstone))
+		assert.Equal(t, "retention", tombstone["reason"])
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		older := uploadTestFile(t, ts, "old.pdf", "old", map[string]string{"tag": "docs"})["id"].(string)
+		pinned := uploadTestFile(t, ts, "pinned.pdf", "pinned", map[string]string{"tag": "docs", "pinned": "true"})["id"].(string)
+		newest := uploadTestFile(t, ts, "new.pdf", "new", map[string]string{"tag": "docs"})["id"].(string)
+		uploadTestFile(t, ts, "scratch.txt", "scratch", nil)
+
+		// The newest file of the tag stays as its latest, and pinned ones stay
+		assert.Eventually(t, func() bool {
+			return len(listIDs(t, "tag=docs")) == 2 && len(listIDs(t, "")) == 3
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.ElementsMatch(t, []string{pinned, newest}, listIDs(t, "tag=docs"))
+		assert.NotContains(t, listIDs(t, ""), older)
+		assert.Equal(t, newest, latest(t, "docs"))
+	})
+}
+
+func TestSavedSearchRetention(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.CleanupInterval = 5 * time.Millisecond
+		cfg.RetentionKeepLast = map[string]int{"@large-reports": 1}
+	})
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := adminRequest(t, "PUT", ts.URL+"/v1/searches/large-reports", strings.NewReader(`{"query":"tag=reports&min_size=5"}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var large []string
+	for i := range 3 {
+		large = append(large, uploadTestFile(t, ts, fmt.Sprintf("report-%d.pdf", i), "quarterly", map[string]string{"tag": "reports"})["id"].(string))
+	}
+	small := uploadTestFile(t, ts, "summary.pdf", "q", map[string]string{"tag": "reports"})["id"].(string)
+	untagged := uploadTestFile(t, ts, "report.pdf", "quarterly", nil)["id"].(string)
+
+	// Only the newest file the search matches is kept; the others aren't
+	// matched by it
+	listIDs := func() []string {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files", nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		var ids []string
+		for _, file := range fileList {
+			ids = append(ids, file["id"].(string))
+		}
+		return ids
+	}
+	assert.Eventually(t, func() bool {
+		return len(listIDs()) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{large[2], small, untagged}, listIDs())
+
+	resp = adminRequest(t, "GET", ts.URL+"/v1/tombstones/"+large[0], nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var tombstone map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tombstone))
+	assert.Equal(t, "retention", tombstone["reason"])
+}
+
+func TestUploadOrigin(t *testing.T) {
+	put := func(t *testing.T, ts *httptest.Server, name string) map[string]any {
+		req, err := http.NewRequest("PUT", ts.URL+"/v1/files/"+name, strings.NewReader("artifact"))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("User-Agent", "ci-uploader/1.0")
+		req.Header.Set("X-Files-Stash-Hostname", "build-07.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var result map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+	listOrigin := func(t *testing.T, ts *httptest.Server) any {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files", nil)
+		defer resp.Body.Close()
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		require.Len(t, fileList, 1)
+		return fileList[0]["origin"]
+	}
+
+	t.Run("AllFields", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			onDisk(t, cfg)
+			cfg.OriginFields = []string{"ip", "user_agent", "hostname"}
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		expected := map[string]any{"ip": "127.0.0.1", "user_agent": "ci-uploader/1.0", "hostname": "build-07.example.com"}
+		assert.Equal(t, expected, put(t, ts, "app.tar.gz")["origin"])
+		assert.Equal(t, expected, listOrigin(t, ts))
+	})
+
+	t.Run("Restricted", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.OriginFields = []string{"hostname"}
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		assert.Equal(t, map[string]any{"hostname": "build-07.example.com"}, put(t, ts, "app.tar.gz")["origin"])
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		srv := setupTestServer(t)
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		assert.NotContains(t, put(t, ts, "app.tar.gz"), "origin")
+		assert.Nil(t, listOrigin(t, ts))
+	})
+
+	t.Run("InvalidField", func(t *testing.T) {
+		assert.Panics(t, func() {
+			setupTestServerWithConfig(t, func(cfg *Config) {
+				cfg.OriginFields = []string{"mac_address"}
+			})
+		})
+	})
+}
+
+func TestLogLevelEndpoint(t *testing.T) {
+	srv := setupTestServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	getLevel := func(t *testing.T) string {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/admin/log-level", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body["level"]
+	}
+
+	assert.Equal(t, "INFO", getLevel(t))
+
+	resp := adminRequest(t, "POST", ts.URL+"/v1/admin/log-level", strings.NewReader(`{"level":"debug"}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "DEBUG", getLevel(t))
+
+	resp = adminRequest(t, "POST", ts.URL+"/v1/admin/log-level", strings.NewReader(`{"level":"loud"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "DEBUG", getLevel(t))
+
+	resp, err := http.Post(ts.URL+"/v1/admin/log-level", "application/json", strings.NewReader(`{"level":"error"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestSIEMEvents(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer collector.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+		cfg.SIEMAddr = "udp://" + collector.LocalAddr().String()
+		cfg.SIEMFormat = "json"
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	receive := func(t *testing.T) map[string]any {
+		buf := make([]byte, 4096)
+		require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := collector.ReadFrom(buf)
+		require.NoError(t, err)
+		_, payload, ok := strings.Cut(string(buf[:n]), " - ")
+		require.True(t, ok)
+		var event map[string]any
+		require.NoError(t, json.Unmarshal([]byte(payload), &event))
+		return event
+	}
+
+	// A bad token is an auth failure
+	req, err := http.NewRequest("DELETE", ts.URL+"/v1/files/missing", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	event := receive(t)
+	assert.Equal(t, "auth_failure", event["event"])
+	assert.Equal(t, "DELETE", event["method"])
+	assert.Equal(t, "/v1/files/missing", event["path"])
+	assert.Equal(t, float64(http.StatusUnauthorized), event["status"])
+	assert.NotContains(t, event, "user")
+
+	// Reads pass silently, changes by the admin are recorded
+	req, err = http.NewRequest("GET", ts.URL+"/v1/files", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer viewer-token")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	uploaded := uploadTestFile(t, ts, "report.txt", "content", nil)
+	event = receive(t)
+	assert.Equal(t, "admin_action", event["event"])
+	assert.Equal(t, "admin", event["user"])
+	assert.Equal(t, "POST", event["method"])
+	assert.Equal(t, "/v1/files", event["path"])
+
+	resp = adminRequest(t, "DELETE", ts.URL+"/v1/files/"+uploaded["id"].(string), nil)
+	resp.Body.Close()
+	event = receive(t)
+	assert.Equal(t, "admin_action", event["event"])
+	assert.Equal(t, "DELETE", event["method"])
+}
+
+func TestReadiness(t *testing.T) {
+	readyz := func(t *testing.T, ts *httptest.Server) (int, map[string]map[string]any) {
+		resp, err := http.Get(ts.URL + "/readyz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body struct {
+			Ready  bool             `json:"ready"`
+			Checks []map[string]any `json:"checks"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, resp.StatusCode == http.StatusOK, body.Ready)
+		checks := make(map[string]map[string]any)
+		for _, check := range body.Checks {
+			checks[check["name"].(string)] = check
+		}
+		return resp.StatusCode, checks
+	}
+
+	t.Run("Ready", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) { onDisk(t, cfg) })
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		status, checks := readyz(t, ts)
+		assert.Equal(t, http.StatusOK, status)
+		require.Len(t, checks, 3)
+		for _, name := range []string{"database", "storage", "disk_space"} {
+			assert.Equal(t, true, checks[name]["ok"], name)
+		}
+		assert.Greater(t, checks["disk_space"]["free_bytes"], float64(0))
+	})
+
+	t.Run("LowDiskSpace", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			onDisk(t, cfg)
+			cfg.MinFreeSpace = 1 << 62
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		status, checks := readyz(t, ts)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, false, checks["disk_space"]["ok"])
+		assert.Contains(t, checks["disk_space"]["error"], "below the")
+		assert.Equal(t, true, checks["database"]["ok"])
+	})
+
+	t.Run("DataDirectoryGone", func(t *testing.T) {
+		var dataDir string
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			onDisk(t, cfg)
+			cfg.DataDir = filepath.Join(cfg.DataDir, "data")
+			require.NoError(t, os.Mkdir(cfg.DataDir, 0o755))
+			dataDir = cfg.DataDir
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		require.NoError(t, os.RemoveAll(dataDir))
+		status, checks := readyz(t, ts)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, false, checks["storage"]["ok"])
+	})
+
+	t.Run("Liveness", func(t *testing.T) {
+		ts := httptest.NewServer(setupTestServer(t).Handler)
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL + "/healthz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		status, checks := readyz(t, ts)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Empty(t, checks)
+	})
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		ts := httptest.NewServer(setupTestServer(t).Handler)
+		defer ts.Close()
+
+		resp := adminRequest(t, "GET", ts.URL+"/debug/vars", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.DebugEndpoints = true
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		for _, path := range []string{"/debug/vars", "/debug/pprof/", "/debug/pprof/heap"} {
+			resp, err := http.Get(ts.URL + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, path)
+		}
+	})
+
+	t.Run("Vars", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/debug/vars", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var vars map[string]json.RawMessage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&vars))
+		assert.Contains(t, vars, "memstats")
+		var runtimeStats map[string]any
+		require.NoError(t, json.Unmarshal(vars["runtime"], &runtimeStats))
+		assert.Greater(t, runtimeStats["goroutines"], float64(0))
+	})
+
+	t.Run("Profiles", func(t *testing.T) {
+		resp := adminRequest(t, "GET", ts.URL+"/debug/pprof/heap?debug=1", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "heap profile")
+	})
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	const size = 30000
+	download := func(t *testing.T, url string) {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		n, err := io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		assert.EqualValues(t, size, n)
+	}
+
+	t.Run("PerDownload", func(t *testing.T) {
+		// A second worth of content is sent right away, the rest at the limit
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.MaxSize = 2 * size
+			cfg.DownloadRateLimit = 20000
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := uploadTestFile(t, ts, "release.bin", strings.Repeat("x", size), nil)
+		start := time.Now()
+		download(t, ts.URL+uploaded["url"].(string))
+		assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+
+	t.Run("Total", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.MaxSize = 2 * size
+			cfg.TotalDownloadRateLimit = 40000
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		uploaded := uploadTestFile(t, ts, "release.bin", strings.Repeat("x", size), nil)
+		url := ts.URL + uploaded["url"].(string)
+
+		// Alone, a download fits in the burst
+		start := time.Now()
+		download(t, url)
+		assert.Less(t, time.Since(start), 400*time.Millisecond)
+
+		// Together, downloads share the limit
+		time.Sleep(time.Second)
+		start = time.Now()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			download(t, url)
+		}()
+		download(t, url)
+		<-done
+		assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	const size = 32 << 20
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.MaxSize = 2 * size
+		cfg.MaxConcurrentDownloads = 1
+		cfg.ConcurrencyQueueTimeout = time.Second
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "release.bin", strings.Repeat("x", size), nil)
+	url := ts.URL + uploaded["url"].(string)
+
+	// The first download holds the only slot while its body isn't read
+	first, err := http.Get(url)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, first.StatusCode)
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Uploads aren't limited
+	uploadTestFile(t, ts, "other.bin", "content", nil)
+
+	// A queued download gets the slot once the first finishes
+	queued := make(chan int)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			queued <- 0
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		queued <- resp.StatusCode
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, err = io.Copy(io.Discard, first.Body)
+	require.NoError(t, err)
+	first.Body.Close()
+	assert.Equal(t, http.StatusOK, <-queued)
+
+	resp = adminRequest(t, "GET", ts.URL+"/metrics", nil)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `files_stash_requests_rejected_total{kind="download"} 1`)
+	assert.Contains(t, string(body), `files_stash_requests_in_flight{kind="download"} 0`)
+}
+
+func TestWebDAV(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+		cfg.WebDAV = true
+		cfg.WebDAVWritable = true
+		cfg.JWTSecret = "jwt-secret"
+		cfg.JWTScopeClaim = "scope"
+		cfg.JWTAdminScope = "stash:admin"
+		cfg.JWTViewerScope = "stash:read"
+		cfg.UploadTokens = map[string]string{"ci": "upload-token"}
+		cfg.UploadTokenNamespaces = map[string]string{"ci": "ci"}
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	oldest := uploadTestFile(t, ts, "app.txt", "old release", map[string]string{"tag": "release"})
+	time.Sleep(time.Millisecond)
+	newest := uploadTestFile(t, ts, "app.txt", "new release", map[string]string{"tag": "release"})
+	uploadTestFile(t, ts, "notes.txt", "untagged", nil)
+
+	dav := func(t *testing.T, method, path, token string, body io.Reader, header map[string]string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, body)
+		require.NoError(t, err)
+		if token != "" {
+			req.SetBasicAuth("anyone", token)
+		}
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(content)
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		status, _ := dav(t, "PROPFIND", "/dav/", "", nil, nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Browse", func(t *testing.T) {
+		status, body := dav(t, "PROPFIND", "/dav/", "viewer-token", nil, map[string]string{"Depth": "1"})
+		require.Equal(t, http.StatusMultiStatus, status)
+		assert.Contains(t, body, "<D:href>/dav/release/</D:href>")
+		assert.Contains(t, body, "<D:href>/dav/notes.txt</D:href>")
+
+		status, body = dav(t, "PROPFIND", "/dav/release/", "viewer-token", nil, map[string]string{"Depth": "1"})
+		require.Equal(t, http.StatusMultiStatus, status)
+		assert.Contains(t, body, "<D:href>/dav/release/app.txt</D:href>")
+		assert.Contains(t, body, "_app.txt</D:href>")
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		// The oldest file keeps the name, the others are named by their ID
+		status, body := dav(t, "GET", "/dav/release/app.txt", "viewer-token", nil, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "old release", body)
+		status, body = dav(t, "GET", "/dav/release/"+newest["id"].(string)+"_app.txt", "viewer-token", nil, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "new release", body)
+		status, _ = dav(t, "GET", "/dav/release/"+oldest["id"].(string)+"_app.txt", "viewer-token", nil, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+
+		status, body = dav(t, "GET", "/dav/release/app.txt", "viewer-token", nil, map[string]string{"Range": "bytes=4-"})
+		assert.Equal(t, http.StatusPartialContent, status)
+		assert.Equal(t, "release", body)
+
+		status, _ = dav(t, "GET", "/dav/release/missing.txt", "viewer-token", nil, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("ViewersCantWrite", func(t *testing.T) {
+		status, _ := dav(t, "PUT", "/dav/release/evil.txt", "viewer-token", strings.NewReader("x"), nil)
+		assert.Equal(t, http.StatusForbidden, status)
+		status, _ = dav(t, "DELETE", "/dav/release/app.txt", "viewer-token", nil, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		status, _ := dav(t, "PUT", "/dav/nightly/build.txt", adminToken, strings.NewReader("nightly build"), nil)
+		require.Equal(t, http.StatusCreated, status)
+		status, body := dav(t, "GET", "/dav/nightly/build.txt", adminToken, nil, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "nightly build", body)
+
+		status, _ = dav(t, "MOVE", "/dav/nightly/build.txt", adminToken, nil, map[string]string{"Destination": ts.URL + "/dav/release/build.txt"})
+		require.Equal(t, http.StatusCreated, status)
+		status, _ = dav(t, "GET", "/dav/nightly/build.txt", adminToken, nil, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?tag=release", nil)
+		defer resp.Body.Close()
+		var listed []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+		names := make([]string, 0, len(listed))
+		for _, file := range listed {
+			names = append(names, file["name"].(string))
+		}
+		assert.ElementsMatch(t, []string{"app.txt", "app.txt", "build.txt"}, names)
+
+		status, _ = dav(t, "DELETE", "/dav/release/app.txt", adminToken, nil, nil)
+		assert.Equal(t, http.StatusNoContent, status)
+		resp = adminRequest(t, "GET", ts.URL+"/v1/files/"+oldest["id"].(string)+"/metadata", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// Tags can't be deleted wholesale
+		status, _ = dav(t, "DELETE", "/dav/release/", adminToken, nil, nil)
+		assert.Equal(t, http.StatusMethodNotAllowed, status)
+	})
+
+	t.Run("JWT", func(t *testing.T) {
+		// WebDAV clients send the token as the password of basic auth
+		hs256 := func(scope string) string {
+			return signJWT(t, map[string]any{"alg": "HS256", "typ": "JWT"}, map[string]any{
+				"sub":   "alice",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"scope": scope,
+			}, func(input []byte) []byte {
+				mac := hmac.New(sha256.New, []byte("jwt-secret"))
+				mac.Write(input)
+				return mac.Sum(nil)
+			})
+		}
+		status, body := dav(t, "GET", "/dav/notes.txt", hs256("stash:read"), nil, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "untagged", body)
+		status, _ = dav(t, "PUT", "/dav/jwt/viewer.txt", hs256("stash:read"), strings.NewReader("x"), nil)
+		assert.Equal(t, http.StatusForbidden, status)
+		status, _ = dav(t, "PUT", "/dav/jwt/admin.txt", hs256("stash:admin"), strings.NewReader("x"), nil)
+		assert.Equal(t, http.StatusCreated, status)
+		status, _ = dav(t, "GET", "/dav/notes.txt", hs256("openid"), nil, nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("UploadToken", func(t *testing.T) {
+		// Uploads land in the namespace of the token
+		status, _ := dav(t, "PUT", "/dav/builds/app.zip", "upload-token", strings.NewReader("build"), nil)
+		require.Equal(t, http.StatusCreated, status)
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?tag=ci/builds", nil)
+		defer resp.Body.Close()
+		var listed []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+		require.Len(t, listed, 1)
+		assert.Equal(t, "app.zip", listed[0]["name"])
+
+		// Untagged uploads would escape the namespace
+		status, _ = dav(t, "PUT", "/dav/app.zip", "upload-token", strings.NewReader("build"), nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		// Upload tokens can't browse, download or delete
+		for _, method := range []string{"PROPFIND", "GET", "DELETE"} {
+			status, _ = dav(t, method, "/dav/notes.txt", "upload-token", nil, nil)
+			assert.Equal(t, http.StatusForbidden, status, method)
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) { cfg.WebDAV = true })
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		req, err := http.NewRequest("PUT", ts.URL+"/dav/a.txt", strings.NewReader("x"))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+// dialSFTP connects an SFTP client to the stash
+func dialSFTP(t *testing.T, addr, password string, opts ...pkgsftp.ClientOption) (*pkgsftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "partner",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := pkgsftp.NewClient(conn, opts...)
+	require.NoError(t, err)
+	return client, nil
+}
+
+// sftpPut uploads a file, returning the error of the request that failed
+func sftpPut(client *pkgsftp.Client, name, content string) error {
+	f, err := client.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sftpGet downloads a file
+func sftpGet(client *pkgsftp.Client, name string) (string, error) {
+	f, err := client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	return string(content), err
+}
+
+// sftpList returns the names in a directory
+func sftpList(t *testing.T, client *pkgsftp.Client, dir string) []string {
+	entries, err := client.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+// sftpTestAddrs writes a host key and takes a free port for an SFTP server
+func sftpTestAddrs(t *testing.T) (addr, hostKeyFile string) {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	hostKeyFile = filepath.Join(t.TempDir(), "host_key")
+	require.NoError(t, os.WriteFile(hostKeyFile, pem.EncodeToMemory(block), 0o600))
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr = free.Addr().String()
+	require.NoError(t, free.Close())
+	return addr, hostKeyFile
+}
+
+func TestSFTPAdminNetworks(t *testing.T) {
+	sftpAddr, hostKeyFile := sftpTestAddrs(t)
+	startTestApp(t, func(cfg *Config) {
+		cfg.SFTPAddr = sftpAddr
+		cfg.SFTPHostKeyFile = hostKeyFile
+		cfg.AdminAllowCIDRs = []string{"10.0.0.0/8"}
+	})
+
+	// The test client connects from loopback, outside the allow list
+	_, err := dialSFTP(t, sftpAddr, adminToken)
+	assert.Error(t, err)
+}
+
+func TestSFTP(t *testing.T) {
+	sftpAddr, hostKeyFile := sftpTestAddrs(t)
+
+	app := startTestApp(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+		cfg.SFTPAddr = sftpAddr
+		cfg.SFTPHostKeyFile = hostKeyFile
+		cfg.OriginFields = []string{"ip", "user_agent"}
+	})
+	ts := &httptest.Server{URL: "http://" + app.Addr().String()}
+	uploadTestFile(t, ts, "notes.txt", "untagged", nil)
+
+	admin, err := dialSFTP(t, sftpAddr, adminToken)
+	require.NoError(t, err)
+
+	t.Run("Upload", func(t *testing.T) {
+		require.NoError(t, sftpPut(admin, "/partner/feed.csv", "id,amount\n1,100\n"))
+
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files?tag=partner", nil)
+		var fileList []map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&fileList))
+		resp.Body.Close()
+		require.Len(t, fileList, 1)
+		assert.Equal(t, "feed.csv", fileList[0]["name"])
+		assert.Equal(t, "text/csv; charset=utf-8", fileList[0]["mime_type"])
+		origin, _ := fileList[0]["origin"].(map[string]any)
+		assert.Equal(t, "127.0.0.1", origin["ip"])
+		assert.Equal(t, "SSH-2.0-Go", origin["user_agent"])
+		assert.Equal(t, float64(len("id,amount\n1,100\n")), fileList[0]["size"])
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		content, err := sftpGet(admin, "/notes.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "untagged", content)
+
+		_, err = sftpGet(admin, "/missing.txt")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		assert.Equal(t, []string{"notes.txt", "partner"}, sftpList(t, admin, "/"))
+		assert.Equal(t, []string{"feed.csv"}, sftpList(t, admin, "/partner"))
+
+		info, err := admin.Stat("/partner/feed.csv")
+		require.NoError(t, err)
+		assert.Equal(t, int64(len("id,amount\n1,100\n")), info.Size())
+	})
+
+	t.Run("Viewer", func(t *testing.T) {
+		viewer, err := dialSFTP(t, sftpAddr, "viewer-token")
+		require.NoError(t, err)
+
+		content, err := sftpGet(viewer, "/partner/feed.csv")
+		require.NoError(t, err)
+		assert.Equal(t, "id,amount\n1,100\n", content)
+		assert.ErrorIs(t, sftpPut(viewer, "/partner/more.csv", "2,200\n"), os.ErrPermission)
+		assert.ErrorIs(t, viewer.Remove("/notes.txt"), os.ErrPermission)
+	})
+
+	t.Run("RenameAndRemove", func(t *testing.T) {
+		require.NoError(t, sftpPut(admin, "/draft.txt", "draft"))
+		require.NoError(t, admin.Rename("/draft.txt", "/partner/final.txt"))
+		assert.Equal(t, []string{"feed.csv", "final.txt"}, sftpList(t, admin, "/partner"))
+
+		require.NoError(t, admin.Remove("/partner/final.txt"))
+		_, err := admin.Stat("/partner/final.txt")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("ConcurrentRequests", func(t *testing.T) {
+		// Small packets split the file over many requests in flight at once
+		client, err := dialSFTP(t, sftpAddr, adminToken,
+			pkgsftp.MaxPacketUnchecked(64), pkgsftp.UseConcurrentWrites(true), pkgsftp.UseConcurrentReads(true))
+		require.NoError(t, err)
+		var content strings.Builder
+		for i := range 100 {
+			fmt.Fprintf(&content, "%09d\n", i)
+		}
+
+		require.NoError(t, sftpPut(client, "/partner/ledger.txt", content.String()))
+		downloaded, err := sftpGet(client, "/partner/ledger.txt")
+		require.NoError(t, err)
+		assert.Equal(t, content.String(), downloaded)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		var status *pkgsftp.StatusError
+		require.ErrorAs(t, sftpPut(admin, "/large.bin", strings.Repeat("x", 2048)), &status)
+		assert.Equal(t, uint32(4), status.Code) // failure
+		_, err := admin.Stat("/large.bin")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		_, err := dialSFTP(t, sftpAddr, "wrong")
+		assert.ErrorContains(t, err, "unable to authenticate")
+	})
+}
+
+// TestMirror syncs the mirror as rclone's http backend does: it follows the
+// links of the HTML indexes, takes the size and modification time of each
+// file from a HEAD request and downloads it, then relies on conditional
+// requests to skip what hasn't changed.
+func TestMirror(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	old := uploadTestFile(t, ts, "app.txt", "old release", map[string]string{"tag": "release/v1"})
+	time.Sleep(time.Millisecond)
+	newer := uploadTestFile(t, ts, "app.txt", "new release", map[string]string{"tag": "release/v1"})
+	uploadTestFile(t, ts, "notes.txt", "untagged", nil)
+	uploadTestFile(t, ts, "secret.txt", "classified", map[string]string{"password": "hunter2"})
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	mirror := func(t *testing.T, method, path, token string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(content)
+	}
+
+	// syncTree downloads the tree under path, keyed by the unescaped path of
+	// each file relative to it
+	var syncTree func(t *testing.T, path, token string, into map[string]string, prefix string)
+	syncTree = func(t *testing.T, path, token string, into map[string]string, prefix string) {
+		resp, body := mirror(t, http.MethodGet, path, token, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		for _, link := range strings.Split(body, `href="`)[1:] {
+			href, _, _ := strings.Cut(link, `"`)
+			base, err := url.Parse(ts.URL + path)
+			require.NoError(t, err)
+			ref, err := url.Parse(href)
+			require.NoError(t, err)
+			target := base.ResolveReference(ref)
+			name, err := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(href, "./"), "/"))
+			require.NoError(t, err)
+
+			if strings.HasSuffix(href, "/") {
+				syncTree(t, target.EscapedPath(), token, into, prefix+name+"/")
+				continue
+			}
+			head, _ := mirror(t, http.MethodHead, target.EscapedPath(), token, nil)
+			require.Equal(t, http.StatusOK, head.StatusCode)
+			_, err = http.ParseTime(head.Header.Get("Last-Modified"))
+			require.NoError(t, err)
+			resp, content := mirror(t, http.MethodGet, target.EscapedPath(), token, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, head.Header.Get("Content-Length"), strconv.Itoa(len(content)))
+			into[prefix+name] = content
+		}
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp, _ := mirror(t, http.MethodGet, "/mirror/", "", nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		viewer := make(map[string]string)
+		syncTree(t, "/mirror/", "viewer-token", viewer, "")
+		assert.Equal(t, map[string]string{
+			"notes.txt":          "untagged",
+			"release/v1/app.txt": "old release",
+			"release/v1/" + newer["id"].(string) + "_app.txt": "new release",
+		}, viewer)
+
+		// Password protected files are only mirrored for admins
+		admin := make(map[string]string)
+		syncTree(t, "/mirror/", adminToken, admin, "")
+		assert.Equal(t, "classified", admin["secret.txt"])
+		assert.Len(t, admin, 4)
+	})
+
+	t.Run("JSONListing", func(t *testing.T) {
+		resp, body := mirror(t, http.MethodGet, "/mirror/release%2Fv1/?format=json", "viewer-token", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var listing mirrorListing
+		require.NoError(t, json.Unmarshal([]byte(body), &listing))
+		assert.Equal(t, "/mirror/release%2Fv1/", listing.Path)
+		require.Len(t, listing.Entries, 2)
+
+		entry := listing.Entries[1]
+		assert.Equal(t, "app.txt", entry.Name)
+		assert.Equal(t, int64(len("old release")), entry.Size)
+		sum := sha256.Sum256([]byte("old release"))
+		assert.Equal(t, hex.EncodeToString(sum[:]), entry.SHA256)
+
+		head, _ := mirror(t, http.MethodHead, "/mirror/release%2Fv1/app.txt", "viewer-token", nil)
+		modTime, err := http.ParseTime(head.Header.Get("Last-Modified"))
+		require.NoError(t, err)
+		assert.True(t, modTime.Equal(entry.ModTime))
+		assert.Equal(t, `"`+entry.SHA256+`"`, head.Header.Get("ETag"))
+
+		resp, _ = mirror(t, http.MethodGet, "/mirror/?format=xml", "viewer-token", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("ConditionalListing", func(t *testing.T) {
+		first, body := mirror(t, http.MethodGet, "/mirror/release%2Fv1/", "viewer-token", nil)
+		etag := first.Header.Get("ETag")
+		require.NotEmpty(t, etag)
+		second, again := mirror(t, http.MethodGet, "/mirror/release%2Fv1/", "viewer-token", nil)
+		assert.Equal(t, body, again)
+		assert.Equal(t, etag, second.Header.Get("ETag"))
+
+		resp, _ := mirror(t, http.MethodGet, "/mirror/release%2Fv1/", "viewer-token", map[string]string{"If-None-Match": etag})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+		uploadTestFile(t, ts, "changelog.txt", "fixes", map[string]string{"tag": "release/v1"})
+		resp, body = mirror(t, http.MethodGet, "/mirror/release%2Fv1/", "viewer-token", map[string]string{"If-None-Match": etag})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+		assert.Contains(t, body, `href="./changelog.txt"`)
+	})
+
+	t.Run("ConditionalContent", func(t *testing.T) {
+		head, _ := mirror(t, http.MethodHead, "/mirror/notes.txt", "viewer-token", nil)
+		require.Equal(t, http.StatusOK, head.StatusCode)
+
+		resp, _ := mirror(t, http.MethodGet, "/mirror/notes.txt", "viewer-token", map[string]string{"If-None-Match": head.Header.Get("ETag")})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		resp, _ = mirror(t, http.MethodGet, "/mirror/notes.txt", "viewer-token", map[string]string{"If-Modified-Since": head.Header.Get("Last-Modified")})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+		resp, body := mirror(t, http.MethodGet, "/mirror/notes.txt", "viewer-token", map[string]string{"Range": "bytes=2-"})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "tagged", body)
+	})
+
+	t.Run("DirectoryRedirect", func(t *testing.T) {
+		resp, _ := mirror(t, http.MethodGet, "/mirror/release%2Fv1", "viewer-token", nil)
+		assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		assert.Equal(t, "/mirror/release%2Fv1/", resp.Header.Get("Location"))
+	})
+
+	t.Run("StableNames", func(t *testing.T) {
+		// Files keep their names as others of the same name come and go
+		newest := uploadTestFile(t, ts, "app.txt", "newest release", map[string]string{"tag": "release/v1"})
+		tree := make(map[string]string)
+		syncTree(t, "/mirror/release%2Fv1/", "viewer-token", tree, "")
+		assert.Equal(t, "old release", tree["app.txt"])
+		assert.Equal(t, "new release", tree[newer["id"].(string)+"_app.txt"])
+		assert.Equal(t, "newest release", tree[newest["id"].(string)+"_app.txt"])
+
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+newer["id"].(string), nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		tree = make(map[string]string)
+		syncTree(t, "/mirror/release%2Fv1/", "viewer-token", tree, "")
+		assert.Equal(t, "old release", tree["app.txt"])
+		assert.Equal(t, "newest release", tree[newest["id"].(string)+"_app.txt"])
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		for _, path := range []string{"/mirror/missing.txt", "/mirror/release%2Fv1/missing.txt", "/mirror/secret.txt", "/mirror/a/b/c",
+			"/mirror/release%2Fv1/" + old["id"].(string) + "_app.txt"} {
+			resp, _ := mirror(t, http.MethodGet, path, "viewer-token", nil)
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+		}
+	})
+}
+
+func TestS3Gateway(t *testing.T) {
+	const accessKey, secretKey = "test-access-key", "test-secret-key"
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.S3AccessKeyID = accessKey
+		cfg.S3SecretAccessKey = secretKey
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// s3 signs requests the way S3 clients do
+	s3 := func(t *testing.T, method, path string, body []byte, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		now := time.Now().UTC()
+		sig := &sigV4{
+			date:          now.Format("20060102"),
+			scope:         now.Format("20060102") + "/us-east-1/s3/aws4_request",
+			signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+			amzDate:       now.Format(sigV4DateFormat),
+			payloadHash:   cmp.Or(req.Header.Get("X-Amz-Content-Sha256"), hashHex(body)),
+		}
+		req.Header.Set("X-Amz-Date", sig.amzDate)
+		req.Header.Set("X-Amz-Content-Sha256", sig.payloadHash)
+		stringToSign := strings.Join([]string{sigV4Algorithm, sig.amzDate, sig.scope, hashHex([]byte(canonicalRequest(req, sig)))}, "\n")
+		signature := hex.EncodeToString(hmacSHA256(sig.signingKey(secretKey), stringToSign))
+		req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			sigV4Algorithm, accessKey, sig.scope, strings.Join(sig.signedHeaders, ";"), signature))
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(content)
+	}
+
+	t.Run("Unsigned", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/s3/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/s3/", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Amz-Date", time.Now().UTC().Format(sigV4DateFormat))
+		req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+		req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+time.Now().UTC().Format("20060102")+
+			"/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=0000")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Contains(t, string(body), "<Code>SignatureDoesNotMatch</Code>")
+	})
+
+	t.Run("PutAndGet", func(t *testing.T) {
+		resp, _ := s3(t, http.MethodPut, "/s3/backups/db/2024/dump.sql", []byte("first"), map[string]string{"Content-Type": "text/plain"})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		time.Sleep(time.Millisecond)
+		resp, _ = s3(t, http.MethodPut, "/s3/backups/db/2024/dump.sql", []byte("second"), map[string]string{"Content-Type": "text/plain"})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		etag := resp.Header.Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		resp, body := s3(t, http.MethodGet, "/s3/backups/db/2024/dump.sql", nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "second", body)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+		resp, body = s3(t, http.MethodGet, "/s3/backups/db/2024/dump.sql", nil, map[string]string{"Range": "bytes=1-3"})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "eco", body)
+
+		resp, _ = s3(t, http.MethodHead, "/s3/backups/db/2024/dump.sql", nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "6", resp.Header.Get("Content-Length"))
+
+		resp, body = s3(t, http.MethodGet, "/s3/backups/missing", nil, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Contains(t, body, "<Code>NoSuchKey</Code>")
+	})
+
+	t.Run("ConditionalPut", func(t *testing.T) {
+		resp, _ := s3(t, http.MethodPut, "/s3/locks/state", []byte("held"), map[string]string{"If-None-Match": "*"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp, _ = s3(t, http.MethodPut, "/s3/locks/state", []byte("held"), map[string]string{"If-None-Match": "*"})
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	})
+
+	t.Run("PayloadMismatch", func(t *testing.T) {
+		resp, body := s3(t, http.MethodPut, "/s3/backups/tampered", []byte("tampered"),
+			map[string]string{"X-Amz-Content-Sha256": hashHex([]byte("original"))})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, body, "<Code>XAmzContentSHA256Mismatch</Code>")
+	})
+
+	t.Run("List", func(t *testing.T) {
+		s3(t, http.MethodPut, "/s3/backups/db/2025/dump.sql", []byte("third"), nil)
+		s3(t, http.MethodPut, "/s3/backups/readme.txt", []byte("readme"), nil)
+
+		resp, body := s3(t, http.MethodGet, "/s3/backups?list-type=2&delimiter=/", nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "<KeyCount>2</KeyCount>")
+		assert.Contains(t, body, "<Key>readme.txt</Key>")
+		assert.Contains(t, body, "<CommonPrefixes><Prefix>db/</Prefix></CommonPrefixes>")
+
+		resp, body = s3(t, http.MethodGet, "/s3/backups?list-type=2&prefix=db/", nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "<Key>db/2024/dump.sql</Key>")
+		assert.Contains(t, body, "<Key>db/2025/dump.sql</Key>")
+		assert.Contains(t, body, "<Size>6</Size>")
+		assert.NotContains(t, body, "readme.txt")
+
+		resp, body = s3(t, http.MethodGet, "/s3/backups?list-type=2&max-keys=1", nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "<IsTruncated>true</IsTruncated>")
+		start := strings.Index(body, "<NextContinuationToken>") + len("<NextContinuationToken>")
+		token := body[start:strings.Index(body, "</NextContinuationToken>")]
+
+		resp, body = s3(t, http.MethodGet, "/s3/backups?list-type=2&max-keys=1&continuation-token="+token, nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "<Key>db/2025/dump.sql</Key>")
+
+		resp, body = s3(t, http.MethodGet, "/s3/backups?marker=db/2025/dump.sql", nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "<Key>readme.txt</Key>")
+		assert.NotContains(t, body, "dump.sql</Key>")
+
+		resp, body = s3(t, http.MethodGet, "/s3/", nil, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, "<Name>backups</Name>")
+		assert.Contains(t, body, "<Name>locks</Name>")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		resp, _ := s3(t, http.MethodDelete, "/s3/backups/db/2024/dump.sql", nil, nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		resp, _ = s3(t, http.MethodGet, "/s3/backups/db/2024/dump.sql", nil, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		resp, _ = s3(t, http.MethodDelete, "/s3/backups/db/2024/dump.sql", nil, nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+}
+
+// fakeClamd answers clamd pings and INSTREAM scans, finding malware in
+// content containing "EICAR"
+func fakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			var content bytes.Buffer
+			command, err := reader.ReadString(0)
+			if command == "zPING\x00" {
+				conn.Write([]byte("PONG\x00"))
+				conn.Close()
+				continue
+			}
+			if err == nil {
+				for {
+					var size uint32
+					if err := binary.Read(reader, binary.BigEndian, &size); err != nil || size == 0 {
+						break
+					}
+					io.CopyN(&content, reader, int64(size))
+				}
+			}
+			if strings.Contains(content.String(), "EICAR") {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestVirusScanning(t *testing.T) {
+	clamd := fakeClamd(t)
+
+	t.Run("Reject", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.ClamAVAddr = clamd
+			cfg.ClamAVAction = files.ScanActionReject
+			cfg.ClamAVTimeout = time.Second
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL + "/readyz")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		clean := uploadTestFile(t, ts, "clean.txt", "hello", nil)
+		scan, ok := clean["scan"].(map[string]any)
+		require.True(t, ok, clean)
+		assert.Equal(t, files.ScanClean, scan["status"])
+		assert.NotEmpty(t, scan["scanned_at"])
+
+		resp = postTestFile(t, ts, "virus.com", "X5O!P%@AP EICAR test", nil)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		assert.Contains(t, string(body), "Eicar-Test-Signature")
+	})
+
+	t.Run("Quarantine", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.ClamAVAddr = clamd
+			cfg.ClamAVAction = files.ScanActionQuarantine
+			cfg.ClamAVTimeout = time.Second
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		infected := uploadTestFile(t, ts, "virus.com", "X5O!P%@AP EICAR test", nil)
+		assert.Equal(t, files.StatusQuarantined, infected["status"])
+		scan, ok := infected["scan"].(map[string]any)
+		require.True(t, ok, infected)
+		assert.Equal(t, files.ScanInfected, scan["status"])
+		assert.Equal(t, "Eicar-Test-Signature", scan["signature"])
+
+		resp, err := http.Get(ts.URL + infected["url"].(string))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusLocked, resp.StatusCode)
+		assert.Equal(t, files.StatusQuarantined, resp.Header.Get("X-Files-Stash-Reason"))
+
+		resp = adminRequest(t, http.MethodGet, ts.URL+"/v1/files/"+infected["id"].(string)+"/metadata", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var metadata files.File
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&metadata))
+		require.NotNil(t, metadata.Scan)
+		assert.Equal(t, "Eicar-Test-Signature", metadata.Scan.Signature)
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := listener.Addr().String()
+		listener.Close()
+
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.ClamAVAddr = "tcp://" + addr
+			cfg.ClamAVAction = files.ScanActionReject
+			cfg.ClamAVTimeout = time.Second
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		resp := postTestFile(t, ts, "clean.txt", "hello", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+		resp, err = http.Get(ts.URL + "/readyz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var health files.Health
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		i := slices.IndexFunc(health.Checks, func(check *files.HealthCheck) bool { return check.Name == files.CheckScanner })
+		require.GreaterOrEqual(t, i, 0)
+		assert.False(t, health.Checks[i].OK)
+	})
+}
+
+func TestCompressionAtRest(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		onDisk(t, cfg)
+		cfg.Compression = true
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	log := strings.Repeat("INFO request served\n", 30)
+	uploaded := uploadTestFile(t, ts, "build.log", log, nil)
+	assert.EqualValues(t, len(log), uploaded["size"])
+	assert.Less(t, uploaded["stored_size"], float64(len(log))/2)
+
+	resp := adminRequest(t, http.MethodGet, ts.URL+"/v1/files/"+uploaded["id"].(string)+"/metadata", nil)
+	defer resp.Body.Close()
+	var metadata files.File
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metadata))
+	assert.EqualValues(t, len(log), metadata.Size)
+	assert.EqualValues(t, uploaded["stored_size"], metadata.StoredSize)
+
+	resp, err := http.Get(ts.URL + uploaded["url"].(string))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, log, string(body))
+
+	// Ranges are read from the decompressed content
+	resp = adminRequest(t, http.MethodPost, ts.URL+"/v1/files/"+uploaded["id"].(string)+"/links?range=20-38", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var link struct {
+		URL string `json:"url"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&link))
+	resp.Body.Close()
+	resp, err = http.Get(ts.URL + link.URL)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "INFO request served", string(body))
+
+	// Images are compressed already
+	png := uploadTestFileWithType(t, ts, "image.png", "image/png", "\x89PNG\r\n\x1a\n"+strings.Repeat("x", 200), nil)
+	assert.Equal(t, png["size"], png["stored_size"])
+}
+
+func TestDownloadCompression(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.DownloadCompression = true
+		cfg.CompressibleMimeTypes = []string{"text/*", "application/json"}
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	log := strings.Repeat("INFO request served\n", 30)
+	uploaded := uploadTestFile(t, ts, "build.log", log, nil)
+	image := uploadTestFileWithType(t, ts, "image.png", "image/png", "\x89PNG\r\n\x1a\n"+strings.Repeat("x", 600), nil)
+	small := uploadTestFile(t, ts, "small.txt", "tiny", nil)
+
+	download := func(t *testing.T, url, accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+url, nil)
+		require.NoError(t, err)
+		// Setting the header keeps the client from decoding the body
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	t.Run("Gzip", func(t *testing.T) {
+		resp, body := download(t, uploaded["url"].(string), "gzip")
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Less(t, len(body), len(log))
+
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		decoded, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, log, string(decoded))
+	})
+
+	t.Run("Zstd", func(t *testing.T) {
+		resp, body := download(t, uploaded["url"].(string), "gzip;q=0.5, zstd")
+		assert.Equal(t, "zstd", resp.Header.Get("Content-Encoding"))
+
+		decoder, err := zstd.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		defer decoder.Close()
+		decoded, err := io.ReadAll(decoder)
+		require.NoError(t, err)
+		assert.Equal(t, log, string(decoded))
+	})
+
+	t.Run("NotAccepted", func(t *testing.T) {
+		resp, body := download(t, uploaded["url"].(string), "identity")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Equal(t, strconv.Itoa(len(log)), resp.Header.Get("Content-Length"))
+		assert.Equal(t, log, string(body))
+	})
+
+	t.Run("NotCompressible", func(t *testing.T) {
+		resp, _ := download(t, image["url"].(string), "gzip")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Empty(t, resp.Header.Get("Vary"))
+
+		resp, body := download(t, small["url"].(string), "gzip")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "tiny", string(body))
+	})
+}
+
+// signJWT encodes claims into a token signed with sign, which gets the
+// signing input and returns the signature
+func signJWT(t *testing.T, header, claims map[string]any, sign func(input []byte) []byte) string {
+	headerJSON, err := json.Marshal(header)
+	require.NoError(t, err)
+	claimsJSON, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func TestJWTAuth(t *testing.T) {
+	const secret = "jwt-secret"
+	hs256 := func(claims map[string]any) string {
+		return signJWT(t, map[string]any{"alg": "HS256", "typ": "JWT"}, claims, func(input []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(input)
+			return mac.Sum(nil)
+		})
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rs256 := func(kid string, key *rsa.PrivateKey, claims map[string]any) string {
+		return signJWT(t, map[string]any{"alg": "RS256", "kid": kid}, claims, func(input []byte) []byte {
+			digest := sha256.Sum256(input)
+			signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+			require.NoError(t, err)
+			return signature
+		})
+	}
+	var jwksFetches atomic.Int32
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksFetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]any{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwksServer.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.JWTSecret = secret
+		cfg.JWKSURL = jwksServer.URL
+		cfg.JWTIssuer = "https://idp.example.com"
+		cfg.JWTAudience = "files-stash"
+		cfg.JWTScopeClaim = "scope"
+		cfg.JWTAdminScope = "stash:admin"
+		cfg.JWTViewerScope = "stash:read"
+		cfg.JWTUploadScope = "stash:upload"
+		cfg.JWTNamespaceClaim = "stash_namespace"
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	claims := func(scope string, changes map[string]any) map[string]any {
+		c := map[string]any{
+			"sub":   "alice",
+			"iss":   "https://idp.example.com",
+			"aud":   []string{"files-stash", "other"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": scope,
+		}
+		maps.Copy(c, changes)
+		return c
+	}
+	status := func(method, path, token string) int {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("Scopes", func(t *testing.T) {
+		admin := hs256(claims("openid stash:admin", nil))
+		assert.Equal(t, http.StatusOK, status("GET", "/v1/files", admin))
+		assert.Equal(t, http.StatusOK, status("GET", "/v1/admin/mode", admin))
+
+		viewer := hs256(claims("stash:read", nil))
+		assert.Equal(t, http.StatusOK, status("GET", "/v1/files", viewer))
+		assert.Equal(t, http.StatusForbidden, status("GET", "/v1/admin/mode", viewer))
+
+		assert.Equal(t, http.StatusUnauthorized, status("GET", "/v1/files", hs256(claims("openid", nil))))
+	})
+
+	t.Run("RS256", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, status("GET", "/v1/admin/mode", rs256("key-1", key, claims("stash:admin", nil))))
+		assert.Equal(t, http.StatusUnauthorized, status("GET", "/v1/files", rs256("key-2", key, claims("stash:admin", nil))))
+
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, status("GET", "/v1/files", rs256("key-1", other, claims("stash:admin", nil))))
+
+		// The key set is cached, and an unknown key doesn't refetch it on
+		// every request
+		assert.EqualValues(t, 1, jwksFetches.Load())
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		for name, token := range map[string]string{
+			"Expired":       hs256(claims("stash:admin", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})),
+			"NoExpiry":      hs256(claims("stash:admin", map[string]any{"exp": nil})),
+			"NotYetValid":   hs256(claims("stash:admin", map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})),
+			"WrongIssuer":   hs256(claims("stash:admin", map[string]any{"iss": "https://evil.example.com"})),
+			"WrongAudience": hs256(claims("stash:admin", map[string]any{"aud": "other"})),
+			"BadSignature":  hs256(claims("stash:admin", nil))[:10] + "x" + hs256(claims("stash:admin", nil))[11:],
+			"AlgNone":       signJWT(t, map[string]any{"alg": "none"}, claims("stash:admin", nil), func([]byte) []byte { return nil }),
+			"Garbage":       "not-a-token",
+		} {
+			assert.Equal(t, http.StatusUnauthorized, status("GET", "/v1/files", token), name)
+		}
+	})
+
+	t.Run("Uploads", func(t *testing.T) {
+		post := func(token string) (int, map[string]any) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			require.NoError(t, writer.WriteField("tag", "builds"))
+			part, err := writer.CreateFormFile("file", "build.log")
+			require.NoError(t, err)
+			_, err = io.WriteString(part, "built")
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var file map[string]any
+			if resp.StatusCode == http.StatusCreated {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&file))
+			}
+			return resp.StatusCode, file
+		}
+
+		// Uploads go under the namespace of the token
+		uploader := hs256(claims("stash:upload", map[string]any{"stash_namespace": "team-a/"}))
+		code, file := post(uploader)
+		require.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, "team-a/builds", file["tag"])
+
+		// Uploading is all the scope grants
+		assert.Equal(t, http.StatusUnauthorized, status("GET", "/v1/files", uploader))
+		assert.Equal(t, http.StatusUnauthorized, status("DELETE", "/v1/files/"+file["id"].(string), uploader))
+
+		// A token without a namespace would store files anywhere
+		code, _ = post(hs256(claims("stash:upload", nil)))
+		assert.Equal(t, http.StatusUnauthorized, code)
+
+		// Admins aren't confined to a namespace
+		code, file = post(hs256(claims("stash:admin stash:upload", map[string]any{"stash_namespace": "team-a"})))
+		require.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, "builds", file["tag"])
+	})
+
+	t.Run("StaticTokens", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, status("GET", "/v1/admin/mode", adminToken))
+	})
+}
+
+func TestJWKSFetch(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]any{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwksServer.Close()
+	keys := &jwks{url: jwksServer.URL, client: jwksServer.Client()}
+
+	t.Run("OneFetchAtATime", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Go(func() {
+				found, err := keys.key("key-1")
+				assert.NoError(t, err)
+				assert.Equal(t, key.N, found.N)
+			})
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		assert.EqualValues(t, 1, fetches.Load())
+	})
+
+	t.Run("RefreshDoesNotBlock", func(t *testing.T) {
+		release = make(chan struct{})
+		defer close(release)
+		keys.mu.Lock()
+		keys.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+		keys.mu.Unlock()
+
+		// The known key is used while the stale set is fetched again
+		found, err := keys.key("key-1")
+		require.NoError(t, err)
+		assert.Equal(t, key.N, found.N)
+		assert.Eventually(t, func() bool { return fetches.Load() == 2 }, time.Second, 5*time.Millisecond)
+		found, err = keys.key("")
+		require.NoError(t, err)
+		assert.Equal(t, key.N, found.N)
+	})
+}
+
+// issueClientCert creates a client certificate signed by the CA, or
+// self-signed when ca is nil
+func issueClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string, emails []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: commonName},
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestCA creates a CA for client certificates and writes it to a file
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600))
+	return ca, caKey, caFile
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca, caKey, caFile := newTestCA(t)
+
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer collector.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ClientCAFile = caFile
+		cfg.AdminCertIdentities = []string{"deploy-bot", "ops@example.com"}
+		cfg.SIEMAddr = "udp://" + collector.LocalAddr().String()
+		cfg.SIEMFormat = "json"
+	})
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	request := func(method, path string, cert *tls.Certificate, token string) int {
+		client := ts.Client()
+		if cert != nil {
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+			client = &http.Client{Transport: transport}
+		}
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	receive := func(t *testing.T) map[string]any {
+		buf := make([]byte, 4096)
+		require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := collector.ReadFrom(buf)
+		require.NoError(t, err)
+		_, payload, ok := strings.Cut(string(buf[:n]), " - ")
+		require.True(t, ok)
+		var event map[string]any
+		require.NoError(t, json.Unmarshal([]byte(payload), &event))
+		return event
+	}
+
+	t.Run("Admitted", func(t *testing.T) {
+		bot := issueClientCert(t, ca, caKey, "deploy-bot", nil)
+		assert.Equal(t, http.StatusOK, request("GET", "/v1/admin/mode", &bot, ""))
+		assert.Equal(t, http.StatusNotFound, request("DELETE", "/v1/searches/missing", &bot, ""))
+		event := receive(t)
+		assert.Equal(t, "admin_action", event["event"])
+		assert.Equal(t, "admin", event["user"])
+		assert.Equal(t, "deploy-bot", event["identity"])
+
+		// Without a common name, the email SAN is the identity
+		ops := issueClientCert(t, ca, caKey, "", []string{"ops@example.com"})
+		assert.Equal(t, http.StatusOK, request("GET", "/v1/admin/mode", &ops, ""))
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request("GET", "/v1/admin/mode", nil, adminToken))
+		assert.Equal(t, "auth_failure", receive(t)["event"])
+
+		stranger := issueClientCert(t, ca, caKey, "stranger", nil)
+		assert.Equal(t, http.StatusForbidden, request("GET", "/v1/admin/mode", &stranger, ""))
+		event := receive(t)
+		assert.Equal(t, "permission_denied", event["event"])
+		assert.Equal(t, "stranger", event["identity"])
+
+		// A certificate the CA didn't issue isn't one
+		selfSigned := issueClientCert(t, nil, nil, "deploy-bot", nil)
+		assert.Equal(t, http.StatusUnauthorized, request("GET", "/v1/admin/mode", &selfSigned, ""))
+		assert.Equal(t, "auth_failure", receive(t)["event"])
+	})
+
+	t.Run("OtherRoutes", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, request("GET", "/v1/files", nil, adminToken))
+		assert.Equal(t, http.StatusOK, request("GET", "/healthz", nil, ""))
+	})
+}
+
+// TestClientCertOtherProtocols checks that the admin token can't stand in
+// for a client certificate over gRPC and SFTP
+func TestClientCertOtherProtocols(t *testing.T) {
+	ca, caKey, caFile := newTestCA(t)
+
+	// The server certificate, issued for the loopback address
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serverDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "files-stash"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &serverKey.PublicKey, caKey)
+	require.NoError(t, err)
+	serverKeyDER, err := x509.MarshalPKCS8PrivateKey(serverKey)
+	require.NoError(t, err)
+	certFile := filepath.Join(t.TempDir(), "server.pem")
+	keyFile := filepath.Join(t.TempDir(), "server.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverDER}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: serverKeyDER}), 0o600))
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcAddr := free.Addr().String()
+	require.NoError(t, free.Close())
+	sftpAddr, hostKeyFile := sftpTestAddrs(t)
+
+	startTestApp(t, func(cfg *Config) {
+		cfg.ViewerToken = "viewer-token"
+		cfg.TLSCertFile = certFile
+		cfg.TLSKeyFile = keyFile
+		cfg.ClientCAFile = caFile
+		cfg.GRPCAddr = grpcAddr
+		cfg.SFTPAddr = sftpAddr
+		cfg.SFTPHostKeyFile = hostKeyFile
+	})
+
+	t.Run("GRPC", func(t *testing.T) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		dial := func(t *testing.T, certs ...tls.Certificate) filesv1.FilesServiceClient {
+			conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(grpccredentials.NewTLS(&tls.Config{
+				RootCAs:      roots,
+				Certificates: certs,
+			})))
+			require.NoError(t, err)
+			t.Cleanup(func() { conn.Close() })
+			return filesv1.NewFilesServiceClient(conn)
+		}
+		withToken := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+adminToken)
+
+		bot := dial(t, issueClientCert(t, ca, caKey, "deploy-bot", nil))
+		_, err := bot.Delete(context.Background(), &filesv1.DeleteRequest{Id: "missing"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		anonymous := dial(t)
+		_, err = anonymous.Delete(withToken, &filesv1.DeleteRequest{Id: "missing"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		_, err = anonymous.List(withToken, &filesv1.ListRequest{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("SFTP", func(t *testing.T) {
+		_, err := dialSFTP(t, sftpAddr, adminToken)
+		assert.Error(t, err)
+		_, err = dialSFTP(t, sftpAddr, "viewer-token")
+		assert.NoError(t, err)
+	})
+}
+
+func TestAdminNetworks(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.TrustedProxies = []string{"127.0.0.1"}
+		cfg.AdminAllowCIDRs = []string{"10.0.0.0/8", "2001:db8::/32"}
+		cfg.AdminDenyCIDRs = []string{"10.6.6.0/24", "10.7.7.7"}
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	request := func(method, url, forwardedFor string) *http.Response {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	for forwardedFor, want := range map[string]int{
+		"10.1.2.3":            http.StatusOK,
+		"192.0.2.1, 10.1.2.3": http.StatusOK, // as the proxy in front got it
+		"::ffff:10.1.2.3":     http.StatusOK,
+		"2001:db8::1":         http.StatusOK,
+		"10.7.7.8":            http.StatusOK,
+		"":                    http.StatusForbidden, // the loopback address of the test client
+		"192.0.2.1":           http.StatusForbidden,
+		"10.1.2.3, 192.0.2.1": http.StatusForbidden, // claimed by the client
+		"10.6.6.1":            http.StatusForbidden,
+		"10.7.7.7":            http.StatusForbidden,
+		"not-an-address":      http.StatusForbidden,
+	} {
+		resp := request("GET", ts.URL+"/v1/files", forwardedFor)
+		resp.Body.Close()
+		assert.Equal(t, want, resp.StatusCode, forwardedFor)
+	}
+
+	// Refused before the token is even checked, for viewer routes too
+	req, err := http.NewRequest("GET", ts.URL+"/v1/stats", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Signed downloads stay open
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "a.txt")
+	require.NoError(t, err)
+	io.WriteString(part, "content")
+	writer.Close()
+	req, err = http.NewRequest("POST", ts.URL+"/v1/files", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("X-Forwarded-For", "10.1.2.3")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var uploaded map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&uploaded))
+
+	download, err := http.Get(ts.URL + uploaded["url"].(string))
+	require.NoError(t, err)
+	download.Body.Close()
+	assert.Equal(t, http.StatusOK, download.StatusCode)
+
+	t.Run("InvalidCIDR", func(t *testing.T) {
+		assert.Panics(t, func() {
+			setupTestServerWithConfig(t, func(cfg *Config) {
+				cfg.AdminAllowCIDRs = []string{"10.0.0.0/33"}
+			})
+		})
+	})
+}
+
+func TestCORS(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.CORSAllowedOrigins = []string{"https://app.example.com"}
+		cfg.CORSAllowCredentials = true
+		cfg.CORSMaxAge = 10 * time.Minute
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	request := func(method, url, origin string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Preflight", func(t *testing.T) {
+		resp := request("OPTIONS", ts.URL+"/v1/files", "https://app.example.com", map[string]string{
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "authorization, content-type",
+		})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+		assert.Contains(t, resp.Header.Get("Access-Control-Allow-Methods"), "POST")
+		assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+		assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+		assert.Contains(t, resp.Header.Values("Vary"), "Origin")
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		uploaded := uploadTestFile(t, ts, "a.txt", "content", nil)
+		resp := request("GET", ts.URL+uploaded["url"].(string), "https://app.example.com", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Content-Disposition")
+	})
+
+	t.Run("OtherOrigin", func(t *testing.T) {
+		resp := request("OPTIONS", ts.URL+"/v1/files", "https://evil.example.com", map[string]string{
+			"Access-Control-Request-Method": "POST",
+		})
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+		resp = request("GET", ts.URL+"/healthz", "https://evil.example.com", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("AnyOrigin", func(t *testing.T) {
+		srv := setupTestServerWithConfig(t, func(cfg *Config) {
+			cfg.CORSAllowedOrigins = []string{"*"}
+		})
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		resp := request("GET", ts.URL+"/healthz", "https://anywhere.example.com", nil)
+		assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		srv := setupTestServer(t)
+		ts := httptest.NewServer(srv.Handler)
+		defer ts.Close()
+
+		resp := request("GET", ts.URL+"/healthz", "https://app.example.com", nil)
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestACME(t *testing.T) {
+	// Find a free port for the HTTP listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	httpAddr := listener.Addr().String()
+	listener.Close()
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ACMEHosts = []string{"files.example.com"}
+		cfg.ACMECacheDir = t.TempDir()
+		cfg.ACMEAddr = ":8443"
+		cfg.ACMEHTTPAddr = httpAddr
+	})
+
+	assert.Equal(t, ":8443", srv.Addr)
+	require.NotNil(t, srv.TLSConfig)
+	assert.Contains(t, srv.TLSConfig.NextProtos, "acme-tls/1")
+
+	// Only the configured hosts get certificates
+	_, err = srv.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	assert.Error(t, err)
+
+	// Plain HTTP requests are redirected to HTTPS
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req, err := http.NewRequest("GET", "http://"+httpAddr+"/v1/files?tag=docs", nil)
+	require.NoError(t, err)
+	req.Host = "files.example.com"
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://files.example.com/v1/files?tag=docs", resp.Header.Get("Location"))
+
+	t.Run("WithCertificateFile", func(t *testing.T) {
+		assert.Panics(t, func() {
+			setupTestServerWithConfig(t, func(cfg *Config) {
+				cfg.ACMEHosts = []string{"files.example.com"}
+				cfg.ACMECacheDir = t.TempDir()
+				cfg.TLSCertFile = "cert.pem"
+			})
+		})
+	})
+}
+
+func TestSearchFiles(t *testing.T) {
+	for name, configure := range map[string]func(cfg *Config){
+		"Memory": nil,
+		"Disk":   func(cfg *Config) { onDisk(t, cfg) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := setupTestServerWithConfig(t, configure)
+			ts := httptest.NewServer(srv.Handler)
+			defer ts.Close()
+
+			for i := range 5 {
+				uploadTestFile(t, ts, fmt.Sprintf("invoice-%d.pdf", i), "content", map[string]string{"tag": "billing"})
+			}
+			uploadTestFile(t, ts, "notes.txt", "content", map[string]string{"tag": "invoices", "attr.customer": "acme"})
+
+			search := func(query string) (int, files.SearchResult) {
+				resp := adminRequest(t, "GET", ts.URL+"/v1/files/search?"+query, nil)
+				defer resp.Body.Close()
+				var result files.SearchResult
+				if resp.StatusCode == http.StatusOK {
+					require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+				}
+				return resp.StatusCode, result
+			}
+
+			status, result := search("q=invoice")
+			require.Equal(t, http.StatusOK, status)
+			assert.Equal(t, 6, result.Total)
+			require.Len(t, result.Files, 6)
+			assert.Equal(t, "notes.txt", result.Files[5].Name, "tag matches rank below name matches")
+
+			status, result = search("q=invoice&limit=2&offset=4")
+			require.Equal(t, http.StatusOK, status)
+			assert.Equal(t, 6, result.Total)
+			assert.Len(t, result.Files, 2)
+			assert.Equal(t, 2, result.Limit)
+			assert.Equal(t, 4, result.Offset)
+
+			status, result = search("q=ACME")
+			require.Equal(t, http.StatusOK, status)
+			require.Len(t, result.Files, 1)
+			assert.Equal(t, "notes.txt", result.Files[0].Name)
+
+			status, result = search("q=nothing")
+			require.Equal(t, http.StatusOK, status)
+			assert.Equal(t, 0, result.Total)
+			assert.NotNil(t, result.Files)
+
+			status, _ = search("q=+")
+			assert.Equal(t, http.StatusBadRequest, status)
+			status, _ = search("q=invoice&limit=0")
+			assert.Equal(t, http.StatusBadRequest, status)
+		})
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(maxSize int, ttl string) {
+		content := fmt.Sprintf("admin_token: %s\nhmac_key: %s\nbackend: memory\nmax_size: %d\nttl: %s\n", adminToken, hmacKey, maxSize, ttl)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	writeConfig(1024, "5m")
+
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.ConfigFile = path
+		cfg.ConfigWatchInterval = 10 * time.Millisecond
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	upload := func(content string) int {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "large.bin")
+		require.NoError(t, err)
+		_, err = io.WriteString(part, content)
+		require.NoError(t, err)
+		writer.Close()
+
+		req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	large := strings.Repeat("x", 2048)
+	require.Equal(t, http.StatusRequestEntityTooLarge, upload(large))
+
+	// Raising the limit and the TTL takes effect without a restart
+	writeConfig(4096, "48h")
+	assert.Eventually(t, func() bool {
+		return upload(large) == http.StatusCreated
+	}, 2*time.Second, 20*time.Millisecond)
+
+	file := uploadTestFile(t, ts, "small.txt", "small", nil)
+	expiresAt, err := time.Parse(time.RFC3339Nano, file["expires_at"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(48*time.Hour), expiresAt, time.Minute)
+}
+
+func TestAdminListener(t *testing.T) {
+	// Take a free port for the admin listener
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	adminAddr := free.Addr().String()
+	require.NoError(t, free.Close())
+
+	app := startTestApp(t, func(cfg *Config) {
+		cfg.AdminListen = adminAddr
+	})
+	ts := &httptest.Server{URL: "http://" + app.Addr().String()}
+	admin := &httptest.Server{URL: "http://" + adminAddr}
+
+	uploaded := uploadTestFile(t, admin, "report.txt", "report", nil)
+	id := uploaded["id"].(string)
+
+	status := func(url string) int {
+		resp := adminRequest(t, "GET", url, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("public listener", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, status(ts.URL+"/healthz"))
+		assert.Equal(t, http.StatusOK, status(ts.URL+uploaded["url"].(string)))
+
+		// The admin surface isn't there, token or not
+		assert.Equal(t, http.StatusNotFound, status(ts.URL+"/v1/files"))
+		assert.Equal(t, http.StatusNotFound, status(ts.URL+"/v1/files/"+id+"/metadata"))
+		assert.Equal(t, http.StatusNotFound, status(ts.URL+"/v1/admin/stats"))
+		assert.Equal(t, http.StatusNotFound, status(ts.URL+"/metrics"))
+		resp := adminRequest(t, "DELETE", ts.URL+"/v1/files/"+id, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("admin listener", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, status(admin.URL+"/v1/files"))
+		assert.Equal(t, http.StatusOK, status(admin.URL+"/v1/files/"+id+"/metadata"))
+		assert.Equal(t, http.StatusOK, status(admin.URL+"/metrics"))
+		assert.Equal(t, http.StatusOK, status(admin.URL+uploaded["url"].(string)))
+	})
+}
+
+func TestAppStop(t *testing.T) {
+	cfg := &Config{
+		AdminToken:      adminToken,
+		HmacKey:         hmacKey,
+		MaxSize:         1024,
+		TTL:             5 * time.Minute,
+		Listen:          "127.0.0.1:0",
+		CleanupInterval: time.Minute,
+	}
+	onDisk(t, cfg)
+	app := NewApp(cfg, new(slog.LevelVar))
+
+	// Note when the upload reaches its handler
+	arrived := make(chan struct{})
+	handler := app.server.Handler
+	app.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			close(arrived)
+		}
+		handler.ServeHTTP(w, r)
+	})
+	require.NoError(t, app.Start())
+	url := "http://" + app.Addr().String()
+
+	// An event stream, which lasts until the server goes away
+	stream := adminRequest(t, "GET", url+"/v1/events", nil)
+	defer stream.Body.Close()
+	require.Equal(t, http.StatusOK, stream.StatusCode)
+
+	// An upload whose body is still arriving when the app is stopped
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	req, err := http.NewRequest("POST", url+"/v1/files", body)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	uploaded := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		uploaded <- resp
+	}()
+	part, err := form.CreateFormFile("file", "slow.txt")
+	require.NoError(t, err)
+	_, err = part.Write([]byte("first half, "))
+	require.NoError(t, err)
+	<-arrived
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		stopped <- app.Stop(ctx)
+	}()
+
+	// New connections are refused while the upload goes on
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", app.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned with a request in progress: %v", err)
+	default:
+	}
+
+	_, err = part.Write([]byte("second half"))
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+	require.NoError(t, writer.Close())
+
+	resp := <-uploaded
+	require.NotNil(t, resp)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, <-stopped)
+
+	// The event stream was ended rather than waited for
+	_, err = io.Copy(io.Discard, stream.Body)
+	assert.NoError(t, err)
+
+	// The repository is closed after the last request
+	_, err = app.repo.FindByID(context.Background(), "missing")
+	assert.ErrorContains(t, err, "database is closed")
+}
+
+func TestUploadTokens(t *testing.T) {
+	srv := setupTestServerWithConfig(t, func(cfg *Config) {
+		cfg.TTL = 24 * time.Hour
+		cfg.UploadTokens = map[string]string{"ci-web": "web-token", "ci-docs": "docs-token", "ci-api": "api-token"}
+		cfg.UploadTokenMaxSize = map[string]int64{"ci-web": 16}
+		cfg.UploadTokenMaxTTL = map[string]time.Duration{"ci-web": time.Hour}
+		cfg.UploadTokenTags = map[string]string{"ci-web": "web-*|shared"}
+		cfg.UploadTokenNamespaces = map[string]string{"ci-web": "web", "ci-api": "api"}
+		cfg.UploadTokenDefaultTTL = map[string]time.Duration{"ci-docs": 48 * time.Hour}
+	})
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	upload := func(t *testing.T, token, content string, fields map[string]string) (int, map[string]any) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		for k, v := range fields {
+			require.NoError(t, writer.WriteField(k, v))
+		}
+		part, err := writer.CreateFormFile("file", "build.txt")
+		require.NoError(t, err)
+		_, err = io.WriteString(part, content)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req, err := http.NewRequest("POST", ts.URL+"/v1/files", body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var result map[string]any
+		if resp.StatusCode == http.StatusCreated {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp.StatusCode, result
+	}
+	expiresIn := func(t *testing.T, result map[string]any) time.Duration {
+		expiresAt, err := time.Parse(time.RFC3339Nano, result["expires_at"].(string))
+		require.NoError(t, err)
+		return time.Until(expiresAt).Round(time.Hour)
+	}
+
+	t.Run("within the policy", func(t *testing.T) {
+		status, result := upload(t, "web-token", "small", map[string]string{"tag": "web-latest"})
+		require.Equal(t, http.StatusCreated, status)
+
+		// The tag is stored under the namespace, and the file expires
+		// within the maximum TTL
+		assert.Equal(t, "web/web-latest", result["tag"])
+		assert.Equal(t, time.Hour, expiresIn(t, result))
+
+		status, result = upload(t, "web-token", "small", map[string]string{"tag": "shared", "ttl": "30m"})
+		require.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, "web/shared", result["tag"])
+	})
+
+	t.Run("outside the policy", func(t *testing.T) {
+		for name, fields := range map[string]map[string]string{
+			"tag not allowed": {"tag": "api-latest"},
+			"untagged":        {},
+			"ttl too long":    {"tag": "shared", "ttl": "2h"},
+			"pinned":          {"tag": "shared", "pinned": "true"},
+		} {
+			status, _ := upload(t, "web-token", "small", fields)
+			assert.Equal(t, http.StatusForbidden, status, name)
+		}
+
+		status, _ := upload(t, "web-token", "larger than sixteen bytes", map[string]string{"tag": "shared"})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	})
+
+	t.Run("namespace without tags", func(t *testing.T) {
+		// Untagged files would escape the namespace
+		status, _ := upload(t, "api-token", "api", nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		status, result := upload(t, "api-token", "api", map[string]string{"tag": "latest"})
+		require.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, "api/latest", result["tag"])
+	})
+
+	t.Run("default TTL", func(t *testing.T) {
+		status, result := upload(t, "docs-token", "docs", nil)
+		require.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, 48*time.Hour, expiresIn(t, result))
+	})
+
+	t.Run("upload only", func(t *testing.T) {
+		for _, token := range []string{"web-token", "docs-token"} {
+			req, err := http.NewRequest("GET", ts.URL+"/v1/files", nil)
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+
+		// Admins aren't held to any policy
+		uploaded := uploadTestFile(t, ts, "big.txt", "larger than sixteen bytes", map[string]string{"tag": "api-latest"})
+		assert.Equal(t, "api-latest", uploaded["tag"])
+	})
+}
+
+func TestFileAccesses(t *testing.T) {
+	srv := setupTestServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	uploaded := uploadTestFile(t, ts, "build.zip", "build content", map[string]string{"tag": "nightly"})
+	id := uploaded["id"].(string)
+
+	download := func(url string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", "deploy-bot/1.0")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, download(ts.URL+uploaded["url"].(string)))
+	require.Equal(t, http.StatusNotFound, download(ts.URL+"/v1/files/"+id+"?signature=forged"))
+	require.Equal(t, http.StatusOK, download(ts.URL+"/v1/files/latest/nightly/content"))
+	require.Equal(t, http.StatusNotFound, download(ts.URL+"/v1/files/missing?signature=forged"))
+
+	accesses := func(t *testing.T, query string) files.AccessLog {
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files/"+id+"/accesses"+query, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var log files.AccessLog
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&log))
+		return log
+	}
+
+	t.Run("latest first", func(t *testing.T) {
+		log := accesses(t, "")
+		assert.Equal(t, 3, log.Total)
+		require.Len(t, log.Accesses, 3)
+		for _, access := range log.Accesses {
+			assert.Equal(t, "127.0.0.1", access.IP)
+			assert.Equal(t, "deploy-bot/1.0", access.UserAgent)
+			assert.WithinDuration(t, time.Now(), access.At, time.Minute)
+		}
+		assert.Equal(t, http.StatusOK, log.Accesses[0].Status)
+		assert.Equal(t, int64(len("build content")), log.Accesses[0].Bytes)
+		assert.Equal(t, http.StatusNotFound, log.Accesses[1].Status)
+		assert.Equal(t, http.StatusOK, log.Accesses[2].Status)
+	})
+
+	t.Run("paged", func(t *testing.T) {
+		log := accesses(t, "?limit=1&offset=1")
+		assert.Equal(t, 3, log.Total)
+		assert.Equal(t, 1, log.Limit)
+		require.Len(t, log.Accesses, 1)
+		assert.Equal(t, http.StatusNotFound, log.Accesses[0].Status)
+
+		resp := adminRequest(t, "GET", ts.URL+"/v1/files/"+id+"/accesses?limit=0", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("admins only", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/v1/files/" + id + "/accesses")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = adminRequest(t, "GET", ts.URL+"/v1/files/missing/accesses", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
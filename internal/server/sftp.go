@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/sftp"
+	"github.com/pavel-fokin/files-stash/internal/siem"
+)
+
+// sftpUserExtension carries the identity of an SFTP client from
+// authentication to its file system
+const sftpUserExtension = "files-stash-user"
+
+// newSFTPServer creates the SFTP server of cfg.SFTPAddr. It serves the
+// directory tree of WebDAV, a directory per tag, to clients whose password
+// is the admin or viewer token; the user name is ignored. Admins may upload,
+// delete and rename files; viewers only download those that aren't password
+// protected. Clients outside the admin network lists are refused, and so is
+// the admin token when admins must present a client certificate, which SSH
+// can't carry.
+func newSFTPServer(cfg *Config, creds *credentials, fileService *files.Service, events *siem.Emitter) (*sftp.Server, error) {
+	key, err := os.ReadFile(cfg.SFTPHostKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %w", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if !creds.networks.admitsAddr(conn.RemoteAddr()) {
+				events.Emit(siem.Event{
+					Type:       siem.EventPermissionDenied,
+					Protocol:   "sftp",
+					RemoteAddr: conn.RemoteAddr().String(),
+					Method:     "SSH",
+					Path:       "/",
+				})
+				return nil, errors.New("address not allowed")
+			}
+			var user string
+			switch {
+			case len(password) > 0 && subtle.ConstantTimeCompare(password, []byte(cfg.AdminToken)) == 1 && !creds.clientCerts:
+				user = adminUser
+			case len(password) > 0 && subtle.ConstantTimeCompare(password, []byte(cfg.ViewerToken)) == 1:
+				user = viewerUser
+			default:
+				events.Emit(siem.Event{
+					Type:       siem.EventAuthFailure,
+					Protocol:   "sftp",
+					RemoteAddr: conn.RemoteAddr().String(),
+					Method:     "SSH",
+					Path:       "/",
+				})
+				return nil, errors.New("invalid token")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{sftpUserExtension: user}}, nil
+		},
+		ServerVersion: "SSH-2.0-files-stash",
+	}
+	config.AddHostKey(signer)
+
+	return sftp.NewServer(config, func(ctx context.Context, conn *ssh.ServerConn) pkgsftp.Handlers {
+		user := conn.Permissions.Extensions[sftpUserExtension]
+		handler := &sftpFS{
+			ctx: context.WithValue(ctx, userContextKey, user),
+			dav: &davFS{
+				fileService: fileService,
+				viewer:      user != adminUser,
+				writable:    user == adminUser,
+				origin:      sftpOrigin(cfg, conn),
+				maxSize:     cfg.maxSize(),
+			},
+			events:     events,
+			remoteAddr: conn.RemoteAddr().String(),
+		}
+		return pkgsftp.Handlers{FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler}
+	}), nil
+}
+
+// sftpOrigin returns the origin recorded for uploads over an SFTP
+// connection, with the client's SSH version for its user agent
+func sftpOrigin(cfg *Config, conn ssh.ConnMetadata) *files.Origin {
+	var origin files.Origin
+	for _, field := range cfg.OriginFields {
+		switch field {
+		case "ip":
+			origin.IP = normalizeIP(conn.RemoteAddr().String())
+		case "user_agent":
+			origin.UserAgent = string(conn.ClientVersion())
+		}
+	}
+	return &origin
+}
+
+// sftpFS is the WebDAV view of the stash for an SFTP connection, serving
+// its requests
+type sftpFS struct {
+	ctx        context.Context
+	dav        *davFS
+	events     *siem.Emitter
+	remoteAddr string
+}
+
+func (f *sftpFS) Fileread(r *pkgsftp.Request) (io.ReaderAt, error) {
+	file, err := f.dav.OpenFile(f.ctx, r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return &sftpDownload{file: file}, nil
+}
+
+func (f *sftpFS) Filewrite(r *pkgsftp.Request) (io.WriterAt, error) {
+	file, err := f.dav.create(f.ctx, r.Filepath)
+	f.audit(http.MethodPut, r.Filepath, err)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return &sftpUpload{upload: file.(*davUpload), pending: make(map[int64][]byte)}, nil
+}
+
+func (f *sftpFS) Filecmd(r *pkgsftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// Files that exist are left as they are: the stash keeps neither
+		// permissions nor times of its clients' choosing
+		_, err := f.dav.Stat(f.ctx, r.Filepath)
+		return sftpError(err)
+	case "Rename":
+		err := f.dav.Rename(f.ctx, r.Filepath, r.Target)
+		f.audit("MOVE", r.Filepath, err)
+		return sftpError(err)
+	case "Remove", "Rmdir":
+		err := f.dav.RemoveAll(f.ctx, r.Filepath)
+		f.audit(http.MethodDelete, r.Filepath, err)
+		return sftpError(err)
+	case "Mkdir":
+		return sftpError(f.dav.Mkdir(f.ctx, r.Filepath, 0))
+	}
+	return pkgsftp.ErrSSHFxOpUnsupported
+}
+
+func (f *sftpFS) Filelist(r *pkgsftp.Request) (pkgsftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		file, err := f.dav.OpenFile(f.ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		defer file.Close()
+		entries, err := file.Readdir(-1)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpListing(entries), nil
+	case "Stat", "Lstat":
+		info, err := f.dav.Stat(f.ctx, r.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpListing{info}, nil
+	}
+	return nil, pkgsftp.ErrSSHFxOpUnsupported
+}
+
+// audit sends a security event for a change refused to a viewer or made by
+// an admin, as the HTTP API does
+func (f *sftpFS) audit(method, name string, err error) {
+	user := userFromContext(f.ctx)
+	event := siem.Event{Protocol: "sftp", User: user, RemoteAddr: f.remoteAddr, Method: method, Path: name}
+	switch {
+	case errors.Is(err, fs.ErrPermission) && user != adminUser:
+		event.Type = siem.EventPermissionDenied
+	case err == nil && user == adminUser:
+		event.Type = siem.EventAdminAction
+	default:
+		return
+	}
+	f.events.Emit(event)
+}
+
+// sftpError maps the errors of the WebDAV view to SFTP statuses
+func sftpError(err error) error {
+	switch {
+	case errors.Is(err, files.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return pkgsftp.ErrSSHFxNoSuchFile
+	case errors.Is(err, fs.ErrPermission):
+		return pkgsftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+// sftpListing lists a directory, or the file a client stats
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	return copy(entries, l[offset:]), nil
+}
+
+// sftpDownloadWindow is how far behind the stream of a download reads may
+// fall without reopening it
+const sftpDownloadWindow = 4 << 20
+
+// sftpDownload reads a stored file at the offsets of SFTP reads, which
+// clients send several at a time and may arrive out of order. The bytes
+// most recently read from the stream are kept, so a read falling behind
+// doesn't reopen it.
+type sftpDownload struct {
+	mu     sync.Mutex
+	file   webdav.File
+	window []byte // read from the stream, up to offset
+	start  int64  // of window[0]
+	offset int64  // of the stream
+}
+
+func (d *sftpDownload) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if off < d.start || off > d.offset+sftpDownloadWindow {
+		if _, err := d.file.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		d.window, d.start, d.offset = d.window[:0], off, off
+	}
+	end := off + int64(len(p))
+	var err error
+	for d.offset < end && err == nil {
+		need := int(end - d.offset)
+		d.window = slices.Grow(d.window, need)
+		var n int
+		n, err = d.file.Read(d.window[len(d.window) : len(d.window)+need])
+		d.window = d.window[:len(d.window)+n]
+		d.offset += int64(n)
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	var n int
+	if off < d.offset {
+		n = copy(p, d.window[off-d.start:])
+	}
+	// Trimming past twice the window keeps the copying down
+	if len(d.window) > 2*sftpDownloadWindow {
+		drop := len(d.window) - sftpDownloadWindow
+		d.window = append(d.window[:0], d.window[drop:]...)
+		d.start += int64(drop)
+	}
+	if n < len(p) {
+		return n, cmp.Or(err, io.EOF)
+	}
+	return n, nil
+}
+
+func (d *sftpDownload) Close() error {
+	return d.file.Close()
+}
+
+// sftpUploadBuffer bounds the writes of an upload held back until the ones
+// before them arrive
+const sftpUploadBuffer = 16 << 20
+
+// errSFTPWriteOrder fails uploads written other than front to back
+var errSFTPWriteOrder = errors.New("writes must go from the start to the end of the file")
+
+// sftpUpload streams the SFTP writes of a file to its upload. Clients send
+// several writes at a time, which may arrive out of order, so writes
+// beyond the end of what's been streamed are held back until the gap is
+// filled.
+type sftpUpload struct {
+	mu       sync.Mutex
+	upload   *davUpload
+	offset   int64 // streamed
+	pending  map[int64][]byte
+	buffered int64
+	err      error // fails the upload
+}
+
+func (u *sftpUpload) WriteAt(p []byte, off int64) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.err != nil {
+		return 0, u.err
+	}
+	switch {
+	case off < u.offset:
+		u.err = errSFTPWriteOrder
+	case off > u.offset:
+		if u.buffered+int64(len(p)) > sftpUploadBuffer {
+			u.err = errSFTPWriteOrder
+			break
+		}
+		// The client reuses p once the write is acknowledged
+		u.pending[off] = bytes.Clone(p)
+		u.buffered += int64(len(p))
+	default:
+		u.write(p)
+		for u.err == nil {
+			next, ok := u.pending[u.offset]
+			if !ok {
+				break
+			}
+			delete(u.pending, u.offset)
+			u.buffered -= int64(len(next))
+			u.write(next)
+		}
+	}
+	if u.err != nil {
+		return 0, u.err
+	}
+	return len(p), nil
+}
+
+func (u *sftpUpload) write(p []byte) {
+	n, err := u.upload.Write(p)
+	u.offset += int64(n)
+	u.err = err
+}
+
+// TransferError aborts an upload the client didn't close
+func (u *sftpUpload) TransferError(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.err = cmp.Or(u.err, err)
+}
+
+func (u *sftpUpload) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.err == nil && len(u.pending) > 0 {
+		u.err = errSFTPWriteOrder
+	}
+	if u.err != nil {
+		u.upload.Abort()
+		return u.err
+	}
+	return u.upload.Close()
+}
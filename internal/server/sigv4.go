@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, as used by S3 clients
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4DateFormat = "20060102T150405Z"
+
+	// sigV4MaxSkew is how far a request's date may be from the server's clock
+	sigV4MaxSkew = 15 * time.Minute
+	// sigV4MaxExpires is the longest a presigned URL may be valid, as on S3
+	sigV4MaxExpires = 7 * 24 * time.Hour
+
+	// Values of X-Amz-Content-Sha256 other than the payload's hash
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedPayload = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// emptySHA256 is the hash of an empty payload
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// sigV4 is the signature of a request, from its Authorization header or,
+// for presigned URLs, its query
+type sigV4 struct {
+	accessKey     string
+	date          string // of the credential scope, YYYYMMDD
+	scope         string // date/region/service/aws4_request
+	signedHeaders []string
+	signature     string
+	amzDate       string // of the request, in sigV4DateFormat
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration // of presigned URLs
+}
+
+// parseSigV4 reads the signature of a request
+func parseSigV4(r *http.Request) (*sigV4, *s3Error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, s3ErrInvalidRequest("Unsupported signature algorithm")
+		}
+		sig := &sigV4{
+			signature:   query.Get("X-Amz-Signature"),
+			amzDate:     query.Get("X-Amz-Date"),
+			payloadHash: unsignedPayload,
+			presigned:   true,
+		}
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds <= 0 {
+			return nil, s3ErrInvalidRequest("Invalid X-Amz-Expires")
+		}
+		if time.Duration(seconds)*time.Second > sigV4MaxExpires {
+			return nil, s3ErrInvalidRequest("X-Amz-Expires must be less than a week (in seconds) that is 604800")
+		}
+		sig.expires = time.Duration(seconds) * time.Second
+		if err := sig.setCredential(query.Get("X-Amz-Credential")); err != nil {
+			return nil, err
+		}
+		sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+		return sig, nil
+	}
+
+	params, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ")
+	if !ok {
+		return nil, s3ErrAccessDenied
+	}
+	sig := &sigV4{
+		amzDate:     r.Header.Get("X-Amz-Date"),
+		payloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch key {
+		case "Credential":
+			if err := sig.setCredential(value); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			sig.signature = value
+		}
+	}
+	if sig.payloadHash == "" {
+		return nil, s3ErrInvalidRequest("Missing X-Amz-Content-Sha256")
+	}
+	return sig, nil
+}
+
+// setCredential parses a "key/date/region/service/aws4_request" credential
+func (sig *sigV4) setCredential(credential string) *s3Error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return s3ErrInvalidRequest("Malformed credential")
+	}
+	sig.accessKey = parts[0]
+	sig.date = parts[1]
+	sig.scope = strings.Join(parts[1:], "/")
+	return nil
+}
+
+// verify checks the signature was made with secret for the request,
+// within the allowed clock skew of now
+func (sig *sigV4) verify(r *http.Request, secret string, now time.Time) *s3Error {
+	signed, err := time.Parse(sigV4DateFormat, sig.amzDate)
+	if err != nil || !strings.HasPrefix(sig.amzDate, sig.date) {
+		return s3ErrAccessDenied
+	}
+	if sig.presigned {
+		// A URL can't be signed ahead of time to outlive its expiry
+		if signed.Sub(now) > sigV4MaxSkew {
+			return &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+		}
+		if now.After(signed.Add(sig.expires)) {
+			return &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+		}
+	} else if now.Sub(signed).Abs() > sigV4MaxSkew {
+		return &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	}
+	if !slices.Contains(sig.signedHeaders, "host") {
+		return s3ErrAccessDenied
+	}
+
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		sig.amzDate,
+		sig.scope,
+		hashHex([]byte(canonicalRequest(r, sig))),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(sig.signingKey(secret), stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	}
+	return nil
+}
+
+// signingKey derives the key of the credential scope from secret
+func (sig *sigV4) signingKey(secret string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(sig.scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+// canonicalRequest builds the canonical form of a request that is signed
+func canonicalRequest(r *http.Request, sig *sigV4) string {
+	var headers strings.Builder
+	for _, name := range sig.signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = r.Header.Get("Content-Length")
+			if value == "" && r.ContentLength >= 0 {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		default:
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.Join(strings.Fields(value), " "))
+	}
+
+	uri := awsEscape(r.URL.Path, false)
+	if uri == "" {
+		uri = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		uri,
+		canonicalQuery(r, sig.presigned),
+		headers.String(),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+// canonicalQuery sorts and encodes the query parameters, leaving out the
+// signature of presigned URLs
+func canonicalQuery(r *http.Request, presigned bool) string {
+	var pairs []string
+	for key, values := range r.URL.Query() {
+		if presigned && key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters and,
+// unless encodeSlash is set, slashes
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// payload reads the request body, checking it against the signed payload
+// hash and decoding aws-chunked bodies, whose chunks are verified with
+// secret
+func (sig *sigV4) payload(r *http.Request, secret string) ([]byte, *s3Error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, s3ErrInvalidRequest("Failed to read request body")
+	}
+
+	switch sig.payloadHash {
+	case unsignedPayload:
+	case streamingPayload:
+		body, err = decodeAWSChunked(body, func(chunk []byte, signature, previous string) bool {
+			stringToSign := strings.Join([]string{
+				sigV4Algorithm + "-PAYLOAD",
+				sig.amzDate,
+				sig.scope,
+				previous,
+				emptySHA256,
+				hashHex(chunk),
+			}, "\n")
+			expected := hex.EncodeToString(hmacSHA256(sig.signingKey(secret), stringToSign))
+			return hmac.Equal([]byte(expected), []byte(signature))
+		}, sig.signature)
+	case streamingUnsignedPayload:
+		body, err = decodeAWSChunked(body, nil, "")
+	default:
+		if hashHex(body) != sig.payloadHash {
+			return nil, &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+		}
+	}
+	if err != nil {
+		return nil, &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", err.Error()}
+	}
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" && decoded != strconv.Itoa(len(body)) {
+		return nil, s3ErrInvalidRequest("Decoded content length mismatch")
+	}
+	return body, nil
+}
+
+// decodeAWSChunked decodes an aws-chunked body. When verify is set, every
+// chunk's signature must chain from the seed signature.
+func decodeAWSChunked(body []byte, verify func(chunk []byte, signature, previous string) bool, seed string) ([]byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(body))
+	var decoded bytes.Buffer
+	previous := seed
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("malformed chunk header")
+		}
+		sizeHex, extension, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size < 0 || size > int64(len(body)) {
+			return nil, fmt.Errorf("malformed chunk size")
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, fmt.Errorf("truncated chunk")
+		}
+		if verify != nil {
+			signature, ok := strings.CutPrefix(extension, "chunk-signature=")
+			if !ok || !verify(chunk, signature, previous) {
+				return nil, fmt.Errorf("chunk signature does not match")
+			}
+			previous = signature
+		}
+		if size == 0 {
+			// Trailing headers such as checksums follow the last chunk
+			return decoded.Bytes(), nil
+		}
+		decoded.Write(chunk)
+		if crlf, err := reader.ReadString('\n'); err != nil || crlf != "\r\n" {
+			return nil, fmt.Errorf("malformed chunk terminator")
+		}
+	}
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
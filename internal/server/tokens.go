@@ -0,0 +1,210 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+const uploadPolicyContextKey contextKey = "upload policy"
+
+var (
+	// errUploadPolicy is returned for uploads the policy of their upload
+	// token doesn't allow
+	errUploadPolicy = errors.New("not allowed for this upload token")
+
+	// errUploadTooLarge is returned for files larger than the policy of
+	// their upload token allows
+	errUploadTooLarge = errors.New("file too large for this upload token")
+)
+
+// uploadPolicy is what the holder of an upload token may upload
+type uploadPolicy struct {
+	name       string
+	maxSize    int64         // of each file, when positive
+	defaultTTL time.Duration // replaces the server's, when positive
+	maxTTL     time.Duration // when positive
+	tags       []string      // allowed, any when empty; a trailing * matches a prefix
+	namespace  string        // tags are stored under, when set
+}
+
+// uploadPolicies returns the policies of the upload tokens in cfg, by token
+func uploadPolicies(cfg *Config) map[string]*uploadPolicy {
+	policies := make(map[string]*uploadPolicy, len(cfg.UploadTokens))
+	for name, token := range cfg.UploadTokens {
+		if token == "" {
+			continue
+		}
+		policy := &uploadPolicy{
+			name:       name,
+			maxSize:    cfg.UploadTokenMaxSize[name],
+			defaultTTL: cfg.UploadTokenDefaultTTL[name],
+			maxTTL:     cfg.UploadTokenMaxTTL[name],
+			namespace:  strings.Trim(cfg.UploadTokenNamespaces[name], "/"),
+		}
+		if tags := cfg.UploadTokenTags[name]; tags != "" {
+			policy.tags = strings.Split(tags, "|")
+		}
+		// Files uploaded without a ttl mustn't outlive the maximum either
+		if policy.maxTTL > 0 {
+			policy.defaultTTL = cmp.Or(policy.defaultTTL, min(cfg.TTL, policy.maxTTL))
+		}
+		policies[token] = policy
+	}
+	return policies
+}
+
+// validateUploadTokens checks the upload tokens and that the policies are
+// set for tokens that exist
+func (cfg *Config) validateUploadTokens() []string {
+	var problems []string
+	for _, name := range slices.Sorted(maps.Keys(cfg.UploadTokens)) {
+		switch token := cfg.UploadTokens[name]; {
+		case token == "":
+			problems = append(problems, fmt.Sprintf("FILES_STASH_UPLOAD_TOKENS has an empty token for %q", name))
+		case token == cfg.AdminToken || token == cfg.ViewerToken:
+			problems = append(problems, fmt.Sprintf("FILES_STASH_UPLOAD_TOKENS reuses the admin or viewer token for %q", name))
+		}
+		if maxTTL := cfg.UploadTokenMaxTTL[name]; maxTTL > 0 && cfg.UploadTokenDefaultTTL[name] > maxTTL {
+			problems = append(problems, fmt.Sprintf("FILES_STASH_UPLOAD_TOKEN_DEFAULT_TTL of %q is longer than its FILES_STASH_UPLOAD_TOKEN_MAX_TTL", name))
+		}
+	}
+	policies := map[string][]string{
+		"FILES_STASH_UPLOAD_TOKEN_MAX_SIZE":    slices.Sorted(maps.Keys(cfg.UploadTokenMaxSize)),
+		"FILES_STASH_UPLOAD_TOKEN_DEFAULT_TTL": slices.Sorted(maps.Keys(cfg.UploadTokenDefaultTTL)),
+		"FILES_STASH_UPLOAD_TOKEN_MAX_TTL":     slices.Sorted(maps.Keys(cfg.UploadTokenMaxTTL)),
+		"FILES_STASH_UPLOAD_TOKEN_TAGS":        slices.Sorted(maps.Keys(cfg.UploadTokenTags)),
+		"FILES_STASH_UPLOAD_TOKEN_NAMESPACES":  slices.Sorted(maps.Keys(cfg.UploadTokenNamespaces)),
+	}
+	for _, variable := range slices.Sorted(maps.Keys(policies)) {
+		for _, name := range policies[variable] {
+			if _, ok := cfg.UploadTokens[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s is set for %q, which isn't in FILES_STASH_UPLOAD_TOKENS", variable, name))
+			}
+		}
+	}
+	return problems
+}
+
+// upload admits admins, as auth does, and holders of an upload token or a
+// JWT with the upload scope, whose policy the upload handler enforces
+func upload(creds *credentials, next http.HandlerFunc) http.HandlerFunc {
+	admin := auth(creds, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := creds.uploadPolicy(r)
+		if !ok {
+			admin(w, r)
+			return
+		}
+		if !creds.networks.admits(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		user := "upload:" + policy.name
+		recordUser(r.Context(), user, "")
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, uploadPolicyContextKey, policy)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// uploadPolicy returns the policy of the upload token or upload JWT r
+// carries, if any
+func (c *credentials) uploadPolicy(r *http.Request) (*uploadPolicy, bool) {
+	token := requestToken(r)
+	if policy, ok := c.uploadTokens[token]; ok {
+		return policy, true
+	}
+	if c.jwt == nil || token == "" {
+		return nil, false
+	}
+	policy, err := c.jwt.uploadPolicy(token)
+	return policy, err == nil
+}
+
+// uploadPolicyFromContext returns the policy of the upload token the
+// request was made with, or nil for admins
+func uploadPolicyFromContext(ctx context.Context) *uploadPolicy {
+	policy, _ := ctx.Value(uploadPolicyContextKey).(*uploadPolicy)
+	return policy
+}
+
+// admit checks an upload against the policy, filling in the TTL, putting
+// the tag under the namespace and capping the size of its content. A nil
+// policy admits every upload.
+func (p *uploadPolicy) admit(req *files.UploadRequest) error {
+	if p == nil {
+		return nil
+	}
+	if p.maxTTL > 0 && req.Pinned {
+		return fmt.Errorf("%w: pinned files never expire", errUploadPolicy)
+	}
+	if p.maxTTL > 0 && req.TTL > p.maxTTL {
+		return fmt.Errorf("%w: ttl is longer than %s", errUploadPolicy, p.maxTTL)
+	}
+	if len(p.tags) > 0 && !slices.ContainsFunc(p.tags, func(allowed string) bool {
+		prefix, ok := strings.CutSuffix(allowed, "*")
+		return req.Tag != "" && (req.Tag == allowed || ok && strings.HasPrefix(req.Tag, prefix))
+	}) {
+		return fmt.Errorf("%w: tag %q", errUploadPolicy, req.Tag)
+	}
+	// An untagged file would escape the namespace
+	if p.namespace != "" && req.Tag == "" {
+		return fmt.Errorf("%w: a tag is required", errUploadPolicy)
+	}
+
+	if req.TTL == 0 {
+		req.TTL = p.defaultTTL
+	}
+	if p.namespace != "" {
+		req.Tag = p.namespace + "/" + req.Tag
+	}
+	// The size is only known once the content has streamed in
+	if p.maxSize > 0 {
+		req.Content = &policyLimitedReader{r: req.Content, n: p.maxSize, err: fmt.Errorf("%w: %s is larger than %d bytes", errUploadTooLarge, req.Name, p.maxSize)}
+	}
+	return nil
+}
+
+// policyLimitedReader fails reads beyond the maximum size of a policy
+type policyLimitedReader struct {
+	r   io.Reader
+	n   int64 // bytes left
+	err error // returned beyond the maximum
+}
+
+func (l *policyLimitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Tell content ending right at the limit from content going over
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, l.err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// writeUploadPolicyError responds to an upload its token's policy refused
+func writeUploadPolicyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUploadTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
@@ -0,0 +1,349 @@
+// Package sftp serves the sftp subsystem of an embedded SSH server with
+// the request server of github.com/pkg/sftp, and shuts down gracefully,
+// letting transfers in progress finish.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// handshakeTimeout bounds how long a client may take to authenticate
+const handshakeTimeout = 30 * time.Second
+
+// Server accepts SSH connections and serves the sftp subsystem on their
+// sessions
+type Server struct {
+	config *ssh.ServerConfig
+	open   func(ctx context.Context, conn *ssh.ServerConn) pkgsftp.Handlers
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]*conn // nil while authenticating
+	closing  bool
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a server authenticating clients with config. open
+// returns the handlers serving the requests of each authenticated
+// connection; ctx is cancelled when the connection ends. Readers and
+// writers the handlers return that have a Close method are closed with
+// their handle, and told of transfers cut short by a TransferError method.
+func NewServer(config *ssh.ServerConfig, open func(ctx context.Context, conn *ssh.ServerConn) pkgsftp.Handlers) *Server {
+	return &Server{config: config, open: open, conns: make(map[net.Conn]*conn)}
+}
+
+// Serve accepts connections on l until Shutdown, after which it returns nil
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			netConn.Close()
+			return nil
+		}
+		s.conns[netConn] = nil
+		s.mu.Unlock()
+		s.wg.Go(func() { s.serveConn(netConn) })
+	}
+}
+
+// Shutdown stops accepting connections and ends the ones that have no file
+// open, then waits for the others to close theirs, until ctx is done, when
+// they're cut off
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for netConn, c := range s.conns {
+		if c == nil {
+			netConn.Close()
+			continue
+		}
+		c.shutdown()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for netConn := range s.conns {
+			netConn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// serveConn authenticates a connection and serves its sessions until it
+// ends
+func (s *Server) serveConn(netConn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, netConn)
+		s.mu.Unlock()
+	}()
+
+	netConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sshConn, channels, requests, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		slog.Debug("SFTP handshake failed", "remote_addr", netConn.RemoteAddr().String(), "error", err)
+		netConn.Close()
+		return
+	}
+	netConn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &conn{ssh: sshConn}
+	c.handlers = c.track(s.open(ctx, sshConn))
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		sshConn.Close()
+		return
+	}
+	s.conns[netConn] = c
+	s.mu.Unlock()
+
+	slog.Info("SFTP connection opened", "user", sshConn.User(), "remote_addr", sshConn.RemoteAddr().String())
+	var sessions sync.WaitGroup
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			slog.Error("Failed to accept SFTP session", "error", err)
+			continue
+		}
+		sessions.Go(func() { c.serveSession(channel, requests) })
+	}
+	// Sessions end with the connection, closing the files they left open
+	sessions.Wait()
+	slog.Info("SFTP connection closed", "user", sshConn.User(), "remote_addr", sshConn.RemoteAddr().String())
+}
+
+// conn is an authenticated connection, which is kept open during shutdown
+// while it has files open
+type conn struct {
+	ssh      *ssh.ServerConn
+	handlers pkgsftp.Handlers
+
+	mu      sync.Mutex
+	open    int // files, over all sessions
+	closing bool
+}
+
+// shutdown ends the connection once it has no files open
+func (c *conn) shutdown() {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	c.endIfIdle()
+}
+
+// endIfIdle ends the connection during shutdown when it has no files open
+func (c *conn) endIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing && c.open == 0 {
+		c.ssh.Close()
+	}
+}
+
+// opened counts a file opened, failing once the server is shutting down
+func (c *conn) opened() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return errShuttingDown
+	}
+	c.open++
+	return nil
+}
+
+// shuttingDown reports whether the server is ending the connection
+func (c *conn) shuttingDown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+// closed counts a file closed
+func (c *conn) closed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open--
+}
+
+// errShuttingDown refuses to open files while the server shuts down
+var errShuttingDown = errors.New("server is shutting down")
+
+// serveSession serves the sftp subsystem, the only request a session may
+// make, until the client ends the session
+func (c *conn) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	started := false
+	for req := range requests {
+		if req.Type != "subsystem" || !isSFTP(req.Payload) {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		started = true
+		go func() {
+			// Drain the requests so the session isn't held up by them
+			for req := range requests {
+				req.Reply(false, nil)
+			}
+		}()
+		break
+	}
+	if !started {
+		return
+	}
+
+	server := pkgsftp.NewRequestServer(&sessionChannel{Channel: channel, conn: c}, c.handlers)
+	if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) && !c.shuttingDown() {
+		slog.Error("SFTP session failed", "user", c.ssh.User(), "error", err)
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+}
+
+// isSFTP reports whether the payload of a subsystem request names sftp
+func isSFTP(payload []byte) bool {
+	var name struct{ Name string }
+	return ssh.Unmarshal(payload, &name) == nil && name.Name == "sftp"
+}
+
+// sessionChannel is the channel of a session, which ends the connection
+// during shutdown once a response leaves it with no files open, so the
+// client still hears back about closing its last file
+type sessionChannel struct {
+	ssh.Channel
+	conn *conn
+}
+
+func (s *sessionChannel) Write(p []byte) (int, error) {
+	n, err := s.Channel.Write(p)
+	s.conn.endIfIdle()
+	return n, err
+}
+
+// track wraps the handlers to count the files open on the connection
+func (c *conn) track(handlers pkgsftp.Handlers) pkgsftp.Handlers {
+	handlers.FileGet = &trackedReads{FileReader: handlers.FileGet, conn: c}
+	handlers.FilePut = &trackedWrites{FileWriter: handlers.FilePut, conn: c}
+	return handlers
+}
+
+type trackedReads struct {
+	pkgsftp.FileReader
+	conn *conn
+}
+
+func (t *trackedReads) Fileread(r *pkgsftp.Request) (io.ReaderAt, error) {
+	if err := t.conn.opened(); err != nil {
+		return nil, err
+	}
+	reader, err := t.FileReader.Fileread(r)
+	if err != nil {
+		t.conn.closed()
+		return nil, err
+	}
+	return &trackedReader{ReaderAt: reader, file: trackedFile{inner: reader, conn: t.conn}}, nil
+}
+
+type trackedWrites struct {
+	pkgsftp.FileWriter
+	conn *conn
+}
+
+func (t *trackedWrites) Filewrite(r *pkgsftp.Request) (io.WriterAt, error) {
+	if err := t.conn.opened(); err != nil {
+		return nil, err
+	}
+	writer, err := t.FileWriter.Filewrite(r)
+	if err != nil {
+		t.conn.closed()
+		return nil, err
+	}
+	return &trackedWriter{WriterAt: writer, file: trackedFile{inner: writer, conn: t.conn}}, nil
+}
+
+type trackedReader struct {
+	io.ReaderAt
+	file trackedFile
+}
+
+func (r *trackedReader) Close() error            { return r.file.Close() }
+func (r *trackedReader) TransferError(err error) { r.file.TransferError(err) }
+
+type trackedWriter struct {
+	io.WriterAt
+	file trackedFile
+}
+
+func (w *trackedWriter) Close() error            { return w.file.Close() }
+func (w *trackedWriter) TransferError(err error) { w.file.TransferError(err) }
+
+// trackedFile forwards the end of a transfer to the reader or writer the
+// handlers returned, counting the file closed once that's done
+type trackedFile struct {
+	inner any
+	conn  *conn
+}
+
+func (f trackedFile) Close() error {
+	defer f.conn.closed()
+	if closer, ok := f.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (f trackedFile) TransferError(err error) {
+	if t, ok := f.inner.(pkgsftp.TransferError); ok {
+		t.TransferError(err)
+	}
+}
@@ -0,0 +1,345 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	pkgsftp "github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+const password = "secret"
+
+// memFS serves requests from a map of files, uploads included once closed
+type memFS struct {
+	mu      sync.Mutex
+	files   fstest.MapFS
+	aborted []string
+}
+
+func relative(name string) string {
+	if name == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+func (m *memFS) Fileread(r *pkgsftp.Request) (io.ReaderAt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := fs.ReadFile(m.files, relative(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(string(data)), nil
+}
+
+func (m *memFS) Filewrite(r *pkgsftp.Request) (io.WriterAt, error) {
+	return &memUpload{fs: m, name: relative(r.Filepath)}, nil
+}
+
+func (m *memFS) Filecmd(r *pkgsftp.Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := relative(r.Filepath)
+	switch r.Method {
+	case "Remove":
+		if _, ok := m.files[name]; !ok {
+			return os.ErrNotExist
+		}
+		delete(m.files, name)
+		return nil
+	case "Rename":
+		file, ok := m.files[name]
+		if !ok {
+			return os.ErrNotExist
+		}
+		delete(m.files, name)
+		m.files[relative(r.Target)] = file
+		return nil
+	case "Mkdir":
+		return pkgsftp.ErrSSHFxPermissionDenied
+	}
+	return pkgsftp.ErrSSHFxOpUnsupported
+}
+
+func (m *memFS) Filelist(r *pkgsftp.Request) (pkgsftp.ListerAt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var infos listing
+	switch r.Method {
+	case "List":
+		entries, err := fs.ReadDir(m.files, relative(r.Filepath))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			info, _ := entry.Info()
+			infos = append(infos, info)
+		}
+	case "Stat", "Lstat":
+		info, err := fs.Stat(m.files, relative(r.Filepath))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	default:
+		return nil, pkgsftp.ErrSSHFxOpUnsupported
+	}
+	return infos, nil
+}
+
+type listing []fs.FileInfo
+
+func (l listing) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	return copy(entries, l[offset:]), nil
+}
+
+// memUpload is an upload to a memFS
+type memUpload struct {
+	fs      *memFS
+	name    string
+	mu      sync.Mutex
+	data    []byte
+	aborted bool
+}
+
+func (u *memUpload) WriteAt(p []byte, off int64) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if end := int(off) + len(p); end > len(u.data) {
+		u.data = append(u.data, make([]byte, end-len(u.data))...)
+	}
+	return copy(u.data[off:], p), nil
+}
+
+func (u *memUpload) TransferError(err error) {
+	u.aborted = true
+}
+
+func (u *memUpload) Close() error {
+	u.fs.mu.Lock()
+	defer u.fs.mu.Unlock()
+	if u.aborted {
+		u.fs.aborted = append(u.fs.aborted, u.name)
+		return nil
+	}
+	u.fs.files[u.name] = &fstest.MapFile{Data: u.data, Mode: 0o644, ModTime: time.Now()}
+	return nil
+}
+
+// startServer serves files on a local port, returning its address
+func startServer(t *testing.T, files *memFS) (*Server, string) {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	srv := NewServer(config, func(ctx context.Context, conn *ssh.ServerConn) pkgsftp.Handlers {
+		return pkgsftp.Handlers{FileGet: files, FilePut: files, FileCmd: files, FileList: files}
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv, listener.Addr().String()
+}
+
+// client is an SFTP client over a connection of its own
+type client struct {
+	*pkgsftp.Client
+	conn *ssh.Client
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "partner",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	c, err := pkgsftp.NewClient(conn)
+	require.NoError(t, err)
+	return &client{Client: c, conn: conn}
+}
+
+func (c *client) put(t *testing.T, name, content string) {
+	f, err := c.Create(name)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func (c *client) get(t *testing.T, name string) string {
+	f, err := c.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestServer(t *testing.T) {
+	files := &memFS{files: fstest.MapFS{
+		"reports/q1.txt": {Data: []byte("first quarter"), ModTime: time.Now()},
+	}}
+	_, addr := startServer(t, files)
+	c := dial(t, addr)
+
+	t.Run("PutAndGet", func(t *testing.T) {
+		c.put(t, "/upload.txt", "partner feed")
+		assert.Equal(t, "partner feed", c.get(t, "/upload.txt"))
+		assert.Equal(t, "first quarter", c.get(t, "reports/q1.txt"))
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := c.Stat("/reports/q1.txt")
+		require.NoError(t, err)
+		assert.Equal(t, int64(len("first quarter")), info.Size())
+		assert.True(t, info.Mode().IsRegular())
+
+		info, err = c.Stat("/reports")
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		_, err = c.Stat("/missing.txt")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		entries, err := c.ReadDir("/reports")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "q1.txt", entries[0].Name())
+
+		entries, err = c.ReadDir("/")
+		require.NoError(t, err)
+		assert.True(t, slices.ContainsFunc(entries, func(info fs.FileInfo) bool { return info.Name() == "reports" }))
+	})
+
+	t.Run("RenameAndRemove", func(t *testing.T) {
+		c.put(t, "/draft.txt", "draft")
+		require.NoError(t, c.Rename("/draft.txt", "/final.txt"))
+		_, err := c.Stat("/draft.txt")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.Equal(t, "draft", c.get(t, "/final.txt"))
+
+		require.NoError(t, c.Remove("/final.txt"))
+		assert.ErrorIs(t, c.Remove("/final.txt"), fs.ErrNotExist)
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		assert.ErrorIs(t, c.Mkdir("/new"), fs.ErrPermission)
+		var status *pkgsftp.StatusError
+		require.ErrorAs(t, c.Symlink("/upload.txt", "/link"), &status)
+		assert.Equal(t, uint32(pkgsftp.ErrSSHFxOpUnsupported), status.Code)
+	})
+}
+
+func TestServerAuth(t *testing.T) {
+	_, addr := startServer(t, &memFS{files: fstest.MapFS{}})
+
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "partner",
+		Auth:            []ssh.AuthMethod{ssh.Password("wrong")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.ErrorContains(t, err, "unable to authenticate")
+}
+
+func TestServerAbortsAbandonedUploads(t *testing.T) {
+	files := &memFS{files: fstest.MapFS{}}
+	_, addr := startServer(t, files)
+	c := dial(t, addr)
+
+	f, err := c.Create("/partial.txt")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("half"))
+	require.NoError(t, err)
+	c.conn.Close()
+
+	assert.Eventually(t, func() bool {
+		files.mu.Lock()
+		defer files.mu.Unlock()
+		return slices.Equal(files.aborted, []string{"partial.txt"})
+	}, time.Second, 10*time.Millisecond)
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	assert.NotContains(t, files.files, "partial.txt")
+}
+
+func TestServerShutdown(t *testing.T) {
+	files := &memFS{files: fstest.MapFS{}}
+	srv, addr := startServer(t, files)
+	busy := dial(t, addr)
+	idle := dial(t, addr)
+
+	f, err := busy.Create("/late.txt")
+	require.NoError(t, err)
+	stopped := make(chan error)
+	go func() { stopped <- srv.Shutdown(context.Background()) }()
+
+	// Idle connections end at once
+	ended := make(chan struct{})
+	go func() {
+		idle.conn.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection wasn't ended")
+	}
+
+	// The upload in progress finishes, but no more files are opened
+	_, err = f.Write([]byte("in time"))
+	require.NoError(t, err)
+	_, err = busy.Create("/more.txt")
+	assert.Error(t, err)
+	select {
+	case <-stopped:
+		t.Fatal("shut down with a file open")
+	default:
+	}
+	require.NoError(t, f.Close())
+
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't shut down")
+	}
+	files.mu.Lock()
+	assert.Equal(t, "in time", string(files.files["late.txt"].Data))
+	files.mu.Unlock()
+
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+package siem
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types streamed to the SIEM
+const (
+	EventAuthFailure      = "auth_failure"
+	EventPermissionDenied = "permission_denied"
+	EventAdminAction      = "admin_action"
+)
+
+// Formats of the event payload
+const (
+	FormatJSON = "json"
+	FormatCEF  = "cef"
+)
+
+// appName identifies the stash in syslog headers and CEF vendor fields
+const appName = "files-stash"
+
+// writeTimeout bounds how long a request waits on a slow collector
+const writeTimeout = time.Second
+
+// Event is a security relevant action taken by or refused to a caller
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"event"`
+	Protocol   string    `json:"protocol"` // http, grpc or sftp
+	User       string    `json:"user,omitempty"`
+	Identity   string    `json:"identity,omitempty"` // of the client certificate
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"` // behind trusted proxies, the client they forwarded for
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status,omitempty"`
+}
+
+// Emitter writes events as syslog messages to a collector. A nil Emitter
+// drops every event, so callers needn't check whether one is configured.
+type Emitter struct {
+	network  string
+	addr     string
+	format   string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// New creates an emitter for a collector at target, a "udp://host:port",
+// "tcp://host:port" or "unix:///path" URL, with payloads in format. The
+// connection is made on the first event, so the collector may start later.
+func New(target, format string) (*Emitter, error) {
+	if format != FormatJSON && format != FormatCEF {
+		return nil, fmt.Errorf("unknown SIEM format %q", format)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SIEM address: %w", err)
+	}
+	addr := u.Host
+	switch u.Scheme {
+	case "udp", "tcp":
+		if addr == "" {
+			return nil, fmt.Errorf("invalid SIEM address %q", target)
+		}
+	case "unix", "unixgram":
+		addr = u.Path
+	default:
+		return nil, fmt.Errorf("unsupported SIEM network %q", u.Scheme)
+	}
+
+	hostname, _ := os.Hostname()
+	return &Emitter{
+		network:  u.Scheme,
+		addr:     addr,
+		format:   format,
+		hostname: cmp.Or(hostname, "-"),
+	}, nil
+}
+
+// Emit sends an event, stamping it with the current time when unset.
+// Delivery is best effort: failures are logged and the event is dropped.
+func (e *Emitter) Emit(event Event) {
+	if e == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	msg, err := e.message(event)
+	if err != nil {
+		slog.Error("Failed to encode SIEM event", "event", event.Type, "error", err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// A stream collector may have dropped the connection, retry once on a
+	// fresh one
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = e.write(msg); err == nil {
+			return
+		}
+		e.closeConn()
+	}
+	slog.Warn("Failed to send SIEM event", "event", event.Type, "error", err)
+}
+
+// Close closes the connection to the collector
+func (e *Emitter) Close() error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closeConn()
+}
+
+func (e *Emitter) write(msg []byte) error {
+	if e.conn == nil {
+		conn, err := net.DialTimeout(e.network, e.addr, writeTimeout)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+	if err := e.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := e.conn.Write(msg)
+	return err
+}
+
+func (e *Emitter) closeConn() error {
+	if e.conn == nil {
+		return nil
+	}
+	err := e.conn.Close()
+	e.conn = nil
+	return err
+}
+
+// message formats an RFC 5424 syslog message carrying the event payload.
+// Stream transports get newline framing, datagrams carry one message each.
+func (e *Emitter) message(event Event) ([]byte, error) {
+	var payload string
+	if e.format == FormatCEF {
+		payload = cef(event)
+	} else {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		payload = string(body)
+	}
+
+	// Facility authpriv (10)
+	priority := 10*8 + severity(event.Type)
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		priority, event.Time.UTC().Format(time.RFC3339Nano), e.hostname, appName, os.Getpid(), event.Type, payload)
+	if e.network == "tcp" || e.network == "unix" {
+		msg += "\n"
+	}
+	return []byte(msg), nil
+}
+
+// severity maps event types to syslog severities: refusals are warnings,
+// admin actions are notices
+func severity(eventType string) int {
+	if eventType == EventAdminAction {
+		return 5
+	}
+	return 4
+}
+
+// cefNames are the human readable CEF names of the event types
+var cefNames = map[string]string{
+	EventAuthFailure:      "Authentication failed",
+	EventPermissionDenied: "Permission denied",
+	EventAdminAction:      "Admin action",
+}
+
+// cef formats an event in ArcSight Common Event Format
+func cef(event Event) string {
+	sev := 3
+	if event.Type != EventAdminAction {
+		sev = 6
+	}
+	ext := []string{
+		"rt=" + strconv.FormatInt(event.Time.UnixMilli(), 10),
+		"app=" + cefValue(event.Protocol),
+		"requestMethod=" + cefValue(event.Method),
+		"request=" + cefValue(event.Path),
+	}
+	if event.User != "" {
+		ext = append(ext, "suser="+cefValue(event.User))
+	}
+	if event.Identity != "" {
+		ext = append(ext, "suid="+cefValue(event.Identity))
+	}
+	if event.ClientIP != "" {
+		ext = append(ext, "src="+cefValue(event.ClientIP))
+	} else if host, _, err := net.SplitHostPort(event.RemoteAddr); err == nil {
+		ext = append(ext, "src="+cefValue(host))
+	} else if event.RemoteAddr != "" {
+		ext = append(ext, "src="+cefValue(event.RemoteAddr))
+	}
+	if event.Status != 0 {
+		ext = append(ext, "outcome="+strconv.Itoa(event.Status))
+	}
+
+	return fmt.Sprintf("CEF:0|%s|%s|1.0|%s|%s|%d|%s",
+		appName, appName, cefHeader(event.Type), cefHeader(cefNames[event.Type]), sev, strings.Join(ext, " "))
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func cefHeader(s string) string { return cefHeaderEscaper.Replace(s) }
+
+func cefValue(s string) string { return cefValueEscaper.Replace(s) }
@@ -0,0 +1,114 @@
+package siem
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitter(t *testing.T) {
+	event := Event{
+		Time:       time.Unix(1700000000, 0),
+		Type:       EventAuthFailure,
+		Protocol:   "http",
+		RemoteAddr: "192.0.2.1:5555",
+		Method:     "DELETE",
+		Path:       "/v1/files/abc",
+		Status:     401,
+	}
+
+	t.Run("json over udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		emitter, err := New("udp://"+conn.LocalAddr().String(), FormatJSON)
+		require.NoError(t, err)
+		defer emitter.Close()
+		emitter.Emit(event)
+
+		buf := make([]byte, 4096)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		msg := string(buf[:n])
+
+		assert.True(t, strings.HasPrefix(msg, "<84>1 2023-11-14T22:13:20Z "), msg)
+		_, payload, ok := strings.Cut(msg, " auth_failure - ")
+		require.True(t, ok, msg)
+		var got Event
+		require.NoError(t, json.Unmarshal([]byte(payload), &got))
+		assert.True(t, event.Time.Equal(got.Time))
+		got.Time = event.Time
+		assert.Equal(t, event, got)
+	})
+
+	t.Run("cef over tcp", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		emitter, err := New("tcp://"+listener.Addr().String(), FormatCEF)
+		require.NoError(t, err)
+		defer emitter.Close()
+
+		admin := event
+		admin.Type = EventAdminAction
+		admin.User = "admin"
+		admin.Identity = "deploy-bot"
+		admin.Path = "/v1/files/a=b|c"
+		admin.Status = 204
+		admin.ClientIP = "198.51.100.7"
+		go emitter.Emit(admin)
+
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+
+		assert.True(t, strings.HasPrefix(line, "<85>1 "), line)
+		assert.Contains(t, line, " admin_action - CEF:0|files-stash|files-stash|1.0|admin_action|Admin action|3|")
+		assert.Contains(t, line, "rt=1700000000000 app=http requestMethod=DELETE request=/v1/files/a\\=b|c suser=admin suid=deploy-bot src=198.51.100.7 outcome=204\n")
+	})
+
+	t.Run("nil emitter", func(t *testing.T) {
+		var emitter *Emitter
+		emitter.Emit(event)
+		assert.NoError(t, emitter.Close())
+	})
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		format string
+		valid  bool
+	}{
+		{name: "udp", target: "udp://localhost:514", format: FormatJSON, valid: true},
+		{name: "tcp", target: "tcp://localhost:601", format: FormatCEF, valid: true},
+		{name: "unix", target: "unix:///dev/log", format: FormatJSON, valid: true},
+		{name: "missing host", target: "udp://", format: FormatJSON},
+		{name: "unknown network", target: "http://localhost", format: FormatJSON},
+		{name: "unknown format", target: "udp://localhost:514", format: "xml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.target, tt.format)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are SQL scripts named NNNN_name.up.sql, with a matching
+// NNNN_name.down.sql undoing them. Applied versions are recorded in the
+// schema_migrations table. Changes SQL can't express run in Go, as the
+// migrationSteps of their version.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a versioned schema change
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+	step    migrationStep
+}
+
+// migrationStep runs in the transaction of a migration, after its script
+type migrationStep struct {
+	up, down func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrationSteps are the steps of migrations, by version
+var migrationSteps = map[int]migrationStep{
+	6: {up: rewriteTimestamps, down: restoreTimestamps},
+}
+
+// MigrationStatus tells whether a migration was applied to a database
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil when pending
+}
+
+// legacyColumns were added to databases created before versioned
+// migrations as the schema grew. They are backfilled before the initial
+// migration, which expects them.
+var legacyColumns = []struct{ table, column, definition string }{
+	{"files", "tag", "TEXT"},
+	{"files", "pinned", "INTEGER NOT NULL DEFAULT 0"},
+	{"files", "description", "TEXT"},
+	{"files", "link", "TEXT"},
+	{"files", "detected_mime_type", "TEXT"},
+	{"files", "checksum", "TEXT"},
+	{"files", "password_hash", "TEXT"},
+	{"files", "status", "TEXT NOT NULL DEFAULT 'active'"},
+	{"files", "origin_ip", "TEXT"},
+	{"files", "origin_user_agent", "TEXT"},
+	{"files", "origin_hostname", "TEXT"},
+	{"files", "scan_status", "TEXT"},
+	{"files", "scan_signature", "TEXT"},
+	{"files", "scanned_at", "DATETIME"},
+	{"files", "stored_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"files", "public", "INTEGER NOT NULL DEFAULT 0"},
+	{"links", "one_time", "INTEGER NOT NULL DEFAULT 0"},
+	{"links", "used_at", "DATETIME"},
+}
+
+// loadMigrations reads the embedded migrations, ordered by version
+func loadMigrations() ([]migration, error) {
+	paths, err := fs.Glob(migrationFiles, "migrations/*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, path := range paths {
+		base := strings.TrimSuffix(strings.TrimPrefix(path, "migrations/"), ".up.sql")
+		number, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration name %q", path)
+		}
+		up, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		down, err := migrationFiles.ReadFile("migrations/" + base + ".down.sql")
+		if err != nil {
+			return nil, fmt.Errorf("migration %q has no down script: %w", base, err)
+		}
+		migrations = append(migrations, migration{version: version, name: name, up: string(up), down: string(down), step: migrationSteps[version]})
+	}
+
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+// LatestVersion is the schema version NewRepository migrates to
+func LatestVersion() int {
+	migrations, err := loadMigrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate applies or rolls back migrations until the schema is at version.
+// Each migration runs in a transaction with the record of its version.
+func (r *Repository) Migrate(ctx context.Context, version int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if version < 0 || (version > 0 && !slices.ContainsFunc(migrations, func(m migration) bool { return m.version == version })) {
+		return fmt.Errorf("unknown schema version %d", version)
+	}
+	if err := r.prepareMigrations(ctx); err != nil {
+		return err
+	}
+	applied, err := r.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok && m.version <= version {
+			if err := r.runMigration(ctx, m.up, m.step.up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, m.version, m.name, time.Now()); err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", m.version, m.name, err)
+			}
+		}
+	}
+	for _, m := range slices.Backward(migrations) {
+		if _, ok := applied[m.version]; ok && m.version > version {
+			if err := r.runMigration(ctx, m.down, m.step.down, `DELETE FROM schema_migrations WHERE version = ?`, m.version); err != nil {
+				return fmt.Errorf("failed to roll back migration %d_%s: %w", m.version, m.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MigrationStatus lists the known migrations with when they were applied
+func (r *Repository) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.prepareMigrations(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := r.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if at, ok := applied[m.version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// runMigration runs a migration script and its step, if any, and records
+// the change in one transaction
+func (r *Repository) runMigration(ctx context.Context, script string, step func(context.Context, *sql.Tx) error, record string, args ...any) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if step != nil {
+		if err := step(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// prepareMigrations creates the schema_migrations table and, for databases
+// created before versioned migrations, backfills the columns the initial
+// migration expects
+func (r *Repository) prepareMigrations(ctx context.Context) error {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')`).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check schema_migrations table: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	for _, c := range legacyColumns {
+		var hasTable bool
+		err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)`, c.table).Scan(&hasTable)
+		if err != nil {
+			return fmt.Errorf("failed to check %s table: %w", c.table, err)
+		}
+		if !hasTable {
+			continue
+		}
+		if err := r.addColumn(c.column, `ALTER TABLE `+c.table+` ADD COLUMN `+c.column+` `+c.definition); err != nil {
+			return err
+		}
+	}
+
+	createMigrationsTableQuery := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	);`
+	if _, err := r.db.ExecContext(ctx, createMigrationsTableQuery); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// appliedMigrations returns when each applied migration was applied
+func (r *Repository) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// addColumn runs an ALTER TABLE statement, ignoring duplicate column errors
+func (r *Repository) addColumn(name, query string) error {
+	if _, err := r.db.Exec(query); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			return fmt.Errorf("failed to add %s column: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// timestampColumns are the times compared in queries, which are stored
+// with timeLayout
+var timestampColumns = []struct{ table, column string }{
+	{"files", "created_at"},
+	{"files", "expires_at"},
+	{"tombstones", "deleted_at"},
+	{"links", "created_at"},
+}
+
+// legacyTimeLayout is how times used to be written, as Go prints them in
+// the server's zone, such as "2006-01-02 15:04:05.999999999 -0700 MST",
+// possibly followed by a monotonic clock reading
+const legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// rewriteTimestamps rewrites the times in timestampColumns written with
+// legacyTimeLayout, which neither sort as text nor parse in SQLite, with
+// timeLayout
+func rewriteTimestamps(ctx context.Context, tx *sql.Tx) error {
+	return convertTimestamps(ctx, tx, `* [+-][0-9][0-9][0-9][0-9] *`, func(value string) (string, error) {
+		value, _, _ = strings.Cut(value, " m=")
+		t, err := time.Parse(legacyTimeLayout, value)
+		return t.UTC().Format(timeLayout), err
+	})
+}
+
+// restoreTimestamps rewrites the times in timestampColumns with
+// legacyTimeLayout in UTC, as earlier versions wrote them
+func restoreTimestamps(ctx context.Context, tx *sql.Tx) error {
+	return convertTimestamps(ctx, tx, `????-??-?? ??:??:??.?????????Z`, func(value string) (string, error) {
+		t, err := time.Parse(timeLayout, value)
+		return t.String(), err
+	})
+}
+
+// convertTimestamps rewrites the times in timestampColumns that match the
+// GLOB pattern with convert
+func convertTimestamps(ctx context.Context, tx *sql.Tx, pattern string, convert func(string) (string, error)) error {
+	for _, c := range timestampColumns {
+		// Cast, as the driver would parse DATETIME columns itself
+		rows, err := tx.QueryContext(ctx, `SELECT rowid, CAST(`+c.column+` AS TEXT) FROM `+c.table+` WHERE `+c.column+` GLOB ?`, pattern)
+		if err != nil {
+			return fmt.Errorf("failed to read %s.%s: %w", c.table, c.column, err)
+		}
+		converted := make(map[int64]string)
+		for rows.Next() {
+			var rowid int64
+			var value string
+			if err := rows.Scan(&rowid, &value); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan %s.%s: %w", c.table, c.column, err)
+			}
+			if converted[rowid], err = convert(value); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to convert %s.%s %q: %w", c.table, c.column, value, err)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to read %s.%s: %w", c.table, c.column, err)
+		}
+
+		for rowid, value := range converted {
+			if _, err := tx.ExecContext(ctx, `UPDATE `+c.table+` SET `+c.column+` = ? WHERE rowid = ?`, value, rowid); err != nil {
+				return fmt.Errorf("failed to rewrite %s.%s: %w", c.table, c.column, err)
+			}
+		}
+	}
+	return nil
+}
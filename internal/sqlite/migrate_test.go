@@ -0,0 +1,141 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	repo, err := NewRepository(path)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	statuses, err := repo.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, statuses)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt, status.Name)
+	}
+	assert.Equal(t, LatestVersion(), statuses[len(statuses)-1].Version)
+
+	t.Run("Down", func(t *testing.T) {
+		require.NoError(t, repo.Migrate(ctx, 0))
+		statuses, err := repo.MigrationStatus(ctx)
+		require.NoError(t, err)
+		for _, status := range statuses {
+			assert.Nil(t, status.AppliedAt, status.Name)
+		}
+		_, err = repo.FindByID(ctx, "any")
+		assert.ErrorContains(t, err, "no such table")
+	})
+
+	t.Run("Up", func(t *testing.T) {
+		require.NoError(t, repo.Migrate(ctx, LatestVersion()))
+		now := time.Now()
+		require.NoError(t, repo.Create(ctx, &files.File{ID: "file", Name: "a.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+		// Reopening leaves a migrated database alone
+		reopened, err := NewRepository(path)
+		require.NoError(t, err)
+		defer reopened.Close()
+		_, err = reopened.FindByID(ctx, "file")
+		assert.NoError(t, err)
+	})
+
+	t.Run("UnknownVersion", func(t *testing.T) {
+		assert.Error(t, repo.Migrate(ctx, LatestVersion()+1))
+		assert.Error(t, repo.Migrate(ctx, -1))
+	})
+}
+
+func TestMigrationsUpgradeLegacyDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// A database from before tags, lifecycle states and the later tables
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+	CREATE TABLE files (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		mime_type TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	ALTER TABLE files ADD COLUMN status TEXT NOT NULL DEFAULT 'ready';
+	INSERT INTO files (id, name, size, mime_type, created_at, expires_at) VALUES ('old', 'a.txt', 1, 'text/plain', '2024-01-01 00:00:00+00:00', '2999-01-01 00:00:00+00:00');
+	`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	repo, err := NewRepository(path)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	file, err := repo.FindByID(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", file.Name)
+	assert.Equal(t, files.StatusActive, file.Status)
+	require.NoError(t, repo.CreateLink(ctx, &files.Link{ID: "link", FileID: "old", CreatedAt: time.Now(), OneTime: true}))
+}
+
+func TestMigrationsRewriteTimestamps(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	// Times as written before they were stored in UTC in SQLite's format
+	require.NoError(t, repo.Migrate(ctx, 5))
+	_, err = repo.db.Exec(`
+	INSERT INTO files (id, name, tag, size, mime_type, created_at, expires_at) VALUES
+		('utc', 'a.txt', 'docs', 1, 'text/plain', '2024-01-01 10:00:00.123456789 +0000 UTC m=+0.5', '2999-01-01 00:00:00 +0000 UTC'),
+		('cest', 'b.txt', 'docs', 1, 'text/plain', '2024-01-01 11:30:00.250000001 +0200 CEST', '2999-01-01 00:00:00 +0000 UTC');
+	INSERT INTO tombstones (id, name, deleted_at) VALUES ('gone', 'c.txt', '2024-01-01 08:00:00 -0100 -01');
+	`)
+	require.NoError(t, err)
+	require.NoError(t, repo.Migrate(ctx, LatestVersion()))
+
+	utc, err := repo.FindByID(ctx, "utc")
+	require.NoError(t, err)
+	assert.True(t, time.Date(2024, 1, 1, 10, 0, 0, 123456789, time.UTC).Equal(utc.CreatedAt))
+	cest, err := repo.FindByID(ctx, "cest")
+	require.NoError(t, err)
+	assert.True(t, time.Date(2024, 1, 1, 9, 30, 0, 250000001, time.UTC).Equal(cest.CreatedAt))
+
+	// Compared in SQL, the file registered later in a zone ahead of UTC
+	// isn't the latest anymore
+	latest, err := repo.FindByTag(ctx, "docs", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, "utc", latest.ID)
+
+	removed, err := repo.DeleteTombstones(ctx, time.Date(2024, 1, 1, 8, 30, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = repo.DeleteTombstones(ctx, time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	// Rolling back writes the times as earlier versions did, in UTC
+	require.NoError(t, repo.Migrate(ctx, 5))
+	var createdAt string
+	require.NoError(t, repo.db.QueryRow(`SELECT CAST(created_at AS TEXT) FROM files WHERE id = 'cest'`).Scan(&createdAt))
+	assert.Equal(t, "2024-01-01 09:30:00.250000001 +0000 UTC", createdAt)
+	require.NoError(t, repo.Migrate(ctx, LatestVersion()))
+	cest, err = repo.FindByID(ctx, "cest")
+	require.NoError(t, err)
+	assert.True(t, time.Date(2024, 1, 1, 9, 30, 0, 250000001, time.UTC).Equal(cest.CreatedAt))
+}
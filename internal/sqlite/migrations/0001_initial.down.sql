@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS tombstones;
+DROP TABLE IF EXISTS downloads;
+DROP TABLE IF EXISTS download_codes;
+DROP TABLE IF EXISTS links;
+DROP TABLE IF EXISTS file_attributes;
+DROP TABLE IF EXISTS short_links;
+DROP TABLE IF EXISTS usage_history;
+DROP TABLE IF EXISTS thumbnails;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS saved_searches;
+DROP TABLE IF EXISTS stars;
+DROP TABLE IF EXISTS files;
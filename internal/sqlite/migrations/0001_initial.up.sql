@@ -0,0 +1,124 @@
+-- The schema as of the introduction of versioned migrations. Every
+-- statement tolerates existing objects, so databases created before are
+-- brought up to it once their missing columns are added.
+
+CREATE TABLE IF NOT EXISTS files (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	mime_type TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	tag TEXT,
+	pinned INTEGER NOT NULL DEFAULT 0,
+	description TEXT,
+	link TEXT,
+	detected_mime_type TEXT,
+	checksum TEXT,
+	password_hash TEXT,
+	status TEXT NOT NULL DEFAULT 'active',
+	origin_ip TEXT,
+	origin_user_agent TEXT,
+	origin_hostname TEXT,
+	scan_status TEXT,
+	scan_signature TEXT,
+	scanned_at DATETIME,
+	stored_size INTEGER NOT NULL DEFAULT 0,
+	public INTEGER NOT NULL DEFAULT 0
+);
+
+-- Uploaded files were "ready" before the lifecycle states were introduced
+UPDATE files SET status = 'active' WHERE status = 'ready';
+
+CREATE TABLE IF NOT EXISTS stars (
+	user TEXT NOT NULL,
+	file_id TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (user, file_id)
+);
+
+CREATE TABLE IF NOT EXISTS saved_searches (
+	name TEXT PRIMARY KEY,
+	query TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+	id TEXT PRIMARY KEY,
+	file_id TEXT NOT NULL,
+	author TEXT NOT NULL,
+	body TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS thumbnails (
+	file_id TEXT NOT NULL,
+	width INTEGER NOT NULL,
+	height INTEGER NOT NULL,
+	storage_id TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (file_id, width, height)
+);
+
+CREATE TABLE IF NOT EXISTS usage_history (
+	day TEXT PRIMARY KEY,
+	files INTEGER NOT NULL,
+	bytes INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS short_links (
+	code TEXT PRIMARY KEY,
+	file_id TEXT NOT NULL,
+	target TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS file_attributes (
+	file_id TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (file_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS links (
+	id TEXT PRIMARY KEY,
+	file_id TEXT NOT NULL,
+	options TEXT NOT NULL DEFAULT '',
+	created_by TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	one_time INTEGER NOT NULL DEFAULT 0,
+	used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS download_codes (
+	code TEXT PRIMARY KEY,
+	file_id TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS downloads (
+	file_id TEXT PRIMARY KEY,
+	count INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	last_downloaded_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tombstones (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	tag TEXT NOT NULL DEFAULT '',
+	deleted_at DATETIME NOT NULL,
+	deleted_by TEXT NOT NULL DEFAULT '',
+	reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_expires_at ON files(expires_at);
+CREATE INDEX IF NOT EXISTS idx_files_tag_created_at ON files(tag, created_at);
+CREATE INDEX IF NOT EXISTS idx_stars_file_id ON stars(file_id);
+CREATE INDEX IF NOT EXISTS idx_comments_file_id_created_at ON comments(file_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_short_links_file_id ON short_links(file_id);
+CREATE INDEX IF NOT EXISTS idx_links_file_id ON links(file_id);
+CREATE INDEX IF NOT EXISTS idx_download_codes_file_id ON download_codes(file_id);
+CREATE INDEX IF NOT EXISTS idx_file_attributes_key_value ON file_attributes(key, value);
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS file_attributes_search_delete;
+DROP TRIGGER IF EXISTS file_attributes_search_insert;
+DROP TRIGGER IF EXISTS files_search_delete;
+DROP TRIGGER IF EXISTS files_search_update;
+DROP TRIGGER IF EXISTS files_search_insert;
+DROP TABLE IF EXISTS files_search;
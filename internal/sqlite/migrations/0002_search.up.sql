@@ -0,0 +1,42 @@
+-- Full-text index over the name, tag and custom attributes of files, kept
+-- in step with them by triggers. Files are matched by ID rather than by
+-- rowid, which VACUUM may renumber.
+
+CREATE VIRTUAL TABLE files_search USING fts5(
+	file_id UNINDEXED,
+	name,
+	tag,
+	attributes,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+-- Attributes are indexed as "key value" pairs
+INSERT INTO files_search (file_id, name, tag, attributes)
+SELECT id, name, coalesce(tag, ''),
+	coalesce((SELECT group_concat(key || ' ' || value, ' ') FROM file_attributes WHERE file_id = files.id), '')
+FROM files;
+
+CREATE TRIGGER files_search_insert AFTER INSERT ON files BEGIN
+	INSERT INTO files_search (file_id, name, tag, attributes)
+	VALUES (new.id, new.name, coalesce(new.tag, ''), '');
+END;
+
+CREATE TRIGGER files_search_update AFTER UPDATE OF name, tag ON files BEGIN
+	UPDATE files_search SET name = new.name, tag = coalesce(new.tag, '') WHERE file_id = new.id;
+END;
+
+CREATE TRIGGER files_search_delete AFTER DELETE ON files BEGIN
+	DELETE FROM files_search WHERE file_id = old.id;
+END;
+
+CREATE TRIGGER file_attributes_search_insert AFTER INSERT ON file_attributes BEGIN
+	UPDATE files_search
+	SET attributes = (SELECT group_concat(key || ' ' || value, ' ') FROM file_attributes WHERE file_id = new.file_id)
+	WHERE file_id = new.file_id;
+END;
+
+CREATE TRIGGER file_attributes_search_delete AFTER DELETE ON file_attributes BEGIN
+	UPDATE files_search
+	SET attributes = coalesce((SELECT group_concat(key || ' ' || value, ' ') FROM file_attributes WHERE file_id = old.file_id), '')
+	WHERE file_id = old.file_id;
+END;
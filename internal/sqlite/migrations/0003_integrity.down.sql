@@ -0,0 +1,3 @@
+ALTER TABLE files DROP COLUMN verified_at;
+ALTER TABLE files DROP COLUMN integrity_checksum;
+ALTER TABLE files DROP COLUMN integrity_status;
@@ -0,0 +1,6 @@
+-- The outcome of the last verification of each file's stored content
+-- against its checksum, NULL until the file is first verified
+
+ALTER TABLE files ADD COLUMN integrity_status TEXT;
+ALTER TABLE files ADD COLUMN integrity_checksum TEXT;
+ALTER TABLE files ADD COLUMN verified_at DATETIME;
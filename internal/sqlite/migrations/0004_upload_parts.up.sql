@@ -0,0 +1,11 @@
+-- The parts of multipart uploads, whose content is stored on its own until
+-- the upload completes
+
+CREATE TABLE upload_parts (
+	file_id TEXT NOT NULL,
+	number INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	checksum TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (file_id, number)
+);
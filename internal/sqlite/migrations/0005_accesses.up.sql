@@ -0,0 +1,14 @@
+-- The access log of each file: every download request, answered or not,
+-- in the order they were made
+
+CREATE TABLE accesses (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_id TEXT NOT NULL,
+	at DATETIME NOT NULL,
+	ip TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	bytes INTEGER NOT NULL,
+	status INTEGER NOT NULL
+);
+
+CREATE INDEX accesses_by_file ON accesses (file_id, id);
@@ -0,0 +1,2 @@
+-- The times are written back as Go prints them, in UTC, by
+-- restoreTimestamps in migrate.go.
@@ -0,0 +1,4 @@
+-- Times used to be written as Go prints them, in the server's zone, which
+-- neither sorts as text nor parses in SQLite. They are rewritten in UTC
+-- with nine fractional digits, "2006-01-02 15:04:05.000000000Z", for the
+-- columns compared in queries, by rewriteTimestamps in migrate.go.
@@ -1,35 +1,69 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/pavel-fokin/files-stash/internal/files"
 	_ "modernc.org/sqlite"
 )
 
+// fileColumns lists the columns selected for a file row, in scan order
+const fileColumns = `id, name, tag, size, mime_type, detected_mime_type, checksum, description, link, pinned, created_at, expires_at, password_hash, status, origin_ip, origin_user_agent, origin_hostname, scan_status, scan_signature, scanned_at, stored_size, public, integrity_status, integrity_checksum, verified_at`
+
 // Repository implements files.FileRepository using SQLite
 type Repository struct {
 	db *sql.DB
 }
 
-// NewRepository creates a new SQLite repository
+// NewRepository opens a SQLite repository, migrating its schema to the
+// latest version
 func NewRepository(dbPath string) (*Repository, error) {
+	repo, err := Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repo.Migrate(context.Background(), LatestVersion()); err != nil {
+		repo.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	return repo, nil
+}
+
+// Open opens a SQLite repository without touching its schema, for tools
+// managing migrations by hand
+func Open(dbPath string) (*Repository, error) {
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	repo := &Repository{db: db}
+	return &Repository{db: db}, nil
+}
 
-	// Initialize database schema
-	if err := repo.initSchema(); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to initialize schema: %w", err)
-	}
+// timeLayout is how times are stored: in UTC with a fixed number of
+// fractional digits, so they sort as text and SQLite's date functions parse
+// them, and read back in UTC
+const timeLayout = "2006-01-02 15:04:05.000000000Z"
 
-	return repo, nil
+// timeArgs formats the times among statement arguments with timeLayout
+func timeArgs(args []any) []any {
+	converted := slices.Clone(args)
+	for i, arg := range converted {
+		switch v := arg.(type) {
+		case time.Time:
+			converted[i] = v.UTC().Format(timeLayout)
+		case sql.NullTime:
+			converted[i] = sql.NullString{String: v.Time.UTC().Format(timeLayout), Valid: v.Valid}
+		}
+	}
+	return converted
 }
 
 // Close closes the database connection
@@ -37,145 +71,343 @@ func (r *Repository) Close() error {
 	return r.db.Close()
 }
 
-// initSchema creates and migrates the necessary database tables
-func (r *Repository) initSchema() error {
-	// Create the table if it doesn't exist, but without the tag column initially
-	// to support migrating from an older schema.
-	createTableQuery := `
-	CREATE TABLE IF NOT EXISTS files (
-		id TEXT PRIMARY KEY,
-		name TEXT NOT NULL,
-		size INTEGER NOT NULL,
-		mime_type TEXT NOT NULL,
-		created_at DATETIME NOT NULL,
-		expires_at DATETIME NOT NULL
-	);`
-	if _, err := r.db.Exec(createTableQuery); err != nil {
-		return fmt.Errorf("failed to create files table: %w", err)
+// Snapshot writes a consistent copy of the database to path, which must not
+// exist yet, while other connections keep reading and writing
+func (r *Repository) Snapshot(ctx context.Context, path string) error {
+	if _, err := r.exec(ctx, `VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
 	}
+	return nil
+}
 
-	// Add the tag column, ignoring the error if it already exists.
-	// This is a simple migration strategy.
-	alterTableQuery := `ALTER TABLE files ADD COLUMN tag TEXT;`
-	if _, err := r.db.Exec(alterTableQuery); err != nil {
-		if !strings.Contains(err.Error(), "duplicate column name") {
-			return fmt.Errorf("failed to add tag column: %w", err)
-		}
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanFile reads a single file row selected with fileColumns
+func scanFile(s scanner) (*files.File, error) {
+	var file files.File
+	var tag, detectedMimeType, checksum, description, link, passwordHash sql.NullString
+	var originIP, originUserAgent, originHostname sql.NullString
+	var scanStatus, scanSignature, integrityStatus, integrityChecksum sql.NullString
+	var scannedAt, verifiedAt sql.NullTime
+	err := s.Scan(
+		&file.ID,
+		&file.Name,
+		&tag,
+		&file.Size,
+		&file.MimeType,
+		&detectedMimeType,
+		&checksum,
+		&description,
+		&link,
+		&file.Pinned,
+		&file.CreatedAt,
+		&file.ExpiresAt,
+		&passwordHash,
+		&file.Status,
+		&originIP,
+		&originUserAgent,
+		&originHostname,
+		&scanStatus,
+		&scanSignature,
+		&scannedAt,
+		&file.StoredSize,
+		&file.Public,
+		&integrityStatus,
+		&integrityChecksum,
+		&verifiedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	file.Tag = tag.String
+	file.DetectedMimeType = detectedMimeType.String
+	file.Checksum = checksum.String
+	file.Description = description.String
+	file.Link = link.String
+	file.PasswordHash = passwordHash.String
+	if originIP.Valid || originUserAgent.Valid || originHostname.Valid {
+		file.Origin = &files.Origin{IP: originIP.String, UserAgent: originUserAgent.String, Hostname: originHostname.String}
+	}
+	if scanStatus.Valid {
+		file.Scan = &files.ScanResult{Status: scanStatus.String, Signature: scanSignature.String, ScannedAt: scannedAt.Time}
+	}
+	if integrityStatus.Valid {
+		file.Integrity = &files.IntegrityCheck{Status: integrityStatus.String, Checksum: integrityChecksum.String, VerifiedAt: verifiedAt.Time}
 	}
+	return &file, nil
+}
 
-	// Create indexes, which is safe now that we know the tag column exists.
-	createIndexesQuery := `
-	CREATE INDEX IF NOT EXISTS idx_files_expires_at ON files(expires_at);
-	CREATE INDEX IF NOT EXISTS idx_files_tag_created_at ON files(tag, created_at);
-	`
-	if _, err := r.db.Exec(createIndexesQuery); err != nil {
-		return fmt.Errorf("failed to create indexes: %w", err)
+// scanValues returns the scan result columns of a file, NULLs when it
+// wasn't scanned
+func scanValues(file *files.File) (status, signature sql.NullString, scannedAt sql.NullTime) {
+	if file.Scan == nil {
+		return
 	}
+	return sql.NullString{String: file.Scan.Status, Valid: true},
+		sql.NullString{String: file.Scan.Signature, Valid: true},
+		sql.NullTime{Time: file.Scan.ScannedAt, Valid: true}
+}
 
-	return nil
+// integrityValues returns the integrity check columns of a file, NULLs
+// when it wasn't verified
+func integrityValues(check *files.IntegrityCheck) (status, checksum sql.NullString, verifiedAt sql.NullTime) {
+	if check == nil {
+		return
+	}
+	return sql.NullString{String: check.Status, Valid: true},
+		sql.NullString{String: check.Checksum, Valid: true},
+		sql.NullTime{Time: check.VerifiedAt, Valid: true}
 }
 
 // Create stores file metadata
-func (r *Repository) Create(file *files.File) error {
+func (r *Repository) Create(ctx context.Context, file *files.File) error {
 	query := `
-	INSERT INTO files (id, name, tag, size, mime_type, created_at, expires_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO files (` + fileColumns + `)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err := r.db.Exec(query,
+	// Origins, scan results and integrity checks are stored as NULLs when
+	// not recorded
+	var origin files.Origin
+	if file.Origin != nil {
+		origin = *file.Origin
+	}
+	scanStatus, scanSignature, scannedAt := scanValues(file)
+	integrityStatus, integrityChecksum, verifiedAt := integrityValues(file.Integrity)
+
+	_, err := r.exec(ctx, query,
 		file.ID,
 		file.Name,
 		file.Tag,
 		file.Size,
 		file.MimeType,
+		file.DetectedMimeType,
+		file.Checksum,
+		file.Description,
+		file.Link,
+		file.Pinned,
 		file.CreatedAt,
 		file.ExpiresAt,
+		file.PasswordHash,
+		file.Status,
+		sql.NullString{String: origin.IP, Valid: file.Origin != nil},
+		sql.NullString{String: origin.UserAgent, Valid: file.Origin != nil},
+		sql.NullString{String: origin.Hostname, Valid: file.Origin != nil},
+		scanStatus,
+		scanSignature,
+		scannedAt,
+		file.StoredSize,
+		file.Public,
+		integrityStatus,
+		integrityChecksum,
+		verifiedAt,
 	)
 
 	if err != nil {
 		return fmt.Errorf("failed to create file record: %w", err)
 	}
 
+	if err := r.setAttributes(ctx, file.ID, file.Attributes); err != nil {
+		// Don't leave a file without the attributes it was created with
+		r.exec(context.WithoutCancel(ctx), `DELETE FROM file_attributes WHERE file_id = ?`, file.ID)
+		r.exec(context.WithoutCancel(ctx), `DELETE FROM files WHERE id = ?`, file.ID)
+		return err
+	}
+
+	return nil
+}
+
+// setAttributes replaces the custom attributes of a file
+func (r *Repository) setAttributes(ctx context.Context, id string, attrs map[string]string) error {
+	if _, err := r.exec(ctx, `DELETE FROM file_attributes WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to replace file attributes: %w", err)
+	}
+	for key, value := range attrs {
+		query := `INSERT INTO file_attributes (file_id, key, value) VALUES (?, ?, ?)`
+		if _, err := r.exec(ctx, query, id, key, value); err != nil {
+			return fmt.Errorf("failed to store file attribute: %w", err)
+		}
+	}
+	return nil
+}
+
+// maxAttributeLookup is the number of files whose attributes are looked up
+// by ID; larger listings read every attribute instead of binding more
+// parameters than SQLite allows
+const maxAttributeLookup = 500
+
+// loadAttributes fills in the custom attributes of files
+func (r *Repository) loadAttributes(ctx context.Context, fileList []*files.File) error {
+	if len(fileList) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*files.File, len(fileList))
+	for _, file := range fileList {
+		byID[file.ID] = file
+	}
+	query := `SELECT file_id, key, value FROM file_attributes`
+	var args []any
+	if len(byID) <= maxAttributeLookup {
+		query += ` WHERE file_id IN (?` + strings.Repeat(", ?", len(byID)-1) + `)`
+		for id := range byID {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query file attributes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, key, value string
+		if err := rows.Scan(&id, &key, &value); err != nil {
+			return fmt.Errorf("failed to scan file attribute row: %w", err)
+		}
+		file, ok := byID[id]
+		if !ok {
+			continue
+		}
+		if file.Attributes == nil {
+			file.Attributes = make(map[string]string)
+		}
+		file.Attributes[key] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating file attribute rows: %w", err)
+	}
+
 	return nil
 }
 
 // FindByID retrieves file metadata by ID
-func (r *Repository) FindByID(id string) (*files.File, error) {
+func (r *Repository) FindByID(ctx context.Context, id string) (*files.File, error) {
 	query := `
-	SELECT id, name, tag, size, mime_type, created_at, expires_at
+	SELECT ` + fileColumns + `
 	FROM files
 	WHERE id = ?
 	`
 
-	var file files.File
-	var tag sql.NullString
-	err := r.db.QueryRow(query, id).Scan(
-		&file.ID,
-		&file.Name,
-		&tag,
-		&file.Size,
-		&file.MimeType,
-		&file.CreatedAt,
-		&file.ExpiresAt,
-	)
-	if tag.Valid {
-		file.Tag = tag.String
-	}
-
+	file, err := scanFile(r.queryRow(ctx, query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("file not found")
+			return nil, files.ErrNotFound
 		}
 		return nil, fmt.Errorf("failed to find file: %w", err)
 	}
+	if err := r.loadAttributes(ctx, []*files.File{file}); err != nil {
+		return nil, err
+	}
 
-	return &file, nil
+	return file, nil
 }
 
-// FindByTag retrieves the latest file metadata by tag
-func (r *Repository) FindByTag(tag string) (*files.File, error) {
+// FindByTag retrieves the latest file metadata by tag among the files
+// created at or before asOf
+func (r *Repository) FindByTag(ctx context.Context, tag string, asOf time.Time) (*files.File, error) {
 	query := `
-	SELECT id, name, tag, size, mime_type, created_at, expires_at
+	SELECT ` + fileColumns + `
 	FROM files
-	WHERE tag = ?
+	WHERE tag = ? AND status IN ('active', '') AND created_at <= ?
 	ORDER BY created_at DESC
 	LIMIT 1
 	`
 
-	var file files.File
-	var sqlTag sql.NullString
-	err := r.db.QueryRow(query, tag).Scan(
-		&file.ID,
-		&file.Name,
-		&sqlTag,
-		&file.Size,
-		&file.MimeType,
-		&file.CreatedAt,
-		&file.ExpiresAt,
-	)
-	if sqlTag.Valid {
-		file.Tag = sqlTag.String
-	}
+	return r.findByTag(ctx, query, tag, asOf)
+}
+
+// FindLatestNonExpiredByTag retrieves the most recent file with a tag that
+// was created at or before asOf and hasn't expired at now
+func (r *Repository) FindLatestNonExpiredByTag(ctx context.Context, tag string, asOf, now time.Time) (*files.File, error) {
+	query := `
+	SELECT ` + fileColumns + `
+	FROM files
+	WHERE tag = ? AND status IN ('active', '') AND created_at <= ? AND (pinned = 1 OR expires_at >= ?)
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+
+	return r.findByTag(ctx, query, tag, asOf, now)
+}
 
+// findByTag runs a query for at most one file with a tag
+func (r *Repository) findByTag(ctx context.Context, query string, args ...any) (*files.File, error) {
+	fileList, err := r.queryFiles(ctx, query, args...)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("file not found")
-		}
 		return nil, fmt.Errorf("failed to find file by tag: %w", err)
 	}
+	if len(fileList) == 0 {
+		return nil, files.ErrNotFound
+	}
+	return fileList[0], nil
+}
 
-	return &file, nil
+// FindByName retrieves the metadata of the files with a tag and a name
+func (r *Repository) FindByName(ctx context.Context, tag, name string) ([]*files.File, error) {
+	query := `
+	SELECT ` + fileColumns + `
+	FROM files
+	WHERE COALESCE(tag, '') = ? AND name = ?
+	`
+
+	fileList, err := r.queryFiles(ctx, query, tag, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find files by name: %w", err)
+	}
+	return fileList, nil
 }
 
 // List retrieves all file metadata
-func (r *Repository) List() ([]*files.File, error) {
+func (r *Repository) List(ctx context.Context) ([]*files.File, error) {
 	query := `
-	SELECT id, name, tag, size, mime_type, created_at, expires_at
+	SELECT ` + fileColumns + `
 	FROM files
 	ORDER BY created_at DESC
 	`
 
-	rows, err := r.db.Query(query)
+	return r.queryFiles(ctx, query)
+}
+
+// Search retrieves the files matching all terms in the full-text index,
+// ranked by BM25 with name matches weighing most, then tag and attributes
+func (r *Repository) Search(ctx context.Context, terms []string) ([]*files.File, error) {
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	// Each term is a quoted prefix query, so its punctuation can't be taken
+	// for FTS5 syntax
+	match := make([]string, len(terms))
+	for i, term := range terms {
+		match[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+
+	query := `
+	SELECT ` + fileColumns + `
+	FROM files
+	JOIN (
+		SELECT file_id, bm25(files_search, 0, 10.0, 5.0, 1.0) AS rank
+		FROM files_search
+		WHERE files_search MATCH ?
+	) AS matches ON matches.file_id = files.id
+	ORDER BY matches.rank, created_at DESC
+	`
+
+	fileList, err := r.queryFiles(ctx, query, strings.Join(match, " "))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search files: %w", err)
+	}
+	return fileList, nil
+}
+
+// queryFiles runs a query selecting fileColumns and scans all resulting rows
+func (r *Repository) queryFiles(ctx context.Context, query string, args ...any) ([]*files.File, error) {
+	rows, err := r.query(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query files: %w", err)
 	}
@@ -183,38 +415,230 @@ func (r *Repository) List() ([]*files.File, error) {
 
 	var fileList []*files.File
 	for rows.Next() {
-		var file files.File
-		var tag sql.NullString
-		err := rows.Scan(
-			&file.ID,
-			&file.Name,
-			&tag,
-			&file.Size,
-			&file.MimeType,
-			&file.CreatedAt,
-			&file.ExpiresAt,
-		)
-		if tag.Valid {
-			file.Tag = tag.String
-		}
+		file, err := scanFile(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan file row: %w", err)
 		}
-		fileList = append(fileList, &file)
+		fileList = append(fileList, file)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating file rows: %w", err)
 	}
+	rows.Close()
+
+	if err := r.loadAttributes(ctx, fileList); err != nil {
+		return nil, err
+	}
 
 	return fileList, nil
 }
 
+// SetPinned marks a file as pinned or unpinned
+func (r *Repository) SetPinned(ctx context.Context, id string, pinned bool) error {
+	query := `UPDATE files SET pinned = ? WHERE id = ?`
+
+	result, err := r.exec(ctx, query, pinned, id)
+	if err != nil {
+		return fmt.Errorf("failed to update file record: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return files.ErrNotFound
+	}
+
+	return nil
+}
+
+// Update stores the mutable metadata fields of an existing file
+func (r *Repository) Update(ctx context.Context, file *files.File) error {
+	query := `
+	UPDATE files
+	SET name = ?, tag = ?, description = ?, link = ?, pinned = ?, public = ?, expires_at = ?
+	WHERE id = ?
+	`
+
+	result, err := r.exec(ctx, query,
+		file.Name,
+		file.Tag,
+		file.Description,
+		file.Link,
+		file.Pinned,
+		file.Public,
+		file.ExpiresAt,
+		file.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update file record: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return files.ErrNotFound
+	}
+
+	return r.setAttributes(ctx, file.ID, file.Attributes)
+}
+
+// SetStatus moves a file from one status to another
+func (r *Repository) SetStatus(ctx context.Context, id, from, to string) error {
+	query := `UPDATE files SET status = ? WHERE id = ? AND status = ?`
+
+	result, err := r.exec(ctx, query, to, id, from)
+	if err != nil {
+		return fmt.Errorf("failed to update file status: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("file with status %q not found", from)
+	}
+
+	return nil
+}
+
+// SetIntegrity records the outcome of verifying a file's content
+func (r *Repository) SetIntegrity(ctx context.Context, id string, check *files.IntegrityCheck) error {
+	query := `
+	UPDATE files
+	SET integrity_status = ?, integrity_checksum = ?, verified_at = ?
+	WHERE id = ?
+	`
+
+	status, checksum, verifiedAt := integrityValues(check)
+	result, err := r.exec(ctx, query, status, checksum, verifiedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update file integrity: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return files.ErrNotFound
+	}
+
+	return nil
+}
+
+// CompleteUpload stores the content metadata, status and times of a
+// processing file
+func (r *Repository) CompleteUpload(ctx context.Context, file *files.File) error {
+	query := `
+	UPDATE files
+	SET size = ?, stored_size = ?, mime_type = ?, detected_mime_type = ?, checksum = ?, status = ?, created_at = ?, expires_at = ?,
+		scan_status = ?, scan_signature = ?, scanned_at = ?
+	WHERE id = ? AND status = 'processing'
+	`
+
+	scanStatus, scanSignature, scannedAt := scanValues(file)
+	result, err := r.exec(ctx, query,
+		file.Size,
+		file.StoredSize,
+		file.MimeType,
+		file.DetectedMimeType,
+		file.Checksum,
+		file.Status,
+		file.CreatedAt,
+		file.ExpiresAt,
+		scanStatus,
+		scanSignature,
+		scannedAt,
+		file.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to complete file record: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("processing %w", files.ErrNotFound)
+	}
+
+	return nil
+}
+
+// FailStalledUploads marks files still pending or processing that were
+// registered before the given time as failed and returns their IDs
+func (r *Repository) FailStalledUploads(ctx context.Context, registeredBefore time.Time) ([]string, error) {
+	query := `
+	SELECT ` + fileColumns + `
+	FROM files
+	WHERE status IN ('pending', 'processing') AND created_at < ?
+	`
+
+	fileList, err := r.queryFiles(ctx, query, registeredBefore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find pending files: %w", err)
+	}
+
+	var ids []string
+	for _, file := range fileList {
+		// A transfer completing meanwhile wins
+		result, err := r.exec(ctx, `UPDATE files SET status = 'failed' WHERE id = ? AND status = ?`, file.ID, file.Status)
+		if err != nil {
+			return ids, fmt.Errorf("failed to update file record: %w", err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			ids = append(ids, file.ID)
+		}
+	}
+
+	return ids, nil
+}
+
 // Delete removes file metadata by ID
-func (r *Repository) Delete(id string) error {
+func (r *Repository) Delete(ctx context.Context, id string) error {
+	if _, err := r.exec(ctx, `DELETE FROM stars WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file stars: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM comments WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file comments: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM thumbnails WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file thumbnails: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM short_links WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file short links: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM links WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file links: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM download_codes WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file download codes: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM file_attributes WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file attributes: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM downloads WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file downloads: %w", err)
+	}
+	if _, err := r.exec(ctx, `DELETE FROM accesses WHERE file_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete file accesses: %w", err)
+	}
+
 	query := `DELETE FROM files WHERE id = ?`
 
-	result, err := r.db.Exec(query, id)
+	result, err := r.exec(ctx, query, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete file record: %w", err)
 	}
@@ -225,8 +649,867 @@ func (r *Repository) Delete(id string) error {
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("file not found")
+		return files.ErrNotFound
 	}
 
 	return nil
 }
+
+// CleanupExpired removes the metadata of files expired at now, with
+// everything attached to them, and returns the storage IDs of the removed
+// files and of their thumbnails
+func (r *Repository) CleanupExpired(ctx context.Context, now time.Time) (fileIDs, thumbnailIDs []string, err error) {
+	query := `
+	SELECT ` + fileColumns + `
+	FROM files
+	WHERE pinned = 0 AND (status = 'expired' OR expires_at < ?)
+	`
+
+	fileList, err := r.queryFiles(ctx, query, now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find expired files: %w", err)
+	}
+
+	for _, file := range fileList {
+		thumbs, err := r.ListThumbnails(ctx, file.ID)
+		if err != nil {
+			return fileIDs, thumbnailIDs, err
+		}
+		if err := r.Delete(ctx, file.ID); err != nil {
+			return fileIDs, thumbnailIDs, err
+		}
+		tombstone := &files.Tombstone{ID: file.ID, Name: file.Name, Tag: file.Tag, DeletedAt: now, Reason: files.ReasonExpired}
+		if err := r.CreateTombstone(ctx, tombstone); err != nil {
+			return fileIDs, thumbnailIDs, err
+		}
+		for _, thumb := range thumbs {
+			thumbnailIDs = append(thumbnailIDs, thumb.StorageID)
+		}
+		fileIDs = append(fileIDs, file.ID)
+	}
+
+	return fileIDs, thumbnailIDs, nil
+}
+
+// Star marks a file as starred by a user
+func (r *Repository) Star(ctx context.Context, user, id string) error {
+	query := `
+	INSERT INTO stars (user, file_id, created_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT (user, file_id) DO NOTHING
+	`
+
+	if _, err := r.exec(ctx, query, user, id, time.Now()); err != nil {
+		return fmt.Errorf("failed to star file: %w", err)
+	}
+
+	return nil
+}
+
+// Unstar removes a user's star from a file
+func (r *Repository) Unstar(ctx context.Context, user, id string) error {
+	query := `DELETE FROM stars WHERE user = ? AND file_id = ?`
+
+	if _, err := r.exec(ctx, query, user, id); err != nil {
+		return fmt.Errorf("failed to unstar file: %w", err)
+	}
+
+	return nil
+}
+
+// ListStarred retrieves metadata of all files starred by a user
+func (r *Repository) ListStarred(ctx context.Context, user string) ([]*files.File, error) {
+	query := `
+	SELECT ` + prefixColumns("f.", fileColumns) + `
+	FROM files f
+	JOIN stars s ON s.file_id = f.id
+	WHERE s.user = ?
+	ORDER BY f.created_at DESC
+	`
+
+	return r.queryFiles(ctx, query, user)
+}
+
+// SaveSearch stores a saved search, replacing one with the same name
+func (r *Repository) SaveSearch(ctx context.Context, search *files.SavedSearch) error {
+	query := `
+	INSERT INTO saved_searches (name, query, created_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT (name) DO UPDATE SET query = excluded.query, created_at = excluded.created_at
+	`
+
+	if _, err := r.exec(ctx, query, search.Name, search.Query, search.CreatedAt); err != nil {
+		return fmt.Errorf("failed to save search: %w", err)
+	}
+
+	return nil
+}
+
+// FindSavedSearch retrieves a saved search by name
+func (r *Repository) FindSavedSearch(ctx context.Context, name string) (*files.SavedSearch, error) {
+	query := `SELECT name, query, created_at FROM saved_searches WHERE name = ?`
+
+	var search files.SavedSearch
+	err := r.queryRow(ctx, query, name).Scan(&search.Name, &search.Query, &search.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("saved search %w", files.ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to find saved search: %w", err)
+	}
+
+	return &search, nil
+}
+
+// ListSavedSearches retrieves all saved searches ordered by name
+func (r *Repository) ListSavedSearches(ctx context.Context) ([]*files.SavedSearch, error) {
+	query := `SELECT name, query, created_at FROM saved_searches ORDER BY name`
+
+	rows, err := r.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query saved searches: %w", err)
+	}
+	defer rows.Close()
+
+	var searches []*files.SavedSearch
+	for rows.Next() {
+		var search files.SavedSearch
+		if err := rows.Scan(&search.Name, &search.Query, &search.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan saved search row: %w", err)
+		}
+		searches = append(searches, &search)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating saved search rows: %w", err)
+	}
+
+	return searches, nil
+}
+
+// DeleteSavedSearch removes a saved search by name
+func (r *Repository) DeleteSavedSearch(ctx context.Context, name string) error {
+	result, err := r.exec(ctx, `DELETE FROM saved_searches WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete saved search: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("saved search %w", files.ErrNotFound)
+	}
+
+	return nil
+}
+
+// CreateComment stores a comment on a file
+func (r *Repository) CreateComment(ctx context.Context, comment *files.Comment) error {
+	query := `
+	INSERT INTO comments (id, file_id, author, body, created_at)
+	VALUES (?, ?, ?, ?, ?)
+	`
+
+	_, err := r.exec(ctx, query, comment.ID, comment.FileID, comment.Author, comment.Body, comment.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create comment record: %w", err)
+	}
+
+	return nil
+}
+
+// ListComments retrieves the comments on a file, oldest first
+func (r *Repository) ListComments(ctx context.Context, fileID string) ([]*files.Comment, error) {
+	query := `
+	SELECT id, file_id, author, body, created_at
+	FROM comments
+	WHERE file_id = ?
+	ORDER BY created_at
+	`
+
+	rows, err := r.query(ctx, query, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query comments: %w", err)
+	}
+	defer rows.Close()
+
+	var comments []*files.Comment
+	for rows.Next() {
+		var comment files.Comment
+		err := rows.Scan(&comment.ID, &comment.FileID, &comment.Author, &comment.Body, &comment.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan comment row: %w", err)
+		}
+		comments = append(comments, &comment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating comment rows: %w", err)
+	}
+
+	return comments, nil
+}
+
+// DeleteComment removes a comment from a file
+func (r *Repository) DeleteComment(ctx context.Context, fileID, id string) error {
+	result, err := r.exec(ctx, `DELETE FROM comments WHERE file_id = ? AND id = ?`, fileID, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete comment record: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("comment %w", files.ErrNotFound)
+	}
+
+	return nil
+}
+
+// CreateThumbnail stores thumbnail metadata, replacing an existing entry for the same size
+func (r *Repository) CreateThumbnail(ctx context.Context, thumb *files.Thumbnail) error {
+	query := `
+	INSERT OR REPLACE INTO thumbnails (file_id, width, height, storage_id, mime_type, size, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := r.exec(ctx, query,
+		thumb.FileID,
+		thumb.Width,
+		thumb.Height,
+		thumb.StorageID,
+		thumb.MimeType,
+		thumb.Size,
+		thumb.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create thumbnail record: %w", err)
+	}
+
+	return nil
+}
+
+// FindThumbnail retrieves thumbnail metadata for a file and size
+func (r *Repository) FindThumbnail(ctx context.Context, fileID string, width, height int) (*files.Thumbnail, error) {
+	query := `
+	SELECT file_id, width, height, storage_id, mime_type, size, created_at
+	FROM thumbnails
+	WHERE file_id = ? AND width = ? AND height = ?
+	`
+
+	var thumb files.Thumbnail
+	err := r.queryRow(ctx, query, fileID, width, height).Scan(
+		&thumb.FileID,
+		&thumb.Width,
+		&thumb.Height,
+		&thumb.StorageID,
+		&thumb.MimeType,
+		&thumb.Size,
+		&thumb.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("thumbnail not found")
+		}
+		return nil, fmt.Errorf("failed to find thumbnail: %w", err)
+	}
+
+	return &thumb, nil
+}
+
+// ListThumbnails retrieves metadata of all cached thumbnails of a file
+func (r *Repository) ListThumbnails(ctx context.Context, fileID string) ([]*files.Thumbnail, error) {
+	query := `
+	SELECT file_id, width, height, storage_id, mime_type, size, created_at
+	FROM thumbnails
+	WHERE file_id = ?
+	`
+
+	rows, err := r.query(ctx, query, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query thumbnails: %w", err)
+	}
+	defer rows.Close()
+
+	var thumbs []*files.Thumbnail
+	for rows.Next() {
+		var thumb files.Thumbnail
+		err := rows.Scan(
+			&thumb.FileID,
+			&thumb.Width,
+			&thumb.Height,
+			&thumb.StorageID,
+			&thumb.MimeType,
+			&thumb.Size,
+			&thumb.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan thumbnail row: %w", err)
+		}
+		thumbs = append(thumbs, &thumb)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating thumbnail rows: %w", err)
+	}
+
+	return thumbs, nil
+}
+
+// prefixColumns qualifies each column of a comma-separated list with a table alias
+func prefixColumns(prefix, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, col := range cols {
+		cols[i] = prefix + col
+	}
+	return strings.Join(cols, ", ")
+}
+
+// usageDayLayout formats usage sample days so they sort as text
+const usageDayLayout = "2006-01-02"
+
+// RecordUsage stores a daily usage sample, replacing any for the same day
+func (r *Repository) RecordUsage(ctx context.Context, sample *files.UsageSample) error {
+	query := `
+	INSERT INTO usage_history (day, files, bytes)
+	VALUES (?, ?, ?)
+	ON CONFLICT (day) DO UPDATE SET files = excluded.files, bytes = excluded.bytes
+	`
+
+	if _, err := r.exec(ctx, query, sample.Date.UTC().Format(usageDayLayout), sample.Files, sample.Bytes); err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+
+	return nil
+}
+
+// ListUsage retrieves the daily usage samples since a day, oldest first
+func (r *Repository) ListUsage(ctx context.Context, since time.Time) ([]*files.UsageSample, error) {
+	query := `
+	SELECT day, files, bytes
+	FROM usage_history
+	WHERE day >= ?
+	ORDER BY day
+	`
+
+	rows, err := r.query(ctx, query, since.UTC().Format(usageDayLayout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage history: %w", err)
+	}
+	defer rows.Close()
+
+	var samples []*files.UsageSample
+	for rows.Next() {
+		var day string
+		var sample files.UsageSample
+		if err := rows.Scan(&day, &sample.Files, &sample.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan usage row: %w", err)
+		}
+		sample.Date, err = time.Parse(usageDayLayout, day)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse usage day: %w", err)
+		}
+		samples = append(samples, &sample)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating usage rows: %w", err)
+	}
+
+	return samples, nil
+}
+
+// CreateLink stores an issued link
+func (r *Repository) CreateLink(ctx context.Context, link *files.Link) error {
+	query := `INSERT INTO links (id, file_id, options, created_by, created_at, one_time) VALUES (?, ?, ?, ?, ?, ?)`
+
+	if _, err := r.exec(ctx, query, link.ID, link.FileID, link.Options, link.CreatedBy, link.CreatedAt, link.OneTime); err != nil {
+		return fmt.Errorf("failed to create link: %w", err)
+	}
+
+	return nil
+}
+
+// FindLink retrieves an issued link by ID
+func (r *Repository) FindLink(ctx context.Context, id string) (*files.Link, error) {
+	query := `SELECT ` + linkColumns + ` FROM links WHERE id = ?`
+
+	link, err := scanLink(r.queryRow(ctx, query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("link %w", files.ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to find link: %w", err)
+	}
+
+	return link, nil
+}
+
+// linkColumns are the links columns read by scanLink
+const linkColumns = `id, file_id, options, created_by, created_at, one_time, used_at`
+
+// scanLink reads a single link row selected with linkColumns
+func scanLink(s scanner) (*files.Link, error) {
+	var link files.Link
+	var usedAt sql.NullTime
+	if err := s.Scan(&link.ID, &link.FileID, &link.Options, &link.CreatedBy, &link.CreatedAt, &link.OneTime, &usedAt); err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		link.UsedAt = &usedAt.Time
+	}
+	return &link, nil
+}
+
+// ListLinks retrieves the links issued for a file, or for every file when
+// fileID is empty, oldest first
+func (r *Repository) ListLinks(ctx context.Context, fileID string) ([]*files.Link, error) {
+	query := `SELECT ` + linkColumns + ` FROM links`
+	var args []any
+	if fileID != "" {
+		query += ` WHERE file_id = ?`
+		args = append(args, fileID)
+	}
+	query += ` ORDER BY created_at`
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []*files.Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan link: %w", err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate links: %w", err)
+	}
+	return links, nil
+}
+
+// UseLink marks a one-time link used at the given time. It fails when the
+// link was used already, so only one caller can use it.
+func (r *Repository) UseLink(ctx context.Context, id string, at time.Time) error {
+	result, err := r.exec(ctx, `UPDATE links SET used_at = ? WHERE id = ? AND used_at IS NULL`, at, id)
+	if err != nil {
+		return fmt.Errorf("failed to use link: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("link not found or %w", files.ErrLinkUsed)
+	}
+
+	return nil
+}
+
+// ReleaseLink marks a one-time link unused again, unless it was used at
+// another time than the given one
+func (r *Repository) ReleaseLink(ctx context.Context, id string, at time.Time) error {
+	if _, err := r.exec(ctx, `UPDATE links SET used_at = NULL WHERE id = ? AND used_at = ?`, id, at); err != nil {
+		return fmt.Errorf("failed to release link: %w", err)
+	}
+	return nil
+}
+
+// DeleteLink removes an issued link by ID
+func (r *Repository) DeleteLink(ctx context.Context, id string) error {
+	result, err := r.exec(ctx, `DELETE FROM links WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete link: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("link not found")
+	}
+
+	return nil
+}
+
+// CreateShortLink stores a short link
+func (r *Repository) CreateShortLink(ctx context.Context, link *files.ShortLink) error {
+	query := `INSERT INTO short_links (code, file_id, target, created_at) VALUES (?, ?, ?, ?)`
+
+	if _, err := r.exec(ctx, query, link.Code, link.FileID, link.Target, link.CreatedAt); err != nil {
+		return fmt.Errorf("failed to create short link: %w", err)
+	}
+
+	return nil
+}
+
+// FindShortLink retrieves a short link by code
+func (r *Repository) FindShortLink(ctx context.Context, code string) (*files.ShortLink, error) {
+	query := `SELECT code, file_id, target, created_at FROM short_links WHERE code = ?`
+
+	var link files.ShortLink
+	err := r.queryRow(ctx, query, code).Scan(&link.Code, &link.FileID, &link.Target, &link.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("short link not found")
+		}
+		return nil, fmt.Errorf("failed to find short link: %w", err)
+	}
+
+	return &link, nil
+}
+
+// CreateDownloadCode stores a download code, failing with
+// files.ErrCodeTaken when the code exists already
+func (r *Repository) CreateDownloadCode(ctx context.Context, code *files.DownloadCode) error {
+	query := `INSERT INTO download_codes (code, file_id, created_at) VALUES (?, ?, ?) ON CONFLICT (code) DO NOTHING`
+
+	result, err := r.exec(ctx, query, code.Code, code.FileID, code.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create download code: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return files.ErrCodeTaken
+	}
+
+	return nil
+}
+
+// FindDownloadCode retrieves a download code
+func (r *Repository) FindDownloadCode(ctx context.Context, code string) (*files.DownloadCode, error) {
+	return r.findDownloadCode(ctx, `SELECT code, file_id, created_at FROM download_codes WHERE code = ?`, code)
+}
+
+// FindFileDownloadCode retrieves the download code of a file
+func (r *Repository) FindFileDownloadCode(ctx context.Context, fileID string) (*files.DownloadCode, error) {
+	return r.findDownloadCode(ctx, `SELECT code, file_id, created_at FROM download_codes WHERE file_id = ? ORDER BY created_at LIMIT 1`, fileID)
+}
+
+func (r *Repository) findDownloadCode(ctx context.Context, query string, arg string) (*files.DownloadCode, error) {
+	var code files.DownloadCode
+	err := r.queryRow(ctx, query, arg).Scan(&code.Code, &code.FileID, &code.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("download code not found")
+		}
+		return nil, fmt.Errorf("failed to find download code: %w", err)
+	}
+
+	return &code, nil
+}
+
+// RecordDownload counts a completed download of bytes from a file
+func (r *Repository) RecordDownload(ctx context.Context, id string, bytes int64, at time.Time) error {
+	query := `
+	INSERT INTO downloads (file_id, count, bytes, last_downloaded_at)
+	VALUES (?, 1, ?, ?)
+	ON CONFLICT (file_id) DO UPDATE SET
+		count = count + 1,
+		bytes = bytes + excluded.bytes,
+		last_downloaded_at = excluded.last_downloaded_at
+	`
+
+	if _, err := r.exec(ctx, query, id, bytes, at); err != nil {
+		return fmt.Errorf("failed to record download: %w", err)
+	}
+
+	return nil
+}
+
+// FindDownloads retrieves the download stats of a file, which are zero for
+// files never downloaded
+func (r *Repository) FindDownloads(ctx context.Context, id string) (*files.DownloadStats, error) {
+	query := `SELECT count, bytes, last_downloaded_at FROM downloads WHERE file_id = ?`
+
+	var stats files.DownloadStats
+	var last time.Time
+	err := r.queryRow(ctx, query, id).Scan(&stats.Downloads, &stats.BytesServed, &last)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &stats, nil
+		}
+		return nil, fmt.Errorf("failed to find downloads: %w", err)
+	}
+	stats.LastDownloadedAt = &last
+
+	return &stats, nil
+}
+
+// ListDownloads retrieves the download stats of every file downloaded at
+// least once, by file ID
+func (r *Repository) ListDownloads(ctx context.Context) (map[string]files.DownloadStats, error) {
+	query := `SELECT file_id, count, bytes, last_downloaded_at FROM downloads`
+
+	rows, err := r.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list downloads: %w", err)
+	}
+	defer rows.Close()
+
+	downloads := make(map[string]files.DownloadStats)
+	for rows.Next() {
+		var id string
+		var stats files.DownloadStats
+		var last time.Time
+		if err := rows.Scan(&id, &stats.Downloads, &stats.BytesServed, &last); err != nil {
+			return nil, fmt.Errorf("failed to scan downloads: %w", err)
+		}
+		stats.LastDownloadedAt = &last
+		downloads[id] = stats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate downloads: %w", err)
+	}
+
+	return downloads, nil
+}
+
+// RecordAccess adds a download request to the access log of its file
+func (r *Repository) RecordAccess(ctx context.Context, access *files.Access) error {
+	query := `
+	INSERT INTO accesses (file_id, at, ip, user_agent, bytes, status)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	if _, err := r.exec(ctx, query, access.FileID, access.At, access.IP, access.UserAgent, access.Bytes, access.Status); err != nil {
+		return fmt.Errorf("failed to record access: %w", err)
+	}
+
+	return nil
+}
+
+// ListAccesses retrieves a page of the access log of a file, latest first,
+// with the number of accesses on all pages
+func (r *Repository) ListAccesses(ctx context.Context, fileID string, limit, offset int) ([]*files.Access, int, error) {
+	var total int
+	if err := r.queryRow(ctx, `SELECT COUNT(*) FROM accesses WHERE file_id = ?`, fileID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count accesses: %w", err)
+	}
+
+	// Accesses are numbered in the order they were recorded
+	query := `
+	SELECT at, ip, user_agent, bytes, status
+	FROM accesses
+	WHERE file_id = ?
+	ORDER BY id DESC
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := r.query(ctx, query, fileID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list accesses: %w", err)
+	}
+	defer rows.Close()
+
+	var accesses []*files.Access
+	for rows.Next() {
+		access := &files.Access{FileID: fileID}
+		if err := rows.Scan(&access.At, &access.IP, &access.UserAgent, &access.Bytes, &access.Status); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan access: %w", err)
+		}
+		accesses = append(accesses, access)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to iterate accesses: %w", err)
+	}
+
+	return accesses, total, nil
+}
+
+// CreateTombstone stores the tombstone of a deleted file, replacing any
+// earlier one for the same ID
+func (r *Repository) CreateTombstone(ctx context.Context, tombstone *files.Tombstone) error {
+	query := `
+	INSERT OR REPLACE INTO tombstones (id, name, tag, deleted_at, deleted_by, reason)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := r.exec(ctx, query, tombstone.ID, tombstone.Name, tombstone.Tag, tombstone.DeletedAt, tombstone.DeletedBy, tombstone.Reason)
+	if err != nil {
+		return fmt.Errorf("failed to create tombstone: %w", err)
+	}
+
+	return nil
+}
+
+// FindTombstone retrieves the tombstone of a deleted file
+func (r *Repository) FindTombstone(ctx context.Context, id string) (*files.Tombstone, error) {
+	query := `SELECT id, name, tag, deleted_at, deleted_by, reason FROM tombstones WHERE id = ?`
+
+	var tombstone files.Tombstone
+	err := r.queryRow(ctx, query, id).Scan(&tombstone.ID, &tombstone.Name, &tombstone.Tag, &tombstone.DeletedAt, &tombstone.DeletedBy, &tombstone.Reason)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("tombstone not found")
+		}
+		return nil, fmt.Errorf("failed to find tombstone: %w", err)
+	}
+
+	return &tombstone, nil
+}
+
+// ListTombstones retrieves all tombstones, most recently deleted first
+func (r *Repository) ListTombstones(ctx context.Context) ([]*files.Tombstone, error) {
+	query := `SELECT id, name, tag, deleted_at, deleted_by, reason FROM tombstones ORDER BY deleted_at DESC`
+
+	rows, err := r.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tombstones: %w", err)
+	}
+	defer rows.Close()
+
+	var tombstones []*files.Tombstone
+	for rows.Next() {
+		var tombstone files.Tombstone
+		if err := rows.Scan(&tombstone.ID, &tombstone.Name, &tombstone.Tag, &tombstone.DeletedAt, &tombstone.DeletedBy, &tombstone.Reason); err != nil {
+			return nil, fmt.Errorf("failed to scan tombstone: %w", err)
+		}
+		tombstones = append(tombstones, &tombstone)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate tombstones: %w", err)
+	}
+	return tombstones, nil
+}
+
+// DeleteTombstones removes tombstones of files deleted before the given
+// time and returns how many were removed
+func (r *Repository) DeleteTombstones(ctx context.Context, before time.Time) (int, error) {
+	result, err := r.exec(ctx, `DELETE FROM tombstones WHERE deleted_at < ?`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete tombstones: %w", err)
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return int(removed), nil
+}
+
+// SaveUploadPart stores a part of a multipart upload, replacing the part
+// with the same number
+func (r *Repository) SaveUploadPart(ctx context.Context, part *files.UploadPart) error {
+	query := `
+	INSERT OR REPLACE INTO upload_parts (file_id, number, size, checksum, created_at)
+	VALUES (?, ?, ?, ?, ?)
+	`
+
+	_, err := r.exec(ctx, query, part.FileID, part.Number, part.Size, part.Checksum, part.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save upload part: %w", err)
+	}
+
+	return nil
+}
+
+// ListUploadParts retrieves the parts of a multipart upload by number, or
+// of every upload when fileID is empty
+func (r *Repository) ListUploadParts(ctx context.Context, fileID string) ([]*files.UploadPart, error) {
+	query := `
+	SELECT file_id, number, size, checksum, created_at
+	FROM upload_parts
+	WHERE ? = '' OR file_id = ?
+	ORDER BY file_id, number
+	`
+
+	rows, err := r.query(ctx, query, fileID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upload parts: %w", err)
+	}
+	defer rows.Close()
+
+	var parts []*files.UploadPart
+	for rows.Next() {
+		var part files.UploadPart
+		if err := rows.Scan(&part.FileID, &part.Number, &part.Size, &part.Checksum, &part.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan upload part: %w", err)
+		}
+		parts = append(parts, &part)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate upload parts: %w", err)
+	}
+
+	return parts, nil
+}
+
+// DeleteUploadParts removes the parts of a multipart upload
+func (r *Repository) DeleteUploadParts(ctx context.Context, fileID string) error {
+	if _, err := r.exec(ctx, `DELETE FROM upload_parts WHERE file_id = ?`, fileID); err != nil {
+		return fmt.Errorf("failed to delete upload parts: %w", err)
+	}
+	return nil
+}
+
+// danglingTables are the tables whose rows belong to a file, by file_id
+var danglingTables = []string{"stars", "comments", "thumbnails", "short_links", "links", "download_codes", "file_attributes", "downloads", "accesses", "files_search"}
+
+// PurgeDangling removes the rows left behind by files that are gone, e.g.
+// by deletions interrupted before they removed the file's row, and returns
+// how many it removed. The content of dangling thumbnails is left in
+// storage, unreferenced. Upload parts are left to the service, which
+// removes their content along with them.
+func (r *Repository) PurgeDangling(ctx context.Context) (int, error) {
+	removed := 0
+	for _, table := range danglingTables {
+		result, err := r.exec(ctx, `DELETE FROM `+table+` WHERE file_id NOT IN (SELECT id FROM files)`)
+		if err != nil {
+			return removed, fmt.Errorf("failed to purge dangling %s: %w", table, err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return removed, fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		removed += int(rows)
+	}
+	return removed, nil
+}
+
+// Optimize rebuilds the database file to reclaim the space of deleted rows
+// and refreshes the statistics the query planner relies on. VACUUM needs
+// the database to itself, so this waits for or fails on other connections.
+func (r *Repository) Optimize(ctx context.Context) error {
+	if _, err := r.exec(ctx, `INSERT INTO files_search (files_search) VALUES ('optimize')`); err != nil {
+		return fmt.Errorf("failed to optimize search index: %w", err)
+	}
+	if _, err := r.exec(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	if _, err := r.exec(ctx, `PRAGMA optimize`); err != nil {
+		return fmt.Errorf("failed to optimize database: %w", err)
+	}
+	return nil
+}
+
+// Ping verifies the database connection and that the schema can be queried
+func (r *Repository) Ping(ctx context.Context) error {
+	if err := r.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+	var count int
+	if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master`).Scan(&count); err != nil {
+		return fmt.Errorf("failed to query database: %w", err)
+	}
+	return nil
+}
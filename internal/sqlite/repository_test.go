@@ -0,0 +1,647 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+func TestRepositoryHonorsContext(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	file := &files.File{ID: "1", Name: "a.txt", Size: 1, MimeType: "text/plain", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, repo.Create(context.Background(), file))
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := repo.Create(ctx, &files.File{ID: "2", Name: "b.txt", CreatedAt: now, ExpiresAt: now})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		_, err = repo.List(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// Nothing was written by the cancelled call
+		_, err = repo.FindByID(context.Background(), "2")
+		assert.Error(t, err)
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), now.Add(-time.Second))
+		defer cancel()
+
+		_, err := repo.FindByID(ctx, "1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		err = repo.Delete(ctx, "1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// The file survived the expired delete
+		found, err := repo.FindByID(context.Background(), "1")
+		require.NoError(t, err)
+		assert.Equal(t, "a.txt", found.Name)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := repo.FindByID(context.Background(), "missing")
+		assert.ErrorIs(t, err, files.ErrNotFound)
+
+		err = repo.Delete(context.Background(), "missing")
+		assert.ErrorIs(t, err, files.ErrNotFound)
+	})
+}
+
+func TestRepositoryCleanupExpired(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "expired", Name: "a.txt", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "live", Name: "b.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "pinned", Name: "c.txt", Pinned: true, CreatedAt: now, ExpiresAt: now.Add(-time.Minute)}))
+	require.NoError(t, repo.CreateThumbnail(ctx, &files.Thumbnail{FileID: "expired", Width: 64, Height: 64, StorageID: "expired.thumb-64x64", CreatedAt: now}))
+
+	fileIDs, thumbnailIDs, err := repo.CleanupExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"expired"}, fileIDs)
+	assert.Equal(t, []string{"expired.thumb-64x64"}, thumbnailIDs)
+
+	_, err = repo.FindByID(ctx, "expired")
+	assert.Error(t, err)
+	thumbs, err := repo.ListThumbnails(ctx, "expired")
+	require.NoError(t, err)
+	assert.Empty(t, thumbs)
+
+	remaining, err := repo.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, remaining, 2)
+
+	// A second pass finds nothing left to remove
+	fileIDs, thumbnailIDs, err = repo.CleanupExpired(ctx, now)
+	require.NoError(t, err)
+	assert.Empty(t, fileIDs)
+	assert.Empty(t, thumbnailIDs)
+}
+
+func TestRepositoryCompleteUpload(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", Tag: "docs", Status: files.StatusPending, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	// Pending files aren't the latest of their tag
+	_, err = repo.FindByTag(ctx, "docs", now)
+	assert.Error(t, err)
+
+	// Only processing files can be completed
+	completed := &files.File{ID: "1", Size: 5, StoredSize: 3, MimeType: "text/plain", Checksum: "abc", Status: files.StatusActive, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.Error(t, repo.CompleteUpload(ctx, completed))
+	assert.Error(t, repo.SetStatus(ctx, "1", files.StatusActive, files.StatusProcessing))
+	require.NoError(t, repo.SetStatus(ctx, "1", files.StatusPending, files.StatusProcessing))
+	require.NoError(t, repo.CompleteUpload(ctx, completed))
+
+	found, err := repo.FindByTag(ctx, "docs", now)
+	require.NoError(t, err)
+	assert.Equal(t, files.StatusActive, found.Status)
+	assert.Equal(t, int64(5), found.Size)
+	assert.Equal(t, int64(3), found.StoredSize)
+	assert.Equal(t, "abc", found.Checksum)
+	assert.Equal(t, "a.txt", found.Name)
+
+	assert.Error(t, repo.CompleteUpload(ctx, completed))
+}
+
+func TestRepositoryScanResults(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	scannedAt := now.Truncate(time.Second).UTC()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", Status: files.StatusActive, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{
+		ID: "2", Name: "b.exe", Status: files.StatusQuarantined, CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+		Scan: &files.ScanResult{Status: files.ScanInfected, Signature: "Eicar-Test-Signature", ScannedAt: scannedAt},
+	}))
+
+	unscanned, err := repo.FindByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Nil(t, unscanned.Scan)
+
+	infected, err := repo.FindByID(ctx, "2")
+	require.NoError(t, err)
+	require.NotNil(t, infected.Scan)
+	assert.Equal(t, files.ScanInfected, infected.Scan.Status)
+	assert.Equal(t, "Eicar-Test-Signature", infected.Scan.Signature)
+	assert.True(t, scannedAt.Equal(infected.Scan.ScannedAt))
+
+	// Registered files are scanned when their content arrives
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "3", Name: "c.txt", Status: files.StatusProcessing, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.CompleteUpload(ctx, &files.File{
+		ID: "3", Status: files.StatusActive, CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+		Scan: &files.ScanResult{Status: files.ScanClean, ScannedAt: scannedAt},
+	}))
+	clean, err := repo.FindByID(ctx, "3")
+	require.NoError(t, err)
+	require.NotNil(t, clean.Scan)
+	assert.Equal(t, files.ScanClean, clean.Scan.Status)
+}
+
+func TestRepositoryFindLatestNonExpiredByTag(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "v1", Tag: "release", Status: files.StatusActive, CreatedAt: now.Add(-3 * time.Hour), ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "2", Name: "v2", Tag: "release", Status: files.StatusActive, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Minute)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "3", Name: "v3", Tag: "release", Status: files.StatusActive, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute), Pinned: true}))
+
+	latest, err := repo.FindByTag(ctx, "release", now)
+	require.NoError(t, err)
+	assert.Equal(t, "3", latest.ID)
+
+	// Pinned files never expire
+	latest, err = repo.FindLatestNonExpiredByTag(ctx, "release", now, now)
+	require.NoError(t, err)
+	assert.Equal(t, "3", latest.ID)
+
+	latest, err = repo.FindLatestNonExpiredByTag(ctx, "release", now.Add(-90*time.Minute), now)
+	require.NoError(t, err)
+	assert.Equal(t, "1", latest.ID)
+
+	_, err = repo.FindLatestNonExpiredByTag(ctx, "release", now, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	_, err = repo.FindLatestNonExpiredByTag(ctx, "release", now.Add(-90*time.Minute), now.Add(2*time.Hour))
+	assert.Error(t, err)
+}
+
+func TestRepositoryFindByName(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "app.txt", Tag: "release", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "2", Name: "app.txt", Tag: "release", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "3", Name: "app.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "4", Name: "notes.txt", Tag: "release", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	ids := func(tag, name string) []string {
+		fileList, err := repo.FindByName(ctx, tag, name)
+		require.NoError(t, err)
+		var ids []string
+		for _, file := range fileList {
+			ids = append(ids, file.ID)
+		}
+		return ids
+	}
+	assert.ElementsMatch(t, []string{"1", "2"}, ids("release", "app.txt"))
+	assert.Equal(t, []string{"3"}, ids("", "app.txt"))
+	assert.Empty(t, ids("release", "missing.txt"))
+}
+
+func TestRepositoryIntegrity(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	verifiedAt := now.Truncate(time.Second).UTC()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", Checksum: "abc", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	unverified, err := repo.FindByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Nil(t, unverified.Integrity)
+
+	require.NoError(t, repo.SetIntegrity(ctx, "1", &files.IntegrityCheck{Status: files.IntegrityMismatch, Checksum: "def", VerifiedAt: verifiedAt}))
+	verified, err := repo.FindByID(ctx, "1")
+	require.NoError(t, err)
+	require.NotNil(t, verified.Integrity)
+	assert.Equal(t, files.IntegrityMismatch, verified.Integrity.Status)
+	assert.Equal(t, "def", verified.Integrity.Checksum)
+	assert.True(t, verifiedAt.Equal(verified.Integrity.VerifiedAt))
+
+	assert.Error(t, repo.SetIntegrity(ctx, "missing", &files.IntegrityCheck{Status: files.IntegrityOK, VerifiedAt: verifiedAt}))
+}
+
+func TestRepositoryUploadParts(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second).UTC()
+	require.NoError(t, repo.SaveUploadPart(ctx, &files.UploadPart{FileID: "b", Number: 1, Size: 3, Checksum: "x", CreatedAt: now}))
+	require.NoError(t, repo.SaveUploadPart(ctx, &files.UploadPart{FileID: "a", Number: 2, Size: 5, Checksum: "y", CreatedAt: now}))
+	require.NoError(t, repo.SaveUploadPart(ctx, &files.UploadPart{FileID: "a", Number: 1, Size: 4, Checksum: "z", CreatedAt: now}))
+	// Uploading a part again replaces it
+	require.NoError(t, repo.SaveUploadPart(ctx, &files.UploadPart{FileID: "a", Number: 1, Size: 6, Checksum: "w", CreatedAt: now}))
+
+	parts, err := repo.ListUploadParts(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+	assert.Equal(t, files.UploadPart{FileID: "a", Number: 1, Size: 6, Checksum: "w", CreatedAt: now}, *parts[0])
+	assert.Equal(t, 2, parts[1].Number)
+
+	all, err := repo.ListUploadParts(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Equal(t, "b", all[2].FileID)
+
+	require.NoError(t, repo.DeleteUploadParts(ctx, "a"))
+	parts, err = repo.ListUploadParts(ctx, "a")
+	require.NoError(t, err)
+	assert.Empty(t, parts)
+}
+
+func TestRepositoryPurgeDangling(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Star(ctx, "admin", "1"))
+	require.NoError(t, repo.CreateComment(ctx, &files.Comment{ID: "c1", FileID: "1", Body: "kept", CreatedAt: now}))
+
+	// Rows of a file whose own row is gone, as an interrupted delete leaves them
+	require.NoError(t, repo.Star(ctx, "admin", "gone"))
+	require.NoError(t, repo.CreateComment(ctx, &files.Comment{ID: "c2", FileID: "gone", Body: "dangling", CreatedAt: now}))
+	require.NoError(t, repo.RecordDownload(ctx, "gone", 10, now))
+
+	removed, err := repo.PurgeDangling(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, removed)
+
+	starred, err := repo.ListStarred(ctx, "admin")
+	require.NoError(t, err)
+	require.Len(t, starred, 1)
+	comments, err := repo.ListComments(ctx, "1")
+	require.NoError(t, err)
+	assert.Len(t, comments, 1)
+
+	removed, err = repo.PurgeDangling(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+
+	require.NoError(t, repo.Optimize(ctx))
+	found, err := repo.Search(ctx, []string{"a"})
+	require.NoError(t, err)
+	assert.Len(t, found, 1)
+}
+
+func TestRepositoryFailStalledUploads(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "stalled", Name: "a.txt", Status: files.StatusPending, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "recent", Name: "b.txt", Status: files.StatusPending, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "processing", Name: "c.txt", Status: files.StatusProcessing, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "active", Name: "d.txt", Status: files.StatusActive, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}))
+
+	ids, err := repo.FailStalledUploads(ctx, now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"stalled", "processing"}, ids)
+
+	stalled, err := repo.FindByID(ctx, "stalled")
+	require.NoError(t, err)
+	assert.Equal(t, files.StatusFailed, stalled.Status)
+
+	// Failed uploads can't be completed anymore
+	assert.Error(t, repo.CompleteUpload(ctx, stalled))
+}
+
+func TestRepositorySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewRepository(filepath.Join(dir, "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", Size: 1, MimeType: "text/plain", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	snapshotPath := filepath.Join(dir, "snapshot.db")
+	require.NoError(t, repo.Snapshot(ctx, snapshotPath))
+
+	// Changes after the snapshot aren't in it
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "2", Name: "b.txt", Size: 1, MimeType: "text/plain", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	snapshot, err := NewRepository(snapshotPath)
+	require.NoError(t, err)
+	defer snapshot.Close()
+	fileList, err := snapshot.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, fileList, 1)
+	assert.Equal(t, "1", fileList[0].ID)
+
+	// An existing file isn't overwritten
+	assert.Error(t, repo.Snapshot(ctx, snapshotPath))
+}
+
+func TestRepositoryPing(t *testing.T) {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	require.NoError(t, repo.Ping(context.Background()))
+
+	require.NoError(t, repo.Close())
+	assert.Error(t, repo.Ping(context.Background()))
+}
+
+func TestRepositoryAttributes(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	file := &files.File{ID: "1", Name: "a.txt", MimeType: "text/plain", CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+		Attributes: map[string]string{"commit": "abc123", "arch": "arm64"}}
+	require.NoError(t, repo.Create(ctx, file))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "2", Name: "b.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	found, err := repo.FindByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, file.Attributes, found.Attributes)
+
+	fileList, err := repo.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, fileList, 2)
+	for _, listed := range fileList {
+		if listed.ID == "1" {
+			assert.Equal(t, file.Attributes, listed.Attributes)
+		} else {
+			assert.Nil(t, listed.Attributes)
+		}
+	}
+
+	// A duplicate file doesn't touch the attributes of the existing one
+	assert.Error(t, repo.Create(ctx, &files.File{ID: "1", Name: "c.txt", CreatedAt: now, ExpiresAt: now, Attributes: map[string]string{"commit": "def456"}}))
+	found, err = repo.FindByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", found.Attributes["commit"])
+
+	found.Attributes = map[string]string{"commit": "def456"}
+	require.NoError(t, repo.Update(ctx, found))
+	found, err = repo.FindByID(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"commit": "def456"}, found.Attributes)
+
+	require.NoError(t, repo.Delete(ctx, "1"))
+	var count int
+	require.NoError(t, repo.db.QueryRow(`SELECT COUNT(*) FROM file_attributes`).Scan(&count))
+	assert.Zero(t, count)
+}
+
+func TestRepositoryTombstones(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	require.NoError(t, repo.CreateTombstone(ctx, &files.Tombstone{ID: "old", Name: "a.txt", DeletedAt: now.Add(-48 * time.Hour), DeletedBy: "admin", Reason: "leaked"}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "expired", Name: "b.txt", Tag: "docs", CreatedAt: now, ExpiresAt: now.Add(-time.Minute)}))
+	_, _, err = repo.CleanupExpired(ctx, now)
+	require.NoError(t, err)
+
+	tombstone, err := repo.FindTombstone(ctx, "expired")
+	require.NoError(t, err)
+	assert.Equal(t, "b.txt", tombstone.Name)
+	assert.Equal(t, "docs", tombstone.Tag)
+	assert.Equal(t, files.ReasonExpired, tombstone.Reason)
+	assert.Empty(t, tombstone.DeletedBy)
+
+	tombstones, err := repo.ListTombstones(ctx)
+	require.NoError(t, err)
+	require.Len(t, tombstones, 2)
+	assert.Equal(t, "expired", tombstones[0].ID)
+	assert.Equal(t, "admin", tombstones[1].DeletedBy)
+
+	removed, err := repo.DeleteTombstones(ctx, now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = repo.FindTombstone(ctx, "old")
+	assert.Error(t, err)
+}
+
+func TestRepositoryDownloads(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	stats, err := repo.FindDownloads(ctx, "1")
+	require.NoError(t, err)
+	assert.Zero(t, stats.Downloads)
+	assert.Nil(t, stats.LastDownloadedAt)
+
+	require.NoError(t, repo.RecordDownload(ctx, "1", 10, now.Add(-time.Minute)))
+	require.NoError(t, repo.RecordDownload(ctx, "1", 4, now))
+
+	stats, err = repo.FindDownloads(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Downloads)
+	assert.Equal(t, int64(14), stats.BytesServed)
+	require.NotNil(t, stats.LastDownloadedAt)
+	assert.True(t, now.Equal(*stats.LastDownloadedAt))
+
+	downloads, err := repo.ListDownloads(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, *stats, downloads["1"])
+
+	// Stats go away with their file
+	require.NoError(t, repo.Delete(ctx, "1"))
+	downloads, err = repo.ListDownloads(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, downloads)
+}
+
+func TestRepositoryAccesses(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "1", Name: "a.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	accesses, total, err := repo.ListAccesses(ctx, "1", 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, accesses)
+	assert.Zero(t, total)
+
+	require.NoError(t, repo.RecordAccess(ctx, &files.Access{FileID: "1", At: now.Add(-time.Minute), IP: "10.0.0.1", UserAgent: "curl/8.5.0", Bytes: 10, Status: 200}))
+	require.NoError(t, repo.RecordAccess(ctx, &files.Access{FileID: "1", At: now, IP: "10.0.0.2", Status: 403}))
+	require.NoError(t, repo.RecordAccess(ctx, &files.Access{FileID: "2", At: now, IP: "10.0.0.3", Status: 200}))
+
+	// Latest first, a page at a time
+	accesses, total, err = repo.ListAccesses(ctx, "1", 1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	require.Len(t, accesses, 1)
+	assert.Equal(t, "10.0.0.2", accesses[0].IP)
+	assert.Equal(t, 403, accesses[0].Status)
+	assert.True(t, now.Equal(accesses[0].At))
+
+	accesses, _, err = repo.ListAccesses(ctx, "1", 1, 1)
+	require.NoError(t, err)
+	require.Len(t, accesses, 1)
+	assert.Equal(t, files.Access{FileID: "1", At: accesses[0].At, IP: "10.0.0.1", UserAgent: "curl/8.5.0", Bytes: 10, Status: 200}, *accesses[0])
+
+	// The log goes away with its file
+	require.NoError(t, repo.Delete(ctx, "1"))
+	_, total, err = repo.ListAccesses(ctx, "1", 10, 0)
+	require.NoError(t, err)
+	assert.Zero(t, total)
+}
+
+func TestRepositoryOneTimeLinks(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	require.NoError(t, repo.CreateLink(ctx, &files.Link{ID: "once", FileID: "file", CreatedAt: now, OneTime: true}))
+	require.NoError(t, repo.CreateLink(ctx, &files.Link{ID: "reusable", FileID: "file", CreatedAt: now.Add(time.Second)}))
+
+	link, err := repo.FindLink(ctx, "once")
+	require.NoError(t, err)
+	assert.True(t, link.OneTime)
+	assert.Nil(t, link.UsedAt)
+
+	_, err = repo.FindLink(ctx, "unknown")
+	assert.ErrorIs(t, err, files.ErrNotFound)
+
+	// A use is released only by whoever made it
+	require.NoError(t, repo.UseLink(ctx, "once", now))
+	assert.ErrorIs(t, repo.UseLink(ctx, "once", now), files.ErrLinkUsed)
+	require.NoError(t, repo.ReleaseLink(ctx, "once", now.Add(time.Second)))
+	assert.ErrorIs(t, repo.UseLink(ctx, "once", now), files.ErrLinkUsed)
+	require.NoError(t, repo.ReleaseLink(ctx, "once", now))
+	require.NoError(t, repo.UseLink(ctx, "once", now))
+	assert.Error(t, repo.UseLink(ctx, "unknown", now))
+
+	links, err := repo.ListLinks(ctx, "file")
+	require.NoError(t, err)
+	require.Len(t, links, 2)
+	require.NotNil(t, links[0].UsedAt)
+	assert.WithinDuration(t, now, *links[0].UsedAt, time.Second)
+	assert.False(t, links[1].OneTime)
+	assert.Nil(t, links[1].UsedAt)
+}
+
+func TestRepositoryDownloadCodes(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "file", Name: "a.txt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.CreateDownloadCode(ctx, &files.DownloadCode{Code: "ABC123", FileID: "file", CreatedAt: now}))
+	assert.ErrorIs(t, repo.CreateDownloadCode(ctx, &files.DownloadCode{Code: "ABC123", FileID: "other", CreatedAt: now}), files.ErrCodeTaken)
+
+	code, err := repo.FindDownloadCode(ctx, "ABC123")
+	require.NoError(t, err)
+	assert.Equal(t, "file", code.FileID)
+	code, err = repo.FindFileDownloadCode(ctx, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "ABC123", code.Code)
+
+	require.NoError(t, repo.Delete(ctx, "file"))
+	_, err = repo.FindDownloadCode(ctx, "ABC123")
+	assert.Error(t, err)
+}
+
+func TestRepositoryPublicFiles(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "file", Name: "notes.txt", Public: true, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	file, err := repo.FindByID(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, file.Public)
+
+	file.Public = false
+	require.NoError(t, repo.Update(ctx, file))
+	file, err = repo.FindByID(ctx, "file")
+	require.NoError(t, err)
+	assert.False(t, file.Public)
+}
+
+func TestRepositorySearch(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+
+	now := time.Now()
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "report", Name: "quarterly-report-2024.pdf", Tag: "finance", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "notes", Name: "notes.txt", Tag: "reports", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, repo.Create(ctx, &files.File{ID: "build", Name: "build.log", CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+		Attributes: map[string]string{"commit": "abc123", "branch": "release-v1.2"}}))
+
+	search := func(terms ...string) []string {
+		fileList, err := repo.Search(ctx, terms)
+		require.NoError(t, err)
+		var ids []string
+		for _, file := range fileList {
+			ids = append(ids, file.ID)
+		}
+		return ids
+	}
+
+	// Name matches rank above tag matches
+	assert.Equal(t, []string{"report", "notes"}, search("report"))
+	assert.Equal(t, []string{"report"}, search("report", "finance"))
+	assert.Equal(t, []string{"build"}, search("abc"))
+	assert.Equal(t, []string{"build"}, search("release-v1.2"))
+	assert.Empty(t, search("missing"))
+	assert.Empty(t, search(`"`))
+
+	// The index follows changes to files and their attributes
+	file, err := repo.FindByID(ctx, "build")
+	require.NoError(t, err)
+	file.Name = "report.log"
+	file.Attributes = map[string]string{"commit": "def456"}
+	require.NoError(t, repo.Update(ctx, file))
+	assert.Empty(t, search("abc"))
+	assert.Equal(t, []string{"build"}, search("def456"))
+	assert.Contains(t, search("report"), "build")
+
+	require.NoError(t, repo.Delete(ctx, "report"))
+	assert.NotContains(t, search("report"), "report")
+}
@@ -0,0 +1,58 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates a span for every SQL statement the repository runs
+var tracer = otel.Tracer("github.com/pavel-fokin/files-stash/internal/sqlite")
+
+// startQuery starts a client span describing a SQL statement
+func startQuery(ctx context.Context, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "sqlite.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "sqlite"),
+			attribute.String("db.query.text", query),
+		),
+	)
+}
+
+// endQuery records err on the span and ends it
+func endQuery(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// exec runs a statement that returns no rows within a span
+func (r *Repository) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuery(ctx, query)
+	result, err := r.db.ExecContext(ctx, query, timeArgs(args)...)
+	endQuery(span, err)
+	return result, err
+}
+
+// query runs a statement returning rows within a span
+func (r *Repository) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := startQuery(ctx, query)
+	rows, err := r.db.QueryContext(ctx, query, timeArgs(args)...)
+	endQuery(span, err)
+	return rows, err
+}
+
+// queryRow runs a statement returning at most one row within a span
+func (r *Repository) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuery(ctx, query)
+	row := r.db.QueryRowContext(ctx, query, timeArgs(args)...)
+	endQuery(span, row.Err())
+	return row
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// cacheEntry is the content of one file held by a Cache
+type cacheEntry struct {
+	id   string
+	data []byte
+}
+
+// Cache implements files.FileStorage by keeping the content of files warmed
+// with Warm in memory, in front of a slower backend. Content that doesn't
+// fit in the cache evicts the least recently read content. Everything else
+// goes to the backend.
+type Cache struct {
+	backend  files.FileStorage
+	capacity int64
+
+	mu      sync.Mutex
+	size    int64
+	writes  uint64     // counts writes, so content read before one isn't cached
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// NewCache creates a cache of up to capacity bytes in front of backend.
+// Content larger than a quarter of the capacity is never cached, so a single
+// large file can't empty the cache.
+func NewCache(backend files.FileStorage, capacity int64) *Cache {
+	return &Cache{
+		backend:  backend,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Save stores content in the backend, dropping any cached content under id.
+// Content warmed while the backend writes isn't cached either.
+func (c *Cache) Save(ctx context.Context, id, name, mimeType string, content io.Reader) (*files.File, error) {
+	c.evict(id)
+	defer c.evict(id)
+	return c.backend.Save(ctx, id, name, mimeType, content)
+}
+
+// Delete removes content from the cache and the backend
+func (c *Cache) Delete(ctx context.Context, id string) error {
+	c.evict(id)
+	defer c.evict(id)
+	return c.backend.Delete(ctx, id)
+}
+
+// GetContent serves cached content, or reads it from the backend. Cached
+// content is returned as an io.Seeker, like the files of fs.Storage.
+func (c *Cache) GetContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if data, ok := c.get(id); ok {
+		return readSeekNopCloser{bytes.NewReader(data)}, nil
+	}
+	return c.backend.GetContent(ctx, id)
+}
+
+// Exists reports whether the backend holds content
+func (c *Cache) Exists(ctx context.Context, id string) (bool, error) {
+	return c.backend.Exists(ctx, id)
+}
+
+// Warm loads content into the cache ahead of its downloads. Content too
+// large for the cache is left in the backend.
+func (c *Cache) Warm(ctx context.Context, id string) error {
+	if _, ok := c.get(id); ok {
+		return nil
+	}
+	c.mu.Lock()
+	writes := c.writes
+	c.mu.Unlock()
+
+	content, err := c.backend.GetContent(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	defer content.Close()
+
+	limit := c.capacity / 4
+	data, err := io.ReadAll(io.LimitReader(content, limit+1))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	if int64(len(data)) > limit {
+		return nil
+	}
+	c.put(id, data, writes)
+	return nil
+}
+
+// Cached returns the number of files and bytes held in the cache
+func (c *Cache) Cached() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size
+}
+
+// FreeSpace reports the free space of the backend, when it knows it
+func (c *Cache) FreeSpace() (int64, error) {
+	reporter, ok := c.backend.(interface{ FreeSpace() (int64, error) })
+	if !ok {
+		return 0, fmt.Errorf("backend storage doesn't report free space")
+	}
+	return reporter.FreeSpace()
+}
+
+// ProbeWrite verifies the backend accepts writes, when it can tell
+func (c *Cache) ProbeWrite(ctx context.Context) error {
+	prober, ok := c.backend.(interface {
+		ProbeWrite(ctx context.Context) error
+	})
+	if !ok {
+		return nil
+	}
+	return prober.ProbeWrite(ctx)
+}
+
+// MigrateLayout moves content to the backend's current layout, when it has
+// layouts
+func (c *Cache) MigrateLayout(ctx context.Context, id string) (bool, error) {
+	migrator, ok := c.backend.(interface {
+		MigrateLayout(ctx context.Context, id string) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return migrator.MigrateLayout(ctx, id)
+}
+
+// Repair restores copies of content in the backend, when it keeps several
+func (c *Cache) Repair(ctx context.Context, id string) (bool, error) {
+	repairer, ok := c.backend.(interface {
+		Repair(ctx context.Context, id string) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return repairer.Repair(ctx, id)
+}
+
+// MoveTier moves content between the backend's tiers, when it has tiers
+func (c *Cache) MoveTier(ctx context.Context, id string, cold bool) (bool, error) {
+	tierer, ok := c.backend.(interface {
+		MoveTier(ctx context.Context, id string, cold bool) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return tierer.MoveTier(ctx, id, cold)
+}
+
+// get returns cached content, marking it as recently used
+func (c *Cache) get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+// put caches content read when writes were counted, evicting the least
+// recently used content to make room
+func (c *Cache) put(id string, data []byte, writes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[id]; ok || c.writes != writes {
+		return
+	}
+	for c.size+int64(len(data)) > c.capacity && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+	c.entries[id] = c.order.PushFront(&cacheEntry{id: id, data: data})
+	c.size += int64(len(data))
+}
+
+// evict drops cached content ahead of a write
+func (c *Cache) evict(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writes++
+	if elem, ok := c.entries[id]; ok {
+		c.remove(elem)
+	}
+}
+
+// remove drops an entry. The caller must hold c.mu.
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.id)
+	c.size -= int64(len(entry.data))
+}
+
+// readSeekNopCloser adds a no-op Close to a bytes.Reader
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/memory"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	backend := memory.NewStorage()
+	cache := NewCache(backend, 40)
+
+	save := func(id, content string) {
+		_, err := cache.Save(ctx, id, id, "text/plain", strings.NewReader(content))
+		require.NoError(t, err)
+	}
+	save("a", "0123456789")
+	save("b", "abcdefghij")
+	save("c", "ABCDEFGHIJ")
+	save("large", strings.Repeat("x", 11))
+
+	t.Run("Warm", func(t *testing.T) {
+		require.NoError(t, cache.Warm(ctx, "a"))
+		require.NoError(t, cache.Warm(ctx, "b"))
+		files, size := cache.Cached()
+		assert.Equal(t, 2, files)
+		assert.EqualValues(t, 20, size)
+
+		// Cached content is served without the backend
+		require.NoError(t, backend.Delete(ctx, "a"))
+		assert.Equal(t, "0123456789", readContent(t, cache, "a"))
+		save("a", "0123456789")
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		require.NoError(t, cache.Warm(ctx, "large"))
+		_, cached := cache.get("large")
+		assert.False(t, cached)
+	})
+
+	t.Run("EvictsLeastRecentlyUsed", func(t *testing.T) {
+		for _, id := range []string{"a", "b", "c"} {
+			require.NoError(t, cache.Warm(ctx, id))
+		}
+		readContent(t, cache, "a")
+		save("d", "klmnopqrst")
+		save("e", "KLMNOPQRST")
+		require.NoError(t, cache.Warm(ctx, "d"))
+		require.NoError(t, cache.Warm(ctx, "e"))
+
+		files, size := cache.Cached()
+		assert.Equal(t, 4, files)
+		assert.EqualValues(t, 40, size)
+		_, cached := cache.get("b")
+		assert.False(t, cached)
+		_, cached = cache.get("a")
+		assert.True(t, cached)
+	})
+
+	t.Run("DeleteEvicts", func(t *testing.T) {
+		require.NoError(t, cache.Delete(ctx, "a"))
+		_, cached := cache.get("a")
+		assert.False(t, cached)
+		assert.False(t, exists(t, cache, "a"))
+	})
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// compressedHeader starts content stored compressed, followed by a zstd
+// stream. Content stored before compression was enabled doesn't start with
+// it and is served as is.
+var compressedHeader = []byte("\x89FSZSTD\n")
+
+// incompressible lists content types that are compressed already, as exact
+// types or, ending with "/", type prefixes
+var incompressible = []string{
+	"image/", "video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-xz", "application/x-bzip2", "application/x-7z-compressed",
+	"application/x-rar-compressed", "application/vnd.rar", "application/java-archive",
+	"application/pdf", "font/woff", "font/woff2",
+}
+
+// compressible lists exceptions to incompressible: uncompressed image and
+// audio formats
+var compressible = []string{
+	"image/svg+xml", "image/bmp", "image/x-ms-bmp", "image/tiff",
+	"audio/wav", "audio/x-wav", "audio/wave",
+}
+
+// Compressed implements files.FileStorage by compressing content with zstd
+// in the backend and decompressing it on read. Content of types that are
+// compressed already is stored as is. Once enabled it has to stay in front
+// of the backend, since compressed content can't be read without it.
+type Compressed struct {
+	backend files.FileStorage
+}
+
+// NewCompressed creates a compressing storage in front of backend
+func NewCompressed(backend files.FileStorage) *Compressed {
+	return &Compressed{backend: backend}
+}
+
+// Save stores content compressed, unless its type is compressed already.
+// The returned file has the size stored in the backend.
+func (c *Compressed) Save(ctx context.Context, id, name, mimeType string, content io.Reader) (*files.File, error) {
+	reader := bufio.NewReader(content)
+	// Content that looks compressed by us is always compressed, so it reads
+	// back as it was written
+	prefix, _ := reader.Peek(len(compressedHeader))
+	if isIncompressible(mimeType) && !bytes.Equal(prefix, compressedHeader) {
+		return c.backend.Save(ctx, id, name, mimeType, reader)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(compress(pw, reader))
+	}()
+	file, err := c.backend.Save(ctx, id, name, mimeType, pr)
+	// Stop compressing when the backend gave up part way
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	return file, err
+}
+
+// compress writes content to w as header and zstd stream
+func compress(w io.Writer, content io.Reader) error {
+	if _, err := w.Write(compressedHeader); err != nil {
+		return err
+	}
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, content); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+// GetContent reads content from the backend, decompressing it when it was
+// stored compressed. Uncompressed content keeps being an io.Seeker when the
+// backend's is.
+func (c *Compressed) GetContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	content, err := c.backend.GetContent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	prefix := make([]byte, len(compressedHeader))
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		n, err := io.ReadFull(seeker, prefix)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			content.Close()
+			return nil, fmt.Errorf("failed to read content: %w", err)
+		}
+		if !bytes.Equal(prefix[:n], compressedHeader) {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				content.Close()
+				return nil, fmt.Errorf("failed to read content: %w", err)
+			}
+			return content, nil
+		}
+		reader = seeker
+	} else {
+		buffered := bufio.NewReader(content)
+		peeked, _ := buffered.Peek(len(compressedHeader))
+		if !bytes.Equal(peeked, compressedHeader) {
+			return struct {
+				io.Reader
+				io.Closer
+			}{buffered, content}, nil
+		}
+		buffered.Discard(len(compressedHeader))
+		reader = buffered
+	}
+
+	decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		content.Close()
+		return nil, fmt.Errorf("failed to decompress content: %w", err)
+	}
+	return &decompressingReader{decoder: decoder, content: content}, nil
+}
+
+// decompressingReader reads decompressed content, releasing the decoder
+// with the content
+type decompressingReader struct {
+	decoder *zstd.Decoder
+	content io.Closer
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	return r.decoder.Read(p)
+}
+
+func (r *decompressingReader) Close() error {
+	r.decoder.Close()
+	return r.content.Close()
+}
+
+// Delete removes content from the backend
+func (c *Compressed) Delete(ctx context.Context, id string) error {
+	return c.backend.Delete(ctx, id)
+}
+
+// Exists reports whether the backend holds content
+func (c *Compressed) Exists(ctx context.Context, id string) (bool, error) {
+	return c.backend.Exists(ctx, id)
+}
+
+// FreeSpace reports the free space of the backend, when it knows it
+func (c *Compressed) FreeSpace() (int64, error) {
+	reporter, ok := c.backend.(interface{ FreeSpace() (int64, error) })
+	if !ok {
+		return 0, fmt.Errorf("backend storage doesn't report free space")
+	}
+	return reporter.FreeSpace()
+}
+
+// ProbeWrite verifies the backend accepts writes, when it can tell
+func (c *Compressed) ProbeWrite(ctx context.Context) error {
+	prober, ok := c.backend.(interface {
+		ProbeWrite(ctx context.Context) error
+	})
+	if !ok {
+		return nil
+	}
+	return prober.ProbeWrite(ctx)
+}
+
+// MigrateLayout moves content to the backend's current layout, when it has
+// layouts
+func (c *Compressed) MigrateLayout(ctx context.Context, id string) (bool, error) {
+	migrator, ok := c.backend.(interface {
+		MigrateLayout(ctx context.Context, id string) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return migrator.MigrateLayout(ctx, id)
+}
+
+// Repair restores copies of content in the backend, when it keeps several
+func (c *Compressed) Repair(ctx context.Context, id string) (bool, error) {
+	repairer, ok := c.backend.(interface {
+		Repair(ctx context.Context, id string) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return repairer.Repair(ctx, id)
+}
+
+// MoveTier moves content between the backend's tiers, when it has tiers
+func (c *Compressed) MoveTier(ctx context.Context, id string, cold bool) (bool, error) {
+	tierer, ok := c.backend.(interface {
+		MoveTier(ctx context.Context, id string, cold bool) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return tierer.MoveTier(ctx, id, cold)
+}
+
+// isIncompressible reports whether content of a type is compressed already
+func isIncompressible(mimeType string) bool {
+	base, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if base == pattern || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(base, pattern)) {
+				return true
+			}
+		}
+		return false
+	}
+	return matches(incompressible) && !matches(compressible)
+}
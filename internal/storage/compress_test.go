@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/fs"
+	"github.com/pavel-fokin/files-stash/internal/memory"
+)
+
+func TestCompressed(t *testing.T) {
+	ctx := context.Background()
+	backend := memory.NewStorage()
+	compressed := NewCompressed(backend)
+	log := strings.Repeat("2024-01-01T00:00:00Z INFO request served status=200\n", 1000)
+
+	t.Run("CompressesText", func(t *testing.T) {
+		file, err := compressed.Save(ctx, "log", "build.log", "text/plain; charset=utf-8", strings.NewReader(log))
+		require.NoError(t, err)
+		assert.Less(t, file.Size, int64(len(log))/10)
+
+		assert.Equal(t, log, readContent(t, compressed, "log"))
+		assert.True(t, strings.HasPrefix(readContent(t, backend, "log"), string(compressedHeader)))
+	})
+
+	t.Run("SkipsCompressedTypes", func(t *testing.T) {
+		file, err := compressed.Save(ctx, "png", "image.png", "image/png", strings.NewReader(log))
+		require.NoError(t, err)
+		assert.EqualValues(t, len(log), file.Size)
+		assert.Equal(t, log, readContent(t, backend, "png"))
+		assert.Equal(t, log, readContent(t, compressed, "png"))
+
+		file, err = compressed.Save(ctx, "svg", "image.svg", "image/svg+xml", strings.NewReader(log))
+		require.NoError(t, err)
+		assert.Less(t, file.Size, int64(len(log)))
+	})
+
+	t.Run("ContentLookingCompressed", func(t *testing.T) {
+		// Stored as is, it would be mistaken for compressed content
+		tricky := string(compressedHeader) + "not zstd"
+		_, err := compressed.Save(ctx, "tricky", "tricky.zip", "application/zip", strings.NewReader(tricky))
+		require.NoError(t, err)
+		assert.Equal(t, tricky, readContent(t, compressed, "tricky"))
+	})
+
+	t.Run("StoredBeforeCompression", func(t *testing.T) {
+		_, err := backend.Save(ctx, "legacy", "old.txt", "text/plain", strings.NewReader("plain"))
+		require.NoError(t, err)
+		assert.Equal(t, "plain", readContent(t, compressed, "legacy"))
+
+		_, err = backend.Save(ctx, "short", "a.txt", "text/plain", strings.NewReader("a"))
+		require.NoError(t, err)
+		assert.Equal(t, "a", readContent(t, compressed, "short"))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		_, err := compressed.Save(ctx, "empty", "empty.txt", "text/plain", strings.NewReader(""))
+		require.NoError(t, err)
+		assert.Equal(t, "", readContent(t, compressed, "empty"))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, compressed.Delete(ctx, "log"))
+		assert.False(t, exists(t, compressed, "log"))
+	})
+}
+
+func TestCompressedKeepsSeekers(t *testing.T) {
+	ctx := context.Background()
+	backend := fs.NewStorage(t.TempDir())
+	compressed := NewCompressed(backend)
+
+	_, err := backend.Save(ctx, "legacy", "old.txt", "text/plain", strings.NewReader("0123456789"))
+	require.NoError(t, err)
+	content, err := compressed.GetContent(ctx, "legacy")
+	require.NoError(t, err)
+	defer content.Close()
+	seeker, ok := content.(io.ReadSeeker)
+	require.True(t, ok)
+	_, err = seeker.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(seeker)
+	require.NoError(t, err)
+	assert.Equal(t, "56789", string(rest))
+
+	_, err = compressed.Save(ctx, "new", "new.txt", "text/plain", strings.NewReader("0123456789"))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", readContent(t, compressed, "new"))
+}
+
+func TestCompressedFailedSave(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	compressed := NewCompressed(memory.NewStorage())
+	_, err := compressed.Save(ctx, "log", "build.log", "text/plain", strings.NewReader("content"))
+	assert.Error(t, err)
+}
+
+func TestIsIncompressible(t *testing.T) {
+	for mimeType, expected := range map[string]bool{
+		"image/jpeg":               true,
+		"video/mp4":                true,
+		"application/zip":          true,
+		"application/gzip":         true,
+		"image/svg+xml":            false,
+		"audio/wav":                false,
+		"text/plain":               false,
+		"text/plain; charset=utf8": false,
+		"application/json":         false,
+		"application/octet-stream": false,
+		"":                         false,
+	} {
+		assert.Equal(t, expected, isIncompressible(mimeType), mimeType)
+	}
+}
@@ -0,0 +1,304 @@
+// Package storage holds files.FileStorage decorators that combine other
+// storage backends.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// queueSize is the number of replications waiting before new ones are
+// parked with the failed ones
+const queueSize = 1024
+
+// replication copies content to, or deletes it from, one secondary
+type replication struct {
+	id        string
+	secondary int
+	delete    bool
+	name      string
+	mimeType  string
+	seq       uint64 // orders replications of the same content
+}
+
+// replicationKey identifies the content of one secondary; only the latest
+// replication for it matters
+type replicationKey struct {
+	id        string
+	secondary int
+}
+
+// Mirror implements files.FileStorage by writing content to a primary
+// storage and replicating it to secondaries in the background, so losing
+// the primary doesn't lose files. Reads fall back to the secondaries when
+// the primary can't serve them. Replications that fail are retried every
+// retry interval until they succeed; Repair brings back content the queue
+// lost, e.g. across restarts.
+type Mirror struct {
+	primary       files.FileStorage
+	secondaries   []files.FileStorage
+	retryInterval time.Duration
+
+	queue  chan replication
+	mu     sync.Mutex
+	seq    uint64
+	latest map[replicationKey]uint64 // seq of the latest replication of content not replicated yet
+	failed map[replicationKey]replication
+}
+
+// NewMirror creates a mirror of primary onto secondaries. Replications only
+// run once Run is started.
+func NewMirror(primary files.FileStorage, secondaries []files.FileStorage, retryInterval time.Duration) *Mirror {
+	return &Mirror{
+		primary:       primary,
+		secondaries:   secondaries,
+		retryInterval: retryInterval,
+		queue:         make(chan replication, queueSize),
+		latest:        make(map[replicationKey]uint64),
+		failed:        make(map[replicationKey]replication),
+	}
+}
+
+// Save stores content in the primary and queues its replication
+func (m *Mirror) Save(ctx context.Context, id, name, mimeType string, content io.Reader) (*files.File, error) {
+	file, err := m.primary.Save(ctx, id, name, mimeType, content)
+	if err != nil {
+		return nil, err
+	}
+	for i := range m.secondaries {
+		m.enqueue(replication{id: id, secondary: i, name: name, mimeType: mimeType})
+	}
+	return file, nil
+}
+
+// Delete removes content from the primary and queues its removal from the
+// secondaries
+func (m *Mirror) Delete(ctx context.Context, id string) error {
+	if err := m.primary.Delete(ctx, id); err != nil {
+		return err
+	}
+	for i := range m.secondaries {
+		m.enqueue(replication{id: id, secondary: i, delete: true})
+	}
+	return nil
+}
+
+// GetContent reads content from the primary, or from the first secondary
+// holding it when the primary fails
+func (m *Mirror) GetContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	content, err := m.primary.GetContent(ctx, id)
+	if err == nil || ctx.Err() != nil {
+		return content, err
+	}
+	for i, secondary := range m.secondaries {
+		if content, secondaryErr := secondary.GetContent(ctx, id); secondaryErr == nil {
+			slog.Warn("Serving content from mirror", "storage_id", id, "secondary", i, "error", err)
+			return content, nil
+		}
+	}
+	return nil, err
+}
+
+// Exists reports whether the primary or any secondary holds content
+func (m *Mirror) Exists(ctx context.Context, id string) (bool, error) {
+	exists, err := m.primary.Exists(ctx, id)
+	if exists || ctx.Err() != nil {
+		return exists, err
+	}
+	for _, secondary := range m.secondaries {
+		if exists, secondaryErr := secondary.Exists(ctx, id); secondaryErr == nil && exists {
+			return true, nil
+		}
+	}
+	return false, err
+}
+
+// FreeSpace reports the free space of the primary, when it knows it
+func (m *Mirror) FreeSpace() (int64, error) {
+	reporter, ok := m.primary.(interface{ FreeSpace() (int64, error) })
+	if !ok {
+		return 0, fmt.Errorf("primary storage doesn't report free space")
+	}
+	return reporter.FreeSpace()
+}
+
+// ProbeWrite verifies the primary accepts writes, when it can tell; failed
+// writes to secondaries are retried and don't keep the stash from serving
+func (m *Mirror) ProbeWrite(ctx context.Context) error {
+	prober, ok := m.primary.(interface {
+		ProbeWrite(ctx context.Context) error
+	})
+	if !ok {
+		return nil
+	}
+	return prober.ProbeWrite(ctx)
+}
+
+// MigrateLayout moves content to the current layout in every backend that
+// has layouts and reports whether any content was moved
+func (m *Mirror) MigrateLayout(ctx context.Context, id string) (bool, error) {
+	moved := false
+	for _, backend := range append([]files.FileStorage{m.primary}, m.secondaries...) {
+		migrator, ok := backend.(interface {
+			MigrateLayout(ctx context.Context, id string) (bool, error)
+		})
+		if !ok {
+			continue
+		}
+		backendMoved, err := migrator.MigrateLayout(ctx, id)
+		if err != nil {
+			return moved, err
+		}
+		moved = moved || backendMoved
+	}
+	return moved, nil
+}
+
+// Repair copies content missing from any backend, the primary included,
+// from one that holds it, and reports whether anything was copied
+func (m *Mirror) Repair(ctx context.Context, id string) (bool, error) {
+	backends := append([]files.FileStorage{m.primary}, m.secondaries...)
+	var source files.FileStorage
+	var missing []files.FileStorage
+	for _, backend := range backends {
+		exists, err := backend.Exists(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			missing = append(missing, backend)
+		} else if source == nil {
+			source = backend
+		}
+	}
+	if source == nil || len(missing) == 0 {
+		return false, nil
+	}
+
+	for _, backend := range missing {
+		if err := copyContent(ctx, source, backend, id, id, ""); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Pending returns the number of replications queued or waiting for a retry
+func (m *Mirror) Pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue) + len(m.failed)
+}
+
+// Run replicates queued content and retries failed replications until the
+// context is cancelled
+func (m *Mirror) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-m.queue:
+			m.replicate(ctx, r)
+		case <-ticker.C:
+			m.retry(ctx)
+		}
+	}
+}
+
+// enqueue queues a replication, superseding earlier ones for the same
+// content. A full queue parks it with the failed ones.
+func (m *Mirror) enqueue(r replication) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := replicationKey{id: r.id, secondary: r.secondary}
+	m.seq++
+	r.seq = m.seq
+	m.latest[key] = r.seq
+	delete(m.failed, key)
+	select {
+	case m.queue <- r:
+	default:
+		m.failed[key] = r
+	}
+}
+
+// replicate performs a replication unless a later one superseded it,
+// parking it for a retry when it fails
+func (m *Mirror) replicate(ctx context.Context, r replication) {
+	key := replicationKey{id: r.id, secondary: r.secondary}
+	if !m.isLatest(key, r.seq) {
+		return
+	}
+
+	secondary := m.secondaries[r.secondary]
+	var err error
+	if r.delete {
+		err = secondary.Delete(ctx, r.id)
+	} else {
+		err = copyContent(ctx, m.primary, secondary, r.id, r.name, r.mimeType)
+		if err != nil {
+			// Content deleted before it was replicated is replicated by its deletion
+			if exists, existsErr := m.primary.Exists(ctx, r.id); existsErr == nil && !exists {
+				err = nil
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latest[key] != r.seq {
+		return // superseded meanwhile
+	}
+	if err == nil {
+		delete(m.latest, key)
+		return
+	}
+	slog.Error("Replication failed", "storage_id", r.id, "secondary", r.secondary, "delete", r.delete, "error", err)
+	m.failed[key] = r
+}
+
+// isLatest reports whether seq is the latest replication of key's content
+func (m *Mirror) isLatest(key replicationKey, seq uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latest[key] == seq
+}
+
+// retry performs the failed replications again
+func (m *Mirror) retry(ctx context.Context) {
+	m.mu.Lock()
+	failed := m.failed
+	m.failed = make(map[replicationKey]replication)
+	m.mu.Unlock()
+
+	for _, r := range failed {
+		if ctx.Err() != nil {
+			return
+		}
+		m.replicate(ctx, r)
+	}
+}
+
+// copyContent copies the content stored under id from one backend to another
+func copyContent(ctx context.Context, from, to files.FileStorage, id, name, mimeType string) error {
+	content, err := from.GetContent(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	defer content.Close()
+
+	if _, err := to.Save(ctx, id, name, mimeType, content); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+	"github.com/pavel-fokin/files-stash/internal/memory"
+)
+
+// flakyStorage fails writes while down is set
+type flakyStorage struct {
+	*memory.Storage
+	down atomic.Bool
+}
+
+func (f *flakyStorage) Save(ctx context.Context, id, name, mimeType string, content io.Reader) (*files.File, error) {
+	if f.down.Load() {
+		return nil, errors.New("storage down")
+	}
+	return f.Storage.Save(ctx, id, name, mimeType, content)
+}
+
+func readContent(t *testing.T, storage files.FileStorage, id string) string {
+	t.Helper()
+	content, err := storage.GetContent(context.Background(), id)
+	require.NoError(t, err)
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func exists(t *testing.T, storage files.FileStorage, id string) bool {
+	t.Helper()
+	ok, err := storage.Exists(context.Background(), id)
+	require.NoError(t, err)
+	return ok
+}
+
+func TestMirror(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	primary := memory.NewStorage()
+	secondary := &flakyStorage{Storage: memory.NewStorage()}
+	mirror := NewMirror(primary, []files.FileStorage{secondary}, 10*time.Millisecond)
+	go mirror.Run(ctx)
+
+	t.Run("Replicates", func(t *testing.T) {
+		_, err := mirror.Save(ctx, "a", "a.txt", "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool { return exists(t, secondary, "a") }, time.Second, 5*time.Millisecond)
+		assert.Equal(t, "hello", readContent(t, secondary, "a"))
+
+		require.NoError(t, mirror.Delete(ctx, "a"))
+		assert.Eventually(t, func() bool { return !exists(t, secondary, "a") }, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("RetriesFailed", func(t *testing.T) {
+		secondary.down.Store(true)
+		_, err := mirror.Save(ctx, "b", "b.txt", "text/plain", strings.NewReader("retry"))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool { return mirror.Pending() == 1 }, time.Second, 5*time.Millisecond)
+		assert.False(t, exists(t, secondary, "b"))
+
+		secondary.down.Store(false)
+		assert.Eventually(t, func() bool { return mirror.Pending() == 0 }, time.Second, 5*time.Millisecond)
+		assert.Equal(t, "retry", readContent(t, secondary, "b"))
+	})
+
+	t.Run("ReadsFromSecondary", func(t *testing.T) {
+		require.NoError(t, primary.Delete(ctx, "b"))
+		assert.True(t, exists(t, mirror, "b"))
+		assert.Equal(t, "retry", readContent(t, mirror, "b"))
+	})
+
+	t.Run("Repairs", func(t *testing.T) {
+		repaired, err := mirror.Repair(ctx, "b")
+		require.NoError(t, err)
+		assert.True(t, repaired)
+		assert.Equal(t, "retry", readContent(t, primary, "b"))
+
+		repaired, err = mirror.Repair(ctx, "b")
+		require.NoError(t, err)
+		assert.False(t, repaired)
+	})
+}
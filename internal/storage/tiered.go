@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/pavel-fokin/files-stash/internal/files"
+)
+
+// Tiered implements files.FileStorage over a hot storage, such as a local
+// disk, and a cold one, such as object storage. New content lands in the
+// hot tier and MoveTier moves it between the tiers; each piece of content
+// lives in one of them. Content in the cold tier is read from there
+// directly, so downloads don't wait for it to move back.
+type Tiered struct {
+	hot  files.FileStorage
+	cold files.FileStorage
+}
+
+// NewTiered creates a tiered storage of hot and cold
+func NewTiered(hot, cold files.FileStorage) *Tiered {
+	return &Tiered{hot: hot, cold: cold}
+}
+
+// Save stores content in the hot tier
+func (t *Tiered) Save(ctx context.Context, id, name, mimeType string, content io.Reader) (*files.File, error) {
+	return t.hot.Save(ctx, id, name, mimeType, content)
+}
+
+// Delete removes content from both tiers
+func (t *Tiered) Delete(ctx context.Context, id string) error {
+	if err := t.hot.Delete(ctx, id); err != nil {
+		return err
+	}
+	return t.cold.Delete(ctx, id)
+}
+
+// GetContent reads content from the hot tier, or from the cold tier when
+// it's not there
+func (t *Tiered) GetContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	content, err := t.hot.GetContent(ctx, id)
+	if err == nil || ctx.Err() != nil {
+		return content, err
+	}
+	if content, coldErr := t.cold.GetContent(ctx, id); coldErr == nil {
+		slog.Debug("Serving content from cold storage", "storage_id", id)
+		return content, nil
+	}
+	return nil, err
+}
+
+// Exists reports whether either tier holds content
+func (t *Tiered) Exists(ctx context.Context, id string) (bool, error) {
+	exists, err := t.hot.Exists(ctx, id)
+	if exists || err != nil {
+		return exists, err
+	}
+	return t.cold.Exists(ctx, id)
+}
+
+// MoveTier moves content to the cold tier, or back to the hot one, and
+// reports whether it moved. Content already in the tier, or in neither,
+// stays put. The content is copied before it's removed from the tier it
+// leaves, so it's readable throughout.
+func (t *Tiered) MoveTier(ctx context.Context, id string, cold bool) (bool, error) {
+	from, to := t.hot, t.cold
+	if !cold {
+		from, to = t.cold, t.hot
+	}
+	exists, err := from.Exists(ctx, id)
+	if err != nil || !exists {
+		return false, err
+	}
+	// A hot copy, newer than a cold one left by an interrupted move, stays
+	if !cold {
+		if hot, err := t.hot.Exists(ctx, id); err != nil || hot {
+			if err == nil {
+				err = t.cold.Delete(ctx, id)
+			}
+			return false, err
+		}
+	}
+
+	if err := copyContent(ctx, from, to, id, id, ""); err != nil {
+		return false, err
+	}
+	if err := from.Delete(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to remove %s after moving it: %w", id, err)
+	}
+	return true, nil
+}
+
+// FreeSpace reports the free space of the hot tier, when it knows it
+func (t *Tiered) FreeSpace() (int64, error) {
+	reporter, ok := t.hot.(interface{ FreeSpace() (int64, error) })
+	if !ok {
+		return 0, fmt.Errorf("hot storage doesn't report free space")
+	}
+	return reporter.FreeSpace()
+}
+
+// ProbeWrite verifies the hot tier accepts writes, when it can tell
+func (t *Tiered) ProbeWrite(ctx context.Context) error {
+	prober, ok := t.hot.(interface {
+		ProbeWrite(ctx context.Context) error
+	})
+	if !ok {
+		return nil
+	}
+	return prober.ProbeWrite(ctx)
+}
+
+// MigrateLayout moves content to the hot tier's current layout, when it
+// has layouts
+func (t *Tiered) MigrateLayout(ctx context.Context, id string) (bool, error) {
+	migrator, ok := t.hot.(interface {
+		MigrateLayout(ctx context.Context, id string) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return migrator.MigrateLayout(ctx, id)
+}
+
+// Repair restores copies of content in the hot tier, when it keeps several
+func (t *Tiered) Repair(ctx context.Context, id string) (bool, error) {
+	repairer, ok := t.hot.(interface {
+		Repair(ctx context.Context, id string) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	return repairer.Repair(ctx, id)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavel-fokin/files-stash/internal/memory"
+)
+
+func TestTiered(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := memory.NewStorage(), memory.NewStorage()
+	tiered := NewTiered(hot, cold)
+
+	_, err := tiered.Save(ctx, "a", "a.txt", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.True(t, exists(t, hot, "a"))
+	assert.False(t, exists(t, cold, "a"))
+
+	t.Run("MovesCold", func(t *testing.T) {
+		moved, err := tiered.MoveTier(ctx, "a", true)
+		require.NoError(t, err)
+		assert.True(t, moved)
+		assert.False(t, exists(t, hot, "a"))
+		assert.Equal(t, "hello", readContent(t, cold, "a"))
+
+		moved, err = tiered.MoveTier(ctx, "a", true)
+		require.NoError(t, err)
+		assert.False(t, moved)
+	})
+
+	t.Run("ReadsCold", func(t *testing.T) {
+		assert.True(t, exists(t, tiered, "a"))
+		assert.Equal(t, "hello", readContent(t, tiered, "a"))
+	})
+
+	t.Run("MovesHot", func(t *testing.T) {
+		moved, err := tiered.MoveTier(ctx, "a", false)
+		require.NoError(t, err)
+		assert.True(t, moved)
+		assert.Equal(t, "hello", readContent(t, hot, "a"))
+		assert.False(t, exists(t, cold, "a"))
+	})
+
+	t.Run("KeepsNewerHotCopy", func(t *testing.T) {
+		_, err := cold.Save(ctx, "a", "a", "", strings.NewReader("stale"))
+		require.NoError(t, err)
+
+		moved, err := tiered.MoveTier(ctx, "a", false)
+		require.NoError(t, err)
+		assert.False(t, moved)
+		assert.Equal(t, "hello", readContent(t, hot, "a"))
+		assert.False(t, exists(t, cold, "a"))
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		moved, err := tiered.MoveTier(ctx, "missing", true)
+		require.NoError(t, err)
+		assert.False(t, moved)
+		_, err = tiered.GetContent(ctx, "missing")
+		assert.Error(t, err)
+	})
+
+	t.Run("DeletesBothTiers", func(t *testing.T) {
+		_, err := cold.Save(ctx, "a", "a", "", strings.NewReader("hello"))
+		require.NoError(t, err)
+
+		require.NoError(t, tiered.Delete(ctx, "a"))
+		assert.False(t, exists(t, hot, "a"))
+		assert.False(t, exists(t, cold, "a"))
+	})
+
+	t.Run("ThroughDecorators", func(t *testing.T) {
+		stack := NewCache(NewCompressed(tiered), 1024)
+		_, err := stack.Save(ctx, "b", "b.txt", "text/plain", strings.NewReader(strings.Repeat("b", 100)))
+		require.NoError(t, err)
+
+		moved, err := stack.MoveTier(ctx, "b", true)
+		require.NoError(t, err)
+		assert.True(t, moved)
+		assert.True(t, exists(t, cold, "b"))
+		assert.Equal(t, strings.Repeat("b", 100), readContent(t, stack, "b"))
+	})
+}
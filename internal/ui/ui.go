@@ -0,0 +1,23 @@
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the embedded single-page UI for browsing, uploading and
+// deleting files, with their descriptions, stars and comments, and for
+// listing the files of saved searches. The page calls the HTTP API with the token the operator
+// enters, so it needs no server-side session. Mount it under a prefix with
+// http.StripPrefix.
+func Handler() http.Handler {
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err) // the embedded directory always exists
+	}
+	return http.FileServerFS(assets)
+}